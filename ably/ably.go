@@ -5,8 +5,21 @@ package ably
 import (
 	"crypto/rand"
 	"encoding/hex"
+
+	"github.com/ably/ably-go/ably/proto"
 )
 
+// GenerateRandomKey returns a random key suitable for channel encryption with
+// proto.CipherParams. keyLength is in bits; it defaults to 256 when zero.
+//
+// Spec RSE2.
+func GenerateRandomKey(keyLength int) ([]byte, error) {
+	if keyLength == 0 {
+		return proto.GenerateRandomKey()
+	}
+	return proto.GenerateRandomKey(keyLength)
+}
+
 func min(i, j int) int {
 	if i < j {
 		return i
@@ -287,30 +287,47 @@ func (rec *StateRecorder) timeout() time.Duration {
 	return 15 * time.Second
 }
 
+// MessagePipe gives a dial function for ClientOptions.Dial whose connections
+// receive the messages sent to in and send the messages to out. Receiving
+// on a closed connection fails with io.EOF, so scripted tests can drive the
+// connection deterministically and close the client cleanly.
 func MessagePipe(in <-chan *proto.ProtocolMessage, out chan<- *proto.ProtocolMessage) func(string, *url.URL) (proto.Conn, error) {
 	return func(proto string, u *url.URL) (proto.Conn, error) {
-		return pipeConn{
-			in:  in,
-			out: out,
+		return &pipeConn{
+			in:     in,
+			out:    out,
+			closed: make(chan struct{}),
 		}, nil
 	}
 }
 
 type pipeConn struct {
-	in  <-chan *proto.ProtocolMessage
-	out chan<- *proto.ProtocolMessage
+	in     <-chan *proto.ProtocolMessage
+	out    chan<- *proto.ProtocolMessage
+	once   sync.Once
+	closed chan struct{}
 }
 
-func (pc pipeConn) Send(msg *proto.ProtocolMessage) error {
-	pc.out <- msg
-	return nil
+func (pc *pipeConn) Send(msg *proto.ProtocolMessage) error {
+	select {
+	case pc.out <- msg:
+		return nil
+	case <-pc.closed:
+		return io.ErrClosedPipe
+	}
 }
 
-func (pc pipeConn) Receive() (*proto.ProtocolMessage, error) {
-	return <-pc.in, nil
+func (pc *pipeConn) Receive() (*proto.ProtocolMessage, error) {
+	select {
+	case msg := <-pc.in:
+		return msg, nil
+	case <-pc.closed:
+		return nil, io.EOF
+	}
 }
 
-func (pc pipeConn) Close() error {
+func (pc *pipeConn) Close() error {
+	pc.once.Do(func() { close(pc.closed) })
 	return nil
 }
 
@@ -320,6 +337,8 @@ type MessageRecorder struct {
 	url      []*url.URL
 	sent     []*proto.ProtocolMessage
 	received []*proto.ProtocolMessage
+	frames   []*proto.ProtocolMessage
+	dial     func(string, *url.URL) (proto.Conn, error)
 }
 
 // NewMessageRecorder gives new spy value that records incoming and outgoing
@@ -334,8 +353,12 @@ func NewMessageRecorder() *MessageRecorder {
 func (rec *MessageRecorder) Dial(proto string, u *url.URL) (proto.Conn, error) {
 	rec.mu.Lock()
 	rec.url = append(rec.url, u)
+	dial := rec.dial
 	rec.mu.Unlock()
-	conn, err := ablyutil.DialWebsocket(proto, u)
+	if dial == nil {
+		dial = dialWebsocket
+	}
+	conn, err := dial(proto, u)
 	if err != nil {
 		return nil, err
 	}
@@ -345,6 +368,16 @@ func (rec *MessageRecorder) Dial(proto string, u *url.URL) (proto.Conn, error) {
 	}, nil
 }
 
+// Hijack injects the dial function into the recorder, so the frames of
+// connections other than the default websocket one can be recorded too.
+// It returns the recorder's Dial, for use with Dial field of ClientOptions.
+func (rec *MessageRecorder) Hijack(dial func(string, *url.URL) (proto.Conn, error)) func(string, *url.URL) (proto.Conn, error) {
+	rec.mu.Lock()
+	rec.dial = dial
+	rec.mu.Unlock()
+	return rec.Dial
+}
+
 // URL
 func (rec *MessageRecorder) URL() []*url.URL {
 	rec.mu.Lock()
@@ -372,6 +405,33 @@ func (rec *MessageRecorder) Received() []*proto.ProtocolMessage {
 	return received
 }
 
+// Frames gives all sent and received messages in order they were recorded.
+func (rec *MessageRecorder) Frames() []*proto.ProtocolMessage {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	frames := make([]*proto.ProtocolMessage, len(rec.frames))
+	copy(frames, rec.frames)
+	return frames
+}
+
+// FramesByAction gives all sent and received messages with the given action,
+// in order they were recorded.
+func (rec *MessageRecorder) FramesByAction(action proto.Action) []*proto.ProtocolMessage {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var frames []*proto.ProtocolMessage
+	for _, msg := range rec.frames {
+		if msg.Action == action {
+			frames = append(frames, msg)
+		}
+	}
+	return frames
+}
+
+func dialWebsocket(proto string, u *url.URL) (proto.Conn, error) {
+	return ablyutil.DialWebsocket(proto, u)
+}
+
 type recConn struct {
 	conn proto.Conn
 	rec  *MessageRecorder
@@ -383,6 +443,7 @@ func (c recConn) Send(msg *proto.ProtocolMessage) error {
 	}
 	c.rec.mu.Lock()
 	c.rec.sent = append(c.rec.sent, msg)
+	c.rec.frames = append(c.rec.frames, msg)
 	c.rec.mu.Unlock()
 	return nil
 }
@@ -394,6 +455,7 @@ func (c recConn) Receive() (*proto.ProtocolMessage, error) {
 	}
 	c.rec.mu.Lock()
 	c.rec.received = append(c.rec.received, msg)
+	c.rec.frames = append(c.rec.frames, msg)
 	c.rec.mu.Unlock()
 	return msg, nil
 }
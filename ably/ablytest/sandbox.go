@@ -72,11 +72,15 @@ type Config struct {
 	Connections []Connection `json:"connections,omitempty"`
 }
 
-func DefaultConfig() *Config {
+// DefaultConfig gives the configuration of the sandbox app most tests use.
+// The app has got the given keys or, if none is given, a single key with
+// the default capability, which allows all operations.
+func DefaultConfig(keys ...Key) *Config {
+	if len(keys) == 0 {
+		keys = []Key{{}}
+	}
 	return &Config{
-		Keys: []Key{
-			{},
-		},
+		Keys: keys,
 		Namespaces: []Namespace{
 			{ID: "persisted", Persisted: true},
 		},
@@ -120,7 +124,7 @@ func NewRestClient(opts *ably.ClientOptions) (*Sandbox, *ably.RestClient) {
 }
 
 func MustSandbox(config *Config) *Sandbox {
-	app, err := NewSandbox(nil)
+	app, err := NewSandbox(config)
 	if err != nil {
 		panic(err)
 	}
@@ -194,14 +198,36 @@ func (app *Sandbox) NewRealtimeClient(opts ...*ably.ClientOptions) *ably.Realtim
 }
 
 func (app *Sandbox) KeyParts() (name, secret string) {
-	return app.Config.AppID + "." + app.Config.Keys[0].ID, app.Config.Keys[0].Value
+	return app.KeyPartsAt(0)
 }
 
 func (app *Sandbox) Key() string {
-	name, secret := app.KeyParts()
+	return app.KeyAt(0)
+}
+
+// KeyPartsAt is like KeyParts, but for the i-th key of the app.
+func (app *Sandbox) KeyPartsAt(i int) (name, secret string) {
+	return app.Config.AppID + "." + app.Config.Keys[i].ID, app.Config.Keys[i].Value
+}
+
+// KeyAt is like Key, but for the i-th key of the app.
+func (app *Sandbox) KeyAt(i int) string {
+	name, secret := app.KeyPartsAt(i)
 	return name + ":" + secret
 }
 
+// KeyByCapability gives the first key of the app which has got exactly
+// the given capability.
+func (app *Sandbox) KeyByCapability(capability ably.Capability) (string, error) {
+	for i := range app.Config.Keys {
+		c := app.Config.Keys[i].Capability()
+		if c.Covers(capability) && capability.Covers(c) {
+			return app.KeyAt(i), nil
+		}
+	}
+	return "", fmt.Errorf("no key with %s capability", capability.Encode())
+}
+
 func (app *Sandbox) Options(opts ...*ably.ClientOptions) *ably.ClientOptions {
 	type transportHijacker interface {
 		Hijack(http.RoundTripper) http.RoundTripper
@@ -225,6 +251,10 @@ func (app *Sandbox) Options(opts ...*ably.ClientOptions) *ably.ClientOptions {
 		}
 	}
 	appOpts = MergeOptions(appOpts, opt)
+	if appOpts.RestHost != "" || appOpts.RealtimeHost != "" {
+		// An explicit host can't be combined with an environment.
+		appOpts.Environment = ""
+	}
 	return appOpts
 }
 
@@ -0,0 +1,168 @@
+package ablytest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ably/ably-go/ably/proto"
+)
+
+// ScriptedConn is a proto.Conn which doesn't touch the network. It feeds
+// the client with the inbound frames it was scripted with, in order, and
+// records every outbound frame the client sends.
+//
+// Once the script is exhausted, Receive blocks until more frames are pushed
+// or the connection is closed. Frames answering client requests, like
+// ATTACHED for an ATTACH, are best pushed after the request was observed
+// with WaitForSent, so they're not delivered before the request is made.
+//
+// A CLOSE sent by the client is answered with CLOSED, as the server does, so
+// closing the client doesn't need to be scripted.
+type ScriptedConn struct {
+	mtx     sync.Mutex
+	script  []*proto.ProtocolMessage
+	sent    []*proto.ProtocolMessage
+	dialed  bool
+	changed chan struct{} // closed and replaced on each push or send
+	once    sync.Once
+	closed  chan struct{}
+}
+
+// NewScriptedConn gives a new connection which delivers the script frames
+// to the client.
+//
+// For use with Dial field of ClientOptions, via the Dial method.
+func NewScriptedConn(script []*proto.ProtocolMessage) *ScriptedConn {
+	return &ScriptedConn{
+		script:  append([]*proto.ProtocolMessage(nil), script...),
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Dial gives the scripted connection itself. A scripted connection can be
+// dialed only once; subsequent dials fail, as if the network was down.
+func (sc *ScriptedConn) Dial(proto string, u *url.URL) (proto.Conn, error) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if sc.dialed {
+		return nil, errors.New("scripted connection already dialed")
+	}
+	sc.dialed = true
+	return sc, nil
+}
+
+// Push appends frames to the script.
+func (sc *ScriptedConn) Push(msgs ...*proto.ProtocolMessage) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.script = append(sc.script, msgs...)
+	sc.notify()
+}
+
+// notify wakes up all waiters; sc.mtx must be held.
+func (sc *ScriptedConn) notify() {
+	close(sc.changed)
+	sc.changed = make(chan struct{})
+}
+
+func (sc *ScriptedConn) Send(msg *proto.ProtocolMessage) error {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	select {
+	case <-sc.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	sc.sent = append(sc.sent, msg)
+	if msg.Action == proto.ActionClose {
+		sc.script = append(sc.script, &proto.ProtocolMessage{Action: proto.ActionClosed})
+	}
+	sc.notify()
+	return nil
+}
+
+func (sc *ScriptedConn) Receive() (*proto.ProtocolMessage, error) {
+	for {
+		sc.mtx.Lock()
+		if len(sc.script) != 0 {
+			msg := sc.script[0]
+			sc.script = sc.script[1:]
+			sc.mtx.Unlock()
+			return msg, nil
+		}
+		changed := sc.changed
+		sc.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-sc.closed:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (sc *ScriptedConn) Close() error {
+	sc.once.Do(func() { close(sc.closed) })
+	return nil
+}
+
+// Sent gives all frames sent by the client, in order.
+func (sc *ScriptedConn) Sent() []*proto.ProtocolMessage {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sent := make([]*proto.ProtocolMessage, len(sc.sent))
+	copy(sent, sc.sent)
+	return sent
+}
+
+// SentActions gives actions of all frames sent by the client, in order.
+func (sc *ScriptedConn) SentActions() []proto.Action {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	actions := make([]proto.Action, len(sc.sent))
+	for i, msg := range sc.sent {
+		actions[i] = msg.Action
+	}
+	return actions
+}
+
+// WaitForSent blocks until the client sends a frame with the given action,
+// giving the first such frame. It fails if none was sent within timeout;
+// zero timeout means Timeout.
+func (sc *ScriptedConn) WaitForSent(action proto.Action, timeout time.Duration) (*proto.ProtocolMessage, error) {
+	if timeout == 0 {
+		timeout = Timeout
+	}
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	for {
+		sc.mtx.Lock()
+		for _, msg := range sc.sent {
+			if msg.Action == action {
+				sc.mtx.Unlock()
+				return msg, nil
+			}
+		}
+		changed := sc.changed
+		sc.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-tm.C:
+			return nil, fmt.Errorf("waiting for %s frame timed out after %v; sent %v", action, timeout, sc.SentActions())
+		}
+	}
+}
+
+// ExpectSentActions fails if the actions of the frames sent by the client
+// are not exactly the given ones, in order.
+func (sc *ScriptedConn) ExpectSentActions(want ...proto.Action) error {
+	if got := sc.SentActions(); !reflect.DeepEqual(got, want) && (len(got) != 0 || len(want) != 0) {
+		return fmt.Errorf("want sent actions=%v; got %v", want, got)
+	}
+	return nil
+}
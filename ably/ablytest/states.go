@@ -0,0 +1,69 @@
+package ablytest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ably/ably-go/ably"
+)
+
+type stateEmitter interface {
+	On(chan<- ably.State, ...ably.StateEnum)
+	Off(chan<- ably.State, ...ably.StateEnum)
+	State() ably.StateEnum
+}
+
+// connEmitter adapts the connection to stateEmitter.
+type connEmitter struct {
+	*ably.Conn
+}
+
+func (c connEmitter) On(ch chan<- ably.State, states ...ably.StateEnum) {
+	c.Notify(ch, states...)
+}
+
+func (c connEmitter) Off(ch chan<- ably.State, states ...ably.StateEnum) {
+	c.StopNotify(ch, states...)
+}
+
+// WaitConnState blocks until the connection is in the given state or the
+// timeout expires; a zero timeout means Timeout.
+func WaitConnState(conn *ably.Conn, state ably.StateEnum, timeout time.Duration) error {
+	return waitState(connEmitter{conn}, state, timeout)
+}
+
+// WaitChannelState blocks until the channel is in the given state or the
+// timeout expires; a zero timeout means Timeout.
+func WaitChannelState(channel *ably.RealtimeChannel, state ably.StateEnum, timeout time.Duration) error {
+	return waitState(channel, state, timeout)
+}
+
+func waitState(emitter stateEmitter, state ably.StateEnum, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = Timeout
+	}
+	// The emitter doesn't block on sending, so the buffer must be large
+	// enough not to miss the awaited state.
+	ch := make(chan ably.State, 64)
+	emitter.On(ch)
+	defer emitter.Off(ch)
+	// Registering first ensures the state isn't missed if it's entered
+	// right after it's checked.
+	current := emitter.State()
+	if current == state {
+		return nil
+	}
+	seen := []ably.StateEnum{current}
+	expired := time.After(timeout)
+	for {
+		select {
+		case st := <-ch:
+			if st.State == state {
+				return nil
+			}
+			seen = append(seen, st.State)
+		case <-expired:
+			return fmt.Errorf("waiting for state %v timed out after %v: states seen were %v", state, timeout, seen)
+		}
+	}
+}
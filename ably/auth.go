@@ -66,13 +66,32 @@ type Auth struct {
 	host     string       // a host part of AuthURL
 	clientID string       // clientID of the authenticated user or wildcard "*"
 
-	serverTimeOffset time.Duration
+	// serverTimeOffset is the difference between the server and local time,
+	// valid once hasServerTimeOffset is set.
+	serverTimeOffset    time.Duration
+	hasServerTimeOffset bool
 
 	// ServerTimeHandler when provided this will be used to query server time.
 	serverTimeHandler func() (time.Time, error)
 
 	// This provides a function that returns the current time.
 	now func() time.Time
+
+	// onExplicitAuthorize is called with the new token after a successful
+	// call to Authorize or a scheduled renewal; realtime client uses it to
+	// reauthenticate its connection.
+	onExplicitAuthorize func(*TokenDetails)
+
+	// renewing is set while the realtime client keeps its token fresh,
+	// renewing it with renewTimer ahead of its expiry. The renewal fields
+	// are guarded by renewMtx rather than mtx, which is held during token
+	// requests, so that the connection can stop and start renewals without
+	// waiting for one; renewMtx may be acquired with mtx held, never the
+	// other way round.
+	renewMtx     sync.Mutex
+	renewing     bool
+	renewTimer   *time.Timer
+	renewRetries int // number of consecutive failed renewals
 }
 
 func newAuth(client *RestClient) (*Auth, error) {
@@ -106,7 +125,9 @@ func newAuth(client *RestClient) (*Auth, error) {
 	return a, nil
 }
 
-// ClientID
+// ClientID gives the clientId the client is identified with, either the one
+// set in ClientOptions, or the one obtained with a token or the connection.
+// It is empty when the client is anonymous or allowed to use any clientId.
 func (a *Auth) ClientID() string {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
@@ -116,19 +137,29 @@ func (a *Auth) ClientID() string {
 	return ""
 }
 
+// authMethod gives the method the client authenticates its requests with,
+// which changes to token auth once a token is obtained.
+func (a *Auth) authMethod() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.method
+}
+
 func (a *Auth) clientIDForCheck() string {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
-	if a.method == authBasic {
+	if a.method == authBasic && a.clientID == "" {
 		return wildcardClientID // for Basic Auth no ClientID check is performed
 	}
 	return a.clientID
 }
 
+// updateClientID adopts the clientID the server identified the connection
+// with, which takes precedence over the configured one.
 func (a *Auth) updateClientID(clientID string) {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
-	if a.clientID == "" {
+	if clientID != "" {
 		//Spec RSA7b3, RSA7b4, RSA12a,RSA12b, RSA7b2,
 		a.clientID = clientID
 	}
@@ -188,12 +219,26 @@ func (a *Auth) requestToken(params *TokenParams, opts *AuthOptions) (tok *TokenD
 			return nil, "", newError(ErrErrorFromClientTokenCallback, err)
 		}
 		switch v := v.(type) {
+		case TokenRequest:
+			tokReq = &v
+			tokReqClientID = tokReq.ClientID
 		case *TokenRequest:
+			if v == nil {
+				return nil, "", newError(ErrErrorFromClientTokenCallback, errInvalidCallbackType)
+			}
 			tokReq = v
 			tokReqClientID = tokReq.ClientID
+		case TokenDetails:
+			return &v, "", nil
 		case *TokenDetails:
+			if v == nil {
+				return nil, "", newError(ErrErrorFromClientTokenCallback, errInvalidCallbackType)
+			}
 			return v, "", nil
 		case string:
+			if v == "" {
+				return nil, "", newError(ErrErrorFromClientTokenCallback, errInvalidCallbackType)
+			}
 			return newTokenDetails(v), "", nil
 		default:
 			return nil, "", newError(ErrErrorFromClientTokenCallback, errInvalidCallbackType)
@@ -217,13 +262,17 @@ func (a *Auth) requestToken(params *TokenParams, opts *AuthOptions) (tok *TokenD
 		}
 		tokReq = req
 	}
+	if err := checkCapability(opts.KeyCapability, tokReq.RawCapability); err != nil {
+		return nil, "", err
+	}
 	tok = &TokenDetails{}
 	r := &Request{
-		Method: "POST",
-		Path:   "/keys/" + tokReq.KeyName + "/requestToken",
-		In:     tokReq,
-		Out:    tok,
-		NoAuth: true,
+		Method:     "POST",
+		Path:       "/keys/" + tokReq.KeyName + "/requestToken",
+		In:         tokReq,
+		Out:        tok,
+		NoAuth:     true,
+		authLocked: true,
 	}
 	if _, err := a.client.do(r); err != nil {
 		return nil, "", err
@@ -246,15 +295,25 @@ func (a *Auth) Authorise(params *TokenParams, opts *AuthOptions) (*TokenDetails,
 // Authorize performs authorization with ably service and returns the
 // authorization token details.
 //
-// Refers to RSA10
+// It always obtains a new token, even if the current one is still valid, and
+// uses it for all subsequent requests. If the realtime connection is
+// connected, it's reauthenticated in place with the new token, adopting its
+// capability and clientId without being dropped; otherwise the token is used
+// by the next connection attempt.
+//
+// Refers to RSA10, RSA10a, RTC8
 func (a *Auth) Authorize(params *TokenParams, opts *AuthOptions) (*TokenDetails, error) {
 	a.mtx.Lock()
-	defer a.mtx.Unlock()
-	force := a.opts().Force
-	if opts != nil && opts.Force {
-		force = true
+	tok, err := a.authorize(params, opts, true)
+	onExplicitAuthorize := a.onExplicitAuthorize
+	a.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if onExplicitAuthorize != nil {
+		onExplicitAuthorize(tok)
 	}
-	return a.authorize(params, opts, force)
+	return tok, nil
 }
 
 func (a *Auth) authorize(params *TokenParams, opts *AuthOptions, force bool) (*TokenDetails, error) {
@@ -284,9 +343,124 @@ func (a *Auth) authorize(params *TokenParams, opts *AuthOptions, force bool) (*T
 	a.opts().TokenDetails = tok
 	a.params = params
 	a.clientID = tok.ClientID // Spec RSA7b2
+	a.scheduleRenewal()
 	return tok, nil
 }
 
+const (
+	renewRetryDelay    = time.Second      // delay before retrying a failed renewal
+	maxRenewRetryDelay = 30 * time.Second // the delay doubles up to this
+)
+
+// startRenewal makes the token be renewed ahead of its expiry, until
+// stopRenewal is called. The realtime client starts renewals when it
+// connects and stops them when it's closed, failed or disconnected with
+// Disconnect.
+func (a *Auth) startRenewal() {
+	a.renewMtx.Lock()
+	defer a.renewMtx.Unlock()
+	if a.renewing {
+		return
+	}
+	a.renewing = true
+	// The renewal is scheduled asynchronously, as looking up the current
+	// token waits for a token request in flight.
+	a.renewTimer = time.AfterFunc(0, func() {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		a.scheduleRenewal()
+	})
+}
+
+func (a *Auth) stopRenewal() {
+	a.renewMtx.Lock()
+	defer a.renewMtx.Unlock()
+	a.renewing = false
+	a.renewRetries = 0
+	if a.renewTimer != nil {
+		a.renewTimer.Stop()
+		a.renewTimer = nil
+	}
+}
+
+// scheduleRenewal schedules the renewal of the current token TokenRenewalBuffer
+// before it expires, or halfway through its remaining lifetime if it's
+// shorter, so that short-lived tokens aren't renewed over and over. It
+// expects a.mtx to be held.
+func (a *Auth) scheduleRenewal() {
+	a.renewMtx.Lock()
+	defer a.renewMtx.Unlock()
+	if !a.renewing {
+		return
+	}
+	if a.renewTimer != nil {
+		a.renewTimer.Stop()
+		a.renewTimer = nil
+	}
+	tok := a.token()
+	if a.method != authToken || tok == nil || tok.Expires == 0 || !a.isTokenRenewable() {
+		return
+	}
+	remaining := tok.ExpireTime().Sub(a.serverNow())
+	delay := remaining - a.opts().tokenRenewalBuffer()
+	if delay < remaining/2 {
+		delay = remaining / 2
+	}
+	a.renewTimer = time.AfterFunc(delay, a.renew)
+}
+
+// renew obtains a new token and reauthenticates the realtime connection
+// with it. A failed renewal is retried with a delay which doubles with every
+// consecutive failure, so the auth server isn't flooded with requests.
+//
+// Renewals may be stopped while the token is being requested, in which
+// case a failed request isn't retried.
+func (a *Auth) renew() {
+	a.renewMtx.Lock()
+	renewing := a.renewing
+	a.renewMtx.Unlock()
+	if !renewing {
+		return
+	}
+	a.mtx.Lock()
+	tok, err := a.authorize(a.params, nil, true)
+	onExplicitAuthorize := a.onExplicitAuthorize
+	a.mtx.Unlock()
+	a.renewMtx.Lock()
+	if err != nil {
+		if a.renewing {
+			delay := renewRetryDelay << uint(a.renewRetries)
+			if delay > maxRenewRetryDelay || delay <= 0 {
+				delay = maxRenewRetryDelay
+			} else {
+				a.renewRetries++
+			}
+			a.logger().Printf(LogWarning, "failed to renew token, retrying in %v: %v", delay, err)
+			a.renewTimer = time.AfterFunc(delay, a.renew)
+		}
+		a.renewMtx.Unlock()
+		return
+	}
+	a.renewRetries = 0
+	a.renewMtx.Unlock()
+	if onExplicitAuthorize != nil {
+		onExplicitAuthorize(tok)
+	}
+}
+
+// serverNow gives the current time, adjusted by the server time offset when
+// it's known, so it's comparable with the token's expiry time.
+func (a *Auth) serverNow() time.Time {
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	if a.hasServerTimeOffset {
+		now = now.Add(a.serverTimeOffset)
+	}
+	return now
+}
+
 func (a *Auth) reauthorize() (*TokenDetails, error) {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
@@ -302,13 +476,14 @@ func (a *Auth) mergeOpts(opts *AuthOptions) *AuthOptions {
 	return opts
 }
 
+// setDefaults populates unset fields of the token request. An unset capability
+// is left empty, in which case the token inherits the capability of the key.
+//
+// Spec RSA6, RSA9
 func (a *Auth) setDefaults(opts *AuthOptions, req *TokenRequest) error {
 	if req.Nonce == "" {
 		req.Nonce = randomString(32)
 	}
-	if req.RawCapability == "" {
-		req.RawCapability = (Capability{"*": {"*"}}).Encode()
-	}
 	if req.TTL == 0 {
 		req.TTL = 60 * 60 * 1000
 	}
@@ -325,6 +500,22 @@ func (a *Auth) setDefaults(opts *AuthOptions, req *TokenRequest) error {
 	return nil
 }
 
+// checkCapability validates the capability requested for a token against
+// the capability of the key, if known.
+func checkCapability(key Capability, requested string) error {
+	if key == nil || requested == "" {
+		return nil
+	}
+	c, err := ParseCapability(requested)
+	if err != nil {
+		return newError(ErrInvalidParameterValue, err)
+	}
+	if !key.Covers(c) {
+		return newErrorf(ErrOperationNotPermittedWithProvidedCapability, "requested capability %s exceeds the capability of the key %s", requested, key.Encode())
+	}
+	return nil
+}
+
 //Timestamp returns the timestamp to be used in authorization request.
 func (a *Auth) timestamp(query bool) (time.Time, error) {
 	var now time.Time
@@ -336,7 +527,7 @@ func (a *Auth) timestamp(query bool) (time.Time, error) {
 	if !query {
 		return now, nil
 	}
-	if a.serverTimeOffset != 0 {
+	if a.hasServerTimeOffset {
 		// refers to rsa10k
 		//
 		// No need to do api call for time from the server. We are calculating it
@@ -351,13 +542,14 @@ func (a *Auth) timestamp(query bool) (time.Time, error) {
 		}
 		serverTime = t
 	} else {
-		t, err := a.client.Time()
+		t, err := a.client.time(true)
 		if err != nil {
 			return time.Time{}, newError(ErrUnauthorized, err)
 		}
 		serverTime = t
 	}
 	a.serverTimeOffset = serverTime.Sub(now)
+	a.hasServerTimeOffset = true
 	return serverTime, nil
 }
 
@@ -391,7 +583,7 @@ func (a *Auth) requestAuthURL(params *TokenParams, opts *AuthOptions) (interface
 		return nil, a.newError(40004, err)
 	}
 	switch typ {
-	case "text/plain":
+	case "text/plain", "application/jwt":
 		token, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return nil, a.newError(40000, err)
@@ -427,6 +619,8 @@ func (a *Auth) newError(code int, err error) error {
 }
 
 func (a *Auth) authReq(req *http.Request) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
 	switch a.method {
 	case authBasic:
 		req.SetBasicAuth(a.opts().KeyName(), a.opts().KeySecret())
@@ -492,6 +686,9 @@ func areClientIDsSet(clientIDs ...string) bool {
 	return true
 }
 
+// isClientIDAllowed reports whether a message with the msgClientID can be sent
+// by a client identified by the clientID. When the clientID is not known yet,
+// the check is left to the server.
 func isClientIDAllowed(clientID, msgClientID string) bool {
-	return clientID == wildcardClientID || msgClientID == "" || clientID == msgClientID
+	return clientID == wildcardClientID || clientID == "" || msgClientID == "" || clientID == msgClientID
 }
@@ -2,13 +2,19 @@ package ably_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -137,14 +143,13 @@ func TestAuth_TokenAuth(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Authorize()=%v", err)
 	}
-	// Call to Authorize with force set to false should not refresh the token
-	// and return existing one.
-	// The following ensures no token request was made.
-	if n := rec.Len(); n != 0 {
-		t.Fatalf("Authorize() did not return existing token; want rec.Len()=0; %d", n)
+	// Call to Authorize always requests a new token, even though the existing
+	// one is still valid.
+	if n := rec.Len(); n == 0 {
+		t.Fatal("Authorize() returned existing token; want a token request")
 	}
-	if auth != tok.Token {
-		t.Fatalf("want auth=%q; got %q", tok.Token, auth)
+	if auth == tok.Token {
+		t.Fatalf("want new token; got existing %q", auth)
 	}
 	if defaultCap := (ably.Capability{"*": {"*"}}); tok.RawCapability != defaultCap.Encode() {
 		t.Fatalf("want tok.Capability=%v; got %v", defaultCap, tok.Capability())
@@ -702,7 +707,7 @@ func TestAuth_ClientID(t *testing.T) {
 	in <- connected
 	proxy.TokenQueue = append(proxy.TokenQueue, tok)
 	failed := make(chan ably.State, 1)
-	client.Connection.On(failed, ably.StateConnFailed)
+	client.Connection.Notify(failed, ably.StateConnFailed)
 	err = ablytest.Wait(client.Connection.Connect())
 	if err = checkError(40012, err); err != nil {
 		t.Fatal(err)
@@ -793,6 +798,93 @@ func TestAuth_CreateTokenRequest(t *testing.T) {
 	})
 }
 
+func TestAuth_TokenRequestMAC(t *testing.T) {
+	t.Parallel()
+	vectors := []struct {
+		req ably.TokenRequest
+		mac string
+	}{
+		{
+			req: ably.TokenRequest{
+				TokenParams: ably.TokenParams{
+					TTL:           3600000,
+					RawCapability: `{"channel":["publish"]}`,
+					ClientID:      "client",
+					Timestamp:     1500000000000,
+				},
+				KeyName: "appid.keyid",
+				Nonce:   "abcdefghijklmnop",
+			},
+			mac: "sR9HEsU4+iwYiTk7BlD+Br+YEyTTZBf/lLWXjbhDVLA=",
+		},
+		{
+			req: ably.TokenRequest{
+				TokenParams: ably.TokenParams{
+					TTL:       3600000,
+					Timestamp: 1500000000000,
+				},
+				KeyName: "appid.keyid",
+				Nonce:   "abcdefghijklmnop",
+			},
+			mac: "tuabsYGrv3r78UAWc2WUcjmNgZxRS/iDMYdLfd1L1tg=",
+		},
+	}
+	for i, v := range vectors {
+		v.req.Sign([]byte("secret"))
+		if v.req.Mac != v.mac {
+			t.Errorf("%d: want mac=%q; got %q", i, v.mac, v.req.Mac)
+		}
+	}
+}
+
+func TestAuth_CreateTokenRequestDefaults(t *testing.T) {
+	t.Parallel()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "appid.keyid:secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTime := time.Unix(1500000000, 0)
+	client.Auth.SetServerTimeFunc(func() (time.Time, error) {
+		return serverTime, nil
+	})
+	req, err := client.Auth.CreateTokenRequest(nil, &ably.AuthOptions{
+		Key:          "appid.keyid:secret",
+		UseQueryTime: true,
+	})
+	if err != nil {
+		t.Fatalf("CreateTokenRequest()=%v", err)
+	}
+	if req.KeyName != "appid.keyid" {
+		t.Errorf("want keyName=%q; got %q", "appid.keyid", req.KeyName)
+	}
+	if req.Timestamp != ably.Time(serverTime) {
+		t.Errorf("want timestamp=%d; got %d", ably.Time(serverTime), req.Timestamp)
+	}
+	if len(req.Nonce) < 16 {
+		t.Errorf("want len(nonce)>=16; got %d", len(req.Nonce))
+	}
+	// RSA6: capability of the key is used when none is requested.
+	if req.RawCapability != "" {
+		t.Errorf("want empty capability; got %q", req.RawCapability)
+	}
+	p, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(p, []byte(`"capability"`)) {
+		t.Errorf("want capability to be omitted; got %s", p)
+	}
+	signed := *req
+	signed.Sign([]byte("secret"))
+	if signed.Mac != req.Mac {
+		t.Errorf("want mac=%q; got %q", signed.Mac, req.Mac)
+	}
+}
+
 func TestAuth_RealtimeAccessToken(t *testing.T) {
 	t.Parallel()
 	rec := ablytest.NewMessageRecorder()
@@ -846,3 +938,927 @@ func TestAuth_RSA7c(t *testing.T) {
 		t.Error("expected an error")
 	}
 }
+
+// tokenCallback gives an AuthCallback, which issues consecutive "token-<n>"
+// tokens.
+func tokenCallback() func(*ably.TokenParams) (interface{}, error) {
+	var mtx sync.Mutex
+	var n int
+	return func(*ably.TokenParams) (interface{}, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		n++
+		return "token-" + strconv.Itoa(n), nil
+	}
+}
+
+func TestAuth_RealtimeAuthorizeInPlace(t *testing.T) {
+	t.Parallel()
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			AuthCallback: tokenCallback(),
+		},
+	}
+	client, conn, out := newDropConnClient(t, opts)
+	defer safeclose(t, client)
+	if got := conn.url.Query().Get("access_token"); got != "token-1" {
+		t.Fatalf("want access_token=%q; got %q", "token-1", got)
+	}
+	states := make(chan ably.State, 1)
+	client.Connection.Notify(states)
+	tok, err := client.Auth.Authorize(nil, &ably.AuthOptions{Force: true})
+	if err != nil {
+		t.Fatalf("Authorize()=%v", err)
+	}
+	if tok.Token != "token-2" {
+		t.Fatalf("want token=%q; got %q", "token-2", tok.Token)
+	}
+	msg, err := expectAction(out, proto.ActionAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Auth == nil || msg.Auth.AccessToken != "token-2" {
+		t.Fatalf("want AUTH with %q token; got %v", "token-2", msg.Auth)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	// Server requests reauthentication.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAuth}
+	if msg, err = expectAction(out, proto.ActionAuth); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Auth == nil || msg.Auth.AccessToken != "token-3" {
+		t.Fatalf("want AUTH with %q token; got %v", "token-3", msg.Auth)
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("unexpected connection state change: %s", state.State)
+	default:
+	}
+}
+
+func TestAuth_RealtimeAuthorizeCapability(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var n int
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			AuthCallback: func(params *ably.TokenParams) (interface{}, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				n++
+				tok := &ably.TokenDetails{Token: "token-" + strconv.Itoa(n)}
+				if params != nil {
+					tok.RawCapability = params.RawCapability
+					tok.ClientID = params.ClientID
+				}
+				return tok, nil
+			},
+		},
+	}
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts.NoConnect = true
+	opts.Dial = dropConnDial(conns, out)
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	// The token obtained before connecting is used to connect.
+	if _, err := client.Auth.Authorize(nil, nil); err != nil {
+		t.Fatalf("Authorize()=%v", err)
+	}
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	if got := conn.url.Query().Get("access_token"); got != "token-1" {
+		t.Fatalf("want access_token=%q; got %q", "token-1", got)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	states := make(chan ably.State, 1)
+	client.Connection.Notify(states)
+	// A new token is obtained even though the current one is still valid,
+	// and the connection is reauthenticated with it in place.
+	narrower := ably.Capability{"chat": {"subscribe"}}
+	tok, err := client.Auth.Authorize(&ably.TokenParams{
+		RawCapability: narrower.Encode(),
+		ClientID:      "client-id",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Authorize()=%v", err)
+	}
+	if tok.Token != "token-2" || tok.RawCapability != narrower.Encode() {
+		t.Fatalf("want token-2 with %s capability; got %+v", narrower.Encode(), tok)
+	}
+	msg, err := expectAction(out, proto.ActionAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Auth == nil || msg.Auth.AccessToken != "token-2" {
+		t.Fatalf("want AUTH with %q token; got %v", "token-2", msg.Auth)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey: "connection-key",
+			ClientID:      "client-id",
+		},
+	}
+	deadline := time.Now().Add(ablytest.Timeout)
+	for client.Connection.Details().ClientID != "client-id" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want connection clientId=%q; got %q", "client-id", client.Connection.Details().ClientID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if id := client.Auth.ClientID(); id != "client-id" {
+		t.Errorf("want clientId=%q; got %q", "client-id", id)
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("unexpected connection state change: %s", state.State)
+	default:
+	}
+}
+
+func TestAuth_RealtimeTokenExpired(t *testing.T) {
+	t.Parallel()
+	t.Run("RTN15h2 must reconnect with renewed token", func(t *testing.T) {
+		conns := make(chan *dropConn, 2)
+		out := make(chan *proto.ProtocolMessage, 16)
+		opts := &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: tokenCallback(),
+			},
+			NoConnect: true,
+			Dial:      dropConnDial(conns, out),
+		}
+		client, err := ably.NewRealtimeClient(opts)
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		defer safeclose(t, client)
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		conn.in <- &proto.ProtocolMessage{
+			Action: proto.ActionDisconnected,
+			Error:  &proto.ErrorInfo{Code: 40142, StatusCode: 401},
+		}
+		conn = <-conns
+		if got := conn.url.Query().Get("access_token"); got != "token-2" {
+			t.Errorf("want access_token=%q; got %q", "token-2", got)
+		}
+		if got := conn.url.Query().Get("resume"); got != "connection-key" {
+			t.Errorf("want resume=%q; got %q", "connection-key", got)
+		}
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("RTN15h2 must not block the connection while renewing the token", func(t *testing.T) {
+		conns := make(chan *dropConn, 2)
+		out := make(chan *proto.ProtocolMessage, 16)
+		var client *ably.RealtimeClient
+		renewing := make(chan ably.StateEnum, 1)
+		next := tokenCallback()
+		callback := func(params *ably.TokenParams) (interface{}, error) {
+			tok, err := next(params)
+			if tok == "token-2" {
+				// Would deadlock if the token was requested with
+				// the connection state locked.
+				renewing <- client.Connection.State()
+			}
+			return tok, err
+		}
+		opts := &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: callback,
+			},
+			NoConnect: true,
+			Dial:      dropConnDial(conns, out),
+		}
+		client, err := ably.NewRealtimeClient(opts)
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		defer safeclose(t, client)
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		conn.in <- &proto.ProtocolMessage{
+			Action: proto.ActionDisconnected,
+			Error:  &proto.ErrorInfo{Code: 40142, StatusCode: 401},
+		}
+		select {
+		case state := <-renewing:
+			if state != ably.StateConnConnecting {
+				t.Errorf("want state=%v while renewing; got %v", ably.StateConnConnecting, state)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatal("waiting for the token to be renewed timed out")
+		}
+		conn = <-conns
+		if got := conn.url.Query().Get("access_token"); got != "token-2" {
+			t.Errorf("want access_token=%q; got %q", "token-2", got)
+		}
+	})
+	t.Run("RTN15h1 must fail when token is not renewable", func(t *testing.T) {
+		client, conn, _ := newDropConnClient(t, &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Token: "token",
+			},
+		})
+		defer client.Close()
+		conn.in <- &proto.ProtocolMessage{
+			Action: proto.ActionDisconnected,
+			Error:  &proto.ErrorInfo{Code: 40142, StatusCode: 401},
+		}
+		if err := await(client.Connection.State, ably.StateConnFailed); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkError(40142, client.Connection.Reason()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("RTN14b must reconnect on ERROR and stay usable", func(t *testing.T) {
+		conns := make(chan *dropConn, 2)
+		out := make(chan *proto.ProtocolMessage, 16)
+		states := make(chan ably.State, 8)
+		opts := &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: tokenCallback(),
+			},
+			NoConnect: true,
+			Dial:      dropConnDial(conns, out),
+		}
+		client, err := ably.NewRealtimeClient(opts)
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		defer safeclose(t, client)
+		client.Connection.Notify(states, ably.StateConnFailed)
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{
+			Action: proto.ActionError,
+			Error:  &proto.ErrorInfo{Code: 40140, StatusCode: 401},
+		}
+		conn = <-conns
+		if got := conn.url.Query().Get("access_token"); got != "token-2" {
+			t.Errorf("want access_token=%q; got %q", "token-2", got)
+		}
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+			t.Fatal(err)
+		}
+		channel := client.Channels.Get("test")
+		res, err := channel.Publish("name", "data")
+		if err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+		if _, err := expectAction(out, proto.ActionAttach); err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+		if err := res.Wait(); err != nil {
+			t.Fatalf("Wait()=%v", err)
+		}
+		select {
+		case state := <-states:
+			t.Fatalf("unexpected %s state: %v", state.State, state.Err)
+		default:
+		}
+	})
+	t.Run("RTN14b must fail when renewing the token fails", func(t *testing.T) {
+		var mtx sync.Mutex
+		var n int
+		callback := func(*ably.TokenParams) (interface{}, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if n++; n > 1 {
+				return nil, errors.New("auth server unavailable")
+			}
+			return "token", nil
+		}
+		client, conn, _ := newDropConnClient(t, &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: callback,
+			},
+		})
+		defer client.Close()
+		conn.in <- &proto.ProtocolMessage{
+			Action: proto.ActionDisconnected,
+			Error:  &proto.ErrorInfo{Code: 40142, StatusCode: 401},
+		}
+		if err := await(client.Connection.State, ably.StateConnFailed); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkError(ably.ErrErrorFromClientTokenCallback, client.Connection.Reason()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAuth_TokenAuthWithClientID(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/time":
+			fmt.Fprintf(w, "[%d]", ably.TimeNow())
+		case "/keys/xxxxxx.yyyyyy/requestToken":
+			w.Write([]byte(`{"token":"requested","keyName":"xxxxxx.yyyyyy","clientId":"me"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	for _, queryTime := range []bool{false, true} {
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key:          "xxxxxx.yyyyyy:zzzzzz",
+				UseTokenAuth: true,
+				UseQueryTime: queryTime,
+			},
+			ClientID:         "me",
+			NoBinaryProtocol: true,
+			HTTPClient:       newTLSHTTPClientMock(server),
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.Auth.Authorize(nil, nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("UseQueryTime=%t: Authorize()=%v", queryTime, err)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("UseQueryTime=%t: Authorize() timed out", queryTime)
+		}
+	}
+}
+
+func TestAuth_AuthCallbackTypes(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/keys/xxxxxx.yyyyyy/requestToken" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"requested","keyName":"xxxxxx.yyyyyy"}`))
+	}))
+	defer server.Close()
+	expired := &ably.TokenDetails{Token: "expired", Expires: ably.TimeNow() - 1000}
+	sample := []struct {
+		desc  string
+		token interface{}
+		want  string
+	}{
+		{"string", "token", "token"},
+		{"TokenDetails", &ably.TokenDetails{Token: "details"}, "details"},
+		{"TokenDetails value", ably.TokenDetails{Token: "details"}, "details"},
+		{"TokenRequest", &ably.TokenRequest{KeyName: "xxxxxx.yyyyyy"}, "requested"},
+		{"TokenRequest value", ably.TokenRequest{KeyName: "xxxxxx.yyyyyy"}, "requested"},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			// The first token has already expired, thus it's renewed
+			// on the next authorization.
+			tokens := []interface{}{expired, v.token}
+			client, err := ably.NewRestClient(&ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{
+					AuthCallback: func(*ably.TokenParams) (interface{}, error) {
+						tok := tokens[0]
+						tokens = tokens[1:]
+						return tok, nil
+					},
+				},
+				NoBinaryProtocol: true,
+				HTTPClient:       newTLSHTTPClientMock(server),
+			})
+			if err != nil {
+				t.Fatalf("NewRestClient()=%v", err)
+			}
+			tok, err := client.Auth.Authorize(nil, nil)
+			if err != nil {
+				t.Fatalf("Authorize()=%v", err)
+			}
+			if tok.Token != expired.Token {
+				t.Fatalf("want token=%q; got %q", expired.Token, tok.Token)
+			}
+			if tok, err = client.Auth.Authorize(nil, nil); err != nil {
+				t.Fatalf("Authorize()=%v", err)
+			}
+			if tok.Token != v.want {
+				t.Errorf("want token=%q; got %q", v.want, tok.Token)
+			}
+		})
+	}
+	for _, token := range []interface{}{nil, "", (*ably.TokenDetails)(nil), 42} {
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: func(*ably.TokenParams) (interface{}, error) {
+					return token, nil
+				},
+			},
+			NoBinaryProtocol: true,
+			HTTPClient:       newTLSHTTPClientMock(server),
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		_, err = client.Auth.Authorize(nil, nil)
+		if err := checkError(ably.ErrErrorFromClientTokenCallback, err); err != nil {
+			t.Errorf("token=%#v: %v", token, err)
+		}
+	}
+}
+
+// signJWT gives an HS256-signed JWT with the given claims.
+func signJWT(claims map[string]interface{}, secret string) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuth_JWT(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Unix()
+	expired := signJWT(map[string]interface{}{"iat": now - 7200, "exp": now - 3600}, "secret")
+	valid := signJWT(map[string]interface{}{
+		"iat":               now,
+		"exp":               now + 3600,
+		"x-ably-clientId":   "jwt-client",
+		"x-ably-capability": `{"*":["*"]}`,
+	}, "secret")
+
+	t.Run("AuthCallback", func(t *testing.T) {
+		t.Parallel()
+		var auths []string
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, err := authValue(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			auths = append(auths, auth)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+		// The first JWT has already expired, thus it's renewed on the next
+		// request, while the second one is used until its exp.
+		tokens := []string{expired, valid}
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: func(*ably.TokenParams) (interface{}, error) {
+					if len(tokens) == 0 {
+						return nil, errors.New("unexpected token renewal")
+					}
+					tok := tokens[0]
+					tokens = tokens[1:]
+					return tok, nil
+				},
+			},
+			NoBinaryProtocol: true,
+			HTTPClient:       newTLSHTTPClientMock(server),
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := client.Channels.Get("test", nil).History(nil); err != nil {
+				t.Fatalf("History()=%v", err)
+			}
+		}
+		if want := []string{expired, valid, valid}; !reflect.DeepEqual(auths, want) {
+			t.Errorf("want bearer tokens=%v; got %v", want, auths)
+		}
+		tok := client.Auth.Token()
+		if want := (now + 3600) * 1000; tok.Expires != want {
+			t.Errorf("want Expires=%d; got %d", want, tok.Expires)
+		}
+		if want := now * 1000; tok.Issued != want {
+			t.Errorf("want Issued=%d; got %d", want, tok.Issued)
+		}
+		if tok.ClientID != "jwt-client" {
+			t.Errorf("want ClientID=%q; got %q", "jwt-client", tok.ClientID)
+		}
+	})
+
+	t.Run("AuthURL", func(t *testing.T) {
+		t.Parallel()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/jwt")
+			w.Write([]byte(valid))
+		}))
+		defer server.Close()
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{AuthURL: server.URL},
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		tok, err := client.Auth.Authorize(nil, nil)
+		if err != nil {
+			t.Fatalf("Authorize()=%v", err)
+		}
+		if tok.Token != valid {
+			t.Errorf("want token=%q; got %q", valid, tok.Token)
+		}
+		if want := time.Unix(now+3600, 0); !tok.ExpireTime().Equal(want) {
+			t.Errorf("want ExpireTime()=%v; got %v", want, tok.ExpireTime())
+		}
+	})
+
+	t.Run("realtime", func(t *testing.T) {
+		t.Parallel()
+		client, conn, _ := newDropConnClient(t, &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: func(*ably.TokenParams) (interface{}, error) {
+					return valid, nil
+				},
+			},
+		})
+		defer safeclose(t, client)
+		if got := conn.url.Query().Get("access_token"); got != valid {
+			t.Errorf("want access_token=%q; got %q", valid, got)
+		}
+	})
+}
+
+func TestAuth_ServerTimeOffsetShared(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var timeRequests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/time":
+			mtx.Lock()
+			timeRequests++
+			mtx.Unlock()
+			fmt.Fprintf(w, "[%d]", ably.Time(time.Now().Add(-time.Hour)))
+		case "/keys/xxxxxx.yyyyyy/requestToken":
+			var req ably.TokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// The server rejects requests with a timestamp far from its time.
+			if d := ably.Time(time.Now().Add(-time.Hour)) - req.Timestamp; d < -60000 || d > 60000 {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":{"code":40104,"statusCode":401}}`))
+				return
+			}
+			fmt.Fprintf(w, `{"token":"token","expires":%d}`, ably.Time(time.Now().Add(time.Hour)))
+		case "/channels/test/messages":
+			w.Write([]byte("[]"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key:          "xxxxxx.yyyyyy:zzzzzz",
+			UseTokenAuth: true,
+			UseQueryTime: true,
+		},
+		NoConnect:        true,
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Auth.CreateTokenRequest(nil, nil); err != nil {
+			t.Fatalf("CreateTokenRequest()=%v", err)
+		}
+	}
+	if _, err := client.Auth.RequestToken(nil, nil); err != nil {
+		t.Fatalf("RequestToken()=%v", err)
+	}
+	// REST requests made by the realtime client authenticate with the same
+	// Auth, and thus the same server time offset.
+	if _, err := client.Channels.Get("test").History(nil); err != nil {
+		t.Fatalf("History()=%v", err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if timeRequests != 1 {
+		t.Errorf("want 1 request to /time; got %d", timeRequests)
+	}
+}
+
+func TestAuth_KeyCapability(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var tokenRequests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		tokenRequests++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"token","expires":%d}`, ably.Time(time.Now().Add(time.Hour)))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key:           "xxxxxx.yyyyyy:zzzzzz",
+			KeyCapability: ably.Capability{"chat:*": {"publish", "subscribe"}},
+		},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	exceeding := []ably.Capability{
+		{"chat:lobby": {"presence"}},
+		{"chat:lobby": {"*"}},
+		{"*": {"subscribe"}},
+		{"chat:*": {"subscribe"}, "news": {"subscribe"}},
+	}
+	for _, c := range exceeding {
+		_, err := client.Auth.RequestToken(&ably.TokenParams{RawCapability: c.Encode()}, nil)
+		if err := checkError(ably.ErrOperationNotPermittedWithProvidedCapability, err); err != nil {
+			t.Errorf("capability %s: %v", c.Encode(), err)
+		}
+	}
+	mtx.Lock()
+	n := tokenRequests
+	mtx.Unlock()
+	if n != 0 {
+		t.Fatalf("want no token requests sent for exceeding capabilities; got %d", n)
+	}
+	covered := ably.Capability{"chat:lobby": {"subscribe"}}
+	if _, err := client.Auth.RequestToken(&ably.TokenParams{RawCapability: covered.Encode()}, nil); err != nil {
+		t.Fatalf("RequestToken()=%v", err)
+	}
+	if _, err := client.Auth.RequestToken(nil, nil); err != nil {
+		t.Fatalf("RequestToken()=%v", err)
+	}
+}
+
+func TestAuth_SandboxKeyCapabilities(t *testing.T) {
+	t.Parallel()
+	app := ablytest.MustSandbox(ablytest.DefaultConfig(
+		ablytest.Key{},
+		ablytest.Key{RawCapability: `{"*":["publish"]}`},
+		ablytest.Key{RawCapability: `{"*":["subscribe"]}`},
+	))
+	defer safeclose(t, app)
+	cases := []struct {
+		capability ably.Capability
+		rejected   bool
+	}{
+		{ably.Capability{"*": {"publish"}}, false},  // i=0
+		{ably.Capability{"*": {"subscribe"}}, true}, // i=1
+	}
+	for i, cas := range cases {
+		key, err := app.KeyByCapability(cas.capability)
+		if err != nil {
+			t.Fatalf("%d: KeyByCapability()=%v", i, err)
+		}
+		client, err := ably.NewRestClient(app.Options(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: key},
+		}))
+		if err != nil {
+			t.Fatalf("%d: NewRestClient()=%v", i, err)
+		}
+		_, err = client.Channels.Get("capability", nil).Publish("name", "data")
+		if cas.rejected {
+			if err := checkError(40160, err); err != nil {
+				t.Errorf("%d: %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("%d: Publish()=%v", i, err)
+		}
+	}
+	if _, err := app.KeyByCapability(ably.Capability{"*": {"history"}}); err == nil {
+		t.Fatal("want KeyByCapability() to fail for missing capability")
+	}
+}
+
+// tokenRequests counts the tokens requested with its authCallback, failing
+// the nth request if fail reports true for it. If hold is set, all requests
+// but the first one don't return until it's closed.
+type tokenRequests struct {
+	mtx   sync.Mutex
+	ttl   time.Duration
+	fail  func(n int) bool
+	hold  chan struct{}
+	times []time.Time
+}
+
+func (r *tokenRequests) authCallback(*ably.TokenParams) (interface{}, error) {
+	r.mtx.Lock()
+	now := time.Now()
+	r.times = append(r.times, now)
+	n := len(r.times)
+	r.mtx.Unlock()
+	if r.hold != nil && n > 1 {
+		<-r.hold
+	}
+	if r.fail != nil && r.fail(n) {
+		return nil, errors.New("auth server unavailable")
+	}
+	return &ably.TokenDetails{
+		Token:   fmt.Sprintf("token-%d", n),
+		Issued:  ably.Time(now),
+		Expires: ably.Time(now.Add(r.ttl)),
+	}, nil
+}
+
+// wait waits for n token requests, giving the times they were made at.
+func (r *tokenRequests) wait(t *testing.T, n int) []time.Time {
+	t.Helper()
+	for deadline := time.Now().Add(ablytest.Timeout); ; time.Sleep(10 * time.Millisecond) {
+		r.mtx.Lock()
+		times := append([]time.Time(nil), r.times...)
+		r.mtx.Unlock()
+		if len(times) >= n {
+			return times
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d token requests; got %d", n, len(times))
+		}
+	}
+}
+
+// expectNoMore fails if more than n tokens are requested within the ttl,
+// when a renewal would otherwise be made.
+func (r *tokenRequests) expectNoMore(t *testing.T, n int) {
+	t.Helper()
+	time.Sleep(r.ttl)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.times) != n {
+		t.Fatalf("want no more renewals; got %d token requests, want %d", len(r.times), n)
+	}
+}
+
+func TestAuth_ScheduledRenewal(t *testing.T) {
+	t.Parallel()
+	const ttl = 400 * time.Millisecond
+	connect := func(t *testing.T, requests *tokenRequests) (*ably.RealtimeClient, *ablytest.ScriptedConn) {
+		requests.ttl = ttl
+		conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}})
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				AuthCallback: requests.authCallback,
+			},
+			NoConnect:          true,
+			Dial:               conn.Dial,
+			TokenRenewalBuffer: ttl / 4,
+		})
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		return client, conn
+	}
+
+	t.Run("renews before expiry", func(t *testing.T) {
+		t.Parallel()
+		requests := &tokenRequests{fail: func(n int) bool { return n == 3 }}
+		client, conn := connect(t, requests)
+		// The token is renewed before it expires and the connection is
+		// reauthenticated with the new one.
+		times := requests.wait(t, 2)
+		if expires := times[0].Add(ttl); !times[1].Before(expires) {
+			t.Fatalf("want renewal before expiry at %v; got %v", expires, times[1])
+		}
+		msg, err := conn.WaitForSent(proto.ActionAuth, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Auth == nil || msg.Auth.AccessToken != "token-2" {
+			t.Fatalf("want AUTH with token-2; got %+v", msg.Auth)
+		}
+		// The next renewal fails and is retried after a delay.
+		times = requests.wait(t, 4)
+		if d := times[3].Sub(times[2]); d < 900*time.Millisecond {
+			t.Fatalf("want failed renewal retried after a delay; retried after %v", d)
+		}
+		if tok := client.Auth.Token(); tok.Token != "token-4" {
+			t.Fatalf("want token-4; got %q", tok.Token)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatalf("Close()=%v", err)
+		}
+		requests.expectNoMore(t, 4)
+	})
+	t.Run("stops on Disconnect", func(t *testing.T) {
+		t.Parallel()
+		requests := &tokenRequests{}
+		client, _ := connect(t, requests)
+		defer safeclose(t, client)
+		requests.wait(t, 2)
+		client.Connection.Disconnect()
+		requests.expectNoMore(t, 2)
+	})
+	t.Run("doesn't block Disconnect while renewing", func(t *testing.T) {
+		t.Parallel()
+		requests := &tokenRequests{hold: make(chan struct{})}
+		client, _ := connect(t, requests)
+		defer safeclose(t, client)
+		requests.wait(t, 2)
+		done := make(chan struct{})
+		go func() {
+			client.Connection.Disconnect()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(ablytest.Timeout):
+			close(requests.hold)
+			t.Fatal("Disconnect blocked by the token renewal in flight")
+		}
+		close(requests.hold)
+		requests.expectNoMore(t, 2)
+	})
+	t.Run("stops on failure", func(t *testing.T) {
+		t.Parallel()
+		requests := &tokenRequests{}
+		client, conn := connect(t, requests)
+		requests.wait(t, 2)
+		conn.Push(&proto.ProtocolMessage{
+			Action: proto.ActionError,
+			Error:  &proto.ErrorInfo{StatusCode: 400, Code: 40000, Message: "failed"},
+		})
+		if err := ablytest.WaitConnState(client.Connection, ably.StateConnFailed, 0); err != nil {
+			t.Fatal(err)
+		}
+		requests.expectNoMore(t, 2)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/ably/ably-go/ably/proto"
 )
@@ -22,19 +23,48 @@ func toStatusCode(code int) int {
 // Error describes error returned from Ably API. It always has non-zero error
 // code. It may contain underlying error value which caused the failure
 // condition.
+//
+// Use errors.As to obtain the *Error from an error value which wraps it.
 type Error struct {
 	Code       int    // internal error code
 	StatusCode int    // HTTP status code
 	Err        error  // underlying error responsible for the failure; may be nil
 	Server     string // non-empty ID of the Ably server which the error was received from
+	HRef       string // URL of the help page for the error; may be empty (Spec TI4)
+	RequestID  string // ID of the failed REST request, set when ClientOptions.AddRequestIDs is true (Spec RSC7c)
 }
 
-// Error implements builtin error interface.
+// ErrorInfo is the name the Ably specification (TI1) gives to Error.
+type ErrorInfo = Error
+
+// Error implements builtin error interface. The message includes the URL of
+// the help page for the error.
 func (err *Error) Error() string {
+	var msg string
 	if err.Err != nil {
-		return fmt.Sprintf("%s (status=%d, internal=%d)", err.Err, err.StatusCode, err.Code)
+		msg = fmt.Sprintf("%s (status=%d, internal=%d)", err.Err, err.StatusCode, err.Code)
+	} else {
+		msg = errCodeText[err.Code]
+	}
+	if href := err.helpURL(); href != "" && !strings.Contains(msg, href) {
+		msg += " See " + href
+	}
+	return msg
+}
+
+// Unwrap gives the underlying error.
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func (err *Error) helpURL() string {
+	if err.HRef != "" {
+		return err.HRef
+	}
+	if err.Code != 0 {
+		return fmt.Sprintf("https://help.ably.io/error/%d", err.Code)
 	}
-	return errCodeText[err.Code]
+	return ""
 }
 
 func newError(code int, err error) *Error {
@@ -75,6 +105,8 @@ func newErrorProto(err *proto.ErrorInfo) *Error {
 		Code:       err.Code,
 		StatusCode: err.StatusCode,
 		Err:        errors.New(err.Message),
+		Server:     err.Server,
+		HRef:       err.HRef,
 	}
 }
 
@@ -107,6 +139,7 @@ func checkValidHTTPResponse(resp *http.Response) error {
 		Code:       body.Error.Code,
 		StatusCode: body.Error.StatusCode,
 		Server:     body.Error.Server,
+		HRef:       body.Error.HRef,
 	}
 	if body.Error.Message != "" {
 		err.Err = errors.New(body.Error.Message)
@@ -1,6 +1,10 @@
 package ably_test
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/ably/ably-go/ably"
@@ -26,3 +30,59 @@ func TestCheckValidHTTPResponse(t *testing.T) {
 		t.Error("want Err to be non-nil")
 	}
 }
+
+func TestErrorInfo_ServerError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"code":40142,"statusCode":401,` +
+			`"message":"Token expired","href":"https://help.ably.io/error/40142",` +
+			`"serverId":"frontend.1"}}`))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+		HTTPClient:  newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	_, err = client.Channels.Get("test", nil).History(nil)
+	info, ok := err.(*ably.ErrorInfo)
+	if !ok {
+		t.Fatalf("want err to be *ably.ErrorInfo; was %T: %v", err, err)
+	}
+	if info.Unwrap() != info.Err {
+		t.Errorf("want Unwrap()=%v; got %v", info.Err, info.Unwrap())
+	}
+	if info.Code != 40142 {
+		t.Errorf("want Code=40142; got %d", info.Code)
+	}
+	if info.StatusCode != 401 {
+		t.Errorf("want StatusCode=401; got %d", info.StatusCode)
+	}
+	if info.HRef != "https://help.ably.io/error/40142" {
+		t.Errorf("want HRef=https://help.ably.io/error/40142; got %q", info.HRef)
+	}
+	if info.Server != "frontend.1" {
+		t.Errorf("want Server=frontend.1; got %q", info.Server)
+	}
+	if info.Err == nil || info.Err.Error() != "Token expired" {
+		t.Errorf("want Err=Token expired; got %v", info.Err)
+	}
+	if n := strings.Count(info.Error(), "https://help.ably.io/error/40142"); n != 1 {
+		t.Errorf("want Error() to include the help URL once; got %q", info.Error())
+	}
+}
+
+func TestErrorInfo_HelpURL(t *testing.T) {
+	t.Parallel()
+	err := &ably.ErrorInfo{Code: 80000, StatusCode: 500, Err: errors.New("connection failed")}
+	if want := "See https://help.ably.io/error/80000"; !strings.Contains(err.Error(), want) {
+		t.Errorf("want %q to contain %q", err.Error(), want)
+	}
+	if cause := err.Unwrap(); cause != err.Err {
+		t.Errorf("want Unwrap()=%v; got %v", err.Err, cause)
+	}
+}
@@ -21,6 +21,7 @@ const (
 	ErrInvalidMessageDataOrEncoding                                            = 40013
 	ErrResourceDisposed                                                        = 40014
 	ErrInvalidDeviceID                                                         = 40015
+	ErrVcdiffDecodeFailure                                                     = 40018
 	ErrBatchError                                                              = 40020
 	ErrInvalidPublishRequestUnspecified                                        = 40030
 	ErrInvalidPublishRequestInvalidClientSpecifiedID                           = 40031
@@ -139,6 +140,7 @@ var errCodeText = map[int]string{
 	40013: "Invalid message data or encoding",
 	40014: "Resource disposed",
 	40015: "Invalid device id",
+	40018: "Vcdiff decode failure",
 	40020: "Batch error",
 	40030: "Invalid publish request (unspecified)",
 	40031: "Invalid publish request (invalid client-specified id)",
@@ -30,6 +30,12 @@ func (a *Auth) Method() int {
 	return a.method
 }
 
+func (a *Auth) Token() *TokenDetails {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.token()
+}
+
 func DecodeResp(resp *http.Response, out interface{}) error {
 	return decodeResp(resp, out)
 }
@@ -57,6 +63,10 @@ func (ch *Channels) GetAndAttach(name string) *RealtimeChannel {
 	return channel
 }
 
+func (req *TokenRequest) Sign(secret []byte) {
+	req.sign(secret)
+}
+
 func (a *Auth) Timestamp(query bool) (time.Time, error) {
 	return a.timestamp(query)
 }
@@ -80,3 +90,26 @@ func (c *RestClient) GetCachedFallbackHost() string {
 func (opts *ClientOptions) GetFallbackRetryTimeout() time.Duration {
 	return opts.fallbackRetryTimeout()
 }
+
+func (opts *ClientOptions) GetFallbackHosts() []string {
+	return opts.fallbackHosts()
+}
+
+func ApplyOptions(options ...ClientOption) *ClientOptions {
+	return applyOptions("ApplyOptions", options)
+}
+
+// MsgSerial gives the serial the next message sent on the connection gets.
+func (c *Conn) MsgSerial() int64 {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.msgSerial
+}
+
+// SetMsgSerial sets the serial the next message sent on the connection gets;
+// it's reset to 0 when a new connection is established.
+func (c *Conn) SetMsgSerial(serial int64) {
+	c.state.Lock()
+	defer c.state.Unlock()
+	c.msgSerial = serial
+}
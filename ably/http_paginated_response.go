@@ -1,6 +1,7 @@
 package ably
 
 import (
+	"encoding/json"
 	"net/http"
 	"reflect"
 
@@ -44,6 +45,7 @@ func newHTTPPaginatedResultFromPaginatedResult(p *PaginatedResult) *HTTPPaginate
 	h.Success = p.success
 	h.ErrorCode = p.errorCode
 	h.ErrorMessage = p.errorMessage
+	h.Headers = p.respHeaders
 	return h
 }
 
@@ -56,3 +58,18 @@ func (h *HTTPPaginatedResponse) Next() (*HTTPPaginatedResponse, error) {
 	}
 	return newHTTPPaginatedResultFromPaginatedResult(p), nil
 }
+
+// RawItems returns the items of the current page, each encoded as JSON
+// regardless of the protocol used for the request.
+func (h *HTTPPaginatedResponse) RawItems() ([]json.RawMessage, error) {
+	items := h.Items()
+	raw := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		p, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, p)
+	}
+	return raw, nil
+}
@@ -2,6 +2,7 @@ package ably_test
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"testing"
@@ -153,3 +154,52 @@ func TestHTTPPaginatedResponse(t *testing.T) {
 		}
 	})
 }
+
+func TestHTTPPaginatedResponse_Request(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/time" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Test", r.Header.Get("X-Test"))
+		w.Write([]byte("[1500000000000]"))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "xxxxxx.yyyyyy:zzzzzz",
+		},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	res, err := client.Request("get", "/time", nil, nil, http.Header{"X-Test": {"value"}})
+	if err != nil {
+		t.Fatalf("Request()=%v", err)
+	}
+	if res.StatusCode != http.StatusOK || !res.Success {
+		t.Fatalf("want status=200 success=true; got status=%d success=%t", res.StatusCode, res.Success)
+	}
+	if h := res.Headers.Get("X-Test"); h != "value" {
+		t.Errorf("want X-Test=%q; got %q", "value", h)
+	}
+	items, err := res.RawItems()
+	if err != nil {
+		t.Fatalf("RawItems()=%v", err)
+	}
+	if len(items) != 1 || string(items[0]) != "1500000000000" {
+		t.Errorf("want items=[1500000000000]; got %s", items)
+	}
+	_, err = client.Request("connect", "/time", nil, nil, nil)
+	if err := checkError(ably.ErrMethodNotAllowed, err); err != nil {
+		t.Error(err)
+	}
+}
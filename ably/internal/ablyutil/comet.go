@@ -0,0 +1,258 @@
+package ablyutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+
+	"github.com/ably/ably-go/ably/proto"
+)
+
+// cometParams are the query parameters of the connection request which are
+// sent along with every other comet request.
+var cometParams = []string{"key", "access_token", "format"}
+
+var errCometClosed = errors.New("comet connection closed")
+
+// CometConn is a connection over the comet transport, which uses HTTP
+// long polling to receive messages and HTTP requests to send them.
+type CometConn struct {
+	client  *http.Client
+	proto   string
+	base    *url.URL   // scheme and host of the comet endpoints
+	query   url.Values // parameters sent with every request
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mtx     sync.Mutex
+	key     string                   // connection key the endpoints are scoped to
+	pending []*proto.ProtocolMessage // received messages not yet read
+	changed chan struct{}            // closed and replaced when pending grows
+	poll    chan cometPoll           // result of the long poll in flight, if any
+}
+
+// cometPoll is the outcome of a long polling request.
+type cometPoll struct {
+	msgs []*proto.ProtocolMessage
+	err  error
+}
+
+// DialComet connects to the comet endpoints of the realtime host u points to,
+// with the query parameters of u. The requests are made with client, except
+// for the long polling ones which are made without the client's timeout.
+func DialComet(proto string, u *url.URL, client *http.Client) (*CometConn, error) {
+	switch proto {
+	case "application/json", "application/x-msgpack":
+	default:
+		return nil, errors.New(`invalid protocol "` + proto + `"`)
+	}
+	base := &url.URL{Scheme: "https", Host: u.Host}
+	if u.Scheme == "ws" || u.Scheme == "http" {
+		base.Scheme = "http"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &CometConn{
+		client:  client,
+		proto:   proto,
+		base:    base,
+		query:   make(url.Values),
+		changed: make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	values := u.Query()
+	for _, k := range cometParams {
+		if v, ok := values[k]; ok {
+			c.query[k] = v
+		}
+	}
+	msgs, err := c.do(client, "GET", c.endpoint("connect", values), nil)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+	c.enqueue(msgs)
+	return c, nil
+}
+
+func (c *CometConn) Send(msg *proto.ProtocolMessage) error {
+	c.mtx.Lock()
+	if msg.Action == proto.ActionAuth && msg.Auth != nil && msg.Auth.AccessToken != "" {
+		c.query.Set("access_token", msg.Auth.AccessToken)
+	}
+	key := c.key
+	c.mtx.Unlock()
+	if key == "" {
+		return errors.New("comet connection is not connected")
+	}
+	body, err := c.marshal([]*proto.ProtocolMessage{msg})
+	if err != nil {
+		return err
+	}
+	msgs, err := c.do(c.client, "POST", c.endpoint(path.Join(key, "send"), nil), body)
+	if err != nil {
+		return err
+	}
+	c.enqueue(msgs)
+	return nil
+}
+
+// Receive gives the next received message, long polling the server for more
+// when all of them were read. Messages received in response to Send, like
+// ACKs, are given without waiting for the long polling request to return,
+// which is then kept for the next call.
+func (c *CometConn) Receive() (*proto.ProtocolMessage, error) {
+	for {
+		c.mtx.Lock()
+		if len(c.pending) != 0 {
+			msg := c.pending[0]
+			c.pending = c.pending[1:]
+			c.mtx.Unlock()
+			return msg, nil
+		}
+		key, changed, poll := c.key, c.changed, c.poll
+		if poll == nil && key != "" {
+			poll = make(chan cometPoll, 1)
+			c.poll = poll
+			go c.longPoll(key, poll)
+		}
+		c.mtx.Unlock()
+		if c.ctx.Err() != nil {
+			return nil, errCometClosed
+		}
+		if key == "" {
+			return nil, errors.New("comet connection is not connected")
+		}
+		select {
+		case res := <-poll:
+			c.mtx.Lock()
+			c.poll = nil
+			c.mtx.Unlock()
+			if res.err != nil {
+				if c.ctx.Err() != nil {
+					return nil, errCometClosed
+				}
+				return nil, res.err
+			}
+			c.enqueue(res.msgs)
+		case <-changed:
+		case <-c.ctx.Done():
+			return nil, errCometClosed
+		}
+	}
+}
+
+// longPoll requests the messages the server has got for the connection,
+// sending the outcome to poll.
+func (c *CometConn) longPoll(key string, poll chan<- cometPoll) {
+	// The server holds the long polling requests open until it has got
+	// messages to send, which may take longer than the client's timeout.
+	client := *c.client
+	client.Timeout = 0
+	msgs, err := c.do(&client, "GET", c.endpoint(path.Join(key, "recv"), nil), nil)
+	poll <- cometPoll{msgs: msgs, err: err}
+}
+
+// Close closes the connection on the server and stops pending long polling
+// requests.
+func (c *CometConn) Close() error {
+	c.mtx.Lock()
+	key := c.key
+	c.mtx.Unlock()
+	var err error
+	if key != "" && c.ctx.Err() == nil {
+		_, err = c.do(c.client, "POST", c.endpoint(path.Join(key, "close"), nil), nil)
+	}
+	c.cancel()
+	return err
+}
+
+func (c *CometConn) endpoint(name string, query url.Values) string {
+	u := *c.base
+	u.Path = "/comet/" + name
+	if query == nil {
+		c.mtx.Lock()
+		query = c.query
+		u.RawQuery = query.Encode()
+		c.mtx.Unlock()
+	} else {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// enqueue appends messages to the ones waiting to be read; the connection
+// key the following requests are made for is taken from CONNECTED messages.
+func (c *CometConn) enqueue(msgs []*proto.ProtocolMessage) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, msg := range msgs {
+		if msg.Action != proto.ActionConnected {
+			continue
+		}
+		if msg.ConnectionDetails != nil && msg.ConnectionDetails.ConnectionKey != "" {
+			c.key = msg.ConnectionDetails.ConnectionKey
+		} else if msg.ConnectionKey != "" {
+			c.key = msg.ConnectionKey
+		}
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	c.pending = append(c.pending, msgs...)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *CometConn) do(client *http.Client, method, u string, body []byte) ([]*proto.ProtocolMessage, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Accept", c.proto)
+	if body != nil {
+		req.Header.Set("Content-Type", c.proto)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("comet request %s %s failed with status %d: %s", method, req.URL.Path, resp.StatusCode, p)
+	}
+	if len(bytes.TrimSpace(p)) == 0 {
+		return nil, nil
+	}
+	var msgs []*proto.ProtocolMessage
+	if err := c.unmarshal(p, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (c *CometConn) marshal(v interface{}) ([]byte, error) {
+	if c.proto == "application/json" {
+		return json.Marshal(v)
+	}
+	return Marshal(v)
+}
+
+func (c *CometConn) unmarshal(p []byte, v interface{}) error {
+	if c.proto == "application/json" {
+		return json.Unmarshal(p, v)
+	}
+	return Unmarshal(p, v)
+}
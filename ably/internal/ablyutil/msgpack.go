@@ -3,6 +3,7 @@ package ablyutil
 import (
 	"bytes"
 	"io"
+	"reflect"
 
 	"github.com/ugorji/go/codec"
 )
@@ -13,6 +14,9 @@ func init() {
 	handle.Raw = true
 	handle.WriteExt = true
 	handle.RawToString = true
+	// Decode nested maps the same way encoding/json does, so payloads
+	// look alike regardless of the protocol in use.
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
 }
 
 // Unmarshal decodes the MessagePack-encoded data and stores the result in the
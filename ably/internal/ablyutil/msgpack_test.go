@@ -27,4 +27,23 @@ func TestMsgpack(t *testing.T) {
 			ts.Errorf("expected 12 got %v", b.Key)
 		}
 	})
+	t.Run("must decode nested maps into map[string]interface{}", func(ts *testing.T) {
+		p, err := Marshal(map[string]interface{}{
+			"extras": map[string]interface{}{"key": "value"},
+		})
+		if err != nil {
+			ts.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := Unmarshal(p, &m); err != nil {
+			ts.Fatal(err)
+		}
+		extras, ok := m["extras"].(map[string]interface{})
+		if !ok {
+			ts.Fatalf("expected map[string]interface{} got %T", m["extras"])
+		}
+		if extras["key"] != "value" {
+			ts.Errorf("expected %q got %v", "value", extras["key"])
+		}
+	})
 }
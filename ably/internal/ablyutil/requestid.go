@@ -0,0 +1,18 @@
+package ablyutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// RequestID returns a URL-safe base64 encoded 12 random bytes, which
+// identifies a request in the server logs.
+//
+// Spec RSC7c
+func RequestID() (string, error) {
+	r := make([]byte, 12)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(r), nil
+}
@@ -2,19 +2,38 @@ package ablyutil
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"time"
 
 	"github.com/ably/ably-go/ably/proto"
 
 	"golang.org/x/net/websocket"
 )
 
+// Websocket subprotocols requested for each of the protocols. They match the
+// values of the format query parameter.
+const (
+	SubprotocolJSON    = "json"
+	SubprotocolMsgpack = "msgpack"
+)
+
 type WebsocketConn struct {
-	conn  *websocket.Conn
-	codec websocket.Codec
+	conn         *websocket.Conn
+	codec        websocket.Codec
+	writeTimeout time.Duration // zero means no timeout
 }
 
+// Send writes msg to the connection. It fails if writing takes longer than
+// the timeout the connection was dialed with, so a stuck socket doesn't
+// block the sender forever.
 func (ws *WebsocketConn) Send(msg *proto.ProtocolMessage) error {
+	if ws.writeTimeout > 0 {
+		if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout)); err != nil {
+			return err
+		}
+	}
 	return ws.codec.Send(ws.conn, msg)
 }
 
@@ -32,23 +51,56 @@ func (ws *WebsocketConn) Close() error {
 }
 
 func DialWebsocket(proto string, u *url.URL) (*WebsocketConn, error) {
-	ws := &WebsocketConn{}
+	return DialWebsocketTimeout(proto, u, 0)
+}
+
+// DialWebsocketTimeout is like DialWebsocket, but it fails when establishing
+// the connection or sending a message takes longer than timeout; zero timeout
+// means no timeout.
+//
+// The websocket subprotocol matching proto is requested during the handshake.
+// If the server selects a different subprotocol, the connection fails with
+// a *proto.ErrorInfo, instead of exchanging messages with the wrong codec.
+// A server which doesn't echo any subprotocol is accepted, as the codec is
+// also negotiated with the format query parameter.
+func DialWebsocketTimeout(proto string, u *url.URL, timeout time.Duration) (*WebsocketConn, error) {
+	ws := &WebsocketConn{writeTimeout: timeout}
+	var subprotocol string
 	switch proto {
 	case "application/json":
 		ws.codec = websocket.JSON
+		subprotocol = SubprotocolJSON
 	case "application/x-msgpack":
 		ws.codec = msgpackCodec
+		subprotocol = SubprotocolMsgpack
 	default:
 		return nil, errors.New(`invalid protocol "` + proto + `"`)
 	}
-	conn, err := websocket.Dial(u.String(), "", "https://"+u.Host)
+	config, err := websocket.NewConfig(u.String(), "https://"+u.Host)
 	if err != nil {
 		return nil, err
 	}
+	config.Dialer = &net.Dialer{Timeout: timeout}
+	config.Protocol = []string{subprotocol}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		if e, ok := err.(*websocket.DialError); ok && e.Err == websocket.ErrBadWebSocketProtocol {
+			return nil, errBadSubprotocol(subprotocol)
+		}
+		return nil, err
+	}
 	ws.conn = conn
 	return ws, nil
 }
 
+func errBadSubprotocol(subprotocol string) error {
+	return &proto.ErrorInfo{
+		StatusCode: 400,
+		Code:       80013, // protocol error
+		Message:    fmt.Sprintf("server didn't accept the %q websocket subprotocol", subprotocol),
+	}
+}
+
 var msgpackCodec = websocket.Codec{
 	Marshal: func(v interface{}) ([]byte, byte, error) {
 		p, err := Marshal(v)
@@ -0,0 +1,106 @@
+package ablyutil
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ably/ably-go/ably/proto"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestDialWebsocket_Subprotocol(t *testing.T) {
+	tests := []struct {
+		proto  string
+		want   string
+		accept string
+		err    bool
+	}{
+		{"application/json", SubprotocolJSON, SubprotocolJSON, false},
+		{"application/x-msgpack", SubprotocolMsgpack, SubprotocolMsgpack, false},
+		{"application/x-msgpack", SubprotocolMsgpack, SubprotocolJSON, true},
+		{"application/json", SubprotocolJSON, "unknown", true},
+	}
+	for _, tt := range tests {
+		var requested []string
+		server := httptest.NewServer(websocket.Server{
+			Handshake: func(config *websocket.Config, _ *http.Request) error {
+				requested = config.Protocol
+				config.Protocol = []string{tt.accept}
+				return nil
+			},
+			Handler: func(conn *websocket.Conn) {
+				conn.Close()
+			},
+		})
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Scheme = "ws"
+		conn, err := DialWebsocket(tt.proto, u)
+		server.Close()
+		if len(requested) != 1 || requested[0] != tt.want {
+			t.Errorf("%s: want requested subprotocols=[%s]; got %v", tt.proto, tt.want, requested)
+		}
+		if !tt.err {
+			if err != nil {
+				t.Errorf("%s: DialWebsocket()=%v", tt.proto, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		e, ok := err.(*proto.ErrorInfo)
+		if !ok {
+			t.Errorf("%s: want *proto.ErrorInfo error; got %#v", tt.proto, err)
+			continue
+		}
+		if e.Code != 80013 {
+			t.Errorf("%s: want code=80013; got %d", tt.proto, e.Code)
+		}
+	}
+}
+
+func TestWebsocketConn_WriteTimeout(t *testing.T) {
+	// The server never reads, so the socket's buffers fill up and writes
+	// block until the deadline.
+	stop := make(chan struct{})
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		<-stop
+	}))
+	defer server.Close()
+	defer close(stop)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "ws"
+	conn, err := DialWebsocketTimeout("application/json", u, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := &proto.ProtocolMessage{
+		Action:   proto.ActionMessage,
+		Messages: []*proto.Message{{Data: strings.Repeat("x", 1<<20)}},
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := conn.Send(msg)
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Fatalf("want timeout error; got %#v", err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want Send to time out")
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Package vcdiff implements a decoder for the VCDIFF generic differencing and
+// compression data format described in RFC 3284, which is used by Ably for
+// delta compressed channel messages.
+//
+// Only deltas using the default code table and no secondary compression are
+// supported. The Adler-32 checksum extension of open-vcdiff is verified when
+// present.
+package vcdiff
+
+import (
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"math"
+)
+
+var magic = []byte{0xD6, 0xC3, 0xC4, 0x00}
+
+// Header indicator bits.
+const (
+	vcdDecompress = 1 << iota
+	vcdCodeTable
+	vcdAppHeader // open-vcdiff extension
+)
+
+// Window indicator bits.
+const (
+	vcdSource = 1 << iota
+	vcdTarget
+	vcdAdler32 // open-vcdiff extension
+)
+
+// Instruction types.
+const (
+	instNoop = iota
+	instAdd
+	instRun
+	instCopy
+)
+
+const (
+	nearSize = 4
+	sameSize = 3
+)
+
+// MaxTargetSize is the maximum size in bytes of a decoded target. It's far
+// above the size of any message accepted by Ably and protects from deltas
+// declaring huge windows.
+const MaxTargetSize = 16 << 20
+
+var errTruncated = errors.New("vcdiff: unexpected end of delta")
+
+type inst struct {
+	typ  byte
+	size byte
+	mode byte
+}
+
+// codeTable is the default instruction code table (RFC 3284, section 5.6).
+var codeTable = func() (t [256][2]inst) {
+	i := 0
+	next := func(a, b inst) {
+		t[i] = [2]inst{a, b}
+		i++
+	}
+	next(inst{typ: instRun}, inst{})
+	for size := 0; size <= 17; size++ {
+		next(inst{typ: instAdd, size: byte(size)}, inst{})
+	}
+	for mode := 0; mode <= 8; mode++ {
+		next(inst{typ: instCopy, mode: byte(mode)}, inst{})
+		for size := 4; size <= 18; size++ {
+			next(inst{typ: instCopy, size: byte(size), mode: byte(mode)}, inst{})
+		}
+	}
+	for mode := 0; mode <= 5; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				next(inst{typ: instAdd, size: byte(addSize)}, inst{typ: instCopy, size: byte(copySize), mode: byte(mode)})
+			}
+		}
+	}
+	for mode := 6; mode <= 8; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			next(inst{typ: instAdd, size: byte(addSize)}, inst{typ: instCopy, size: 4, mode: byte(mode)})
+		}
+	}
+	for mode := 0; mode <= 8; mode++ {
+		next(inst{typ: instCopy, size: 4, mode: byte(mode)}, inst{typ: instAdd, size: 1})
+	}
+	return t
+}()
+
+// Decode applies the delta to the source and returns the reconstructed
+// target.
+func Decode(source, delta []byte) ([]byte, error) {
+	r := &reader{b: delta}
+	hdr, err := r.bytes(len(magic))
+	if err != nil {
+		return nil, err
+	}
+	for i := range magic {
+		if hdr[i] != magic[i] {
+			return nil, errors.New("vcdiff: invalid header")
+		}
+	}
+	indicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if indicator&vcdDecompress != 0 {
+		return nil, errors.New("vcdiff: secondary compression is not supported")
+	}
+	if indicator&vcdCodeTable != 0 {
+		return nil, errors.New("vcdiff: custom code tables are not supported")
+	}
+	if indicator&vcdAppHeader != 0 {
+		n, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.bytes(n); err != nil {
+			return nil, err
+		}
+	}
+	var target []byte
+	for !r.empty() {
+		if target, err = decodeWindow(r, source, target); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+func decodeWindow(r *reader, source, target []byte) ([]byte, error) {
+	indicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	var segment []byte
+	if indicator&(vcdSource|vcdTarget) != 0 {
+		size, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		pos, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		from := source
+		if indicator&vcdTarget != 0 {
+			from = target
+		}
+		if pos+size > len(from) {
+			return nil, errors.New("vcdiff: source segment out of range")
+		}
+		segment = from[pos : pos+size]
+	}
+	if _, err := r.int(); err != nil { // length of the delta encoding
+		return nil, err
+	}
+	size, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxTargetSize-len(target) {
+		return nil, fmt.Errorf("vcdiff: target window of %d bytes exceeds the maximum target size", size)
+	}
+	deltaIndicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if deltaIndicator != 0 {
+		return nil, errors.New("vcdiff: secondary compression is not supported")
+	}
+	dataLen, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+	instLen, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+	addrLen, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+	var checksum uint32
+	if indicator&vcdAdler32 != 0 {
+		b, err := r.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+		checksum = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	data, err := r.bytes(dataLen)
+	if err != nil {
+		return nil, err
+	}
+	insts, err := r.bytes(instLen)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.bytes(addrLen)
+	if err != nil {
+		return nil, err
+	}
+	w := &window{
+		segment: segment,
+		data:    &reader{b: data},
+		insts:   &reader{b: insts},
+		addrs:   &reader{b: addrs},
+		out:     make([]byte, 0, size),
+	}
+	if err := w.decode(); err != nil {
+		return nil, err
+	}
+	if len(w.out) != size {
+		return nil, fmt.Errorf("vcdiff: decoded window has %d bytes, expected %d", len(w.out), size)
+	}
+	if indicator&vcdAdler32 != 0 && adler32.Checksum(w.out) != checksum {
+		return nil, errors.New("vcdiff: checksum mismatch")
+	}
+	return append(target, w.out...), nil
+}
+
+type window struct {
+	segment []byte
+	data    *reader
+	insts   *reader
+	addrs   *reader
+	out     []byte
+
+	near     [nearSize]int
+	nextSlot int
+	same     [sameSize * 256]int
+}
+
+func (w *window) decode() error {
+	for !w.insts.empty() {
+		code, err := w.insts.byte()
+		if err != nil {
+			return err
+		}
+		for _, in := range codeTable[code] {
+			if in.typ == instNoop {
+				continue
+			}
+			size := int(in.size)
+			if size == 0 {
+				if size, err = w.insts.int(); err != nil {
+					return err
+				}
+			}
+			if err := w.exec(in, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *window) exec(in inst, size int) error {
+	if size > cap(w.out)-len(w.out) {
+		return errors.New("vcdiff: instruction exceeds the target window")
+	}
+	switch in.typ {
+	case instAdd:
+		b, err := w.data.bytes(size)
+		if err != nil {
+			return err
+		}
+		w.out = append(w.out, b...)
+	case instRun:
+		b, err := w.data.byte()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			w.out = append(w.out, b)
+		}
+	case instCopy:
+		here := len(w.segment) + len(w.out)
+		addr, err := w.addr(in.mode, here)
+		if err != nil {
+			return err
+		}
+		// Copies from the target window may overlap with the bytes being
+		// produced, so they are appended one at a time.
+		for i := 0; i < size; i++ {
+			if p := addr + i; p < len(w.segment) {
+				w.out = append(w.out, w.segment[p])
+			} else {
+				w.out = append(w.out, w.out[p-len(w.segment)])
+			}
+		}
+	}
+	return nil
+}
+
+// addr decodes a copy address and updates the address caches
+// (RFC 3284, section 5.3).
+func (w *window) addr(mode byte, here int) (int, error) {
+	var addr int
+	switch m := int(mode); {
+	case m == 0: // VCD_SELF
+		n, err := w.addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = n
+	case m == 1: // VCD_HERE
+		n, err := w.addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = here - n
+	case m < 2+nearSize:
+		n, err := w.addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = w.near[m-2] + n
+	default:
+		b, err := w.addrs.byte()
+		if err != nil {
+			return 0, err
+		}
+		addr = w.same[(m-2-nearSize)*256+int(b)]
+	}
+	if addr < 0 || addr >= here {
+		return 0, fmt.Errorf("vcdiff: invalid copy address %d", addr)
+	}
+	w.near[w.nextSlot] = addr
+	w.nextSlot = (w.nextSlot + 1) % nearSize
+	w.same[addr%len(w.same)] = addr
+	return addr, nil
+}
+
+type reader struct {
+	b []byte
+}
+
+func (r *reader) empty() bool {
+	return len(r.b) == 0
+}
+
+func (r *reader) byte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, errTruncated
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, errTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// int reads a variable-length integer (RFC 3284, section 2).
+func (r *reader) int() (int, error) {
+	var n uint64
+	for i := 0; i < 5; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			if n > math.MaxInt32 {
+				break
+			}
+			return int(n), nil
+		}
+	}
+	return 0, errors.New("vcdiff: integer overflow")
+}
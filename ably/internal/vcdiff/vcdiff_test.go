@@ -0,0 +1,155 @@
+package vcdiff_test
+
+import (
+	"hash/adler32"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ably/ably-go/ably/internal/vcdiff"
+)
+
+var header = []byte{0xD6, 0xC3, 0xC4, 0x00, 0x00}
+
+// window encodes a single delta window; segment holds the size and position
+// of the source segment, if any.
+func window(indicator byte, segment []byte, target string, data, insts, addrs []byte) []byte {
+	enc := varint(len(target))
+	enc = append(enc, 0x00)
+	enc = append(enc, varint(len(data))...)
+	enc = append(enc, varint(len(insts))...)
+	enc = append(enc, varint(len(addrs))...)
+	if indicator&0x04 != 0 {
+		sum := adler32.Checksum([]byte(target))
+		enc = append(enc, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+	}
+	enc = append(enc, data...)
+	enc = append(enc, insts...)
+	enc = append(enc, addrs...)
+	w := append([]byte{indicator}, segment...)
+	w = append(w, varint(len(enc))...)
+	return append(w, enc...)
+}
+
+func varint(n int) []byte {
+	b := []byte{byte(n & 0x7F)}
+	for n >>= 7; n > 0; n >>= 7 {
+		b = append([]byte{byte(n&0x7F) | 0x80}, b...)
+	}
+	return b
+}
+
+func delta(windows ...[]byte) []byte {
+	d := append([]byte(nil), header...)
+	for _, w := range windows {
+		d = append(d, w...)
+	}
+	return d
+}
+
+func TestDecode(t *testing.T) {
+	const source = "abcdefghijklmnop"
+	sample := []struct {
+		desc   string
+		delta  []byte
+		target string
+	}{
+		{
+			// The example from RFC 3284, section 6.
+			desc: "add, copy, overlapping copy and run",
+			delta: delta(window(0x01, []byte{16, 0}, "abcdwxyzefghefghefghefghzzzz",
+				[]byte("wxyzz"),
+				[]byte{20, 172, 44, 0, 4},
+				[]byte{0, 4, 4},
+			)),
+			target: "abcdwxyzefghefghefghefghzzzz",
+		},
+		{
+			desc: "near and same address caches",
+			delta: delta(window(0x01, []byte{16, 0}, "ijklijklijkl",
+				nil,
+				[]byte{20, 52, 116},
+				[]byte{8, 0, 8},
+			)),
+			target: "ijklijklijkl",
+		},
+		{
+			desc: "multiple windows with target segment and checksums",
+			delta: delta(
+				window(0x04, nil, "hello", []byte("hello"), []byte{6}, nil),
+				window(0x06, []byte{5, 0}, "hellohello", nil, []byte{21, 21}, []byte{0, 0}),
+			),
+			target: "hellohellohello",
+		},
+		{
+			desc:   "multi-byte sizes",
+			delta:  delta(window(0x00, nil, strings.Repeat("x", 200), []byte("x"), append([]byte{0}, varint(200)...), nil)),
+			target: strings.Repeat("x", 200),
+		},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			got, err := vcdiff.Decode([]byte(source), v.delta)
+			if err != nil {
+				t.Fatalf("Decode()=%v", err)
+			}
+			if string(got) != v.target {
+				t.Errorf("want %q; got %q", v.target, got)
+			}
+		})
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	valid := window(0x05, []byte{16, 0}, "abcd", nil, []byte{20}, []byte{0})
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-3]++ // last checksum byte
+	sample := []struct {
+		desc  string
+		delta []byte
+	}{
+		{"invalid header", []byte{0xD6, 0xC3, 0xC5, 0x00, 0x00}},
+		{"truncated window", delta(valid[:len(valid)-1])},
+		{"checksum mismatch", delta(corrupted)},
+		{"source segment out of range", delta(window(0x01, []byte{17, 0}, "abcd", nil, []byte{20}, []byte{0}))},
+		{"copy beyond decoded data", delta(window(0x01, []byte{16, 0}, "abcd", nil, []byte{20}, []byte{16}))},
+		{"negative copy address", delta(window(0x01, []byte{16, 0}, "abcd", nil, []byte{36}, []byte{99}))},
+		{"run beyond target window", delta(window(0x00, nil, "x", []byte("x"), append([]byte{0}, varint(1<<30)...), nil))},
+		{"target window too large", delta(append([]byte{0x00, 0x06}, append(varint(vcdiff.MaxTargetSize+1), 0, 0, 0, 0)...))},
+		{"integer overflow", delta([]byte{0x00, 0x8F, 0xFF, 0xFF, 0xFF, 0x7F})},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			if _, err := vcdiff.Decode([]byte("abcdefghijklmnop"), v.delta); err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
+
+func TestDecode_Corrupted(t *testing.T) {
+	const source = "abcdefghijklmnop"
+	valid := delta(
+		window(0x05, []byte{16, 0}, "abcdwxyzefghefghefghefghzzzz",
+			[]byte("wxyzz"),
+			[]byte{20, 172, 44, 0, 4},
+			[]byte{0, 4, 4},
+		),
+		window(0x01, []byte{16, 0}, "ijklijklijkl", nil, []byte{20, 52, 116}, []byte{8, 0, 8}),
+	)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		d := append([]byte(nil), valid...)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			d[len(header)+rnd.Intn(len(d)-len(header))] = byte(rnd.Intn(256))
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("Decode(% x) panicked: %v", d, r)
+				}
+			}()
+			vcdiff.Decode([]byte(source), d)
+		}()
+	}
+}
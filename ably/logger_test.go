@@ -1,9 +1,13 @@
 package ably_test
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ably/ably-go/ably"
+	"github.com/ably/ably-go/ably/proto"
 )
 
 type dummyLogger struct {
@@ -76,3 +80,70 @@ func TestLoggerOptions(t *testing.T) {
 		}
 	})
 }
+
+// recordingLogger records the formatted log lines.
+type recordingLogger struct {
+	mtx   sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) Print(level ably.LogLevel, v ...interface{}) {
+	r.mtx.Lock()
+	r.lines = append(r.lines, fmt.Sprint(v...))
+	r.mtx.Unlock()
+}
+
+func (r *recordingLogger) Printf(level ably.LogLevel, format string, v ...interface{}) {
+	r.mtx.Lock()
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+	r.mtx.Unlock()
+}
+
+func (r *recordingLogger) contains(s string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, line := range r.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger_Realtime(t *testing.T) {
+	t.Parallel()
+	logger := &recordingLogger{}
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{
+		Logger: ably.LoggerOptions{Level: ably.LogVerbose, Logger: logger},
+	})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	res, err := channel.Publish("name", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	msg, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+	if err := res.Wait(); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	for _, line := range []string{
+		"connection state changed from ably.StateConnInitialized to ably.StateConnConnecting",
+		"connection state changed from ably.StateConnConnecting to ably.StateConnConnected",
+		`channel "test" state changed from ably.StateChanAttaching to ably.StateChanAttached`,
+		"Realtime Connection: sending",
+		"Realtime Connection: received",
+		fmt.Sprintf("received ACK for message serial %d", msg.MsgSerial),
+	} {
+		if !logger.contains(line) {
+			t.Errorf("want %q logged", line)
+		}
+	}
+}
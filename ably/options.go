@@ -1,6 +1,8 @@
 package ably
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -22,16 +24,33 @@ const (
 	RestHost = "rest.ably.io"
 )
 
+// Transports the realtime connection can be established with.
+const (
+	TransportWebSocket = "web_socket"
+	TransportComet     = "comet"
+)
+
 var defaultOptions = &ClientOptions{
 	RestHost:             RestHost,
 	FallbackHosts:        DefaultFallbackHosts(),
 	HTTPMaxRetryCount:    3,
+	HTTPMaxRetryDuration: 15 * time.Second,
 	RealtimeHost:         "realtime.ably.io",
 	TimeoutConnect:       15 * time.Second,
 	TimeoutDisconnect:    30 * time.Second,
 	TimeoutSuspended:     2 * time.Minute,
 	FallbackRetryTimeout: 10 * time.Minute,
 	IdempotentRestPublishing: false,
+
+	DisconnectedRetryTimeout: 15 * time.Second,
+	SuspendedRetryTimeout:    30 * time.Second,
+	ChannelRetryTimeout:      15 * time.Second,
+	RealtimeRequestTimeout:   10 * time.Second,
+	TokenRenewalBuffer:       15 * time.Second,
+	HTTPRequestTimeout:       10 * time.Second,
+	MaxMessageSize:           65536,
+	Port:                     80,
+	TLSPort:                  443,
 }
 
 func DefaultFallbackHosts() []string {
@@ -44,6 +63,38 @@ func DefaultFallbackHosts() []string {
 	}
 }
 
+// EnvironmentFallbackHosts gives the fallback hosts of the given environment.
+//
+// Spec RSC15g2
+func EnvironmentFallbackHosts(environment string) []string {
+	return []string{
+		environment + "-a-fallback.ably-realtime.com",
+		environment + "-b-fallback.ably-realtime.com",
+		environment + "-c-fallback.ably-realtime.com",
+		environment + "-d-fallback.ably-realtime.com",
+		environment + "-e-fallback.ably-realtime.com",
+	}
+}
+
+var errEnvironmentHost = errors.New("cannot use Environment together with a custom RestHost or RealtimeHost")
+
+var errEmptyTransports = errors.New("at least one transport is required")
+
+// reservedTransportParams are the query params of realtime connection
+// requests set by the library.
+var reservedTransportParams = map[string]bool{
+	"access_token":      true,
+	"clientId":          true,
+	"connection_serial": true,
+	"echo":              true,
+	"format":            true,
+	"key":               true,
+	"recover":           true,
+	"request_id":        true,
+	"resume":            true,
+	"timestamp":         true,
+}
+
 const (
 	authBasic = 1 + iota
 	authToken
@@ -62,6 +113,9 @@ type AuthOptions struct {
 	//   - *ably.TokenRequest, which is then used as an already signed request
 	//   - *ably.TokenDetails, which is then used as a token
 	//
+	// TokenRequest and TokenDetails values are accepted as well. When the
+	// obtained token expires, the callback is called again to renew it.
+	//
 	AuthCallback func(params *TokenParams) (token interface{}, err error)
 
 	// URL which is queried to obtain a signed token request.
@@ -123,14 +177,19 @@ type AuthOptions struct {
 	// Spec: TO3j11
 	DefaultTokenParams *TokenParams
 
+	// KeyCapability is the capability of the key. When set, requesting a token
+	// whose capability is not covered by it fails locally, without a round
+	// trip, with ErrOperationNotPermittedWithProvidedCapability instead of
+	// silently getting a token with the intersection of both.
+	KeyCapability Capability
+
 	// UseTokenAuth makes the Rest and Realtime clients always use token
 	// authentication method.
 	UseTokenAuth bool
 
 	// Force when true makes the client request new token unconditionally.
 	//
-	// By default the client does not request new token if the current one
-	// is still valid.
+	// Deprecated: Auth.Authorize always requests a new token.
 	Force bool
 }
 
@@ -172,17 +231,43 @@ type ClientOptions struct {
 	RestHost                string // optional; overwrite endpoint hostname for REST client
 	FallbackHostsUseDefault bool
 
-	FallbackHosts   []string
-	RealtimeHost    string        // optional; overwrite endpoint hostname for Realtime client
-	Environment     string        // optional; prefixes both hostname with the environment string
-	ClientID        string        // optional; required for managing realtime presence of the current client
-	Recover         string        // optional; used to recover client state
-	Logger          LoggerOptions // optional; overwrite logging defaults
+	FallbackHosts []string
+	RealtimeHost  string        // optional; overwrite endpoint hostname for Realtime client
+	Environment   string        // optional; prefixes the default hostnames, including fallback ones, with the environment string
+	ClientID      string        // optional; required for managing realtime presence of the current client
+	Recover       string        // optional; recovery key given by Conn.RecoveryKey of the connection to recover
+	Logger        LoggerOptions // optional; overwrite logging defaults
+
+	// TransportParams are added to the query string of realtime connection
+	// requests, e.g. {"heartbeats": "true"} or {"remainPresentFor": "5000"}.
+	// Params set by the library itself, like the auth or resume ones,
+	// can't be overridden.
+	//
+	// Spec RTC1f
 	TransportParams map[string]string
 
+	// RecoverCallback, if set, is called before the first connection
+	// attempt when Recover is empty. The recovery key it returns, if any,
+	// is used as Recover; for example one persisted with StoreRecoveryKey
+	// before the app was suspended.
+	RecoverCallback func() string
+
+	// StoreRecoveryKey, if set, is called with the connection's recovery
+	// key, as given by Conn.RecoveryKey, whenever it changes after
+	// a message was received, so it can be persisted for RecoverCallback.
+	// It's called with an empty key once the connection can't be recovered
+	// anymore, for example after it was closed.
+	StoreRecoveryKey func(key string)
+
 	// max number of fallback hosts to use as a fallback.
 	HTTPMaxRetryCount int
 
+	// The maximum elapsed time in which fallback host retries for HTTP requests
+	// will be attempted.
+	//
+	// spec TO3l6
+	HTTPMaxRetryDuration time.Duration
+
 	// The period in milliseconds before HTTP requests are retried against the
 	// default endpoint
 	//
@@ -192,20 +277,110 @@ type ClientOptions struct {
 	NoTLS            bool // when true REST and realtime client won't use TLS
 	NoConnect        bool // when true realtime client will not attempt to connect automatically
 	NoEcho           bool // when true published messages will not be echoed back
-	NoQueueing       bool // when true drops messages published during regaining connection
+	NoQueueing       bool // when true publishing while not connected fails with ErrDisconnected instead of being queued
 	NoBinaryProtocol bool // when true uses JSON for network serialization protocol instead of MsgPack
 
-	// When true idempotent rest publishing will be enabled.
+	// Dedup when true makes realtime channels drop messages whose ID matches
+	// one of the last received messages, as the server may replay messages
+	// already delivered when the connection is resumed. The number of
+	// dropped messages is reported by RealtimeChannel.DroppedDuplicates.
+	Dedup bool
+
+	// InboundBufferSize limits the number of received messages each realtime
+	// channel or presence subscription queues while its subscriber is busy;
+	// zero means no limit. Messages received by a subscription whose queue
+	// is full are dropped, with a warning logged.
+	InboundBufferSize int
+
+	// FailOnInboundOverflow when true makes a realtime channel fail with
+	// ErrInternalChannelError once one of its subscriptions drops messages
+	// because of InboundBufferSize, instead of only logging them.
+	FailOnInboundOverflow bool
+
+	// Port is the port REST and realtime clients connect to when NoTLS
+	// is true; it defaults to 80.
+	//
+	// Spec TO3k4
+	Port int
+
+	// TLSPort is the port REST and realtime clients connect to when NoTLS
+	// is false; it defaults to 443.
+	//
+	// Spec TO3k5
+	TLSPort int
+
+	// When true idempotent publishing will be enabled; each published message
+	// is assigned a unique ID, unless provided by the user, so retried publishes
+	// are deduplicated by the server.
 	// Spec TO3n
 	IdempotentRestPublishing   bool
 	TimeoutConnect             time.Duration // time period after which connect request is failed
 	TimeoutDisconnect          time.Duration // time period after which disconnect request is failed
-	TimeoutSuspended           time.Duration // time period after which no more reconnection attempts are performed
+	TimeoutSuspended           time.Duration // time period after which a lost connection is suspended, unless the server provides one
+
+	// DisconnectedRetryTimeout is the time period after which a connection
+	// which was unexpectedly lost is retried, when the immediate attempt to
+	// resume it has failed.
+	//
+	// Spec TO3l1
+	DisconnectedRetryTimeout time.Duration
+
+	// SuspendedRetryTimeout is the time period after which a connection is
+	// retried, when it's suspended after being lost for longer than
+	// TimeoutSuspended.
+	//
+	// Spec TO3l2
+	SuspendedRetryTimeout time.Duration
+
+	// ChannelRetryTimeout is the time period after which a channel is
+	// reattached, when it's suspended after an attach attempt has timed out.
+	//
+	// Spec TO3l7
+	ChannelRetryTimeout time.Duration
+
+	// RealtimeRequestTimeout is the time period after which a realtime request,
+	// like a ping, a connection attempt or a channel attach or detach, is
+	// considered failed with ErrTimeoutError. The connection is pinged with
+	// this period to detect whether it was silently lost.
+	//
+	// Spec TO3l11
+	RealtimeRequestTimeout time.Duration
+
+	// TokenRenewalBuffer is how long before its token expires a realtime
+	// client renews it, reauthenticating the connection in place. Tokens
+	// whose remaining lifetime is shorter than twice the buffer are renewed
+	// halfway through it instead.
+	TokenRenewalBuffer time.Duration
+
+	// HTTPRequestTimeout is the time period after which a REST request is
+	// considered failed with ErrTimeoutError, unless HTTPClient has its own
+	// timeout set.
+	//
+	// Spec TO3l4
+	HTTPRequestTimeout time.Duration
+
+	// MaxMessageSize is the maximum size in bytes of the messages published
+	// at once, computed as described by proto.Message.Size. Publishing larger
+	// ones fails with ErrMaximumMessageLengthExceeded without contacting
+	// the server. A realtime connection uses the limit the server sends
+	// when connecting instead.
+	//
+	// Spec TO3l8
+	MaxMessageSize int64
+
+	// Transports are the transports the realtime connection is attempted
+	// with, in order; when a transport fails to connect, the next one is
+	// tried. The supported ones are TransportWebSocket and TransportComet,
+	// the latter being useful where websockets are blocked.
+	//
+	// If Transports is nil, only TransportWebSocket is used.
+	Transports []string
 
 	// Dial specifies the dial function for creating message connections used
 	// by RealtimeClient.
 	//
-	// If Dial is nil, the default websocket connection is used.
+	// If Dial is nil, the default websocket connection is used. Dial replaces
+	// the TransportWebSocket transport only.
 	Dial func(protocol string, u *url.URL) (proto.Conn, error)
 
 	// Listener if set, will be automatically registered with On method for every
@@ -213,13 +388,37 @@ type ClientOptions struct {
 	// The listener will receive events for all state transitions.
 	Listener chan<- State
 
+	// Context, when set, bounds the lifetime of a RealtimeClient. Once it's
+	// done, the client closes its connection, releases its channels and stops
+	// all of its goroutines; it can't be connected anymore afterwards.
+	//
+	// The client watches the context with a goroutine, which exits only once
+	// the context is done, so it should be cancelled eventually.
+	Context context.Context
+
 	// HTTPClient specifies the client used for HTTP communication by RestClient.
 	//
 	// If HTTPClient is nil, the http.DefaultClient is used.
+	//
+	// The client can be shared by many RestClient and RealtimeClient values,
+	// which then share the connection pool of its Transport; tune its
+	// keep-alives there. Authentication and fallback hosts are applied to
+	// every request, whatever the client. If the client has got no Timeout,
+	// a copy of it with HTTPRequestTimeout is used, which still shares
+	// the Transport. Closing the Transport's idle connections affects all
+	// the clients sharing it, so do it only once none of them is in use.
 	HTTPClient *http.Client
 
 	//When provided this will be used on every request.
 	Trace *httptrace.ClientTrace
+
+	// AddRequestIDs when true adds a random request_id query param to every
+	// REST request and realtime connection attempt, so they can be traced
+	// in the server logs. A REST request keeps its ID when it's retried, and
+	// errors of failed REST requests carry the ID in their RequestID.
+	//
+	// Spec RSC7c
+	AddRequestIDs bool
 }
 
 func NewClientOptions(key string) *ClientOptions {
@@ -230,6 +429,207 @@ func NewClientOptions(key string) *ClientOptions {
 	}
 }
 
+// ClientOption configures the options a client is created with, e.g.
+//
+//	client, err := ably.NewRealtimeClient(
+//		ably.WithKey(key),
+//		ably.WithClientID("client"),
+//		ably.WithAutoConnect(false),
+//	)
+//
+// A *ClientOptions value is a ClientOption as well, which replaces the options
+// set by the preceding ones with a copy of itself. The options following it
+// override its fields.
+type ClientOption interface {
+	apply(*ClientOptions)
+}
+
+type clientOptionFunc func(*ClientOptions)
+
+func (fn clientOptionFunc) apply(opts *ClientOptions) {
+	fn(opts)
+}
+
+func (opts *ClientOptions) apply(other *ClientOptions) {
+	*other = *opts
+}
+
+// applyOptions gives the ClientOptions built from the given options. A single
+// *ClientOptions is returned as is.
+//
+// It panics if any of the options is nil, naming the caller in the message.
+func applyOptions(caller string, options []ClientOption) *ClientOptions {
+	for _, o := range options {
+		if opts, ok := o.(*ClientOptions); o == nil || ok && opts == nil {
+			panic("called " + caller + " with nil ClientOptions")
+		}
+	}
+	if len(options) == 1 {
+		if opts, ok := options[0].(*ClientOptions); ok {
+			return opts
+		}
+	}
+	opts := &ClientOptions{}
+	for _, o := range options {
+		o.apply(opts)
+	}
+	return opts
+}
+
+// WithKey sets ClientOptions.Key.
+func WithKey(key string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Key = key })
+}
+
+// WithToken sets ClientOptions.Token.
+func WithToken(token string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Token = token })
+}
+
+// WithTokenDetails sets ClientOptions.TokenDetails.
+func WithTokenDetails(details *TokenDetails) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.TokenDetails = details })
+}
+
+// WithAuthCallback sets ClientOptions.AuthCallback.
+func WithAuthCallback(fn func(params *TokenParams) (token interface{}, err error)) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.AuthCallback = fn })
+}
+
+// WithAuthURL sets ClientOptions.AuthURL.
+func WithAuthURL(url string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.AuthURL = url })
+}
+
+// WithUseTokenAuth sets ClientOptions.UseTokenAuth.
+func WithUseTokenAuth(use bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.UseTokenAuth = use })
+}
+
+// WithClientID sets ClientOptions.ClientID.
+func WithClientID(clientID string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.ClientID = clientID })
+}
+
+// WithEnvironment sets ClientOptions.Environment.
+func WithEnvironment(env string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Environment = env })
+}
+
+// WithRestHost sets ClientOptions.RestHost.
+func WithRestHost(host string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.RestHost = host })
+}
+
+// WithRealtimeHost sets ClientOptions.RealtimeHost.
+func WithRealtimeHost(host string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.RealtimeHost = host })
+}
+
+// WithPort sets ClientOptions.Port.
+func WithPort(port int) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Port = port })
+}
+
+// WithTLSPort sets ClientOptions.TLSPort.
+func WithTLSPort(port int) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.TLSPort = port })
+}
+
+// WithTLS sets whether the client uses TLS; it's the inverse of
+// ClientOptions.NoTLS.
+func WithTLS(tls bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.NoTLS = !tls })
+}
+
+// WithAutoConnect sets whether the realtime client connects once created;
+// it's the inverse of ClientOptions.NoConnect.
+func WithAutoConnect(connect bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.NoConnect = !connect })
+}
+
+// WithEchoMessages sets whether published messages are echoed back; it's
+// the inverse of ClientOptions.NoEcho.
+func WithEchoMessages(echo bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.NoEcho = !echo })
+}
+
+// WithQueueMessages sets whether messages published while not connected are
+// queued; it's the inverse of ClientOptions.NoQueueing.
+func WithQueueMessages(queue bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.NoQueueing = !queue })
+}
+
+// WithUseBinaryProtocol sets whether MsgPack is used instead of JSON; it's
+// the inverse of ClientOptions.NoBinaryProtocol.
+func WithUseBinaryProtocol(binary bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.NoBinaryProtocol = !binary })
+}
+
+// WithInboundBufferSize sets ClientOptions.InboundBufferSize.
+func WithInboundBufferSize(size int) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.InboundBufferSize = size })
+}
+
+// WithFailOnInboundOverflow sets ClientOptions.FailOnInboundOverflow.
+func WithFailOnInboundOverflow(fail bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.FailOnInboundOverflow = fail })
+}
+
+// WithTransportParams sets ClientOptions.TransportParams.
+func WithTransportParams(params map[string]string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.TransportParams = params })
+}
+
+// WithRecoverCallback sets ClientOptions.RecoverCallback.
+func WithRecoverCallback(recover func() string) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.RecoverCallback = recover })
+}
+
+// WithStoreRecoveryKey sets ClientOptions.StoreRecoveryKey.
+func WithStoreRecoveryKey(store func(key string)) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.StoreRecoveryKey = store })
+}
+
+// WithLogger sets ClientOptions.Logger.
+func WithLogger(logger LoggerOptions) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Logger = logger })
+}
+
+// WithHTTPClient sets ClientOptions.HTTPClient.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.HTTPClient = client })
+}
+
+// WithTokenRenewalBuffer sets ClientOptions.TokenRenewalBuffer.
+func WithTokenRenewalBuffer(buffer time.Duration) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.TokenRenewalBuffer = buffer })
+}
+
+// WithAddRequestIDs sets ClientOptions.AddRequestIDs.
+func WithAddRequestIDs(add bool) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.AddRequestIDs = add })
+}
+
+// WithContext sets ClientOptions.Context.
+func WithContext(ctx context.Context) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Context = ctx })
+}
+
+// WithDial sets ClientOptions.Dial.
+func WithDial(dial func(protocol string, u *url.URL) (proto.Conn, error)) ClientOption {
+	return clientOptionFunc(func(opts *ClientOptions) { opts.Dial = dial })
+}
+
+// done gives the Done channel of the client's Context, or a nil channel
+// if there's no context.
+func (opts *ClientOptions) done() <-chan struct{} {
+	if opts.Context == nil {
+		return nil
+	}
+	return opts.Context.Done()
+}
+
 func (opts *ClientOptions) timeoutConnect() time.Duration {
 	if opts.TimeoutConnect != 0 {
 		return opts.TimeoutConnect
@@ -251,6 +651,41 @@ func (opts *ClientOptions) timeoutSuspended() time.Duration {
 	return defaultOptions.TimeoutSuspended
 }
 
+func (opts *ClientOptions) disconnectedRetryTimeout() time.Duration {
+	if opts.DisconnectedRetryTimeout != 0 {
+		return opts.DisconnectedRetryTimeout
+	}
+	return defaultOptions.DisconnectedRetryTimeout
+}
+
+func (opts *ClientOptions) suspendedRetryTimeout() time.Duration {
+	if opts.SuspendedRetryTimeout != 0 {
+		return opts.SuspendedRetryTimeout
+	}
+	return defaultOptions.SuspendedRetryTimeout
+}
+
+func (opts *ClientOptions) channelRetryTimeout() time.Duration {
+	if opts.ChannelRetryTimeout != 0 {
+		return opts.ChannelRetryTimeout
+	}
+	return defaultOptions.ChannelRetryTimeout
+}
+
+func (opts *ClientOptions) realtimeRequestTimeout() time.Duration {
+	if opts.RealtimeRequestTimeout != 0 {
+		return opts.RealtimeRequestTimeout
+	}
+	return defaultOptions.RealtimeRequestTimeout
+}
+
+func (opts *ClientOptions) tokenRenewalBuffer() time.Duration {
+	if opts.TokenRenewalBuffer != 0 {
+		return opts.TokenRenewalBuffer
+	}
+	return defaultOptions.TokenRenewalBuffer
+}
+
 func (opts *ClientOptions) fallbackRetryTimeout() time.Duration {
 	if opts.FallbackRetryTimeout != 0 {
 		return opts.FallbackRetryTimeout
@@ -258,17 +693,105 @@ func (opts *ClientOptions) fallbackRetryTimeout() time.Duration {
 	return defaultOptions.FallbackRetryTimeout
 }
 
-func (opts *ClientOptions) restURL() string {
-	host := opts.RestHost
-	if host == "" {
-		host = defaultOptions.RestHost
-		if opts.Environment != "" {
-			host = opts.Environment + "-" + host
+// validate reports options which can't be used together.
+//
+// Spec TO3k2, TO3k3
+func (opts *ClientOptions) validate() error {
+	if opts.environment() != "" && (opts.RestHost != "" || opts.RealtimeHost != "") {
+		return newError(ErrInvalidParameterValue, errEnvironmentHost)
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return newErrorf(ErrInvalidParameterValue, "invalid port %d", opts.Port)
+	}
+	if opts.TLSPort < 0 || opts.TLSPort > 65535 {
+		return newErrorf(ErrInvalidParameterValue, "invalid TLS port %d", opts.TLSPort)
+	}
+	for k := range opts.TransportParams {
+		if k == "" || reservedTransportParams[k] {
+			return newErrorf(ErrInvalidParameterValue, "invalid transport param %q", k)
+		}
+	}
+	if opts.Recover != "" {
+		// Spec RTN16
+		if _, err := parseRecoveryKey(opts.Recover); err != nil {
+			return err
+		}
+	}
+	if opts.Transports != nil && len(opts.Transports) == 0 {
+		return newError(ErrInvalidParameterValue, errEmptyTransports)
+	}
+	for _, transport := range opts.Transports {
+		switch transport {
+		case TransportWebSocket, TransportComet:
+		default:
+			return newErrorf(ErrInvalidParameterValue, "unsupported transport %q", transport)
 		}
 	}
+	return nil
+}
+
+func (opts *ClientOptions) transports() []string {
+	if opts.Transports != nil {
+		return opts.Transports
+	}
+	return []string{TransportWebSocket}
+}
+
+// environment gives the environment the client connects to; it's empty for
+// the production one.
+func (opts *ClientOptions) environment() string {
+	if opts.Environment == "production" {
+		return ""
+	}
+	return opts.Environment
+}
+
+func (opts *ClientOptions) fallbackHosts() []string {
+	if opts.FallbackHosts != nil {
+		return opts.FallbackHosts
+	}
+	if env := opts.environment(); env != "" && !opts.FallbackHostsUseDefault {
+		return EnvironmentFallbackHosts(env)
+	}
+	return defaultOptions.FallbackHosts
+}
+
+func (opts *ClientOptions) httpMaxRetryCount() int {
+	if opts.HTTPMaxRetryCount != 0 {
+		return opts.HTTPMaxRetryCount
+	}
+	return defaultOptions.HTTPMaxRetryCount
+}
+
+func (opts *ClientOptions) httpMaxRetryDuration() time.Duration {
+	if opts.HTTPMaxRetryDuration != 0 {
+		return opts.HTTPMaxRetryDuration
+	}
+	return defaultOptions.HTTPMaxRetryDuration
+}
+
+func (opts *ClientOptions) restURL() string {
+	host := opts.restHost()
+	if port, isDefault := opts.activePort(); !isDefault {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
 	return opts.scheme() + host
 }
 
+// restHost gives the primary REST host; it's prefixed with the environment
+// unless overridden.
+//
+// Spec RSC11
+func (opts *ClientOptions) restHost() string {
+	if opts.RestHost != "" {
+		return opts.RestHost
+	}
+	if env := opts.environment(); env != "" {
+		return env + "-" + defaultOptions.RestHost
+	}
+	return defaultOptions.RestHost
+}
+
 // This returns http scheme to use . http if NoTLS is true otherwise defaults to
 // https.
 func (opts *ClientOptions) scheme() string {
@@ -279,24 +802,70 @@ func (opts *ClientOptions) scheme() string {
 }
 
 func (opts *ClientOptions) realtimeURL() string {
-	host := opts.RealtimeHost
-	if host == "" {
-		host = defaultOptions.RealtimeHost
-		if opts.Environment != "" {
-			host = opts.Environment + "-" + host
-		}
+	port, _ := opts.activePort()
+	host := net.JoinHostPort(opts.realtimeHost(), strconv.Itoa(port))
+	if opts.NoTLS {
+		return "ws://" + host
 	}
+	return "wss://" + host
+}
+
+// activePort gives the port to connect to, depending on whether TLS is used;
+// isDefault is true when it's the default port of the scheme.
+func (opts *ClientOptions) activePort() (port int, isDefault bool) {
 	if opts.NoTLS {
-		return "ws://" + net.JoinHostPort(host, "80")
+		port = opts.Port
+		if port == 0 {
+			port = defaultOptions.Port
+		}
+		return port, port == defaultOptions.Port
+	}
+	port = opts.TLSPort
+	if port == 0 {
+		port = defaultOptions.TLSPort
+	}
+	return port, port == defaultOptions.TLSPort
+}
+
+// realtimeHost gives the realtime host; it's prefixed with the environment
+// unless overridden.
+//
+// Spec RTN2
+func (opts *ClientOptions) realtimeHost() string {
+	if opts.RealtimeHost != "" {
+		return opts.RealtimeHost
+	}
+	if env := opts.environment(); env != "" {
+		return env + "-" + defaultOptions.RealtimeHost
+	}
+	return defaultOptions.RealtimeHost
+}
+
+func (opts *ClientOptions) httpRequestTimeout() time.Duration {
+	if opts.HTTPRequestTimeout != 0 {
+		return opts.HTTPRequestTimeout
+	}
+	return defaultOptions.HTTPRequestTimeout
+}
+
+func (opts *ClientOptions) maxMessageSize() int64 {
+	if opts.MaxMessageSize != 0 {
+		return opts.MaxMessageSize
 	}
-	return "wss://" + net.JoinHostPort(host, "443")
+	return defaultOptions.MaxMessageSize
 }
 
 func (opts *ClientOptions) httpclient() *http.Client {
+	client := http.DefaultClient
 	if opts.HTTPClient != nil {
-		return opts.HTTPClient
+		client = opts.HTTPClient
 	}
-	return http.DefaultClient
+	if client.Timeout == 0 {
+		c := *client
+		c.Timeout = opts.httpRequestTimeout()
+		client = &c
+	}
+	return client
 }
 
 func (opts *ClientOptions) protocol() string {
@@ -335,7 +904,7 @@ type ScopeParams struct {
 
 func (s *ScopeParams) EncodeValues(out *url.Values) error {
 	if s.Start != 0 && s.End != 0 && s.Start > s.End {
-		return fmt.Errorf("start must be before end")
+		return fmt.Errorf("start must be before end, got start=%d end=%d", s.Start, s.End)
 	}
 	if s.Start != 0 {
 		out.Set("start", strconv.FormatInt(s.Start, 10))
@@ -349,6 +918,14 @@ func (s *ScopeParams) EncodeValues(out *url.Values) error {
 	return nil
 }
 
+// maxLimit is the maximum number of items a single page of results can hold.
+const maxLimit = 1000
+
+// PaginateParams are the parameters of paginated queries, like channel and
+// presence history or stats. They are validated before any request is made.
+//
+// A negative Limit requests the default limit of 100 items per page, a zero
+// one lets the server decide.
 type PaginateParams struct {
 	ScopeParams
 	Limit     int
@@ -358,6 +935,8 @@ type PaginateParams struct {
 func (p *PaginateParams) EncodeValues(out *url.Values) error {
 	if p.Limit < 0 {
 		out.Set("limit", strconv.Itoa(100))
+	} else if p.Limit > maxLimit {
+		return fmt.Errorf("limit must be at most %d, got %d", maxLimit, p.Limit)
 	} else if p.Limit != 0 {
 		out.Set("limit", strconv.Itoa(p.Limit))
 	}
@@ -370,6 +949,30 @@ func (p *PaginateParams) EncodeValues(out *url.Values) error {
 	default:
 		return fmt.Errorf("Invalid value for direction: %s", p.Direction)
 	}
-	p.ScopeParams.EncodeValues(out)
-	return nil
+	return p.ScopeParams.EncodeValues(out)
+}
+
+// PresenceGetParams are the parameters of presence member queries. Members
+// match when they've got the ClientID and ConnectionID, unless these are
+// empty. PaginateParams are used only by REST queries.
+type PresenceGetParams struct {
+	PaginateParams
+	ClientID     string
+	ConnectionID string
+}
+
+func (p *PresenceGetParams) filterQuery() url.Values {
+	query := make(url.Values)
+	if p.ClientID != "" {
+		query.Set("clientId", p.ClientID)
+	}
+	if p.ConnectionID != "" {
+		query.Set("connectionId", p.ConnectionID)
+	}
+	return query
+}
+
+func (p *PresenceGetParams) matches(member *proto.PresenceMessage) bool {
+	return (p.ClientID == "" || p.ClientID == member.ClientID) &&
+		(p.ConnectionID == "" || p.ConnectionID == member.ConnectionID)
 }
@@ -1,10 +1,13 @@
 package ably_test
 
 import (
+	"net/http"
 	"net/url"
+	"reflect"
 	"testing"
 
 	"github.com/ably/ably-go/ably"
+	"github.com/ably/ably-go/ably/proto"
 )
 
 func TestClientOptions(t *testing.T) {
@@ -32,6 +35,219 @@ func TestClientOptions(t *testing.T) {
 	})
 }
 
+func TestClientOptions_Functional(t *testing.T) {
+	t.Parallel()
+	tok := &ably.TokenDetails{Token: "details"}
+	client := &http.Client{}
+	cases := []struct {
+		name   string
+		option ably.ClientOption
+		expect *ably.ClientOptions
+	}{
+		{"WithKey", ably.WithKey("key:secret"), &ably.ClientOptions{AuthOptions: ably.AuthOptions{Key: "key:secret"}}},
+		{"WithToken", ably.WithToken("token"), &ably.ClientOptions{AuthOptions: ably.AuthOptions{Token: "token"}}},
+		{"WithTokenDetails", ably.WithTokenDetails(tok), &ably.ClientOptions{AuthOptions: ably.AuthOptions{TokenDetails: tok}}},
+		{"WithAuthURL", ably.WithAuthURL("https://auth"), &ably.ClientOptions{AuthOptions: ably.AuthOptions{AuthURL: "https://auth"}}},
+		{"WithUseTokenAuth", ably.WithUseTokenAuth(true), &ably.ClientOptions{AuthOptions: ably.AuthOptions{UseTokenAuth: true}}},
+		{"WithClientID", ably.WithClientID("client"), &ably.ClientOptions{ClientID: "client"}},
+		{"WithEnvironment", ably.WithEnvironment("sandbox"), &ably.ClientOptions{Environment: "sandbox"}},
+		{"WithRestHost", ably.WithRestHost("rest"), &ably.ClientOptions{RestHost: "rest"}},
+		{"WithRealtimeHost", ably.WithRealtimeHost("realtime"), &ably.ClientOptions{RealtimeHost: "realtime"}},
+		{"WithPort", ably.WithPort(8080), &ably.ClientOptions{Port: 8080}},
+		{"WithTLSPort", ably.WithTLSPort(8443), &ably.ClientOptions{TLSPort: 8443}},
+		{"WithTLS", ably.WithTLS(false), &ably.ClientOptions{NoTLS: true}},
+		{"WithAutoConnect", ably.WithAutoConnect(false), &ably.ClientOptions{NoConnect: true}},
+		{"WithEchoMessages", ably.WithEchoMessages(false), &ably.ClientOptions{NoEcho: true}},
+		{"WithQueueMessages", ably.WithQueueMessages(false), &ably.ClientOptions{NoQueueing: true}},
+		{"WithUseBinaryProtocol", ably.WithUseBinaryProtocol(false), &ably.ClientOptions{NoBinaryProtocol: true}},
+		{"WithTransportParams", ably.WithTransportParams(map[string]string{"a": "b"}), &ably.ClientOptions{TransportParams: map[string]string{"a": "b"}}},
+		{"WithLogger", ably.WithLogger(ably.LoggerOptions{Level: ably.LogDebug}), &ably.ClientOptions{Logger: ably.LoggerOptions{Level: ably.LogDebug}}},
+		{"WithHTTPClient", ably.WithHTTPClient(client), &ably.ClientOptions{HTTPClient: client}},
+	}
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			if got := ably.ApplyOptions(cas.option); !reflect.DeepEqual(got, cas.expect) {
+				t.Errorf("want %+v; got %+v", cas.expect, got)
+			}
+		})
+	}
+	t.Run("functions", func(t *testing.T) {
+		opts := ably.ApplyOptions(
+			ably.WithAuthCallback(func(*ably.TokenParams) (interface{}, error) { return "token", nil }),
+			ably.WithDial(func(string, *url.URL) (proto.Conn, error) { return nil, nil }),
+		)
+		if opts.AuthCallback == nil || opts.Dial == nil {
+			t.Errorf("want AuthCallback and Dial to be set; got %+v", opts)
+		}
+	})
+	t.Run("struct followed by options", func(t *testing.T) {
+		base := &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "key:secret"},
+			ClientID:    "base",
+		}
+		opts := ably.ApplyOptions(base, ably.WithClientID("override"), ably.WithTLS(false))
+		expect := &ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "key:secret"},
+			ClientID:    "override",
+			NoTLS:       true,
+		}
+		if !reflect.DeepEqual(opts, expect) {
+			t.Errorf("want %+v; got %+v", expect, opts)
+		}
+		if base.ClientID != "base" || base.NoTLS {
+			t.Errorf("want base options to be left intact; got %+v", base)
+		}
+		if single := ably.ApplyOptions(base); single != base {
+			t.Errorf("want single *ClientOptions to be used as is")
+		}
+	})
+	t.Run("constructors", func(t *testing.T) {
+		rest, err := ably.NewRestClient(ably.WithKey("key:secret"), ably.WithClientID("client"))
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		if id := rest.Auth.ClientID(); id != "client" {
+			t.Errorf("want ClientID=client; got %q", id)
+		}
+		realtime, err := ably.NewRealtimeClient(ably.WithKey("key:secret"), ably.WithAutoConnect(false))
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		if state := realtime.Connection.State(); state != ably.StateConnInitialized {
+			t.Errorf("want state=%v; got %v", ably.StateConnInitialized, state)
+		}
+		if _, err := ably.NewRestClient(ably.WithKey("key:secret"), ably.WithEnvironment("sandbox"), ably.WithRestHost("rest")); err == nil {
+			t.Error("want error for Environment with a custom RestHost")
+		}
+	})
+	t.Run("nil", func(t *testing.T) {
+		expectPanic := func(want string, fn func()) {
+			t.Helper()
+			defer func() {
+				if r := recover(); r != want {
+					t.Errorf("want panic %q; got %v", want, r)
+				}
+			}()
+			fn()
+		}
+		expectPanic("called NewRestClient with nil ClientOptions", func() {
+			ably.NewRestClient(nil)
+		})
+		expectPanic("called NewRestClient with nil ClientOptions", func() {
+			ably.NewRestClient(ably.WithKey("key:secret"), (*ably.ClientOptions)(nil))
+		})
+		expectPanic("called NewRealtimeClient with nil ClientOptions", func() {
+			ably.NewRealtimeClient(ably.WithKey("key:secret"), nil)
+		})
+	})
+}
+
+func TestClientOptions_Hosts(t *testing.T) {
+	t.Parallel()
+	sample := []struct {
+		desc      string
+		opts      *ably.ClientOptions
+		rest      string
+		realtime  string
+		fallbacks []string
+	}{
+		{
+			desc:      "default",
+			opts:      &ably.ClientOptions{},
+			rest:      "https://rest.ably.io",
+			realtime:  "wss://realtime.ably.io:443",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:      "production environment",
+			opts:      &ably.ClientOptions{Environment: "production"},
+			rest:      "https://rest.ably.io",
+			realtime:  "wss://realtime.ably.io:443",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:     "environment",
+			opts:     &ably.ClientOptions{Environment: "eu"},
+			rest:     "https://eu-rest.ably.io",
+			realtime: "wss://eu-realtime.ably.io:443",
+			fallbacks: []string{
+				"eu-a-fallback.ably-realtime.com",
+				"eu-b-fallback.ably-realtime.com",
+				"eu-c-fallback.ably-realtime.com",
+				"eu-d-fallback.ably-realtime.com",
+				"eu-e-fallback.ably-realtime.com",
+			},
+		},
+		{
+			desc:      "environment with default fallback hosts",
+			opts:      &ably.ClientOptions{Environment: "eu", FallbackHostsUseDefault: true},
+			rest:      "https://eu-rest.ably.io",
+			realtime:  "wss://eu-realtime.ably.io:443",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:      "environment with custom fallback hosts",
+			opts:      &ably.ClientOptions{Environment: "eu", FallbackHosts: []string{"fallback.example.com"}},
+			rest:      "https://eu-rest.ably.io",
+			realtime:  "wss://eu-realtime.ably.io:443",
+			fallbacks: []string{"fallback.example.com"},
+		},
+		{
+			desc:      "custom hosts",
+			opts:      &ably.ClientOptions{RestHost: "rest.example.com", RealtimeHost: "realtime.example.com", NoTLS: true},
+			rest:      "http://rest.example.com",
+			realtime:  "ws://realtime.example.com:80",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:      "custom TLS port",
+			opts:      &ably.ClientOptions{RestHost: "rest.example.com", RealtimeHost: "realtime.example.com", TLSPort: 8443, Port: 8080},
+			rest:      "https://rest.example.com:8443",
+			realtime:  "wss://realtime.example.com:8443",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:      "custom port",
+			opts:      &ably.ClientOptions{RestHost: "rest.example.com", RealtimeHost: "realtime.example.com", NoTLS: true, TLSPort: 8443, Port: 8080},
+			rest:      "http://rest.example.com:8080",
+			realtime:  "ws://realtime.example.com:8080",
+			fallbacks: ably.DefaultFallbackHosts(),
+		},
+		{
+			desc:      "default ports set explicitly",
+			opts:      &ably.ClientOptions{Environment: "eu", TLSPort: 443, Port: 80},
+			rest:      "https://eu-rest.ably.io",
+			realtime:  "wss://eu-realtime.ably.io:443",
+			fallbacks: ably.EnvironmentFallbackHosts("eu"),
+		},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			if got := v.opts.RestURL(); got != v.rest {
+				t.Errorf("want rest URL=%q; got %q", v.rest, got)
+			}
+			if got := v.opts.RealtimeURL(); got != v.realtime {
+				t.Errorf("want realtime URL=%q; got %q", v.realtime, got)
+			}
+			if got := v.opts.GetFallbackHosts(); !reflect.DeepEqual(got, v.fallbacks) {
+				t.Errorf("want fallback hosts=%v; got %v", v.fallbacks, got)
+			}
+		})
+	}
+	for _, opts := range []*ably.ClientOptions{
+		{Environment: "eu", RestHost: "rest.example.com"},
+		{Environment: "eu", RealtimeHost: "realtime.example.com"},
+		{Port: -1},
+		{TLSPort: 65536},
+	} {
+		opts.Key = "name:secret"
+		_, err := ably.NewRestClient(opts)
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("RestHost=%q, RealtimeHost=%q, Port=%d, TLSPort=%d: %v", opts.RestHost, opts.RealtimeHost, opts.Port, opts.TLSPort, err)
+		}
+	}
+}
+
 func TestScopeParams(t *testing.T) {
 	t.Parallel()
 	t.Run("must error when given invalid range", func(ts *testing.T) {
@@ -137,6 +353,22 @@ func TestPaginateParams(t *testing.T) {
 			ts.Fatal("expected an error")
 		}
 	})
+	t.Run("with limit over maximum", func(ts *testing.T) {
+		values := make(url.Values)
+		params := ably.PaginateParams{Limit: 1001}
+		if err := params.EncodeValues(&values); err == nil {
+			ts.Fatal("expected an error")
+		}
+	})
+	t.Run("with invalid range", func(ts *testing.T) {
+		values := make(url.Values)
+		params := ably.PaginateParams{}
+		params.Start = 124
+		params.End = 123
+		if err := params.EncodeValues(&values); err == nil {
+			ts.Fatal("expected an error")
+		}
+	})
 	t.Run("with invalid value for limit", func(ts *testing.T) {
 		values := make(url.Values)
 		params := ably.PaginateParams{}
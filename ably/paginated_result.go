@@ -3,7 +3,6 @@ package ably
 import (
 	"net/http"
 	"net/url"
-	"path"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -53,6 +52,7 @@ type paginatedRequest struct {
 	logger    *LoggerOptions
 	respCheck func(*http.Response) error
 	decoder   func(*proto.ChannelOptions, reflect.Type, *http.Response) (interface{}, error)
+	filter    func(*proto.Message) bool
 }
 
 func decodePaginatedResult(opts *proto.ChannelOptions, typ reflect.Type, resp *http.Response) (interface{}, error) {
@@ -146,6 +146,9 @@ func newPaginatedResult(opts *proto.ChannelOptions, req paginatedRequest) (*Pagi
 		return nil, err
 	}
 	p.typItems = v
+	if req.filter != nil {
+		p.applyFilter()
+	}
 	return p, nil
 }
 
@@ -161,17 +164,70 @@ func copyHeader(dest, src http.Header) {
 // The response headers from the REST API contains a relative link to the next result.
 // (Link: <./path>; rel="next").
 func (p *PaginatedResult) Next() (*PaginatedResult, error) {
-	nextPath, ok := p.paginationHeaders()["next"]
+	return p.follow("next")
+}
+
+// First returns the first page of the results, as found in the response headers
+// (Link: <./path>; rel="first").
+func (p *PaginatedResult) First() (*PaginatedResult, error) {
+	return p.follow("first")
+}
+
+// HasNext returns true when there is a next page available, in which case
+// calling Next is going to retrieve it.
+func (p *PaginatedResult) HasNext() bool {
+	_, ok := p.paginationHeaders()["next"]
+	return ok
+}
+
+func (p *PaginatedResult) follow(rel string) (*PaginatedResult, error) {
+	relPath, ok := p.paginationHeaders()[rel]
 	if !ok {
-		return nil, newErrorf(ErrProtocolError, "no next page after %q", p.path)
+		return nil, newErrorf(ErrProtocolError, "no %s page after %q", rel, p.path)
 	}
-	nextPage := p.buildPath(p.path, nextPath)
 	req := p.req
-	req.path = nextPage
+	req.path = p.buildPath(p.path, relPath)
 	req.params = nil
 	return newPaginatedResult(p.opts, req)
 }
 
+// Filter returns a view of the page which holds only the messages for which
+// fn returns true. Filtering is done on the client side, as the REST API
+// doesn't support it.
+//
+// Calling Next or First on the filtered view still fetches whole pages from
+// the server and re-applies the filter to each of them, thus a filtered page
+// may be empty even though HasNext returns true. Filters are combined when
+// called on an already filtered view.
+// The method panics if the underlying paginated result is not a message.
+func (p *PaginatedResult) Filter(fn func(*proto.Message) bool) *PaginatedResult {
+	if p.req.typ != msgType {
+		panic(errInvalidType{typ: p.req.typ})
+	}
+	filtered := *p
+	filtered.items = nil
+	if prev := p.req.filter; prev != nil {
+		filtered.req.filter = func(m *proto.Message) bool {
+			return prev(m) && fn(m)
+		}
+	} else {
+		filtered.req.filter = fn
+	}
+	filtered.applyFilter()
+	return &filtered
+}
+
+func (p *PaginatedResult) applyFilter() {
+	msgs, _ := p.typItems.([]*proto.Message)
+	filtered := make([]*proto.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if p.req.filter(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	p.typItems = filtered
+}
+
 // Items gives a slice of results of the current page.
 func (p *PaginatedResult) Items() []interface{} {
 	if p.items == nil {
@@ -225,28 +281,38 @@ func (c *PaginatedResult) buildPaginatedPath(path string, params *PaginateParams
 	values := &url.Values{}
 	err := params.EncodeValues(values)
 	if err != nil {
-		return "", newError(50000, err)
+		return "", newError(ErrInvalidParameterValue, err)
 	}
 	queryString := values.Encode()
-	if len(queryString) > 0 {
-		return path + "?" + queryString, nil
+	if len(queryString) == 0 {
+		return path, nil
+	}
+	if strings.Contains(path, "?") {
+		return path + "&" + queryString, nil
 	}
-	return path, nil
+	return path + "?" + queryString, nil
 }
 
 // buildPath finds the absolute path based on the path parameter and the new relative path.
+// The query string of the new path is preserved as is.
 func (p *PaginatedResult) buildPath(origPath string, newRelativePath string) string {
-	if i := strings.IndexRune(origPath, '?'); i != -1 {
-		origPath = origPath[:i]
+	base, err := url.Parse(origPath)
+	if err != nil {
+		return origPath
+	}
+	rel, err := url.Parse(newRelativePath)
+	if err != nil {
+		return origPath
 	}
-	return path.Join(path.Dir(origPath), newRelativePath)
+	return base.ResolveReference(rel).RequestURI()
 }
 
 func (p *PaginatedResult) paginationHeaders() map[string]string {
 	if p.headers == nil {
 		p.headers = make(map[string]string)
 		for _, link := range p.links {
-			if result := relLinkRegexp.FindStringSubmatch(link); result != nil {
+			// A single Link header may hold multiple comma-separated links.
+			for _, result := range relLinkRegexp.FindAllStringSubmatch(link, -1) {
 				p.addMatch(result)
 			}
 		}
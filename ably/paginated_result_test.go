@@ -1,17 +1,157 @@
 package ably_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/ably/ably-go/ably"
+	"github.com/ably/ably-go/ably/proto"
 )
 
 func TestPaginatedResult(t *testing.T) {
 	t.Parallel()
 	result := &ably.PaginatedResult{}
-	newPath := result.BuildPath("/path/to/resource?hello", "./newresource?world")
-	expected := "/path/to/newresource?world"
-	if newPath != expected {
-		t.Errorf("expected %s got %s", expected, newPath)
+	paths := []struct {
+		base, rel, expected string
+	}{
+		{"/path/to/resource?hello", "./newresource?world", "/path/to/newresource?world"},
+		{"/path/to/resource", "/other/resource?start=0&end=1", "/other/resource?start=0&end=1"},
+		{"/channels/a%3Fb%23c/messages?limit=1", "./messages?limit=1&start=10", "/channels/a%3Fb%23c/messages?limit=1&start=10"},
+		{"/channels/a/messages", "https://rest.ably.io/channels/a/messages?dir=forwards", "/channels/a/messages?dir=forwards"},
+	}
+	for _, p := range paths {
+		if newPath := result.BuildPath(p.base, p.rel); newPath != p.expected {
+			t.Errorf("BuildPath(%q, %q): expected %s got %s", p.base, p.rel, p.expected, newPath)
+		}
+	}
+}
+
+func TestPaginatedResult_Links(t *testing.T) {
+	t.Parallel()
+	var requests []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "", "1":
+			w.Header().Set("Link", `<./messages?page=1>; rel="first", <./messages?page=1>; rel="current", <./messages?page=2>; rel="next"`)
+			w.Write([]byte(`[{"name":"first","data":"1"}]`))
+		case "2":
+			w.Header().Add("Link", `<./messages?page=1>; rel="first"`)
+			w.Header().Add("Link", `<./messages?page=2>; rel="current"`)
+			w.Write([]byte(`[{"name":"second","data":"2"}]`))
+		}
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := client.Channels.Get("test", nil).History(&ably.PaginateParams{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page1.HasNext() {
+		t.Fatal("expected page 1 to have a next page")
+	}
+	if msgs := page1.Messages(); len(msgs) != 1 || msgs[0].Name != "first" {
+		t.Errorf("expected message %q got %v", "first", msgs)
+	}
+	page2, err := page1.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page2.HasNext() {
+		t.Error("expected page 2 to be the last one")
+	}
+	if _, err := page2.Next(); err == nil {
+		t.Error("expected Next() to fail on the last page")
+	}
+	if msgs := page2.Messages(); len(msgs) != 1 || msgs[0].Name != "second" {
+		t.Errorf("expected message %q got %v", "second", msgs)
+	}
+	first, err := page2.First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := first.Messages(); len(msgs) != 1 || msgs[0].Name != "first" {
+		t.Errorf("expected message %q got %v", "first", msgs)
+	}
+	expected := []string{
+		"/channels/test/messages?limit=1",
+		"/channels/test/messages?page=2",
+		"/channels/test/messages?page=1",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests got %v", len(expected), requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("%d: expected request to %s got %s", i, expected[i], requests[i])
+		}
+	}
+}
+
+func TestPaginatedResult_Filter(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `<./messages?page=2>; rel="next"`)
+			w.Write([]byte(`[{"name":"join","data":"1"},{"name":"chat","data":"2"},{"name":"join","data":"3"}]`))
+		case "2":
+			w.Header().Set("Link", `<./messages?page=3>; rel="next"`)
+			w.Write([]byte(`[{"name":"chat","data":"4"}]`))
+		case "3":
+			w.Write([]byte(`[{"name":"join","data":"5"}]`))
+		}
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := client.Channels.Get("test", nil).History(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page = page.Filter(func(m *proto.Message) bool {
+		return m.Name == "join"
+	})
+	var pages [][]string
+	for {
+		var data []string
+		for _, m := range page.Messages() {
+			data = append(data, m.Data.(string))
+		}
+		if len(page.Items()) != len(data) {
+			t.Errorf("want %d items; got %d", len(data), len(page.Items()))
+		}
+		pages = append(pages, data)
+		if !page.HasNext() {
+			break
+		}
+		if page, err = page.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]string{{"1", "3"}, nil, {"5"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Fatalf("want pages=%v; got %v", want, pages)
 	}
 }
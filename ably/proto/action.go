@@ -20,6 +20,7 @@ const (
 	ActionPresence
 	ActionMessage
 	ActionSync
+	ActionAuth
 )
 
 var actions = map[Action]string{
@@ -40,6 +41,7 @@ var actions = map[Action]string{
 	ActionPresence:     "presence",
 	ActionMessage:      "message",
 	ActionSync:         "sync",
+	ActionAuth:         "auth",
 }
 
 func (a Action) String() string {
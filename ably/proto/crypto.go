@@ -36,7 +36,7 @@ const (
 func (c CipherMode) String() string {
 	switch c {
 	case CBC:
-		return "cbs"
+		return "cbc"
 	default:
 		return ""
 	}
@@ -74,9 +74,52 @@ type CipherParams struct {
 // ChannelOptions defines options provided for creating a new channel.
 type ChannelOptions struct {
 	Cipher CipherParams
+
+	// Params are sent to the server when attaching a realtime channel, e.g.
+	// {"delta": "vcdiff"} enables delta compression of the channel's
+	// messages (Spec RTL4k).
+	//
+	// The "rewind" param makes the server replay recent messages to the
+	// subscribers upon attach; its value is either a number of messages,
+	// like "5", or a time interval, like "1m" or "30s". Replayed messages
+	// are not marked by the protocol, they can be told apart by having a
+	// Timestamp earlier than the attach.
+	Params map[string]string
+
+	// Modes are requested when attaching a realtime channel; the server
+	// may grant fewer of them. When empty, the server picks the modes
+	// allowed by the client's capability (Spec RTL4l).
+	Modes []ChannelMode
+
+	// NoAttachOnSubscribe when true makes subscribing to a realtime channel's
+	// messages or presence only register the subscription, without
+	// implicitly attaching the channel, which is then attached with Attach.
+	NoAttachOnSubscribe bool
+
 	cipher ChannelCipher
 }
 
+// PublishOnlyOptions gives options for a realtime channel which is used
+// only for publishing, see IsPublishOnly.
+func PublishOnlyOptions() *ChannelOptions {
+	return &ChannelOptions{Modes: []ChannelMode{ChannelModePublish}}
+}
+
+// IsPublishOnly reports whether the only requested channel mode is
+// ChannelModePublish. A realtime channel with such options publishes without
+// attaching and never delivers messages to its subscribers.
+func (c *ChannelOptions) IsPublishOnly() bool {
+	if c == nil || len(c.Modes) == 0 {
+		return false
+	}
+	for _, m := range c.Modes {
+		if m != ChannelModePublish {
+			return false
+		}
+	}
+	return true
+}
+
 // GetCipher retruns a ChannelCipher based on the algorithms set in the
 // ChannelOptions.CipherParams.
 func (c *ChannelOptions) GetCipher() (ChannelCipher, error) {
@@ -119,7 +162,17 @@ func NewCBCCipher(opts CipherParams) (*CBCCipher, error) {
 	if opts.Mode != 0 && opts.Mode != CBC {
 		return nil, errors.New("unknown cipher mode")
 	}
-	algo := fmt.Sprintf("cipher+%s-%d-cbc", opts.Algorithm, opts.KeyLength)
+	keyLength := len(opts.Key) * 8
+	switch keyLength {
+	case 128, 256:
+	default:
+		return nil, fmt.Errorf("invalid key length %d, must be 128 or 256 bits", keyLength)
+	}
+	if opts.KeyLength != 0 && opts.KeyLength != keyLength {
+		return nil, fmt.Errorf("key length %d does not match the length of the key %d", opts.KeyLength, keyLength)
+	}
+	opts.KeyLength = keyLength
+	algo := fmt.Sprintf("cipher+%s-%d-%s", opts.Algorithm, keyLength, CBC)
 	return &CBCCipher{
 		algorithm: algo,
 		params:    opts,
@@ -166,15 +219,11 @@ func (c *CBCCipher) Encrypt(plainText []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Apply padding to the payload if it's not already padded. Event if
-	// len(m.Data)%aes.Block == 0 we have no guarantee it's already padded.
-	// Try to unpad it and pad on failure.
-	if _, err := pkcs7Unpad(plainText, aes.BlockSize); err != nil {
-		data, err := pkcs7Pad(plainText, aes.BlockSize)
-		if err != nil {
-			return nil, err
-		}
-		plainText = data
+	// The payload is always padded, even when its length is already a
+	// multiple of the block size, so other clients can unpad it reliably.
+	plainText, err = pkcs7Pad(plainText, aes.BlockSize)
+	if err != nil {
+		return nil, err
 	}
 	iv := c.params.IV
 	if iv == nil {
@@ -4,11 +4,12 @@ import (
 	"crypto/aes"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/ably/ably-go/ably/internal/vcdiff"
 	"github.com/ugorji/go/codec"
 )
 
@@ -18,18 +19,27 @@ const (
 	JSON   = "json"
 	Base64 = "base64"
 	Cipher = "cipher"
+	VCDiff = "vcdiff"
 )
 
 type Message struct {
 	ID              string                 `json:"id,omitempty" codec:"id,omitempty"`
 	ClientID        string                 `json:"clientId,omitempty" codec:"clientId,omitempty"`
-	ConnectionID    string                 `json:"connectionId,omitempty" codec:"connectionID,omitempty"`
+	ConnectionID    string                 `json:"connectionId,omitempty" codec:"connectionId,omitempty"`
+	ConnectionKey   string                 `json:"connectionKey,omitempty" codec:"connectionKey,omitempty"` // publishes on behalf of the realtime connection with the key
 	Name            string                 `json:"name,omitempty" codec:"name,omitempty"`
 	Data            interface{}            `json:"data,omitempty" codec:"data,omitempty"`
 	Encoding        string                 `json:"encoding,omitempty" codec:"encoding,omitempty"`
 	Timestamp       int64                  `json:"timestamp" codec:"timestamp"`
-	Extras          map[string]interface{} `json:"extras" codec:"extras"`
+	Extras          map[string]interface{} `json:"extras,omitempty" codec:"extras,omitempty"`
 	*ChannelOptions `json:"-" codec:"-"`
+
+	// deltaSource is the payload the vcdiff encoded data is a delta of.
+	deltaSource []byte
+	// deltaBase is the payload deltas generated from this message apply to.
+	deltaBase []byte
+	// decodeErr is the error the payload failed to decode with.
+	decodeErr error
 }
 
 func (m *Message) maybeJSONEncode() error {
@@ -55,9 +65,15 @@ func (m *Message) maybeJSONEncode() error {
 		return nil
 	}
 	dataType := reflect.TypeOf(m.Data)
+	if dataType.Kind() == reflect.Ptr {
+		dataType = dataType.Elem()
+	}
 
-	// marshal any sort of slice except for []byte (i.e. []uint8)
-	if dataType.Kind() == reflect.Slice && dataType.Elem().Kind() != reflect.Uint8 {
+	// marshal any sort of map, struct or slice except for []byte (i.e. []uint8)
+	switch kind := dataType.Kind(); {
+	case kind == reflect.Map,
+		kind == reflect.Struct,
+		kind == reflect.Slice && dataType.Elem().Kind() != reflect.Uint8:
 		bs, err := json.Marshal(m.Data)
 		if err != nil {
 			return err
@@ -76,7 +92,28 @@ func (m Message) HasCipher() bool {
 	return false
 }
 
+// ValidateData checks whether data is a payload messages can carry: a
+// string, a byte slice or a value marshaled as JSON, like a struct, a map
+// or a slice, or a pointer to any of them.
+//
+// Spec RSL1a
+func ValidateData(data interface{}) error {
+	m := Message{Data: data}
+	_, err := m.encode()
+	return err
+}
+
 func (m Message) encode() (Message, error) {
+	switch v := m.Data.(type) {
+	case *string:
+		if v != nil {
+			m.Data = *v
+		}
+	case *[]byte:
+		if v != nil {
+			m.Data = *v
+		}
+	}
 	if m.Data == nil {
 		return m, nil
 	}
@@ -92,7 +129,7 @@ func (m Message) encode() (Message, error) {
 	case []byte:
 		// ok
 	default:
-		return Message{}, errors.New("unsupported payload type")
+		return Message{}, fmt.Errorf("unsupported payload type %T", m.Data)
 	}
 	if m.ChannelOptions != nil {
 		if cipher, err := m.GetCipher(); err == nil {
@@ -164,6 +201,9 @@ func (m Message) ToMap() map[string]interface{} {
 	if m.ConnectionID != "" {
 		ctx["connectionId"] = m.ConnectionID
 	}
+	if m.ConnectionKey != "" {
+		ctx["connectionKey"] = m.ConnectionKey
+	}
 	if m.Name != "" {
 		ctx["name"] = m.Name
 	}
@@ -177,7 +217,7 @@ func (m Message) ToMap() map[string]interface{} {
 	if m.Timestamp != 0 {
 		ctx["timestamp"] = m.Timestamp
 	}
-	if m.Extras != nil {
+	if len(m.Extras) != 0 {
 		ctx["extras"] = m.Extras
 	}
 	return ctx
@@ -211,7 +251,9 @@ func (m Message) CodecEncodeSelf(encoder *codec.Encoder) {
 func (m *Message) CodecDecodeSelf(decoder *codec.Decoder) {
 	ctx := make(map[string]interface{})
 	decoder.MustDecode(&ctx)
-	m.FromMap(ctx)
+	if err := m.FromMap(ctx); err != nil {
+		panic(err)
+	}
 }
 
 func (m *Message) FromMap(ctx map[string]interface{}) error {
@@ -236,6 +278,13 @@ func (m *Message) FromMap(ctx map[string]interface{}) error {
 		}
 		m.ConnectionID = string(x)
 	}
+	if v, ok := ctx["connectionKey"]; ok {
+		x, err := coerceString(v)
+		if err != nil {
+			return err
+		}
+		m.ConnectionKey = string(x)
+	}
 	if v, ok := ctx["name"]; ok {
 		x, err := coerceString(v)
 		if err != nil {
@@ -252,24 +301,21 @@ func (m *Message) FromMap(ctx map[string]interface{}) error {
 	}
 	if v, ok := ctx["data"]; ok {
 		m.Data = v
+		// A payload that fails to decode is kept decoded up to the failed
+		// encoding, with the remaining ones retained (Spec RSL6b).
 		dec, err := m.decode()
-		if err != nil {
-			return err
-		}
 		*m = dec
+		m.decodeErr = err
 	}
-	if v, ok := ctx["timestamp"]; ok {
-		switch e := v.(type) {
-		case float64:
-			m.Timestamp = int64(e)
-		case uint64:
-			m.Timestamp = int64(e)
-		case int64:
-			m.Timestamp = e
-		}
+	if v, ok := ctx["timestamp"]; ok && v != nil {
+		m.Timestamp = coerceInt64(v)
 	}
-	if v, ok := ctx["extras"]; ok {
-		m.Extras = v.(map[string]interface{})
+	if v, ok := ctx["extras"]; ok && v != nil {
+		x, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("unexpected extras type %T", v)
+		}
+		m.Extras = x
 	}
 	return nil
 }
@@ -279,6 +325,15 @@ func (m *Message) MemberKey() string {
 	return m.ConnectionID + ":" + m.ClientID
 }
 
+// Time returns the timestamp of the message, in milliseconds since epoch,
+// as a time.Time; it's the zero time if the timestamp is unset.
+func (m *Message) Time() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, m.Timestamp*int64(time.Millisecond))
+}
+
 func (m Message) Decrypt() (interface{}, error) {
 	cipher, err := m.GetCipher()
 	if err != nil {
@@ -291,60 +346,181 @@ func (m Message) Decrypt() (interface{}, error) {
 	}
 	v, err := cipher.Decrypt(d)
 	if err != nil {
-		fmt.Println("decrypting ", m.Encoding, len(d), len(string(d)))
 		return nil, err
 	}
 	return v, nil
 }
 
+// Decode decodes the payload of a message that was received without cipher
+// params, using the ones from opts. On error, the message holds the payload
+// decoded up to the failed encoding, with the remaining ones retained, and
+// DecodeError reports the error.
+func (m *Message) Decode(opts *ChannelOptions) error {
+	msg := *m
+	msg.ChannelOptions = opts
+	dec, err := msg.decode()
+	dec.decodeErr = err
+	*m = dec
+	return err
+}
+
+// DecodeDelta reconstructs the payload of a vcdiff encoded message from base,
+// the payload of the message the delta was generated from, and finishes
+// decoding it using opts. The message is left unchanged on error.
+//
+// Spec RTL19, PC3.
+func (m *Message) DecodeDelta(base []byte, opts *ChannelOptions) error {
+	msg := *m
+	msg.ChannelOptions = opts
+	msg.deltaSource = base
+	dec, err := msg.decode()
+	if err != nil {
+		return err
+	}
+	*m = dec
+	return nil
+}
+
+// Size gives the size of the message in bytes, which counts towards
+// the maximum message size: the length of its name, client ID, data and
+// extras, with data other than strings and byte slices, as well as
+// the extras, counted as their JSON encoding.
+//
+// Spec TM6
+func (m *Message) Size() (int, error) {
+	size := len(m.Name) + len(m.ClientID)
+	if len(m.Extras) != 0 {
+		p, err := json.Marshal(m.Extras)
+		if err != nil {
+			return 0, err
+		}
+		size += len(p)
+	}
+	e, err := Message{Data: m.Data}.encode()
+	if err != nil {
+		return 0, err
+	}
+	if e.Data != nil {
+		p, err := coerceBytes(e.Data)
+		if err != nil {
+			return 0, err
+		}
+		size += len(p)
+	}
+	return size, nil
+}
+
+// DecodeError gives the error the message payload failed to decode with, or
+// nil if it was decoded successfully. A message that failed to decode holds
+// the payload decoded up to the failed encoding; Encoding lists the ones
+// not applied yet.
+func (m *Message) DecodeError() error {
+	return m.decodeErr
+}
+
+// DeltaBase gives the payload that deltas generated from this message are
+// applied to; it's the message data before any encodings other than base64
+// and vcdiff were decoded.
+func (m *Message) DeltaBase() []byte {
+	return m.deltaBase
+}
+
+// DeltaFrom gives the ID of the message that the payload of this message is
+// a delta of, or an empty string if it's not a delta.
+func (m *Message) DeltaFrom() string {
+	delta, _ := m.Extras["delta"].(map[string]interface{})
+	from, _ := delta["from"].(string)
+	return from
+}
+
 func (m Message) decode() (Message, error) {
+	m.decodeErr = nil
+	m.deltaBase, _ = coerceBytes(m.Data)
 	// strings.Split on empty string returns []string{""}
 	if m.Data == nil || m.Encoding == "" {
 		return m, nil
 	}
 	encodings := strings.Split(m.Encoding, "/")
+	// fail keeps the payload decoded so far, along with the encodings
+	// not applied yet, including the failed one (Spec RSL6b).
+	fail := func(i int, err error) (Message, error) {
+		m.Encoding = strings.Join(encodings[:i+1], "/")
+		return m, err
+	}
 	for i := len(encodings) - 1; i >= 0; i-- {
 		switch encodings[i] {
 		case Base64:
 			d, err := coerceString(m.Data)
 			if err != nil {
-				return Message{}, err
+				return fail(i, err)
 			}
 			data, err := base64.StdEncoding.DecodeString(d)
 			if err != nil {
-				return Message{}, err
+				return fail(i, err)
+			}
+			m.Data = data
+			if i == len(encodings)-1 {
+				m.deltaBase = data
+			}
+		case VCDiff:
+			if m.deltaSource == nil {
+				// The base payload is tracked by the channel; keep the
+				// encodings not yet applied so the caller can finish
+				// decoding it with DecodeDelta.
+				m.Encoding = strings.Join(encodings[:i+1], "/")
+				return m, nil
+			}
+			d, err := coerceBytes(m.Data)
+			if err != nil {
+				return fail(i, err)
+			}
+			data, err := vcdiff.Decode(m.deltaSource, d)
+			if err != nil {
+				return fail(i, err)
 			}
 			m.Data = data
+			m.deltaBase = data
+			m.deltaSource = nil
 		case UTF8:
 			d, err := coerceString(m.Data)
 			if err != nil {
-				return Message{}, err
+				return fail(i, err)
 			}
 			m.Data = d
 		case JSON:
 			d, err := coerceBytes(m.Data)
 			if err != nil {
-				return Message{}, err
+				return fail(i, err)
 			}
 			var result interface{}
 			if err := json.Unmarshal(d, &result); err != nil {
-				return m, fmt.Errorf("error unmarshaling JSON payload of type %T: %s", m.Data, err.Error())
+				return fail(i, fmt.Errorf("error unmarshaling JSON payload of type %T: %s", m.Data, err.Error()))
 			}
 			m.Data = result
 		default:
 			switch {
 			case strings.HasPrefix(encodings[i], Cipher):
+				if m.ChannelOptions == nil {
+					// Without cipher params the payload can't be decrypted;
+					// keep the encodings not yet applied so the caller can
+					// finish decoding it later with Decode.
+					m.Encoding = strings.Join(encodings[:i+1], "/")
+					return m, nil
+				}
 				d, err := m.Decrypt()
 				if err != nil {
-					return m, err
+					return fail(i, err)
 				}
 				m.Data = d
 			default:
-				return m, fmt.Errorf("unknown encoding %s", encodings[i])
+				return fail(i, fmt.Errorf("unknown encoding %s", encodings[i]))
 			}
 
 		}
 	}
+	// All the encodings were decoded, so the message holds the native
+	// payload now.
+	m.Encoding = ""
 	return m, nil
 }
 
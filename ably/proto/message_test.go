@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/ably/ably-go/ably/ablytest"
+	"github.com/ably/ably-go/ably/internal/ablyutil"
 	"github.com/ably/ably-go/ably/proto"
 )
 
@@ -114,6 +115,185 @@ func TestMessage(t *testing.T) {
 	}
 }
 
+// TestCBCCipher_Interop checks the cipher output against payloads encrypted
+// with openssl, which other Ably client libraries are able to decrypt.
+func TestCBCCipher_Interop(t *testing.T) {
+	sample := []struct {
+		desc      string
+		key       string
+		iv        string
+		data      string
+		encrypted string
+		encoding  string
+	}{
+		{
+			desc:      "aes-128-cbc with block-aligned payload",
+			key:       "WUP6u0K7MXI5Zeo0VppPwg==",
+			iv:        "HO4cYSP8LybPYBPZPHQOtg==",
+			data:      "0123456789abcdef",
+			encrypted: "HO4cYSP8LybPYBPZPHQOtvpdfATAJKjG18xBVaFbSdm4UWfnhN7e1wcbHmumet0L",
+			encoding:  "utf-8/cipher+aes-128-cbc",
+		},
+		{
+			desc:      "aes-256-cbc",
+			key:       "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+			iv:        "EBESExQVFhcYGRobHB0eHw==",
+			data:      "The quick brown fox jumped over the lazy dog",
+			encrypted: "EBESExQVFhcYGRobHB0eH7dG5PG84jUtIEQLii4OuP3zhEFWgU8a+lDox2wmXRzLimwdOFIbOnQ3VKps/hVosA==",
+			encoding:  "utf-8/cipher+aes-256-cbc",
+		},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(ts *testing.T) {
+			key, err := base64.StdEncoding.DecodeString(v.key)
+			if err != nil {
+				ts.Fatal(err)
+			}
+			iv, err := base64.StdEncoding.DecodeString(v.iv)
+			if err != nil {
+				ts.Fatal(err)
+			}
+			opts := &proto.ChannelOptions{
+				Cipher: proto.CipherParams{
+					Key:       key,
+					IV:        iv,
+					Algorithm: proto.AES,
+				},
+			}
+			msg := &proto.Message{Data: v.data, ChannelOptions: opts}
+			b, err := json.Marshal(msg)
+			if err != nil {
+				ts.Fatal(err)
+			}
+			var encoded struct {
+				Data     string `json:"data"`
+				Encoding string `json:"encoding"`
+			}
+			if err := json.Unmarshal(b, &encoded); err != nil {
+				ts.Fatal(err)
+			}
+			if encoded.Data != v.encrypted {
+				ts.Errorf("expected data %s got %s", v.encrypted, encoded.Data)
+			}
+			if expected := v.encoding + "/base64"; encoded.Encoding != expected {
+				ts.Errorf("expected encoding %s got %s", expected, encoded.Encoding)
+			}
+
+			// A message decoded without cipher params keeps the encrypted
+			// payload until it's decoded with them.
+			var decoded proto.Message
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				ts.Fatal(err)
+			}
+			if decoded.Encoding != v.encoding {
+				ts.Errorf("expected encoding %s got %s", v.encoding, decoded.Encoding)
+			}
+			if err := decoded.Decode(opts); err != nil {
+				ts.Fatal(err)
+			}
+			if decoded.Data != v.data {
+				ts.Errorf("expected %q got %v", v.data, decoded.Data)
+			}
+		})
+	}
+}
+
+func TestCBCCipher_InvalidKey(t *testing.T) {
+	for _, length := range []int{64, 192} {
+		key := make([]byte, length/8)
+		_, err := proto.NewCBCCipher(proto.CipherParams{Algorithm: proto.AES, Key: key})
+		if err == nil {
+			t.Errorf("expected error for %d-bit key", length)
+		}
+	}
+	_, err := proto.NewCBCCipher(proto.CipherParams{Algorithm: proto.AES, Key: make([]byte, 16), KeyLength: 256})
+	if err == nil {
+		t.Error("expected error for mismatched key length")
+	}
+}
+
+func TestMessage_Protocols(t *testing.T) {
+	type payload struct {
+		Name  string   `json:"name"`
+		Count int      `json:"count"`
+		Tags  []string `json:"tags"`
+	}
+	protocols := map[string]struct {
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		"application/json":      {json.Marshal, json.Unmarshal},
+		"application/x-msgpack": {ablyutil.Marshal, ablyutil.Unmarshal},
+	}
+	sample := []struct {
+		desc    string
+		data    interface{}
+		decoded interface{}
+	}{
+		{
+			desc:    "with string data",
+			data:    "data",
+			decoded: "data",
+		},
+		{
+			desc:    "with binary data",
+			data:    []byte{0x00, 0xff, 0x10, 0x7f},
+			decoded: []byte{0x00, 0xff, 0x10, 0x7f},
+		},
+		{
+			desc: "with struct data",
+			data: payload{Name: "name", Count: 2, Tags: []string{"a", "b"}},
+			decoded: map[string]interface{}{
+				"name":  "name",
+				"count": float64(2),
+				"tags":  []interface{}{"a", "b"},
+			},
+		},
+		{
+			desc: "with struct pointer data",
+			data: &payload{Name: "name"},
+			decoded: map[string]interface{}{
+				"name":  "name",
+				"count": float64(0),
+				"tags":  nil,
+			},
+		},
+	}
+	for typ, codec := range protocols {
+		for _, v := range sample {
+			t.Run(typ+" "+v.desc, func(ts *testing.T) {
+				msg := &proto.ProtocolMessage{
+					Messages: []*proto.Message{{
+						Data:   v.data,
+						Extras: map[string]interface{}{"push": map[string]interface{}{"title": "title"}},
+					}},
+				}
+				p, err := codec.marshal(msg)
+				if err != nil {
+					ts.Fatal(err)
+				}
+				decoded := &proto.ProtocolMessage{}
+				if err := codec.unmarshal(p, decoded); err != nil {
+					ts.Fatal(err)
+				}
+				if len(decoded.Messages) != 1 {
+					ts.Fatalf("expected 1 message got %d", len(decoded.Messages))
+				}
+				got := decoded.Messages[0]
+				if !reflect.DeepEqual(got.Data, v.decoded) {
+					ts.Errorf("expected %#v got %#v", v.decoded, got.Data)
+				}
+				if got.Encoding != "" {
+					ts.Errorf("expected empty encoding got %q", got.Encoding)
+				}
+				if !reflect.DeepEqual(got.Extras, msg.Messages[0].Extras) {
+					ts.Errorf("expected %#v got %#v", msg.Messages[0].Extras, got.Extras)
+				}
+			})
+		}
+	}
+}
+
 func TestMessage_CryptoDataFixtures_RSL6a1_RSL5b_RSL5c(t *testing.T) {
 	fixtures := []struct {
 		desc, file string
@@ -163,3 +343,210 @@ func TestMessage_CryptoDataFixtures_RSL6a1_RSL5b_RSL5c(t *testing.T) {
 		})
 	}
 }
+
+func TestMessage_ConnectionID(t *testing.T) {
+	protocols := map[string]struct {
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		"application/json":      {json.Marshal, json.Unmarshal},
+		"application/x-msgpack": {ablyutil.Marshal, ablyutil.Unmarshal},
+	}
+	wire := map[string]interface{}{
+		"name":          "name",
+		"connectionId":  "connection-id",
+		"connectionKey": "connection-key",
+	}
+	for typ, codec := range protocols {
+		p, err := codec.marshal(wire)
+		if err != nil {
+			t.Fatalf("%s: Marshal()=%v", typ, err)
+		}
+		var msg proto.Message
+		if err := codec.unmarshal(p, &msg); err != nil {
+			t.Fatalf("%s: Unmarshal()=%v", typ, err)
+		}
+		if msg.ConnectionID != "connection-id" {
+			t.Errorf("%s: want ConnectionID=%q; got %q", typ, "connection-id", msg.ConnectionID)
+		}
+		if msg.ConnectionKey != "connection-key" {
+			t.Errorf("%s: want ConnectionKey=%q; got %q", typ, "connection-key", msg.ConnectionKey)
+		}
+	}
+}
+
+func TestMessage_EmptyExtras(t *testing.T) {
+	protocols := map[string]struct {
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		"application/json":      {json.Marshal, json.Unmarshal},
+		"application/x-msgpack": {ablyutil.Marshal, ablyutil.Unmarshal},
+	}
+	for typ, codec := range protocols {
+		t.Run(typ, func(t *testing.T) {
+			for _, extras := range []map[string]interface{}{nil, {}} {
+				p, err := codec.marshal(proto.Message{Name: "name", Extras: extras})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var fields map[string]interface{}
+				if err := codec.unmarshal(p, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := fields["extras"]; ok {
+					t.Errorf("want extras=%#v to be omitted; got %v", extras, fields)
+				}
+			}
+		})
+	}
+	var msg proto.Message
+	if err := json.Unmarshal([]byte(`{"name":"name","extras":null}`), &msg); err != nil {
+		t.Fatalf("Unmarshal()=%v", err)
+	}
+	if msg.Extras != nil {
+		t.Errorf("want nil extras; got %#v", msg.Extras)
+	}
+}
+
+func TestMessage_DecodeError(t *testing.T) {
+	protocols := map[string]struct {
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		"application/json":      {json.Marshal, json.Unmarshal},
+		"application/x-msgpack": {ablyutil.Marshal, ablyutil.Unmarshal},
+	}
+	for typ, codec := range protocols {
+		t.Run(typ, func(t *testing.T) {
+			p, err := codec.marshal(map[string]interface{}{
+				"name":      "name",
+				"data":      "payload",
+				"encoding":  "custom/utf-8",
+				"timestamp": 1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg proto.Message
+			if err := codec.unmarshal(p, &msg); err != nil {
+				t.Fatalf("Unmarshal()=%v", err)
+			}
+			if msg.DecodeError() == nil {
+				t.Error("want non-nil DecodeError()")
+			}
+			if data, _ := msg.Data.(string); data != "payload" {
+				t.Errorf("want Data=%q; got %#v", "payload", msg.Data)
+			}
+			// The utf-8 encoding was applied before the unknown one failed.
+			if msg.Encoding != "custom" {
+				t.Errorf("want Encoding=%q; got %q", "custom", msg.Encoding)
+			}
+			if msg.Timestamp != 1 {
+				t.Errorf("want Timestamp=1; got %d", msg.Timestamp)
+			}
+		})
+	}
+}
+
+func TestMessage_DecodeChain(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString("WUP6u0K7MXI5Zeo0VppPwg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &proto.ChannelOptions{
+		Cipher: proto.CipherParams{
+			Key:       key,
+			KeyLength: 128,
+			Algorithm: proto.AES,
+		},
+	}
+	encrypted, err := json.Marshal(&proto.Message{
+		Data:           map[string]interface{}{"key": "value"},
+		ChannelOptions: opts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		msg      string
+		opts     *proto.ChannelOptions
+		data     interface{}
+		encoding string
+		err      bool
+	}{{
+		name: "json/utf-8/base64",
+		msg:  `{"data":"eyJrZXkiOiJ2YWx1ZSJ9","encoding":"json/utf-8/base64"}`,
+		data: map[string]interface{}{"key": "value"},
+	}, {
+		name: "cipher",
+		msg:  string(encrypted),
+		opts: opts,
+		data: map[string]interface{}{"key": "value"},
+	}, {
+		name:     "cipher without params",
+		msg:      string(encrypted),
+		encoding: "json/utf-8/cipher+aes-128-cbc",
+	}, {
+		name:     "invalid json",
+		msg:      `{"data":"bm90IGpzb24=","encoding":"json/utf-8/base64"}`,
+		data:     "not json",
+		encoding: "json",
+		err:      true,
+	}, {
+		name:     "invalid base64",
+		msg:      `{"data":"not base64","encoding":"utf-8/base64"}`,
+		data:     "not base64",
+		encoding: "utf-8/base64",
+		err:      true,
+	}}
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			var msg proto.Message
+			if err := json.Unmarshal([]byte(cas.msg), &msg); err != nil {
+				t.Fatalf("Unmarshal()=%v", err)
+			}
+			if cas.opts != nil {
+				if err := msg.Decode(cas.opts); err != nil {
+					t.Fatalf("Decode()=%v", err)
+				}
+			}
+			if msg.Encoding != cas.encoding {
+				t.Errorf("want Encoding=%q; got %q", cas.encoding, msg.Encoding)
+			}
+			if err := msg.DecodeError(); (err != nil) != cas.err {
+				t.Errorf("want error=%t; got DecodeError()=%v", cas.err, err)
+			}
+			if cas.data != nil && !reflect.DeepEqual(msg.Data, cas.data) {
+				t.Errorf("want Data=%#v; got %#v", cas.data, msg.Data)
+			}
+		})
+	}
+}
+
+func TestMessage_Size(t *testing.T) {
+	sample := []struct {
+		desc string
+		msg  proto.Message
+		size int
+	}{
+		{"empty", proto.Message{}, 0},
+		{"string data", proto.Message{Name: "name", Data: "data"}, 8},
+		{"utf-8 string data", proto.Message{Data: "żółw"}, 7},
+		{"binary data", proto.Message{Data: []byte{0x00, 0xff}}, 2},
+		{"json data", proto.Message{Data: map[string]interface{}{"a": "b"}}, 9},
+		{"client ID and extras", proto.Message{ClientID: "client", Extras: map[string]interface{}{"a": "b"}}, 15},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			size, err := v.msg.Size()
+			if err != nil {
+				t.Fatalf("Size()=%v", err)
+			}
+			if size != v.size {
+				t.Errorf("want Size()=%d; got %d", v.size, size)
+			}
+		})
+	}
+}
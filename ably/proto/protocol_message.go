@@ -6,8 +6,18 @@ import (
 )
 
 const (
-	FlagPresence Flag = iota + 1
+	FlagPresence Flag = 1 << iota
 	FlagBacklog
+	FlagResumed
+)
+
+// Channel mode flags, set on ATTACH to request the modes and on ATTACHED by
+// the server to confirm them (Spec TR3).
+const (
+	FlagModePresence Flag = 1 << (iota + 16)
+	FlagModePublish
+	FlagModeSubscribe
+	FlagModePresenceSubscribe
 )
 
 type Flag int64
@@ -16,6 +26,59 @@ func (f Flag) Has(flag Flag) bool {
 	return f&flag == flag
 }
 
+// ChannelMode describes an operation a client attaches to a channel for.
+// Attaching with a subset of the modes lets the client operate with
+// a narrower capability, e.g. as a subscriber only.
+type ChannelMode int64
+
+const (
+	ChannelModePresence          = ChannelMode(FlagModePresence)
+	ChannelModePublish           = ChannelMode(FlagModePublish)
+	ChannelModeSubscribe         = ChannelMode(FlagModeSubscribe)
+	ChannelModePresenceSubscribe = ChannelMode(FlagModePresenceSubscribe)
+)
+
+var channelModes = []ChannelMode{
+	ChannelModePresence,
+	ChannelModePublish,
+	ChannelModeSubscribe,
+	ChannelModePresenceSubscribe,
+}
+
+func (m ChannelMode) String() string {
+	switch m {
+	case ChannelModePresence:
+		return "PRESENCE"
+	case ChannelModePublish:
+		return "PUBLISH"
+	case ChannelModeSubscribe:
+		return "SUBSCRIBE"
+	case ChannelModePresenceSubscribe:
+		return "PRESENCE_SUBSCRIBE"
+	}
+	return fmt.Sprintf("ChannelMode(%d)", int64(m))
+}
+
+// ModeFlags gives the flags encoding the given modes.
+func ModeFlags(modes []ChannelMode) Flag {
+	var f Flag
+	for _, m := range modes {
+		f |= Flag(m)
+	}
+	return f
+}
+
+// Modes gives the channel modes set in the flags.
+func (f Flag) Modes() []ChannelMode {
+	var modes []ChannelMode
+	for _, m := range channelModes {
+		if f.Has(Flag(m)) {
+			modes = append(modes, m)
+		}
+	}
+	return modes
+}
+
 type ConnectionDetails struct {
 	ClientID           string `json:"clientId,omitempty" codec:"clientId,omitempty"`
 	ConnectionKey      string `json:"connectionKey,omitempty" codec:"connectionKey,omitempty"`
@@ -23,6 +86,8 @@ type ConnectionDetails struct {
 	MaxFrameSize       int64  `json:"maxFrameSize,omitempty" codec:"maxFrameSize,omitempty"`
 	MaxInboundRate     int64  `json:"maxInboundRate,omitempty" codec:"maxInboundRate,omitempty"`
 	ConnectionStateTTL int64  `json:"connectionStateTtl,omitempty" codec:"connectionStateTtl,omitempty"`
+	ServerID           string `json:"serverId,omitempty" codec:"serverId,omitempty"`
+	MaxIdleInterval    int64  `json:"maxIdleInterval,omitempty" codec:"maxIdleInterval,omitempty"`
 }
 
 func (c *ConnectionDetails) FromMap(ctx map[string]interface{}) {
@@ -44,6 +109,18 @@ func (c *ConnectionDetails) FromMap(ctx map[string]interface{}) {
 	if v, ok := ctx["connectionStateTtl"]; ok {
 		c.ConnectionStateTTL = coerceInt64(v)
 	}
+	if v, ok := ctx["serverId"]; ok {
+		c.ServerID = v.(string)
+	}
+	if v, ok := ctx["maxIdleInterval"]; ok {
+		c.MaxIdleInterval = coerceInt64(v)
+	}
+}
+
+// AuthDetails carries the token sent with AUTH messages, which is used to
+// reauthenticate an active connection.
+type AuthDetails struct {
+	AccessToken string `json:"accessToken,omitempty" codec:"accessToken,omitempty"`
 }
 
 func coerceInt8(v interface{}) int8 {
@@ -67,6 +144,8 @@ func coerceInt64(v interface{}) int64 {
 	switch e := v.(type) {
 	case float64:
 		return int64(e)
+	case uint64:
+		return int64(e)
 	default:
 		return v.(int64)
 	}
@@ -89,6 +168,8 @@ type ProtocolMessage struct {
 	Count             int                `json:"count,omitempty" codec:"count,omitempty"`
 	Action            Action             `json:"action,omitempty" codec:"action,omitempty"`
 	Flags             Flag               `json:"flags,omitempty" codec:"flags,omitempty"`
+	Auth              *AuthDetails       `json:"auth,omitempty" codec:"auth,omitempty"`
+	Params            map[string]string  `json:"params,omitempty" codec:"params,omitempty"`
 }
 
 func (p *ProtocolMessage) UnmarshalJSON(b []byte) error {
@@ -164,6 +245,20 @@ func (p *ProtocolMessage) FromMap(ctx map[string]interface{}) {
 	if v, ok := ctx["flags"]; ok {
 		p.Flags = Flag(coerceInt64(v))
 	}
+	if v, ok := ctx["params"]; ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			p.Params = make(map[string]string, len(m))
+			for k, v := range m {
+				p.Params[k], _ = v.(string)
+			}
+		}
+	}
+	if v, ok := ctx["auth"]; ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			p.Auth = &AuthDetails{}
+			p.Auth.AccessToken, _ = m["accessToken"].(string)
+		}
+	}
 }
 
 func (msg *ProtocolMessage) String() string {
@@ -1,6 +1,9 @@
 package proto
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 const (
 	StatGranularityMinute = "minute"
@@ -22,6 +25,16 @@ func IntervalFormatFor(t time.Time, granulatity string) string {
 	return t.Format(intervalFormats[granulatity])
 }
 
+// ParseInterval parses the interval ID of the given granularity, as
+// formatted by IntervalFormatFor, into the UTC time the interval starts at.
+func ParseInterval(id, granularity string) (time.Time, error) {
+	format, ok := intervalFormats[granularity]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown stats granularity %q", granularity)
+	}
+	return time.Parse(format, id)
+}
+
 type ResourceCount struct {
 	Peak    float64 `json:"peak" codec:"peak"`
 	Min     float64 `json:"min" codec:"min"`
@@ -44,12 +57,36 @@ type MessageCount struct {
 	Refused float64 `json:"refused" codec:"refused"`
 }
 
+// Add gives the sum of both message counts.
+func (c MessageCount) Add(other MessageCount) MessageCount {
+	return MessageCount{
+		Count:   c.Count + other.Count,
+		Data:    c.Data + other.Data,
+		Failed:  c.Failed + other.Failed,
+		Refused: c.Refused + other.Refused,
+	}
+}
+
+// MessageTypes breaks down message counts into regular and presence messages.
+// Plain holds the regular messages, which the server reports in the
+// "messages" field.
+//
+// Spec TS5.
 type MessageTypes struct {
 	All      MessageCount `json:"all" codec:"all"`
-	Plain    MessageCount `json:"plain" codec:"plain"`
+	Plain    MessageCount `json:"messages" codec:"messages"`
 	Presence MessageCount `json:"presence" codec:"presence"`
 }
 
+// Add gives the sum of both message counts, type by type.
+func (t MessageTypes) Add(other MessageTypes) MessageTypes {
+	return MessageTypes{
+		All:      t.All.Add(other.All),
+		Plain:    t.Plain.Add(other.Plain),
+		Presence: t.Presence.Add(other.Presence),
+	}
+}
+
 type MessageTraffic struct {
 	All           MessageTypes `json:"all" codec:"all"`
 	RealTime      MessageTypes `json:"realtime" codec:"realtime"`
@@ -136,3 +173,16 @@ type Stats struct {
 	XchgConsumer  XchgMessages    `json:"xchgConsumer" codec:"xchgConsumer"`
 	PeakRates     Rates           `json:"peakRates" codec:"peakRates"`
 }
+
+// IntervalTime gives the UTC time the interval of the stats starts at.
+//
+// Spec TS12p
+func (s *Stats) IntervalTime() (time.Time, error) {
+	return ParseInterval(s.IntervalID, s.Unit)
+}
+
+// Traffic gives the inbound and outbound message counts of the interval
+// added together.
+func (s *Stats) Traffic() MessageTypes {
+	return s.Inbound.All.Add(s.Outbound.All)
+}
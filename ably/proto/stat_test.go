@@ -0,0 +1,87 @@
+package proto_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ably/ably-go/ably/internal/ablyutil"
+	"github.com/ably/ably-go/ably/proto"
+)
+
+func TestStats_Decode(t *testing.T) {
+	const data = `{
+		"intervalId": "2019-01-02:15:04",
+		"unit": "minute",
+		"all": {"all": {"count": 90, "data": 9000}},
+		"inbound": {
+			"all": {"all": {"count": 70, "data": 7000}, "messages": {"count": 60, "data": 6000}, "presence": {"count": 10, "data": 1000}},
+			"realtime": {"messages": {"count": 50, "data": 5000}}
+		},
+		"outbound": {
+			"all": {"all": {"count": 20, "data": 2000}, "presence": {"count": 20, "data": 2000}},
+			"rest": {"presence": {"count": 20, "data": 2000}}
+		},
+		"persisted": {"messages": {"count": 30, "data": 3000}},
+		"connections": {"tls": {"peak": 20, "opened": 10}},
+		"channels": {"peak": 50, "opened": 30},
+		"apiRequests": {"succeeded": 50, "failed": 10},
+		"tokenRequests": {"succeeded": 60, "failed": 20}
+	}`
+	check := func(t *testing.T, stats *proto.Stats) {
+		t.Helper()
+		for _, v := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"all.all.count", stats.All.All.Count, 90},
+			{"inbound.realtime.messages.count", stats.Inbound.RealTime.Plain.Count, 50},
+			{"inbound.realtime.messages.data", stats.Inbound.RealTime.Plain.Data, 5000},
+			{"outbound.rest.presence.count", stats.Outbound.Rest.Presence.Count, 20},
+			{"persisted.messages.count", stats.Persisted.Plain.Count, 30},
+			{"connections.tls.peak", stats.Connections.TLS.Peak, 20},
+			{"channels.opened", stats.Channels.Opened, 30},
+			{"apiRequests.failed", stats.APIRequests.Failed, 10},
+			{"tokenRequests.succeeded", stats.TokenRequests.Succeeded, 60},
+		} {
+			if v.got != v.want {
+				t.Errorf("%s: want %v; got %v", v.name, v.want, v.got)
+			}
+		}
+		if stats.IntervalID != "2019-01-02:15:04" || stats.Unit != proto.StatGranularityMinute {
+			t.Errorf("want interval=2019-01-02:15:04 unit=minute; got interval=%s unit=%s", stats.IntervalID, stats.Unit)
+		}
+		interval, err := stats.IntervalTime()
+		if err != nil {
+			t.Fatalf("IntervalTime()=%v", err)
+		}
+		if want := time.Date(2019, 1, 2, 15, 4, 0, 0, time.UTC); !interval.Equal(want) {
+			t.Errorf("want IntervalTime()=%v; got %v", want, interval)
+		}
+		traffic := stats.Traffic()
+		want := proto.MessageTypes{
+			All:      proto.MessageCount{Count: 90, Data: 9000},
+			Plain:    proto.MessageCount{Count: 60, Data: 6000},
+			Presence: proto.MessageCount{Count: 30, Data: 3000},
+		}
+		if traffic != want {
+			t.Errorf("want Traffic()=%+v; got %+v", want, traffic)
+		}
+	}
+	var stats proto.Stats
+	if err := json.Unmarshal([]byte(data), &stats); err != nil {
+		t.Fatal(err)
+	}
+	check(t, &stats)
+
+	// Round trip through msgpack, which is used by the binary protocol.
+	b, err := ablyutil.Marshal(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded proto.Stats
+	if err := ablyutil.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	check(t, &decoded)
+}
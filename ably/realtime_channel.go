@@ -1,17 +1,27 @@
 package ably
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ably/ably-go/ably/proto"
 )
 
 var (
-	errAttach = errors.New("attempted to attach channel to inactive connection")
-	errDetach = errors.New("attempted to detach channel from inactive connection")
+	errAttach          = errors.New("attempted to attach channel to inactive connection")
+	errDetach          = errors.New("attempted to detach channel from inactive connection")
+	errAttachCancelled = errors.New("channel was detached before it got attached")
+
+	errAttachTimeout = errors.New("no response to attach request received")
+	errDetachTimeout = errors.New("no response to detach request received")
+
+	errNoCipherParams = errors.New("no cipher params set")
 )
 
 type chanSlice []*RealtimeChannel
@@ -39,10 +49,14 @@ func newChannels(client *RealtimeClient) *Channels {
 // Get looks up a channel given by the name and creates it if it does not exist
 // already.
 //
+// Optional channel options, like the cipher params used for encrypting
+// messages, are set on the channel; if it already exists, its options are
+// replaced with the given ones (Spec RTS3c).
+//
 // It is safe to call Get from multiple goroutines - a single channel is
 // guaranteed to be created only once for multiple calls to Get from different
 // goroutines.
-func (ch *Channels) Get(name string) *RealtimeChannel {
+func (ch *Channels) Get(name string, opts ...*proto.ChannelOptions) *RealtimeChannel {
 	ch.mtx.Lock()
 	c, ok := ch.chans[name]
 	if !ok {
@@ -50,6 +64,9 @@ func (ch *Channels) Get(name string) *RealtimeChannel {
 		ch.chans[name] = c
 	}
 	ch.mtx.Unlock()
+	if len(opts) > 0 && opts[0] != nil {
+		c.setOptions(opts[0])
+	}
 	return c
 }
 
@@ -71,22 +88,66 @@ func (ch *Channels) All() []*RealtimeChannel {
 	return chans
 }
 
-// Release closes a channel looked up by the name.
+// serials gives the serials of the channels which have got one by name.
+func (ch *Channels) serials() map[string]string {
+	serials := make(map[string]string)
+	for _, c := range ch.All() {
+		if serial := c.Serial(); serial != "" {
+			serials[c.Name] = serial
+		}
+	}
+	return serials
+}
+
+// Exists reports whether a channel with the given name was created and not
+// released yet.
+//
+// Spec RTS2
+func (ch *Channels) Exists(name string) bool {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	_, ok := ch.chans[name]
+	return ok
+}
+
+// Iterate returns a list of created channels, like All.
+func (ch *Channels) Iterate() []*RealtimeChannel {
+	return ch.All()
+}
+
+// Release detaches a channel looked up by the name and then removes it, so
+// a subsequent Get creates a new channel. Subscriptions of the released
+// channel are closed.
 //
 // It is safe to call Release from multiple goroutines - if a channel happened
 // to be already concurrently released, the method is a nop.
+//
+// Spec RTS4a
 func (ch *Channels) Release(name string) error {
 	ch.mtx.Lock()
-	defer ch.mtx.Unlock()
-	if c, ok := ch.chans[name]; ok {
-		delete(ch.chans, name)
-		return c.Close()
+	c, ok := ch.chans[name]
+	ch.mtx.Unlock()
+	if !ok {
+		return nil
 	}
-	return nil
+	err := c.Close()
+	ch.mtx.Lock()
+	if ch.chans[name] != c {
+		ch.mtx.Unlock()
+		return nil
+	}
+	delete(ch.chans, name)
+	ch.mtx.Unlock()
+	c.release()
+	return err
 }
 
 // RealtimeChannel represents a single named message channel.
 type RealtimeChannel struct {
+	// duplicates is the number of dropped duplicate messages; it's accessed
+	// atomically, so it's kept first for 64-bit alignment.
+	duplicates int64
+
 	Name     string            // name used to create the channel
 	Presence *RealtimePresence //
 
@@ -95,14 +156,35 @@ type RealtimeChannel struct {
 	subs   *subscriptions
 	queue  *msgQueue
 	listen chan State
+
+	optionsMtx  sync.Mutex
+	options     *proto.ChannelOptions
+	onDecodeErr func(*proto.Message, error) // guarded by optionsMtx
+
+	params  map[string]string   // accepted by the server on attach, guarded by state
+	modes   []proto.ChannelMode // granted by the server on attach, guarded by state
+	serial  string              // serial of the last received message, guarded by state
+	attempt int                 // identifies the pending attach or detach, guarded by state
+
+	// The fields below are accessed only when processing messages
+	// received on the connection.
+	lastMessageID string   // ID of the last received message
+	lastPayload   []byte   // payload the next delta message applies to
+	deltaRecovery bool     // whether the messages are dropped until reattached
+	recentIDs     []string // IDs of the last received messages, if deduplicating
+	recentNext    int      // index in recentIDs the next ID is stored at
 }
 
+// dedupWindow is the number of last received message IDs a channel checks
+// incoming messages against when ClientOptions.Dedup is set.
+const dedupWindow = 100
+
 func newRealtimeChannel(name string, client *RealtimeClient) *RealtimeChannel {
 	c := &RealtimeChannel{
 		Name:   name,
 		client: client,
 		state:  newStateEmitter(StateChan, StateChanInitialized, name, client.logger()),
-		subs:   newSubscriptions(subscriptionMessages, client.logger()),
+		subs:   newSubscriptions(subscriptionMessages, client.opts().InboundBufferSize, client.logger()),
 		listen: make(chan State, 1),
 	}
 	c.Presence = newRealtimePresence(c)
@@ -110,29 +192,128 @@ func newRealtimeChannel(name string, client *RealtimeClient) *RealtimeChannel {
 	if c.opts().Listener != nil {
 		c.On(c.opts().Listener)
 	}
-	c.client.Connection.On(c.listen, StateConnFailed, StateConnClosed)
+	c.client.Connection.Notify(c.listen, StateConnFailed, StateConnClosed, StateConnConnected, StateConnSuspended)
 	go c.listenLoop()
 	return c
 }
 
+// release stops the channel from following the connection state once it's
+// removed from Channels.
+func (c *RealtimeChannel) release() {
+	c.client.Connection.StopNotify(c.listen)
+	close(c.listen)
+}
+
 func (c *RealtimeChannel) listenLoop() {
 	for state := range c.listen {
 		c.state.Lock()
 		active := c.isActive()
+		suspended := c.state.current == StateChanSuspended
 		c.state.Unlock()
 		switch state.State {
 		case StateConnFailed:
 			if active {
 				c.state.syncSet(StateChanFailed, state.Err)
+				c.queue.Fail(stateError(StateConnFailed, state.Err))
 			}
 		case StateConnClosed:
 			if active {
 				c.state.syncSet(StateChanClosed, state.Err)
+				c.queue.Fail(stateError(StateConnClosed, state.Err))
+			}
+		case StateConnSuspended:
+			// Spec RTL3c
+			if active {
+				c.state.syncSet(StateChanSuspended, state.Err)
+				c.queue.Fail(stateError(StateConnSuspended, state.Err))
+			}
+		case StateConnConnected:
+			// The connection was not resumed and the server no longer
+			// knows about the channel, thus it needs to be reattached.
+			//
+			// Spec RTN15c3, RTL3d
+			if suspended || active && state.Err != nil {
+				c.reattach(nil)
 			}
 		}
 	}
 }
 
+// reattach sends a new ATTACH for an active or suspended channel; err is
+// reported as the reason of the transition to the attaching state.
+func (c *RealtimeChannel) reattach(err error) {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if !c.isActive() && c.state.current != StateChanSuspended {
+		return
+	}
+	c.state.set(StateChanAttaching, err)
+	if err := c.client.Connection.send(c.attachMessage(), nil); err != nil {
+		c.state.set(StateChanFailed, err)
+		return
+	}
+	c.startTimeout(StateChanAttaching)
+}
+
+// startTimeout fails the pending attach or detach, if the channel is still in
+// the given state after the RealtimeRequestTimeout. It expects the state lock
+// to be held.
+func (c *RealtimeChannel) startTimeout(state StateEnum) {
+	c.attempt++
+	attempt := c.attempt
+	time.AfterFunc(c.opts().realtimeRequestTimeout(), func() {
+		c.state.Lock()
+		defer c.state.Unlock()
+		if c.attempt != attempt || c.state.current != state {
+			return
+		}
+		switch state {
+		case StateChanAttaching:
+			// Spec RTL4f, RTL13b
+			retryIn := c.opts().channelRetryTimeout()
+			c.state.setRetry(StateChanSuspended, newError(ErrTimeoutError, errAttachTimeout), retryIn)
+			time.AfterFunc(retryIn, func() { c.retryAttach(attempt) })
+		case StateChanDetaching:
+			// Spec RTL5f
+			c.state.set(StateChanAttached, newError(ErrTimeoutError, errDetachTimeout))
+		}
+	})
+}
+
+// retryAttach reattaches the channel, which was suspended after the given
+// attach attempt has timed out.
+func (c *RealtimeChannel) retryAttach(attempt int) {
+	c.state.Lock()
+	retry := c.attempt == attempt && c.state.current == StateChanSuspended
+	c.state.Unlock()
+	if retry && c.client.Connection.State() == StateConnConnected {
+		c.reattach(nil)
+	}
+}
+
+// attachMessage gives an ATTACH message carrying the channel params, modes
+// and the serial to attach from, if any.
+func (c *RealtimeChannel) attachMessage() *proto.ProtocolMessage {
+	msg := &proto.ProtocolMessage{
+		Action:  proto.ActionAttach,
+		Channel: c.state.channel,
+	}
+	if opts := c.channelOptions(); opts != nil {
+		msg.Params = opts.Params
+		msg.Flags = proto.ModeFlags(opts.Modes)
+	}
+	// A reattached channel resumes from the last message it received,
+	// so that no messages are lost; a channel of a recovered connection
+	// continues from where it left off.
+	//
+	// Spec RTL4c1
+	msg.ChannelSerial = c.serial
+	if msg.ChannelSerial == "" {
+		msg.ChannelSerial = c.client.Connection.recoveredSerial(c.Name)
+	}
+	return msg
+}
+
 // Attach initiates attach request, which is being processed on a separate
 // goroutine.
 //
@@ -144,8 +325,19 @@ func (c *RealtimeChannel) Attach() (Result, error) {
 	return c.attach(true)
 }
 
+// AttachCtx attaches the channel and blocks until it's attached or ctx is
+// done, in which case ctx.Err() is returned. Cancelling ctx does not abort
+// the attach request itself.
+func (c *RealtimeChannel) AttachCtx(ctx context.Context) error {
+	res, err := c.Attach()
+	return waitCtx(ctx, res, err)
+}
+
 var attachResultStates = []StateEnum{
 	StateChanAttached, // expected state
+	StateChanSuspended,
+	StateChanDetaching,
+	StateChanDetached,
 	StateChanClosing,
 	StateChanClosed,
 	StateChanFailed,
@@ -155,6 +347,9 @@ func (c *RealtimeChannel) attach(result bool) (Result, error) {
 	c.state.Lock()
 	defer c.state.Unlock()
 	if c.isActive() {
+		if result && c.state.current == StateChanAttaching {
+			return c.state.listenResult(attachResultStates...), nil
+		}
 		return nopResult, nil
 	}
 	if !c.client.Connection.lockIsActive() {
@@ -165,14 +360,11 @@ func (c *RealtimeChannel) attach(result bool) (Result, error) {
 	if result {
 		res = c.state.listenResult(attachResultStates...)
 	}
-	msg := &proto.ProtocolMessage{
-		Action:  proto.ActionAttach,
-		Channel: c.state.channel,
-	}
-	err := c.client.Connection.send(msg, nil)
+	err := c.client.Connection.send(c.attachMessage(), nil)
 	if err != nil {
 		return nil, c.state.set(StateChanFailed, err)
 	}
+	c.startTimeout(StateChanAttaching)
 	return res, nil
 }
 
@@ -189,6 +381,7 @@ func (c *RealtimeChannel) Detach() (Result, error) {
 
 var detachResultStates = []StateEnum{
 	StateChanDetached, // expected state
+	StateChanAttached,
 	StateChanClosing,
 	StateChanClosed,
 	StateChanFailed,
@@ -206,6 +399,11 @@ func (c *RealtimeChannel) detach(result bool) (Result, error) {
 	if !c.client.Connection.lockIsActive() {
 		return nil, c.state.set(StateChanFailed, errDetach)
 	}
+	// Detaching cancels a pending attach along with the messages waiting
+	// for it.
+	if c.state.current == StateChanAttaching {
+		c.queue.Fail(newError(ErrChannelOperationFailed, errAttachCancelled))
+	}
 	c.state.set(StateChanDetaching, nil)
 	var res Result
 	if result {
@@ -219,6 +417,7 @@ func (c *RealtimeChannel) detach(result bool) (Result, error) {
 	if err != nil {
 		return nil, c.state.set(StateChanFailed, err)
 	}
+	c.startTimeout(StateChanDetaching)
 	return res, nil
 }
 
@@ -239,16 +438,35 @@ func (c *RealtimeChannel) Close() error {
 // Subscribe subscribes to a realtime channel, which makes any newly received
 // messages relayed to the returned Subscription value.
 //
-// If no names are given, returned Subscription will receive all messages.
-// If ch is non-nil and it was already registered to receive messages with different
-// names than the ones given, it will be added to receive also the new ones.
+// If no names are given, returned Subscription will receive all messages,
+// otherwise only the messages with one of the given names are relayed.
+//
+// All subscriptions share a single attachment of the channel; closing a
+// subscription stops the delivery without detaching the channel.
+//
+// If the channel is not attached, Subscribe implicitly attaches it, unless
+// the channel's options have got NoAttachOnSubscribe set. A publish-only
+// channel (see proto.ChannelOptions.IsPublishOnly) is never attached and its
+// subscriptions get no messages.
 func (c *RealtimeChannel) Subscribe(names ...string) (*Subscription, error) {
-	if _, err := c.attach(false); err != nil {
+	if err := c.attachOnSubscribe(); err != nil {
 		return nil, err
 	}
 	return c.subs.subscribe(namesToKeys(names)...)
 }
 
+// attachOnSubscribe implicitly attaches the channel for a new subscription,
+// unless disabled with the NoAttachOnSubscribe channel option.
+//
+// Spec RTL7c, RTP6c
+func (c *RealtimeChannel) attachOnSubscribe() error {
+	if opts := c.channelOptions(); opts != nil && (opts.NoAttachOnSubscribe || opts.IsPublishOnly()) {
+		return nil
+	}
+	_, err := c.attach(false)
+	return err
+}
+
 // Unsubscribe removes previous Subscription for the given message names.
 //
 // Unsubscribe panics if the given sub was subscribed for presence messages and
@@ -281,6 +499,24 @@ func (c *RealtimeChannel) Off(ch chan<- State, states ...StateEnum) {
 	c.state.off(ch, states...)
 }
 
+// OnDecodeError registers fn to be called with each received message whose
+// payload failed to decode, for example because the channel has no or wrong
+// cipher params, or the message uses an unsupported encoding. The message
+// holds the payload and the encodings that weren't decoded yet.
+//
+// Messages that failed to decode are still delivered to the subscribers
+// (Spec RTL7e), except for vcdiff deltas that could not be applied, which
+// make the channel reattach instead (Spec RTL18).
+//
+// The fn is called from the goroutine which reads messages from the
+// connection, so it must not block. If fn is nil, a previously registered
+// function is removed.
+func (c *RealtimeChannel) OnDecodeError(fn func(*proto.Message, error)) {
+	c.optionsMtx.Lock()
+	c.onDecodeErr = fn
+	c.optionsMtx.Unlock()
+}
+
 // Publish publishes a message on the channel, which is send on separate
 // goroutine. Publish does not block.
 //
@@ -289,16 +525,72 @@ func (c *RealtimeChannel) Publish(name string, data interface{}) (Result, error)
 	return c.PublishAll([]*proto.Message{{Name: name, Data: data}})
 }
 
+// PublishOption sets optional fields of a message published with
+// PublishWithOptions.
+type PublishOption func(*proto.Message)
+
+// PublishWithClientID publishes the message on behalf of the given client.
+// It's allowed only when the library's clientId is a wildcard, unset or
+// equal to the given one; otherwise publishing fails with ErrInvalidClientID.
+//
+// Spec RTL6g
+func PublishWithClientID(clientID string) PublishOption {
+	return func(m *proto.Message) {
+		m.ClientID = clientID
+	}
+}
+
+// PublishWithOptions publishes a message on the channel with the optional
+// fields set by the given options, e.g. PublishWithClientID. Like Publish,
+// it does not block.
+func (c *RealtimeChannel) PublishWithOptions(name string, data interface{}, options ...PublishOption) (Result, error) {
+	m := &proto.Message{Name: name, Data: data}
+	for _, o := range options {
+		o(m)
+	}
+	return c.PublishAll([]*proto.Message{m})
+}
+
+// PublishCtx publishes a message on the channel and blocks until it's
+// acknowledged or ctx is done, in which case ctx.Err() is returned.
+//
+// A message which was not sent yet when ctx is done is dropped; otherwise
+// the server may still receive it.
+func (c *RealtimeChannel) PublishCtx(ctx context.Context, name string, data interface{}) error {
+	res, err := c.Publish(name, data)
+	return waitCtx(ctx, res, err)
+}
+
 // PublishAll publishes all given messages on the channel at once.
 // PublishAll does not block.
 //
-// This implicitly attaches the channel if it's not already attached.
+// The messages are sent in a single protocol message, so the returned
+// result is resolved by a single acknowledgement for all of them. The
+// clientId, payload and size checks apply to the whole batch: if any
+// message fails them, none is sent.
+//
+// This implicitly attaches the channel if it's not already attached, except
+// for a publish-only channel, whose messages are sent without attaching.
 func (c *RealtimeChannel) PublishAll(messages []*proto.Message) (Result, error) {
-	id := c.client.Auth.clientIDForCheck()
-	for _, v := range messages {
-		if v.ClientID != "" && id != wildcardClientID && v.ClientID != id {
-			// Spec RSL1g3,RSL1g4
-			return nil, fmt.Errorf("Unable to publish message containing a clientId (%s) that is incompatible with the library clientId (%s)", v.ClientID, id)
+	if err := checkClientIDs(c.client.Auth.clientIDForCheck(), messages); err != nil {
+		return nil, err
+	}
+	if err := checkPayloads(messages); err != nil {
+		return nil, err
+	}
+	if err := checkMessageSize(c.client.Connection.MaxMessageSize(), messages); err != nil {
+		return nil, err
+	}
+	if opts := c.channelOptions(); opts != nil {
+		for _, v := range messages {
+			v.ChannelOptions = opts
+		}
+	}
+	if c.opts().idempotentRestPublishing() {
+		// Message IDs are assigned once, so that the messages resent after
+		// the connection is resumed are deduplicated by the server.
+		if err := setIdempotentIDs(messages); err != nil {
+			return nil, err
 		}
 	}
 	msg := &proto.ProtocolMessage{
@@ -306,6 +598,9 @@ func (c *RealtimeChannel) PublishAll(messages []*proto.Message) (Result, error)
 		Channel:  c.state.channel,
 		Messages: messages,
 	}
+	if opts := c.channelOptions(); opts.IsPublishOnly() {
+		return c.sendPublishOnly(msg)
+	}
 	return c.send(msg)
 }
 
@@ -313,21 +608,44 @@ func (c *RealtimeChannel) PublishAll(messages []*proto.Message) (Result, error)
 // The returned result can be inspected for the messages via the Messages()
 // method.
 func (c *RealtimeChannel) History(params *PaginateParams) (*PaginatedResult, error) {
-	return c.client.rest.Channels.Get(c.Name, nil).History(params)
+	return c.client.rest.Channels.Get(c.Name, c.channelOptions()).History(params)
 }
 
 func (c *RealtimeChannel) send(msg *proto.ProtocolMessage) (Result, error) {
-	if _, err := c.attach(false); err != nil {
+	res, listen := newErrResult()
+	if err := c.sendTo(msg, listen, res); err != nil {
 		return nil, err
 	}
-	res, listen := newErrResult()
+	return res, nil
+}
+
+// sendTo sends msg once the channel is attached, notifying listen of its
+// ACK or NACK; res.cancel is set to stop listen from being notified.
+func (c *RealtimeChannel) sendTo(msg *proto.ProtocolMessage, listen chan<- error, res *errResult) error {
+	if _, err := c.attach(false); err != nil {
+		return err
+	}
+	res.cancel = func() {
+		c.queue.Remove(listen)
+		c.client.Connection.cancelPending(listen)
+	}
 	switch c.State() {
 	case StateChanInitialized, StateChanAttaching:
 		c.queue.Enqueue(msg, listen)
-		return res, nil
+		return nil
 	case StateChanAttached:
 	default:
-		return nil, &Error{Code: 90001}
+		return &Error{Code: 90001}
+	}
+	return c.client.Connection.send(msg, listen)
+}
+
+// sendPublishOnly sends msg over the connection without attaching the
+// channel; the returned result is still resolved by the message's ACK or NACK.
+func (c *RealtimeChannel) sendPublishOnly(msg *proto.ProtocolMessage) (Result, error) {
+	res, listen := newErrResult()
+	res.cancel = func() {
+		c.client.Connection.cancelPending(listen)
 	}
 	if err := c.client.Connection.send(msg, listen); err != nil {
 		return nil, err
@@ -349,31 +667,310 @@ func (c *RealtimeChannel) Reason() error {
 	return c.state.err
 }
 
+// Params gives the channel parameters, like "rewind" or "delta", which were
+// accepted by the server when the channel was last attached. They may differ
+// from the requested ones, e.g. when the server doesn't support some of them.
+// The returned map is a copy.
+//
+// Spec RTL4k1
+func (c *RealtimeChannel) Params() map[string]string {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.params == nil {
+		return nil
+	}
+	params := make(map[string]string, len(c.params))
+	for k, v := range c.params {
+		params[k] = v
+	}
+	return params
+}
+
+// Modes gives the channel modes which were granted by the server when the
+// channel was last attached. The returned slice is a copy.
+//
+// Spec RTL4m
+func (c *RealtimeChannel) Modes() []proto.ChannelMode {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.modes == nil {
+		return nil
+	}
+	modes := make([]proto.ChannelMode, len(c.modes))
+	copy(modes, c.modes)
+	return modes
+}
+
+// Serial gives the channel serial obtained from Ably with the most recently
+// received ATTACHED, MESSAGE or PRESENCE message. Serials increase with every
+// message published on the channel; the serial is reset when the channel
+// attaches without resuming its continuity, detaches or fails.
+//
+// The channel reattaches from its serial, so that the server can resume
+// its continuity.
+//
+// Spec RTL15b
+func (c *RealtimeChannel) Serial() string {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.serial
+}
+
+func (c *RealtimeChannel) updateSerial(msg *proto.ProtocolMessage) {
+	if msg.ChannelSerial == "" && msg.Action != proto.ActionAttached {
+		return
+	}
+	c.state.Lock()
+	c.serial = msg.ChannelSerial
+	c.state.Unlock()
+}
+
 func (c *RealtimeChannel) notify(msg *proto.ProtocolMessage) {
+	switch msg.Action {
+	case proto.ActionAttached, proto.ActionMessage, proto.ActionPresence:
+		c.updateSerial(msg)
+	}
+	switch msg.Action {
+	case proto.ActionAttached, proto.ActionMessage, proto.ActionPresence, proto.ActionSync:
+		// Once the channel is being detached, an ATTACHED for an attach
+		// cancelled by the detach is ignored and no messages are delivered.
+		if c.lockIsDetached() {
+			return
+		}
+	}
 	switch msg.Action {
 	case proto.ActionAttached:
+		c.deltaRecovery = false
 		c.Presence.onAttach(msg)
-		c.state.syncSet(StateChanAttached, nil)
+		var err error
+		if msg.Error != nil {
+			err = newErrorProto(msg.Error)
+		}
+		st := State{State: StateChanAttached, Resumed: msg.Flags.Has(proto.FlagResumed)}
+		c.state.Lock()
+		c.params = msg.Params
+		c.modes = msg.Flags.Modes()
+		if c.state.current == StateChanAttached && !st.Resumed {
+			// The channel lost its continuity while attached, which is
+			// reported to let the application resynchronize its state.
+			//
+			// Spec RTL12
+			c.state.update(st, err)
+		} else {
+			c.state.transition(st, err)
+		}
+		c.state.Unlock()
 		c.queue.Flush()
 	case proto.ActionDetached:
-		c.state.syncSet(StateChanDetached, nil)
+		c.state.Lock()
+		c.serial = ""
+		c.state.set(StateChanDetached, nil)
+		c.state.Unlock()
 	case proto.ActionSync:
-		c.Presence.processIncomingMessage(msg, syncSerial(msg))
+		c.decodePresence(msg)
+		c.Presence.processIncomingMessage(msg, true)
 	case proto.ActionPresence:
-		c.Presence.processIncomingMessage(msg, "")
+		c.decodePresence(msg)
+		c.Presence.processIncomingMessage(msg, false)
 	case proto.ActionError:
-		c.state.syncSet(StateChanFailed, newErrorProto(msg.Error))
+		c.state.Lock()
+		c.serial = ""
+		c.state.set(StateChanFailed, newErrorProto(msg.Error))
+		c.state.Unlock()
 		c.queue.Fail(newErrorProto(msg.Error))
 	case proto.ActionMessage:
-		c.subs.messageEnqueue(msg)
+		if c.channelOptions().IsPublishOnly() {
+			return
+		}
+		if c.opts().Dedup && !c.dropDuplicates(msg) {
+			return
+		}
+		if c.decodeMessages(msg) && !c.subs.messageEnqueue(msg) {
+			c.overflow()
+		}
 	default:
 	}
 }
 
+// overflow is called when a subscription of the channel dropped messages,
+// as its queue had ClientOptions.InboundBufferSize messages already; it fails
+// the channel if ClientOptions.FailOnInboundOverflow is set.
+func (c *RealtimeChannel) overflow() {
+	if !c.opts().FailOnInboundOverflow {
+		return
+	}
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.state.current == StateChanFailed {
+		return
+	}
+	c.state.set(StateChanFailed, newErrorf(ErrInternalChannelError, "subscription queue overflowed %d messages", c.opts().InboundBufferSize))
+}
+
+func (c *RealtimeChannel) setOptions(opts *proto.ChannelOptions) {
+	c.optionsMtx.Lock()
+	c.options = opts
+	c.optionsMtx.Unlock()
+}
+
+func (c *RealtimeChannel) channelOptions() *proto.ChannelOptions {
+	c.optionsMtx.Lock()
+	defer c.optionsMtx.Unlock()
+	return c.options
+}
+
+// decodeMessages finishes decoding of the received messages, which are
+// decoded by the connection without knowing the channel's cipher params nor
+// the payloads that delta messages apply to. It reports whether the messages
+// should be delivered to the subscribers.
+//
+// Messages that fail to decrypt are delivered with their remaining encoding
+// retained (Spec RTL7e). A delta that can't be applied makes the channel
+// reattach and drop the messages until it's attached again (Spec RTL18).
+func (c *RealtimeChannel) decodeMessages(msg *proto.ProtocolMessage) bool {
+	if c.deltaRecovery {
+		return false
+	}
+	for i, m := range msg.Messages {
+		if m.ID == "" && msg.ID != "" {
+			// Spec TM2a
+			m.ID = fmt.Sprintf("%s:%d", msg.ID, i)
+		}
+		if m.ConnectionID == "" {
+			// Spec TM2c
+			m.ConnectionID = msg.ConnectionID
+		}
+		if m.Timestamp == 0 {
+			// Spec TM2f
+			m.Timestamp = msg.Timestamp
+		}
+		if err := m.DecodeError(); err != nil {
+			c.decodeFailed(m, err)
+		} else if strings.Contains(m.Encoding, proto.VCDiff) {
+			if err := c.decodeDelta(m); err != nil {
+				c.logger().Printf(LogError, "unable to decode delta message %q from %q on channel %q: %v", m.ID, m.DeltaFrom(), c.Name, err)
+				err = newError(ErrVcdiffDecodeFailure, err)
+				c.notifyDecodeError(m, err)
+				c.deltaRecovery = true
+				c.reattach(err)
+				return false
+			}
+		} else {
+			c.decode(m)
+		}
+		c.lastMessageID = m.ID
+		c.lastPayload = m.DeltaBase()
+	}
+	return true
+}
+
+// dropDuplicates removes from msg the messages whose ID was already seen
+// among the last dedupWindow received messages, which happens when the
+// server replays messages after the connection is resumed. It reports
+// whether any messages are left to be delivered.
+func (c *RealtimeChannel) dropDuplicates(msg *proto.ProtocolMessage) bool {
+	if c.recentIDs == nil {
+		c.recentIDs = make([]string, 0, dedupWindow)
+	}
+	messages := msg.Messages[:0]
+	for i, m := range msg.Messages {
+		if m.ID == "" && msg.ID != "" {
+			// Spec TM2a
+			m.ID = fmt.Sprintf("%s:%d", msg.ID, i)
+		}
+		if m.ID != "" && c.seen(m.ID) {
+			c.logger().Printf(LogVerbose, "dropping duplicate message %q on channel %q", m.ID, c.Name)
+			atomic.AddInt64(&c.duplicates, 1)
+			continue
+		}
+		if m.ID != "" {
+			if len(c.recentIDs) < dedupWindow {
+				c.recentIDs = append(c.recentIDs, m.ID)
+			} else {
+				c.recentIDs[c.recentNext] = m.ID
+				c.recentNext = (c.recentNext + 1) % dedupWindow
+			}
+		}
+		messages = append(messages, m)
+	}
+	msg.Messages = messages
+	return len(messages) != 0
+}
+
+func (c *RealtimeChannel) seen(id string) bool {
+	for _, recent := range c.recentIDs {
+		if recent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DroppedDuplicates gives the number of received messages that were dropped
+// as duplicates of already delivered ones; it's always 0 unless
+// ClientOptions.Dedup is set.
+func (c *RealtimeChannel) DroppedDuplicates() int64 {
+	return atomic.LoadInt64(&c.duplicates)
+}
+
+func (c *RealtimeChannel) decodeDelta(m *proto.Message) error {
+	switch from := m.DeltaFrom(); {
+	case c.lastPayload == nil:
+		return errors.New("no base payload for delta")
+	case from != c.lastMessageID:
+		return fmt.Errorf("delta is from message %q, last received message is %q", from, c.lastMessageID)
+	}
+	return m.DecodeDelta(c.lastPayload, c.channelOptions())
+}
+
+func (c *RealtimeChannel) decodePresence(msg *proto.ProtocolMessage) {
+	for _, m := range msg.Presence {
+		if err := m.DecodeError(); err != nil {
+			c.decodeFailed(&m.Message, err)
+		} else {
+			c.decode(&m.Message)
+		}
+	}
+}
+
+func (c *RealtimeChannel) decode(m *proto.Message) {
+	if m.ChannelOptions != nil || !strings.Contains(m.Encoding, proto.Cipher) {
+		return
+	}
+	opts := c.channelOptions()
+	if opts == nil {
+		c.decodeFailed(m, errNoCipherParams)
+		return
+	}
+	if err := m.Decode(opts); err != nil {
+		c.decodeFailed(m, err)
+	}
+}
+
+func (c *RealtimeChannel) decodeFailed(m *proto.Message, err error) {
+	c.logger().Printf(LogError, "unable to decode message %q with encoding %q on channel %q: %v", m.ID, m.Encoding, c.Name, err)
+	c.notifyDecodeError(m, newError(ErrInvalidMessageDataOrEncoding, err))
+}
+
+func (c *RealtimeChannel) notifyDecodeError(m *proto.Message, err error) {
+	c.optionsMtx.Lock()
+	fn := c.onDecodeErr
+	c.optionsMtx.Unlock()
+	if fn != nil {
+		fn(m, err)
+	}
+}
+
 func (c *RealtimeChannel) isActive() bool {
 	return c.state.current == StateChanAttaching || c.state.current == StateChanAttached
 }
 
+func (c *RealtimeChannel) lockIsDetached() bool {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.state.current == StateChanDetaching || c.state.current == StateChanDetached
+}
+
 func (c *RealtimeChannel) opts() *ClientOptions {
 	return c.client.opts()
 }
@@ -1,15 +1,25 @@
 package ably_test
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ably/ably-go/ably"
 	"github.com/ably/ably-go/ably/ablytest"
 	"github.com/ably/ably-go/ably/proto"
+	"golang.org/x/net/websocket"
 )
 
 func expectMsg(ch <-chan *proto.Message, name string, data interface{}, t time.Duration, received bool) error {
@@ -33,6 +43,75 @@ func expectMsg(ch <-chan *proto.Message, name string, data interface{}, t time.D
 	}
 }
 
+func TestRealtimeChannels(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+
+	if client.Channels.Exists("test") {
+		t.Fatal("want channel not to exist before Get")
+	}
+	channel := client.Channels.Get("test")
+	if other := client.Channels.Get("test"); other != channel {
+		t.Fatal("want Get to return the same channel for the same name")
+	}
+	var wg sync.WaitGroup
+	got := make([]*ably.RealtimeChannel, 16)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i] = client.Channels.Get("concurrent")
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range got {
+		if c != got[0] {
+			t.Fatal("want concurrent Get to return the same channel")
+		}
+	}
+	if !client.Channels.Exists("test") || !client.Channels.Exists("concurrent") {
+		t.Fatal("want channels to exist after Get")
+	}
+	var names []string
+	for _, c := range client.Channels.Iterate() {
+		names = append(names, c.Name)
+	}
+	if want := []string{"concurrent", "test"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("want Iterate()=%v; got %v", want, names)
+	}
+
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	released := make(chan error, 1)
+	go func() { released <- client.Channels.Release("test") }()
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	// The channel is removed only once detached.
+	if !client.Channels.Exists("test") {
+		t.Fatal("want channel to exist while detaching")
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "test"}
+	if err := <-released; err != nil {
+		t.Fatalf("Release()=%v", err)
+	}
+	if state := channel.State(); state != ably.StateChanDetached {
+		t.Fatalf("want released channel to be detached; got %v", state)
+	}
+	if client.Channels.Exists("test") {
+		t.Fatal("want channel not to exist after Release")
+	}
+	if other := client.Channels.Get("test"); other == channel {
+		t.Fatal("want Get to create a new channel after Release")
+	}
+	if err := client.Channels.Release("missing"); err != nil {
+		t.Fatalf("Release()=%v for a missing channel", err)
+	}
+}
+
 func TestRealtimeChannel_Publish(t *testing.T) {
 	t.Parallel()
 	app, client := ablytest.NewRealtimeClient(nil)
@@ -129,6 +208,90 @@ func TestRealtimeChannel_Subscribe(t *testing.T) {
 	}
 }
 
+func TestRealtimeChannel_ConnectionID(t *testing.T) {
+	t.Parallel()
+	app, publisher := ablytest.NewRealtimeClient(nil)
+	defer safeclose(t, publisher, app)
+	subscriber := app.NewRealtimeClient()
+	defer safeclose(t, subscriber)
+
+	channel := subscriber.Channels.Get("persisted:connection-id")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if err := ablytest.Wait(publisher.Channels.Get("persisted:connection-id").Publish("hello", "data")); err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	id := publisher.Connection.ID()
+	select {
+	case m := <-sub.MessageChannel():
+		if m.ConnectionID != id {
+			t.Errorf("want received ConnectionID=%q; got %q", id, m.ConnectionID)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for message timed out")
+	}
+	for deadline := time.Now().Add(ablytest.Timeout); ; time.Sleep(100 * time.Millisecond) {
+		page, err := channel.History(nil)
+		if err != nil {
+			t.Fatalf("History()=%v", err)
+		}
+		if msgs := page.Messages(); len(msgs) == 1 {
+			if msgs[0].ConnectionID != id {
+				t.Errorf("want history ConnectionID=%q; got %q", id, msgs[0].ConnectionID)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting for the message in history timed out")
+		}
+	}
+}
+
+// The connectionId of the messages is taken from the protocol message
+// they're delivered in, unless set.
+//
+// Spec TM2c
+func TestRealtimeChannel_ConnectionIDFromProtocolMessage(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionMessage,
+		Channel:      "test",
+		ConnectionID: "publisher",
+		Messages: []*proto.Message{
+			{Name: "inherited"},
+			{Name: "own", ConnectionID: "other"},
+		},
+	}
+	for _, want := range []string{"publisher", "other"} {
+		select {
+		case m := <-sub.MessageChannel():
+			if m.ConnectionID != want {
+				t.Errorf("%s: want ConnectionID=%q; got %q", m.Name, want, m.ConnectionID)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatal("waiting for message timed out")
+		}
+	}
+}
+
 var chanCloseTransitions = [][]ably.StateEnum{{
 	ably.StateConnConnecting,
 	ably.StateChanAttaching,
@@ -203,3 +366,1871 @@ func TestRealtimeChannel_Close(t *testing.T) {
 	}
 	t.Error(err)
 }
+
+func TestRealtimeChannel_IdempotentPublish(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:                true,
+		IdempotentRestPublishing: true,
+		Dial:                     dropConnDial(conns, out),
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	channel := client.Channels.Get("test")
+	messages := []*proto.Message{
+		{Name: "first"},
+		{Name: "second"},
+	}
+	if _, err := channel.PublishAll(messages); err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	for msg := range out {
+		if msg.Action != proto.ActionMessage {
+			continue
+		}
+		if len(msg.Messages) != 2 {
+			t.Fatalf("want 2 messages; got %d", len(msg.Messages))
+		}
+		for i, m := range msg.Messages {
+			if m.ID == "" || m.ID != messages[i].ID {
+				t.Errorf("%d: want id=%q; got %q", i, messages[i].ID, m.ID)
+			}
+			if want := fmt.Sprintf(":%d", i); m.ID[len(m.ID)-len(want):] != want {
+				t.Errorf("%d: want ID with %s index suffix; got %q", i, want, m.ID)
+			}
+		}
+		break
+	}
+}
+
+func TestRealtimeChannel_PublishAllOneFrame(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{ClientID: "client"})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message with an incompatible clientId rejects the whole batch.
+	_, err = channel.PublishAll([]*proto.Message{
+		{Name: "valid", Data: "data", ClientID: "client"},
+		{Name: "invalid", Data: "data", ClientID: "other"},
+	})
+	if err := checkError(ably.ErrInvalidClientID, err); err != nil {
+		t.Fatalf("PublishAll(): %v", err)
+	}
+
+	names := []string{"first", "second", "third"}
+	var messages []*proto.Message
+	for _, name := range names {
+		messages = append(messages, &proto.Message{Name: name, Data: "data"})
+	}
+	res, err := channel.PublishAll(messages)
+	if err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	msg, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Messages) != len(names) {
+		t.Fatalf("want %d messages in one frame; got %d", len(names), len(msg.Messages))
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("want a single frame sent; got another %s", msg.Action)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The server echoes the messages back in the order they were sent.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", Messages: msg.Messages}
+	for _, name := range names {
+		if err := expectMsg(sub.MessageChannel(), name, "data", ablytest.Timeout, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("want the batch acknowledged; got %v", err)
+	}
+}
+
+func TestRealtimeChannel_Encryption(t *testing.T) {
+	t.Parallel()
+	key, err := ably.GenerateRandomKey(128)
+	if err != nil {
+		t.Fatalf("GenerateRandomKey()=%v", err)
+	}
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", &proto.ChannelOptions{
+		Cipher: proto.CipherParams{Key: key, Algorithm: proto.AES},
+	})
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if _, err := channel.Publish("secret", "hello"); err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	msg, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal()=%v", err)
+	}
+
+	// Echo the message back the way the server would relay it to
+	// the subscribers.
+	var echo proto.ProtocolMessage
+	if err := json.Unmarshal(b, &echo); err != nil {
+		t.Fatalf("Unmarshal()=%v", err)
+	}
+	if want, got := "utf-8/cipher+aes-128-cbc", echo.Messages[0].Encoding; got != want {
+		t.Fatalf("want encoding=%q; got %q", want, got)
+	}
+	if data, ok := echo.Messages[0].Data.([]byte); !ok || string(data) == "hello" {
+		t.Fatalf("want encrypted payload; got %#v", echo.Messages[0].Data)
+	}
+	conn.in <- &echo
+	select {
+	case m := <-sub.MessageChannel():
+		if m.Data != "hello" {
+			t.Fatalf("want data=%q; got %#v", "hello", m.Data)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for message timed out")
+	}
+}
+
+func TestRealtimeChannel_SubscribeByName(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	all, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer all.Close()
+	named, err := channel.Subscribe("greeting")
+	if err != nil {
+		t.Fatalf("Subscribe(greeting)=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	receive := func(sub *ably.Subscription) (*proto.Message, error) {
+		select {
+		case m := <-sub.MessageChannel():
+			return m, nil
+		case <-time.After(ablytest.Timeout):
+			return nil, errors.New("waiting for message timed out")
+		}
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionMessage,
+		Channel: "test",
+		Messages: []*proto.Message{
+			{Name: "other", Data: "1"},
+			{Name: "greeting", Data: "2"},
+		},
+	}
+	for _, want := range []string{"1", "2"} {
+		m, err := receive(all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Data != want {
+			t.Errorf("all: want data=%q; got %v", want, m.Data)
+		}
+	}
+	m, err := receive(named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "greeting" || m.Data != "2" {
+		t.Errorf("named: want greeting message; got name=%q data=%v", m.Name, m.Data)
+	}
+
+	// Unsubscribing the named subscription neither detaches the channel
+	// nor stops delivery to the remaining subscriptions.
+	channel.Unsubscribe(named, "greeting")
+	if _, ok := <-named.MessageChannel(); ok {
+		t.Error("want named subscription closed")
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:   proto.ActionMessage,
+		Channel:  "test",
+		Messages: []*proto.Message{{Name: "greeting", Data: "3"}},
+	}
+	if m, err := receive(all); err != nil {
+		t.Fatal(err)
+	} else if m.Data != "3" {
+		t.Errorf("all: want data=%q; got %v", "3", m.Data)
+	}
+	if state := channel.State(); state != ably.StateChanAttached {
+		t.Errorf("want channel state=%v; got %v", ably.StateChanAttached, state)
+	}
+	select {
+	case msg := <-out:
+		t.Errorf("want no messages sent; got %v", msg.Action)
+	default:
+	}
+}
+
+// vcdiffDelta encodes target as a delta, which copies the first keep bytes of
+// source and adds the rest of target.
+func vcdiffDelta(source, target string, keep int) []byte {
+	insts := []byte{19, byte(keep), 1, byte(len(target) - keep)}
+	data := []byte(target[keep:])
+	enc := []byte{byte(len(target)), 0x00, byte(len(data)), byte(len(insts)), 1}
+	enc = append(enc, data...)
+	enc = append(enc, insts...)
+	enc = append(enc, 0) // copy address
+	delta := []byte{0xD6, 0xC3, 0xC4, 0x00, 0x00, 0x01, byte(len(source)), 0x00, byte(len(enc))}
+	return append(delta, enc...)
+}
+
+// receivedMessage gives a protocol message decoded the same way as one
+// received by the connection.
+func receivedMessage(t *testing.T, id string, messages ...map[string]interface{}) *proto.ProtocolMessage {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{
+		"action":   proto.ActionMessage,
+		"channel":  "test",
+		"id":       id,
+		"messages": messages,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg proto.ProtocolMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func deltaMessage(from, source, target string, keep int) map[string]interface{} {
+	return map[string]interface{}{
+		"data":     base64.StdEncoding.EncodeToString(vcdiffDelta(source, target, keep)),
+		"encoding": "json/vcdiff/base64",
+		"extras": map[string]interface{}{
+			"delta": map[string]interface{}{"from": from, "format": "vcdiff"},
+		},
+	}
+}
+
+func TestRealtimeChannel_DeltaDecoding(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", &proto.ChannelOptions{
+		Params: map[string]string{"delta": "vcdiff"},
+	})
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	attach, err := expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta := attach.Params["delta"]; delta != "vcdiff" {
+		t.Fatalf("want ATTACH with delta=vcdiff param; got %v", attach.Params)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	expect := func(id string, n float64) {
+		t.Helper()
+		select {
+		case m := <-sub.MessageChannel():
+			if m.ID != id {
+				t.Errorf("want id=%q; got %q", id, m.ID)
+			}
+			if data, ok := m.Data.(map[string]interface{}); !ok || data["n"] != n {
+				t.Errorf("%s: want data n=%v; got %#v", id, n, m.Data)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for message %s timed out", id)
+		}
+	}
+
+	conn.in <- receivedMessage(t, "msg1", map[string]interface{}{
+		"data":     `{"n":1}`,
+		"encoding": "json",
+	})
+	expect("msg1:0", 1)
+	conn.in <- receivedMessage(t, "msg2",
+		deltaMessage("msg1:0", `{"n":1}`, `{"n":12}`, 6),
+		deltaMessage("msg2:0", `{"n":12}`, `{"n":123}`, 7),
+	)
+	expect("msg2:0", 12)
+	expect("msg2:1", 123)
+
+	// A delta which doesn't apply to the last received message makes the
+	// channel reattach and drop messages until it's attached again.
+	conn.in <- receivedMessage(t, "msg3", deltaMessage("msg1:0", `{"n":1}`, `{"n":14}`, 6))
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkError(ably.ErrVcdiffDecodeFailure, channel.Reason()); err != nil {
+		t.Error(err)
+	}
+	if state := channel.State(); state != ably.StateChanAttaching {
+		t.Errorf("want state=%v; got %v", ably.StateChanAttaching, state)
+	}
+	conn.in <- receivedMessage(t, "msg4", deltaMessage("msg3:0", `{"n":14}`, `{"n":145}`, 7))
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	conn.in <- receivedMessage(t, "msg5", map[string]interface{}{
+		"data":     `{"n":5}`,
+		"encoding": "json",
+	})
+	expect("msg5:0", 5)
+}
+
+func TestRealtimeChannel_StateChanges(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	states := make(chan ably.State, 10)
+	channel.On(states)
+	expect := func(state ably.StateEnum) ably.State {
+		t.Helper()
+		select {
+		case st := <-states:
+			if st.State != state {
+				t.Fatalf("want state=%v; got %v", state, st.State)
+			}
+			return st
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for %v timed out", state)
+		}
+		return ably.State{}
+	}
+
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	expect(ably.StateChanAttaching)
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if st := expect(ably.StateChanAttached); st.Resumed {
+		t.Error("want Resumed=false for the initial attach")
+	}
+
+	if _, err := channel.Detach(); err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	expect(ably.StateChanDetaching)
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "test"}
+	expect(ably.StateChanDetached)
+
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	expect(ably.StateChanAttaching)
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+		Flags:   proto.FlagResumed,
+	}
+	if st := expect(ably.StateChanAttached); !st.Resumed || st.Previous != ably.StateChanAttaching {
+		t.Errorf("want Resumed=true, Previous=%v; got %+v", ably.StateChanAttaching, st)
+	}
+
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionError,
+		Channel: "test",
+		Error:   &proto.ErrorInfo{StatusCode: 400, Code: 40160, Message: "denied"},
+	}
+	if err := checkError(40160, expect(ably.StateChanFailed).Err); err != nil {
+		t.Error(err)
+	}
+
+	// No further state changes are delivered once the listener is removed.
+	channel.Off(states)
+	channel.Attach()
+	select {
+	case st := <-states:
+		t.Errorf("unexpected state change after Off: %+v", st)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRealtimeChannel_AttachParams(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", &proto.ChannelOptions{
+		Params: map[string]string{"rewind": "5"},
+	})
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	attach, err := expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewind := attach.Params["rewind"]; rewind != "5" {
+		t.Fatalf("want ATTACH with rewind=5 param; got %v", attach.Params)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+		Params:  map[string]string{"rewind": "5"},
+	}
+	if err := res.Wait(); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	if params := channel.Params(); !reflect.DeepEqual(params, attach.Params) {
+		t.Errorf("want Params()=%v; got %v", attach.Params, params)
+	}
+	channel.Params()["rewind"] = "1"
+	if rewind := channel.Params()["rewind"]; rewind != "5" {
+		t.Errorf("want Params() to be a copy; got rewind=%s", rewind)
+	}
+
+	// The params confirmed by the server take precedence over the
+	// requested ones.
+	if _, err := channel.Detach(); err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanDetached); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+		Params:  map[string]string{"rewind": "2"},
+	}
+	if err := res.Wait(); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	if want, params := map[string]string{"rewind": "2"}, channel.Params(); !reflect.DeepEqual(params, want) {
+		t.Errorf("want Params()=%v; got %v", want, params)
+	}
+}
+
+func TestRealtimeChannel_AttachModes(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", &proto.ChannelOptions{
+		Modes: []proto.ChannelMode{proto.ChannelModeSubscribe},
+	})
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	attach, err := expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attach.Flags != proto.FlagModeSubscribe {
+		t.Fatalf("want ATTACH with flags=%d; got %d", proto.FlagModeSubscribe, attach.Flags)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+		Flags:   proto.FlagResumed | proto.FlagModeSubscribe,
+	}
+	if err := res.Wait(); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	want := []proto.ChannelMode{proto.ChannelModeSubscribe}
+	if modes := channel.Modes(); !reflect.DeepEqual(modes, want) {
+		t.Errorf("want Modes()=%v; got %v", want, modes)
+	}
+	channel.Modes()[0] = proto.ChannelModePublish
+	if modes := channel.Modes(); !reflect.DeepEqual(modes, want) {
+		t.Errorf("want Modes() to be a copy; got %v", modes)
+	}
+}
+
+func TestRealtimeChannel_Rewind(t *testing.T) {
+	t.Parallel()
+	app, client1 := ablytest.NewRealtimeClient(nil)
+	defer safeclose(t, client1, app)
+
+	channel1 := client1.Channels.Get("test")
+	for i := 0; i < 3; i++ {
+		if err := ablytest.Wait(channel1.Publish("rewind", fmt.Sprint(i))); err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+	}
+
+	client2 := app.NewRealtimeClient(nil)
+	defer safeclose(t, client2)
+	channel2 := client2.Channels.Get("test", &proto.ChannelOptions{
+		Params: map[string]string{"rewind": "2"},
+	})
+	sub, err := channel2.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+
+	timeout := 15 * time.Second
+	for _, data := range []string{"1", "2"} {
+		if err := expectMsg(sub.MessageChannel(), "rewind", data, timeout, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expectMsg(sub.MessageChannel(), "rewind", "", time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	if rewind := channel2.Params()["rewind"]; rewind != "2" {
+		t.Errorf("want rewind=2 param; got %v", channel2.Params())
+	}
+}
+
+func TestRealtimeChannel_Serial(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	if serial := channel.Serial(); serial != "" {
+		t.Errorf("want empty serial before attach; got %q", serial)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionAttached,
+		Channel:       "test",
+		ChannelSerial: "abc:0",
+	}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if serial := channel.Serial(); serial != "abc:0" {
+		t.Errorf("want serial=%q; got %q", "abc:0", serial)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionMessage,
+		Channel:       "test",
+		ChannelSerial: "abc:1",
+		Messages:      []*proto.Message{{Name: "name", Data: "data"}},
+	}
+	if err := expectMsg(sub.MessageChannel(), "name", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+	if serial := channel.Serial(); serial != "abc:1" {
+		t.Errorf("want serial=%q; got %q", "abc:1", serial)
+	}
+}
+
+func TestRealtimeChannel_SuspendedReattach(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	dial := dropConnDial(conns, out)
+	var mtx sync.Mutex
+	unreachable := false
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:              ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:                true,
+		DisconnectedRetryTimeout: 10 * time.Millisecond,
+		SuspendedRetryTimeout:    10 * time.Millisecond,
+		TimeoutSuspended:         50 * time.Millisecond,
+		Dial: func(protocol string, u *url.URL) (proto.Conn, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if unreachable {
+				return nil, errors.New("network unreachable")
+			}
+			return dial(protocol, u)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	attach := func(name string) *ably.RealtimeChannel {
+		t.Helper()
+		channel := client.Channels.Get(name)
+		res, err := channel.Attach()
+		if err != nil {
+			t.Fatalf("Attach()=%v", err)
+		}
+		if _, err := expectAction(out, proto.ActionAttach); err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: name}
+		if err := ablytest.Wait(res, nil); err != nil {
+			t.Fatalf("Attach()=%v", err)
+		}
+		return channel
+	}
+	attached := attach("attached")
+	detached := attach("detached")
+	res, err := detached.Detach()
+	if err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "detached"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	sub, err := attached.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	states := make(chan ably.State, 16)
+	attached.On(states)
+
+	// The connection can't be reestablished for longer than the connection
+	// state TTL, so it gets suspended along with the attached channel.
+	mtx.Lock()
+	unreachable = true
+	mtx.Unlock()
+	conn.drop()
+	if err := await(client.Connection.State, ably.StateConnSuspended); err != nil {
+		t.Fatal(err)
+	}
+	if err := await(attached.State, ably.StateChanSuspended); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	unreachable = false
+	mtx.Unlock()
+	conn = <-conns
+	if resume := conn.url.Query().Get("resume"); resume != "" {
+		t.Errorf("want suspended connection not resumed; got resume=%q", resume)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "new-connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+	}
+	msg, err := expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Channel != "attached" {
+		t.Fatalf("want only the attached channel reattached; got ATTACH for %q", msg.Channel)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "attached"}
+	if err := await(attached.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	want := []ably.StateEnum{
+		ably.StateChanSuspended,
+		ably.StateChanAttaching,
+		ably.StateChanAttached,
+	}
+	for _, want := range want {
+		select {
+		case st := <-states:
+			if st.State != want {
+				t.Fatalf("want state=%v; got %v", want, st.State)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for %v timed out", want)
+		}
+	}
+	if state := detached.State(); state != ably.StateChanDetached {
+		t.Errorf("want explicitly detached channel to stay %v; got %v", ably.StateChanDetached, state)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:   proto.ActionMessage,
+		Channel:  "attached",
+		Messages: []*proto.Message{{Name: "name", Data: "data"}},
+	}
+	if err := expectMsg(sub.MessageChannel(), "name", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeChannel_RequestTimeout(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	dial := dropConnDial(conns, out)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:            ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:              true,
+		RealtimeRequestTimeout: 50 * time.Millisecond,
+		ChannelRetryTimeout:    50 * time.Millisecond,
+		Dial: func(protocol string, u *url.URL) (proto.Conn, error) {
+			conn, err := dial(protocol, u)
+			return closeConn{conn.(*dropConn), nil}, err
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+
+	// An unanswered attach suspends the channel, which is then reattached.
+	channel := client.Channels.Get("test")
+	if err := checkError(ably.ErrTimeoutError, ablytest.Wait(channel.Attach())); err != nil {
+		t.Fatal(err)
+	}
+	if state := channel.State(); state != ably.StateChanSuspended {
+		t.Fatalf("want state=%v; got %v", ably.StateChanSuspended, state)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unanswered detach leaves the channel attached.
+	if err := checkError(ably.ErrTimeoutError, ablytest.Wait(channel.Detach())); err != nil {
+		t.Fatal(err)
+	}
+	if state := channel.State(); state != ably.StateChanAttached {
+		t.Fatalf("want state=%v; got %v", ably.StateChanAttached, state)
+	}
+}
+
+func TestRealtimeChannel_SingleAttach(t *testing.T) {
+	t.Parallel()
+	rec := ablytest.NewMessageRecorder()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:   true,
+		Dial:        rec.Hijack(dropConnDial(conns, out)),
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test", nil)
+	for _, name := range []string{"a", "b"} {
+		sub, err := channel.Subscribe(name)
+		if err != nil {
+			t.Fatalf("Subscribe(%q)=%v", name, err)
+		}
+		defer sub.Close()
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+	}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := channel.Subscribe("c")
+	if err != nil {
+		t.Fatalf("Subscribe(%q)=%v", "c", err)
+	}
+	defer sub.Close()
+	if n := len(rec.FramesByAction(proto.ActionAttach)); n != 1 {
+		t.Errorf("want exactly one ATTACH frame; got %d", n)
+	}
+	var actions []proto.Action
+	for _, msg := range rec.Frames() {
+		actions = append(actions, msg.Action)
+	}
+	want := []proto.Action{proto.ActionConnected, proto.ActionAttach, proto.ActionAttached}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("want frames=%v; got %v", want, actions)
+	}
+}
+
+func TestRealtimeChannel_DecodeError(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", nil)
+	type decodeError struct {
+		msg *proto.Message
+		err error
+	}
+	errs := make(chan decodeError, 2)
+	channel.OnDecodeError(func(msg *proto.Message, err error) {
+		errs <- decodeError{msg: msg, err: err}
+	})
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+	}
+	var msg proto.ProtocolMessage
+	frame := `{"channel":"test","messages":[` +
+		`{"id":"custom","data":"payload","encoding":"custom"},` +
+		`{"id":"cipher","data":"cGF5bG9hZA==","encoding":"utf-8/cipher+aes-128-cbc/base64"}]}`
+	if err := json.Unmarshal([]byte(frame), &msg); err != nil {
+		t.Fatalf("Unmarshal()=%v", err)
+	}
+	msg.Action = proto.ActionMessage
+	conn.in <- &msg
+	for _, want := range []struct{ id, encoding string }{
+		{"custom", "custom"},
+		{"cipher", "utf-8/cipher+aes-128-cbc"},
+	} {
+		select {
+		case e := <-errs:
+			if e.msg.ID != want.id || e.msg.Encoding != want.encoding {
+				t.Errorf("want message %q with encoding %q; got %q with %q", want.id, want.encoding, e.msg.ID, e.msg.Encoding)
+			}
+			if err := checkError(ably.ErrInvalidMessageDataOrEncoding, e.err); err != nil {
+				t.Error(err)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for decode error of message %q timed out", want.id)
+		}
+		select {
+		case m := <-sub.MessageChannel():
+			if m.ID != want.id {
+				t.Errorf("want message %q to be delivered; got %q", want.id, m.ID)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for message %q timed out", want.id)
+		}
+	}
+}
+
+func TestRealtimeChannel_PublishWithClientID(t *testing.T) {
+	t.Parallel()
+	t.Run("allowed with wildcard or matching clientId", func(t *testing.T) {
+		cases := []struct {
+			clientID string // clientId of the library
+			sent     string // clientId sent with the message
+		}{
+			{"", "user1"},
+			// The server sets the clientId of the connection itself.
+			{"user1", ""},
+		}
+		for _, cas := range cases {
+			clientID := cas.clientID
+			client, conn, out := newDropConnClient(t, &ably.ClientOptions{ClientID: clientID})
+			defer safeclose(t, client)
+			channel := client.Channels.Get("test")
+			res, err := channel.PublishWithOptions("name", "data", ably.PublishWithClientID("user1"))
+			if err != nil {
+				t.Fatalf("PublishWithOptions()=%v (library clientId=%q)", err, clientID)
+			}
+			if _, err := expectAction(out, proto.ActionAttach); err != nil {
+				t.Fatal(err)
+			}
+			conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+			msg, err := expectAction(out, proto.ActionMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Messages) != 1 || msg.Messages[0].ClientID != cas.sent {
+				t.Fatalf("want a message with clientId=%q; got %v", cas.sent, msg.Messages)
+			}
+			p, err := json.Marshal(msg.Messages[0])
+			if err != nil {
+				t.Fatalf("Marshal()=%v", err)
+			}
+			var m map[string]interface{}
+			if err := json.Unmarshal(p, &m); err != nil {
+				t.Fatalf("Unmarshal()=%v", err)
+			}
+			if id, _ := m["clientId"].(string); id != cas.sent {
+				t.Errorf("want serialized clientId=%q; got %s", cas.sent, p)
+			}
+			conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+			if err := res.Wait(); err != nil {
+				t.Errorf("Wait()=%v", err)
+			}
+		}
+	})
+	t.Run("disallowed with another clientId", func(t *testing.T) {
+		client, _, out := newDropConnClient(t, &ably.ClientOptions{ClientID: "user2"})
+		defer safeclose(t, client)
+		channel := client.Channels.Get("test")
+		_, err := channel.PublishWithOptions("name", "data", ably.PublishWithClientID("user1"))
+		if err := checkError(ably.ErrInvalidClientID, err); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-out:
+			t.Fatalf("want message rejected before sending; got %s sent", msg.Action)
+		default:
+		}
+	})
+}
+
+func TestRealtimeChannel_PublishMaxMessageSize(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{MaxMessageSize: 10})
+	defer safeclose(t, client)
+	if size := client.Connection.MaxMessageSize(); size != 10 {
+		t.Fatalf("want MaxMessageSize()=10; got %d", size)
+	}
+	channel := client.Channels.Get("test")
+	_, err := channel.Publish("name", "too long data")
+	if err := checkError(ably.ErrMaximumMessageLengthExceeded, err); err != nil {
+		t.Errorf("Publish(): %v", err)
+	}
+	_, err = channel.PublishAll([]*proto.Message{
+		{Name: "name", Data: "data"},
+		{Name: "name", Data: "data"},
+	})
+	if err := checkError(ably.ErrMaximumMessageLengthExceeded, err); err != nil {
+		t.Errorf("PublishAll(): %v", err)
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("want messages rejected before sending; got %s sent", msg.Action)
+	default:
+	}
+	// The limit sent by the server takes precedence.
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey:  "connection-key",
+			MaxMessageSize: 100,
+		},
+	}
+	for deadline := time.Now().Add(ablytest.Timeout); client.Connection.MaxMessageSize() != 100; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want MaxMessageSize()=100; got %d", client.Connection.MaxMessageSize())
+		}
+	}
+	if _, err := channel.Publish("name", "too long data"); err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeChannel_AttachCtx(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- channel.AttachCtx(ctx) }()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("want AttachCtx()=%v; got %v", context.Canceled, err)
+	}
+	// Cancelling does not abort the attach request itself.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.AttachCtx(context.Background()); err != nil {
+		t.Fatalf("AttachCtx()=%v", err)
+	}
+}
+
+func TestRealtimeChannel_PublishCtx(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+
+	// A message cancelled before the channel is attached is never sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := channel.PublishCtx(ctx, "cancelled", "data"); err != context.Canceled {
+		t.Fatalf("want PublishCtx()=%v; got %v", context.Canceled, err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message cancelled while awaiting its ACK stops waiting for it.
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- channel.PublishCtx(ctx, "first", "data") }()
+	first, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := first.Messages[0].Name; name != "first" {
+		t.Fatalf("want message %q sent; got %q", "first", name)
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("want PublishCtx()=%v; got %v", context.Canceled, err)
+	}
+	go func() { errc <- channel.PublishCtx(context.Background(), "second", "data") }()
+	second, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: first.MsgSerial, Count: 2}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("PublishCtx()=%v", err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for ACK of message serial %d timed out", second.MsgSerial)
+	}
+}
+
+// newConnectingClient gives a client which is connecting, until CONNECTED
+// is sent on the returned conn.
+func newConnectingClient(t *testing.T, opts *ably.ClientOptions) (*ably.RealtimeClient, *dropConn, <-chan *proto.ProtocolMessage) {
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts.Key = "abc:abc"
+	opts.NoConnect = true
+	opts.Dial = dropConnDial(conns, out)
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	return client, <-conns, out
+}
+
+func TestRealtimeChannel_QueueMessages(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newConnectingClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	var results []ably.Result
+	for _, name := range []string{"first", "second", "third"} {
+		res, err := channel.Publish(name, "data")
+		if err != nil {
+			t.Fatalf("Publish(%q)=%v", name, err)
+		}
+		results = append(results, res)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	var serial int64
+	for i, name := range []string{"first", "second", "third"} {
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Messages[0].Name; got != name {
+			t.Fatalf("want message %q sent; got %q", name, got)
+		}
+		if i == 0 {
+			serial = msg.MsgSerial
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		for _, res := range results {
+			if err := res.Wait(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("publish completed before ACK: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: serial, Count: 3}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Wait()=%v", err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for ACK timed out after %v", ablytest.Timeout)
+	}
+}
+
+func TestRealtimeChannel_QueueMessagesFailed(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newConnectingClient(t, &ably.ClientOptions{})
+	defer client.Close()
+	channel := client.Channels.Get("test")
+	res, err := channel.Publish("name", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action: proto.ActionError,
+		Error:  &proto.ErrorInfo{StatusCode: 400, Code: 40000, Message: "failed"},
+	}
+	if err := ablytest.Wait(res, nil); err == nil {
+		t.Fatal("want queued message to fail")
+	}
+	if state := client.Connection.State(); state != ably.StateConnFailed {
+		t.Fatalf("want state=%v; got %v", ably.StateConnFailed, state)
+	}
+}
+
+func TestRealtimeChannel_NoQueueing(t *testing.T) {
+	t.Parallel()
+	client, _, out := newConnectingClient(t, &ably.ClientOptions{NoQueueing: true})
+	defer safeclose(t, client)
+	_, err := client.Channels.Get("test").Publish("name", "data")
+	if err := checkError(ably.ErrDisconnected, err); err != nil {
+		t.Fatalf("Publish(): %v", err)
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("want no message sent; got %s", msg.Action)
+	default:
+	}
+}
+
+// BenchmarkPublish_OneOff compares publishing a single message with a new
+// REST client against publishing it with a new realtime client, which has
+// to connect and attach first.
+func BenchmarkPublish_OneOff(b *testing.B) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channels/test/messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	})
+	mux.Handle("/", websocket.Handler(func(ws *websocket.Conn) {
+		websocket.JSON.Send(ws, &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		})
+		for {
+			var msg proto.ProtocolMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Action {
+			case proto.ActionAttach:
+				websocket.JSON.Send(ws, &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: msg.Channel})
+			case proto.ActionMessage:
+				websocket.JSON.Send(ws, &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1})
+			case proto.ActionClose:
+				websocket.JSON.Send(ws, &proto.ProtocolMessage{Action: proto.ActionClosed})
+				return
+			}
+		}
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := func() *ably.ClientOptions {
+		opts := &ably.ClientOptions{
+			RestHost:         host,
+			RealtimeHost:     host,
+			NoTLS:            true,
+			NoBinaryProtocol: true,
+		}
+		opts.Port, _ = strconv.Atoi(port)
+		opts.Token = "token"
+		return opts
+	}
+	b.Run("REST", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			client, err := ably.NewRestClient(opts())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := client.Channels.Get("test", nil).Publish("event", "data"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Realtime", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			client, err := ably.NewRealtimeClient(opts())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := ablytest.Wait(client.Channels.Get("test").Publish("event", "data")); err != nil {
+				b.Fatal(err)
+			}
+			if err := client.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRealtimeChannel_DetachResubscribe(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	message := func(name string) *proto.ProtocolMessage {
+		return &proto.ProtocolMessage{
+			Action:   proto.ActionMessage,
+			Channel:  "test",
+			Messages: []*proto.Message{{Name: name, Data: "data"}},
+		}
+	}
+	conn.in <- message("attached")
+	if err := expectMsg(sub.MessageChannel(), "attached", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := channel.Detach()
+	if err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	// Messages sent before the server got the DETACH aren't delivered.
+	conn.in <- message("detaching")
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "test"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	conn.in <- message("detached")
+	if err := expectMsg(sub.MessageChannel(), "", nil, 50*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.in <- message("reattached")
+	if err := expectMsg(sub.MessageChannel(), "reattached", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeChannel_DetachWhileAttaching(t *testing.T) {
+	t.Parallel()
+	rec := ablytest.NewStateChanRecorder(8)
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{Listener: rec.Channel()})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	attach, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	publish, err := channel.Publish("name", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	detach, err := channel.Detach()
+	if err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	if err := ablytest.Wait(attach, nil); err == nil {
+		t.Fatal("want attach to be cancelled by the detach")
+	}
+	if err := checkError(ably.ErrChannelOperationFailed, ablytest.Wait(publish, nil)); err != nil {
+		t.Fatalf("Publish(): %v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectAction(out, proto.ActionDetach); err != nil {
+		t.Fatal(err)
+	}
+	// The server responds to both the ATTACH and the DETACH.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionDetached, Channel: "test"}
+	if err := ablytest.Wait(detach, nil); err != nil {
+		t.Fatalf("Detach()=%v", err)
+	}
+	want := []ably.StateEnum{
+		ably.StateChanAttaching,
+		ably.StateChanDetaching,
+		ably.StateChanDetached,
+	}
+	if err := rec.WaitFor(want); err != nil {
+		t.Fatal(err)
+	}
+	if state := channel.State(); state != ably.StateChanDetached {
+		t.Fatalf("want state=%v; got %v", ably.StateChanDetached, state)
+	}
+	select {
+	case msg := <-out:
+		if msg.Action == proto.ActionMessage {
+			t.Fatalf("want cancelled message not sent; got %v", msg)
+		}
+	default:
+	}
+}
+
+func TestRealtimeChannel_Dedup(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{Dedup: true})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	message := func(id string, names ...string) *proto.ProtocolMessage {
+		msg := &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", ID: id}
+		for _, name := range names {
+			msg.Messages = append(msg.Messages, &proto.Message{Name: name, Data: "data"})
+		}
+		return msg
+	}
+	conn.in <- message("first", "a", "b")
+	// The replayed messages are dropped, the new ones delivered.
+	conn.in <- message("first", "a", "b")
+	conn.in <- message("second", "c")
+	for _, name := range []string{"a", "b", "c"} {
+		if err := expectMsg(sub.MessageChannel(), name, "data", ablytest.Timeout, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expectMsg(sub.MessageChannel(), "", nil, 100*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := channel.DroppedDuplicates(); n != 2 {
+		t.Errorf("want DroppedDuplicates()=2; got %d", n)
+	}
+}
+
+func TestRealtimeChannel_InboundOverflow(t *testing.T) {
+	t.Parallel()
+	for _, fail := range []bool{false, true} {
+		fail := fail
+		t.Run(fmt.Sprintf("fail=%t", fail), func(t *testing.T) {
+			t.Parallel()
+			client, conn, out := newDropConnClient(t, &ably.ClientOptions{
+				InboundBufferSize:     2,
+				FailOnInboundOverflow: fail,
+			})
+			defer safeclose(t, client)
+			channel := client.Channels.Get("test")
+			sub, err := channel.Subscribe()
+			if err != nil {
+				t.Fatalf("Subscribe()=%v", err)
+			}
+			defer sub.Close()
+			if _, err := expectAction(out, proto.ActionAttach); err != nil {
+				t.Fatal(err)
+			}
+			conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+			if err := await(channel.State, ably.StateChanAttached); err != nil {
+				t.Fatal(err)
+			}
+			// The subscriber doesn't receive anything until all the messages
+			// are dispatched, which the following empty message's serial
+			// signals.
+			msg := &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test"}
+			for i := 1; i <= 6; i++ {
+				msg.Messages = append(msg.Messages, &proto.Message{Name: strconv.Itoa(i), Data: "data"})
+			}
+			conn.in <- msg
+			conn.in <- &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", ChannelSerial: "dispatched"}
+			for deadline := time.Now().Add(ablytest.Timeout); channel.Serial() != "dispatched"; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("want Serial()=%q; got %q", "dispatched", channel.Serial())
+				}
+			}
+			// The first message may have been already taken off the queue,
+			// waiting to be received, when the others were queued.
+			var received []string
+			for {
+				select {
+				case m := <-sub.MessageChannel():
+					received = append(received, m.Name)
+					continue
+				case <-time.After(100 * time.Millisecond):
+				}
+				break
+			}
+			if n := len(received); n < 2 || n > 3 || received[0] != "1" || received[1] != "2" {
+				t.Errorf("want the first 2 or 3 messages received; got %v", received)
+			}
+			if !fail {
+				if state := channel.State(); state != ably.StateChanAttached {
+					t.Errorf("want channel to stay attached; got %v", state)
+				}
+				return
+			}
+			if state := channel.State(); state != ably.StateChanFailed {
+				t.Fatalf("want channel to fail; got %v", state)
+			}
+			if err := checkError(50001, channel.Reason()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRealtimeChannel_MessageTimestamp(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+
+	// A timestamp set by the publisher is sent as is.
+	published := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	if _, err := channel.PublishAll([]*proto.Message{{Name: "name", Data: "data", Timestamp: ably.Time(published)}}); err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	msg, err := expectAction(out, proto.ActionMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := msg.Messages[0].Time(); !ts.Equal(published) {
+		t.Errorf("want published timestamp=%v; got %v", published, ts)
+	}
+
+	// A received message without a timestamp gets the one of the protocol
+	// message set by the server (Spec TM2f).
+	received := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	conn.in <- &proto.ProtocolMessage{
+		Action:    proto.ActionMessage,
+		Channel:   "test",
+		Timestamp: ably.Time(received),
+		Messages: []*proto.Message{
+			{Name: "unset", Data: "data"},
+			{Name: "set", Data: "data", Timestamp: ably.Time(published)},
+		},
+	}
+	for _, want := range []time.Time{received, published} {
+		select {
+		case m := <-sub.MessageChannel():
+			if m.Timestamp == 0 {
+				t.Fatalf("want non-zero timestamp for %q", m.Name)
+			}
+			if ts := m.Time(); !ts.Equal(want) {
+				t.Errorf("want timestamp=%v for %q; got %v", want, m.Name, ts)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatal("waiting for message timed out")
+		}
+	}
+}
+
+func TestRealtimeChannel_ReattachFromSerial(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:              ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:                true,
+		DisconnectedRetryTimeout: 10 * time.Millisecond,
+		Dial:                     dropConnDial(conns, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	channel := client.Channels.Get("test")
+	states := make(chan ably.State, 10)
+	channel.On(states, ably.StateChanAttached)
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	attach, err := expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attach.ChannelSerial != "" {
+		t.Errorf("want no serial for the first attach; got %q", attach.ChannelSerial)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", ChannelSerial: "abc:0"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionMessage,
+		Channel:       "test",
+		ChannelSerial: "abc:1",
+		Messages:      []*proto.Message{{Name: "name", Data: "data"}},
+	}
+	deadline := time.Now().Add(ablytest.Timeout)
+	for channel.Serial() != "abc:1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want serial=%q; got %q", "abc:1", channel.Serial())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectAttached := func(resumed bool, previous ably.StateEnum) {
+		t.Helper()
+		select {
+		case st := <-states:
+			if st.Resumed != resumed || st.Previous != previous {
+				t.Fatalf("want Resumed=%t, Previous=%v; got %+v", resumed, previous, st)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatal("waiting for ATTACHED state timed out")
+		}
+	}
+	expectAttached(false, ably.StateChanAttaching)
+
+	// The connection is lost and can't be resumed, thus the channel is
+	// reattached from the last message it received.
+	conn.drop()
+	conn = <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "new-connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+		Error:             &proto.ErrorInfo{StatusCode: 400, Code: 80008, Message: "unable to recover connection"},
+	}
+	attach, err = expectAction(out, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attach.ChannelSerial != "abc:1" {
+		t.Fatalf("want reattach from serial %q; got %q", "abc:1", attach.ChannelSerial)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", ChannelSerial: "abc:1", Flags: proto.FlagResumed}
+	expectAttached(true, ably.StateChanAttaching)
+
+	// The server reports the continuity was lost while attached.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", ChannelSerial: "def:0"}
+	expectAttached(false, ably.StateChanAttached)
+	// An ATTACHED preserving the continuity isn't reported.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", ChannelSerial: "def:0", Flags: proto.FlagResumed}
+	select {
+	case st := <-states:
+		t.Fatalf("unexpected state change: %+v", st)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRealtimeChannel_ScriptedAttach(t *testing.T) {
+	t.Parallel()
+	conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      conn.Dial,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test")
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	attach, err := conn.WaitForSent(proto.ActionAttach, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attach.Channel != "test" {
+		t.Fatalf("want channel=test; got %q", attach.Channel)
+	}
+	conn.Push(&proto.ProtocolMessage{
+		Action:  proto.ActionAttached,
+		Channel: "test",
+	})
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if state := channel.State(); state != ably.StateChanAttached {
+		t.Fatalf("want state=%v; got %v", ably.StateChanAttached, state)
+	}
+	if err := conn.ExpectSentActions(proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeChannel_NoAttachOnSubscribe(t *testing.T) {
+	t.Parallel()
+	conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      conn.Dial,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test", &proto.ChannelOptions{NoAttachOnSubscribe: true})
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	presenceSub, err := channel.Presence.Subscribe()
+	if err != nil {
+		t.Fatalf("Presence.Subscribe()=%v", err)
+	}
+	defer presenceSub.Close()
+	if _, err := conn.WaitForSent(proto.ActionAttach, 100*time.Millisecond); err == nil {
+		t.Fatal("want no ATTACH sent before explicit attach")
+	}
+	if state := channel.State(); state != ably.StateChanInitialized {
+		t.Fatalf("want state=%v; got %v", ably.StateChanInitialized, state)
+	}
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := conn.WaitForSent(proto.ActionAttach, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.Push(&proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"})
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if err := conn.ExpectSentActions(proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	// The subscription registered before attaching gets the messages.
+	conn.Push(&proto.ProtocolMessage{
+		Action:   proto.ActionMessage,
+		Channel:  "test",
+		Messages: []*proto.Message{{Name: "name", Data: "data"}},
+	})
+	if err := expectMsg(sub.MessageChannel(), "name", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeChannel_PublishOnly(t *testing.T) {
+	t.Parallel()
+	conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      conn.Dial,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test", proto.PublishOnlyOptions())
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	res, err := channel.Publish("name", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	msg, err := conn.WaitForSent(proto.ActionMessage, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Push(&proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1})
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("want the message acknowledged; got %v", err)
+	}
+	if err := conn.ExpectSentActions(proto.ActionMessage); err != nil {
+		t.Fatal(err)
+	}
+	if state := channel.State(); state != ably.StateChanInitialized {
+		t.Fatalf("want state=%v; got %v", ably.StateChanInitialized, state)
+	}
+	// Messages published by others are not delivered.
+	conn.Push(&proto.ProtocolMessage{
+		Action:   proto.ActionMessage,
+		Channel:  "test",
+		Messages: []*proto.Message{{Name: "other", Data: "data"}},
+	})
+	if err := expectMsg(sub.MessageChannel(), "other", "data", 100*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package ably
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -13,17 +14,16 @@ type RealtimeClient struct {
 	Channels   *Channels
 	Connection *Conn
 
-	chansMtx sync.RWMutex
-	chans    map[string]*RealtimeChannel
-	rest     *RestClient
-	err      chan error
+	chansMtx     sync.RWMutex
+	chans        map[string]*RealtimeChannel
+	rest         *RestClient
+	err          chan error
+	dispatchOnce sync.Once
 }
 
 // NewRealtimeClient
-func NewRealtimeClient(opts *ClientOptions) (*RealtimeClient, error) {
-	if opts == nil {
-		panic("called NewRealtimeClient with nil ClientOptions")
-	}
+func NewRealtimeClient(options ...ClientOption) (*RealtimeClient, error) {
+	opts := applyOptions("NewRealtimeClient", options)
 	c := &RealtimeClient{
 		err:   make(chan error),
 		chans: make(map[string]*RealtimeChannel),
@@ -38,9 +38,23 @@ func NewRealtimeClient(opts *ClientOptions) (*RealtimeClient, error) {
 		return nil, err
 	}
 	c.Auth = rest.Auth
+	c.Auth.onExplicitAuthorize = conn.onClientAuthorize
 	c.Channels = newChannels(c)
 	c.Connection = conn
-	go c.dispatchloop()
+	// Nothing runs in the background until the client connects, so that
+	// listeners can be registered beforehand when NoConnect is set.
+	conn.beforeConnect = func() {
+		c.dispatchOnce.Do(func() { go c.dispatchloop() })
+	}
+	conn.channelSerials = c.Channels.serials
+	if ctx := c.opts().Context; ctx != nil {
+		go c.closeOnDone(ctx)
+	}
+	if !c.opts().NoConnect {
+		if _, err := conn.connect(false); err != nil {
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
@@ -62,8 +76,29 @@ func (c *RealtimeClient) Time() (time.Time, error) {
 }
 
 func (c *RealtimeClient) dispatchloop() {
-	for msg := range c.Connection.msgCh {
-		c.Channels.Get(msg.Channel).notify(msg)
+	done := c.opts().done()
+	for {
+		select {
+		case msg := <-c.Connection.msgCh:
+			c.Channels.Get(msg.Channel).notify(msg)
+			// Channel messages update the serials in the recovery key.
+			c.Connection.storeRecoveryKey()
+		case <-done:
+			return
+		}
+	}
+}
+
+// closeOnDone closes the client once ctx is done, releasing its channels.
+func (c *RealtimeClient) closeOnDone(ctx context.Context) {
+	<-ctx.Done()
+	if err := c.Close(); err != nil {
+		c.logger().Printf(LogVerbose, "closing connection on context done: %v", err)
+	}
+	for _, channel := range c.Channels.All() {
+		if err := c.Channels.Release(channel.Name); err != nil {
+			c.logger().Printf(LogVerbose, "releasing channel %q on context done: %v", channel.Name, err)
+		}
 	}
 }
 
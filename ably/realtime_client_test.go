@@ -1,12 +1,17 @@
 package ably_test
 
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/ably/ably-go/ably"
 	"github.com/ably/ably-go/ably/ablytest"
+	"github.com/ably/ably-go/ably/proto"
 )
 
 func TestRealtimeClient_RealtimeHost(t *testing.T) {
@@ -26,6 +31,7 @@ func TestRealtimeClient_RealtimeHost(t *testing.T) {
 	}
 	stateRec := ablytest.NewStateRecorder(len(hosts))
 	for _, host := range hosts {
+		// The sandbox environment is dropped in favour of the host.
 		opts := rec.Options(host)
 		opts.Listener = stateRec.Channel()
 		client, err := ably.NewRealtimeClient(app.Options(opts))
@@ -169,3 +175,116 @@ func TestRealtimeClient_DontCrashOnCloseWhenEchoOff(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRealtimeClient_WaitState(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      dropConnDial(conns, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	// The current state is observed without waiting for a transition.
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnecting, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	channel := client.Channels.Get("test")
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.WaitChannelState(channel, ably.StateChanAttached, 0); err != nil {
+		t.Fatal(err)
+	}
+	err = ablytest.WaitChannelState(channel, ably.StateChanDetached, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), ably.StateChanAttached.String()) {
+		t.Fatalf("want error listing the seen states; got %v", err)
+	}
+}
+
+func TestRealtimeClient_ContextDone(t *testing.T) {
+	// The test counts goroutines, so it doesn't run in parallel.
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *proto.ProtocolMessage, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      ablytest.MessagePipe(in, out),
+		Context:   ctx,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test")
+	if _, err := channel.Subscribe(); err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	// The fake server confirms the attach and the close.
+	go func() {
+		for msg := range out {
+			switch msg.Action {
+			case proto.ActionAttach:
+				in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: msg.Channel}
+			case proto.ActionClose:
+				in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+				return
+			}
+		}
+	}()
+	if err := ablytest.WaitChannelState(channel, ably.StateChanAttached, 0); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnClosed, 0); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(ablytest.Timeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("want %d goroutines; got %d:\n%s", before, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Channels.Exists("test") {
+		t.Error("want channel released")
+	}
+	if _, err := client.Connection.Connect(); err == nil {
+		t.Error("want Connect to fail once the context is done")
+	}
+}
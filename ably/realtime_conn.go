@@ -1,10 +1,18 @@
 package ably
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ably/ably-go/ably/internal/ablyutil"
@@ -12,13 +20,26 @@ import (
 )
 
 var (
-	errQueueing      = errors.New("unable to send messages in current state with disabled queueing")
-	errCloseInactive = errors.New("attempted to close inactive connection")
+	errQueueing       = errors.New("unable to send messages in current state with disabled queueing")
+	errCloseInactive  = errors.New("attempted to close inactive connection")
+	errNotConnected   = errors.New("unable to ping connection which is not connected")
+	errPingTimeout    = errors.New("no response to ping received")
+	errNotAcked       = errors.New("connection closed before the message was acknowledged")
+	errNotResumed     = errors.New("connection was not resumed before the message was acknowledged")
+	errAckTimeout     = errors.New("no acknowledgement of the message received")
+	errConnectTimeout = errors.New("no response to connection request received")
+	errConnectAborted = errors.New("connection attempt was aborted while dialing")
+	errIdleTimeout    = errors.New("no activity seen on the connection within the max idle interval")
+	errStateTTL       = errors.New("connection was not resumed within the connection state TTL")
 )
 
 // Conn represents a single connection RealtimeClient instantiates for
 // communication with Ably servers.
 type Conn struct {
+	// lastActivity is the UnixNano time of the last received message;
+	// it's accessed atomically, so it's kept first for 64-bit alignment.
+	lastActivity int64
+
 	details   proto.ConnectionDetails
 	id        string
 	serial    int64
@@ -32,6 +53,52 @@ type Conn struct {
 	pending   pendingEmitter
 	queue     *msgQueue
 	auth      *Auth
+
+	// resumeErr is the reason of the last failed attempt to resume the
+	// connection; it is reported with the next StateConnConnected event.
+	resumeErr error
+	retry     *time.Timer
+
+	// recover is the recovery key of the connection to be recovered by
+	// the first connection attempt; it's cleared once connected.
+	recover    string
+	recovering bool // whether the current connection attempt recovers a connection
+
+	// recoveredSerials are the channel serials held by the recovery key,
+	// which channels attach from until they get serials of their own.
+	recoveredSerials map[string]string
+
+	// disconnectedAt is when the connection was lost; it's zero while
+	// the connection is connected.
+	disconnectedAt time.Time
+	suspend        *time.Timer // suspends the lost connection after the state TTL
+
+	// userDisconnected is set after Disconnect was called, until Connect is
+	// called; meanwhile no attempt to reconnect is made.
+	userDisconnected bool
+
+	// reauthorize makes the next connection attempt request a new token
+	// first; it's set when the server rejected the current one.
+	reauthorize  bool
+	reauthorized bool // whether the current connection attempt uses a renewed token
+
+	pings map[string]chan<- struct{} // pending pings by heartbeat ID
+
+	transport string // name of the transport the connection was dialed with
+	retries   int    // number of consecutive failed connection attempts
+	dialing   int    // identifies the connection attempt being dialed
+
+	// beforeConnect is called with the state lock held before every
+	// connection attempt; the client starts dispatching messages with it.
+	beforeConnect func()
+
+	// channelSerials gives the serials of the client's channels by name,
+	// for the recovery key.
+	channelSerials func() map[string]string
+
+	recoverOnce   sync.Once  // asks RecoverCallback for the key once
+	storeMtx      sync.Mutex // serializes StoreRecoveryKey calls
+	storedSerials string     // serials of the key StoreRecoveryKey was last called with
 }
 
 func newConn(opts *ClientOptions, auth *Auth) (*Conn, error) {
@@ -41,24 +108,99 @@ func newConn(opts *ClientOptions, auth *Auth) (*Conn, error) {
 		state:   newStateEmitter(StateConn, StateConnInitialized, "", auth.logger()),
 		pending: newPendingEmitter(auth.logger()),
 		auth:    auth,
+		recover: opts.Recover,
 	}
 	c.queue = newMsgQueue(c)
+	c.state.handlers = newStateHandlers()
 	if opts.Listener != nil {
-		c.On(opts.Listener)
+		c.Notify(opts.Listener)
+	}
+	return c, nil
+}
+
+// dial connects to the realtime host. When it's unreachable, the connection
+// is attempted against the fallback hosts, picked in random order, up to
+// HTTPMaxRetryCount of them. It returns the name of the transport used.
+//
+// Spec RTN17
+func (c *Conn) dial(proto string, u *url.URL, attempt int) (conn proto.Conn, transport string, err error) {
+	conn, transport, err = c.dialHost(proto, u)
+	if err == nil || !c.useFallbacks(u.Hostname(), err) {
+		return conn, transport, dialError(err)
 	}
-	if !opts.NoConnect {
-		if _, err := c.connect(false); err != nil {
-			return nil, err
+	fallback := c.opts.fallbackHosts()
+	maxCount := c.opts.httpMaxRetryCount()
+	for i, n := range rand.Perm(len(fallback)) {
+		if i == maxCount {
+			break
+		}
+		if c.dialAborted(attempt) {
+			return nil, "", errConnectAborted
+		}
+		c.logger().Printf(LogWarning, "unable to connect to %s, trying fallback host %s: %v", u.Hostname(), fallback[n], err)
+		fu := *u
+		fu.Host = net.JoinHostPort(fallback[n], u.Port())
+		if conn, transport, err = c.dialHost(proto, &fu); err == nil {
+			return conn, transport, nil
 		}
 	}
-	return c, nil
+	return nil, "", dialError(err)
 }
 
-func (c *Conn) dial(proto string, u *url.URL) (proto.Conn, error) {
-	if c.opts.Dial != nil {
-		return c.opts.Dial(proto, u)
+// dialAborted reports whether the given connection attempt was aborted while
+// dialing, by Close, Disconnect or a subsequent attempt.
+func (c *Conn) dialAborted(attempt int) bool {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.state.current != StateConnConnecting || c.dialing != attempt
+}
+
+// dialHost connects to the host of u with the configured transports, trying
+// them in order until one of them succeeds.
+func (c *Conn) dialHost(proto string, u *url.URL) (conn proto.Conn, transport string, err error) {
+	for _, transport = range c.opts.transports() {
+		conn, err = c.dialTransport(transport, proto, u)
+		if err == nil {
+			return conn, transport, nil
+		}
+		c.logger().Printf(LogWarning, "unable to connect with %s transport: %v", transport, err)
+	}
+	return nil, "", err
+}
+
+// useFallbacks reports whether a connection which failed to be established
+// to the given host with err can be attempted against fallback hosts. Only
+// network failures qualify, not the server rejecting the connection.
+//
+// Spec RTN17b
+func (c *Conn) useFallbacks(host string, err error) bool {
+	if _, ok := err.(*proto.ErrorInfo); ok {
+		return false
+	}
+	return c.opts.FallbackHostsUseDefault ||
+		strings.HasSuffix(host, defaultOptions.RealtimeHost) ||
+		c.opts.FallbackHosts != nil
+}
+
+// dialError converts protocol errors reported by the transports, like
+// a rejected websocket subprotocol, into *Error values.
+func dialError(err error) error {
+	if e, ok := err.(*proto.ErrorInfo); ok {
+		return newErrorProto(e)
+	}
+	return err
+}
+
+func (c *Conn) dialTransport(transport, proto string, u *url.URL) (proto.Conn, error) {
+	switch transport {
+	case TransportComet:
+		return ablyutil.DialComet(proto, u, c.opts.httpclient())
+	default:
+		if c.opts.Dial != nil {
+			return c.opts.Dial(proto, u)
+		}
+		return ablyutil.DialWebsocketTimeout(proto, u, c.opts.realtimeRequestTimeout())
 	}
-	return ablyutil.DialWebsocket(proto, u)
 }
 
 // Connect is used to connect to Ably servers manually, when the client owning
@@ -74,28 +216,55 @@ func (c *Conn) Connect() (Result, error) {
 	return c.connect(true)
 }
 
+// ConnectCtx connects the client and blocks until it's connected or ctx is
+// done, in which case ctx.Err() is returned. Cancelling ctx does not abort
+// the connection attempt itself.
+func (c *Conn) ConnectCtx(ctx context.Context) error {
+	res, err := c.Connect()
+	return waitCtx(ctx, res, err)
+}
+
 var connectResultStates = []StateEnum{
 	StateConnConnected, // expected state
 	StateConnFailed,
 	StateConnDisconnected,
 }
 
-func (c *Conn) connect(result bool) (Result, error) {
+func (c *Conn) connect(result bool) (_ Result, err error) {
+	defer func() {
+		// Messages queued while connecting can't be sent anymore.
+		//
+		// Spec RTN7c
+		if err != nil && c.State() == StateConnFailed {
+			c.queue.Fail(err)
+		}
+	}()
+	c.loadRecoveryKey()
 	c.state.Lock()
 	defer c.state.Unlock()
 	if c.isActive() {
 		return nopResult, nil
 	}
+	if ctx := c.opts.Context; ctx != nil && ctx.Err() != nil {
+		return nil, newError(ErrConnectionClosed, ctx.Err())
+	}
+	if c.beforeConnect != nil {
+		c.beforeConnect()
+	}
+	c.auth.startRenewal()
+	c.stopRetry()
+	c.userDisconnected = false
+	reconnecting := c.state.current == StateConnDisconnected || c.state.current == StateConnSuspended
 	c.state.set(StateConnConnecting, nil)
 	u, err := url.Parse(c.opts.realtimeURL())
 	if err != nil {
-		return nil, c.state.set(StateConnFailed, err)
+		return nil, c.setFailed(err)
 	}
 	var res Result
 	if result {
 		res = c.state.listenResult(connectResultStates...)
 	}
-	proto := c.opts.protocol()
+	protocol := c.opts.protocol()
 	query := url.Values{
 		"timestamp": []string{strconv.FormatInt(TimeNow(), 10)},
 		"echo":      []string{"true"},
@@ -107,37 +276,139 @@ func (c *Conn) connect(result bool) (Result, error) {
 	if c.opts.NoBinaryProtocol {
 		query.Set("format", "json")
 	}
-	if c.opts.ClientID != "" && c.auth.method == authBasic {
+	if c.opts.ClientID != "" && c.auth.authMethod() == authBasic {
 		// References RSA7e1
 		query.Set("clientId", c.opts.ClientID)
 	}
 	for k, v := range c.opts.TransportParams {
 		query.Set(k, v)
 	}
-	if err := c.auth.authQuery(query); err != nil {
-		return nil, c.state.set(StateConnFailed, err)
+	if c.opts.AddRequestIDs {
+		// Spec RSC7c
+		id, err := ablyutil.RequestID()
+		if err != nil {
+			return nil, c.setFailed(newError(ErrInternalError, err))
+		}
+		query.Set("request_id", id)
+	}
+	reauthorize := c.reauthorize
+	c.reauthorized = reauthorize
+	c.reauthorize = false
+	c.recovering = false
+	if c.details.ConnectionKey != "" {
+		// Spec RTN15b
+		query.Set("resume", c.details.ConnectionKey)
+		query.Set("connection_serial", strconv.FormatInt(c.serial, 10))
+	} else if c.recover != "" {
+		// Spec RTN16c, RTN16f
+		if key, err := parseRecoveryKey(c.recover); err != nil {
+			c.logger().Printf(LogError, "unable to recover connection, connecting anew: %v", err)
+			c.recover = ""
+		} else if !key.validUntil.IsZero() && time.Now().After(key.validUntil) {
+			// The server has already discarded the connection's state,
+			// so the expired key is reported with the fresh connection
+			// instead of being sent.
+			c.resumeErr = newErrorf(ErrUnableToRecoverConnectionConnectionExpired, "recovery key expired at %v", key.validUntil)
+			c.logger().Printf(LogWarning, "unable to recover connection, connecting anew: %v", c.resumeErr)
+			c.recover = ""
+		} else {
+			query.Set("recover", key.connectionKey)
+			query.Set("connection_serial", strconv.FormatInt(key.serial, 10))
+			c.serial = key.serial
+			c.msgSerial = key.msgSerial
+			c.recoveredSerials = key.channelSerials
+			c.recovering = true
+		}
+	}
+	// The state lock is released while requesting a token and dialing,
+	// which may take a while when an auth callback is called or fallback
+	// hosts are tried, so the connection can be used and closed meanwhile;
+	// an attempt that was aborted is abandoned afterwards.
+	c.dialing++
+	attempt := c.dialing
+	c.state.Unlock()
+	var conn proto.Conn
+	var transport string
+	authErr := c.authorizeQuery(query, reauthorize)
+	if authErr == nil {
+		u.RawQuery = query.Encode()
+		conn, transport, err = c.dial(protocol, u, attempt)
+	}
+	c.state.Lock()
+	if c.state.current != StateConnConnecting || c.dialing != attempt {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, stateError(c.state.current, errConnectAborted)
+	}
+	if authErr != nil {
+		return nil, c.setFailed(authErr)
 	}
-	u.RawQuery = query.Encode()
-	conn, err := c.dial(proto, u)
 	if err != nil {
-		return nil, c.state.set(StateConnFailed, err)
+		if reconnecting {
+			c.disconnected(err, c.retryDelay(c.opts.disconnectedRetryTimeout()))
+			return nil, c.state.err
+		}
+		return nil, c.setFailed(err)
 	}
 	if c.logger().Is(LogVerbose) {
-		c.setConn(verboseConn{conn: conn, logger: c.logger()})
-	} else {
-		c.setConn(conn)
+		conn = verboseConn{conn: conn, logger: c.logger()}
 	}
+	c.transport = transport
+	c.setConn(conn)
+	time.AfterFunc(c.opts.realtimeRequestTimeout(), func() { c.connectTimeout(conn) })
 	return res, nil
 }
 
+// authorizeQuery adds the credentials of the connection attempt to query,
+// requesting a new token first if reauthorize is true. It must be called
+// without the state lock held, as the token request may take a while.
+func (c *Conn) authorizeQuery(query url.Values, reauthorize bool) error {
+	if reauthorize {
+		// Spec RTN14b, RTN15h2
+		if _, err := c.auth.reauthorize(); err != nil {
+			return err
+		}
+	}
+	return c.auth.authQuery(query)
+}
+
+// connectTimeout drops the conn if the server hasn't confirmed the connection
+// yet, retrying it later.
+//
+// Spec RTN14c
+func (c *Conn) connectTimeout(conn proto.Conn) {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.state.current != StateConnConnecting || c.conn != conn {
+		return
+	}
+	c.conn = nil
+	c.disconnected(newError(ErrTimeoutError, errConnectTimeout), c.retryDelay(c.opts.disconnectedRetryTimeout()))
+	conn.Close()
+}
+
 // Close initiates closing sequence for the connection; it waits until the
 // operation is complete.
 //
+// Close sends a CLOSE message and waits for the server to acknowledge it, so
+// messages published beforehand are acknowledged first. If no CLOSED message
+// is received within ClientOptions.RealtimeRequestTimeout, or the underlying
+// connection is already gone, the connection transitions to the closed state
+// without an error.
+//
 // If connection is already closed, this method is a nop.
 func (c *Conn) Close() error {
-	err := wait(c.close())
-	if c.conn != nil {
-		c.conn.Close()
+	c.auth.stopRenewal()
+	res, err := c.close()
+	if err == nil {
+		err = c.waitClosed(res)
+	}
+	c.state.Lock()
+	conn := c.conn
+	c.state.Unlock()
+	if conn != nil {
+		conn.Close()
 	}
 	if err != nil {
 		return c.state.syncSet(StateConnFailed, err)
@@ -145,6 +416,68 @@ func (c *Conn) Close() error {
 	return nil
 }
 
+// Disconnect drops the transport without closing the connection on the
+// server, moving it to the disconnected state, for example when an app goes
+// to the background. Unlike after a connection loss, no attempt to reconnect
+// is made until Connect is called, which then resumes the connection, so the
+// attached channels stay attached and no messages are missed. The recovery
+// key remains valid in the meantime.
+//
+// Like any lost connection, it's suspended if it isn't resumed within the
+// connection state TTL.
+func (c *Conn) Disconnect() {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if !c.isActive() {
+		return
+	}
+	if conn := c.conn; conn != nil {
+		c.conn = nil
+		conn.Close()
+	}
+	// Tokens are renewed again once Connect is called.
+	c.auth.stopRenewal()
+	c.stopRetry()
+	c.userDisconnected = true
+	c.lost()
+	c.state.set(StateConnDisconnected, nil)
+}
+
+// waitClosed waits for the result of the closing sequence.
+//
+// Spec RTN12b
+func (c *Conn) waitClosed(res Result) error {
+	done := make(chan error, 1)
+	go func() { done <- res.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(c.opts.realtimeRequestTimeout()):
+		c.state.Lock()
+		if c.state.current == StateConnClosing {
+			c.setClosed()
+		}
+		c.state.Unlock()
+		return <-done
+	}
+}
+
+// setFailed transitions to the failed state, which no longer needs the
+// token to be kept fresh; it must be called with the state lock held.
+func (c *Conn) setFailed(err error) error {
+	c.auth.stopRenewal()
+	return c.state.set(StateConnFailed, err)
+}
+
+// setClosed transitions to the closed state, failing the messages still
+// awaiting an ACK; it must be called with the state lock held.
+func (c *Conn) setClosed() {
+	c.id = ""
+	c.details = proto.ConnectionDetails{}
+	c.state.set(StateConnClosed, nil)
+	c.pending.Fail(newError(ErrConnectionClosed, errNotAcked))
+}
+
 var closeResultStates = []StateEnum{
 	StateConnClosed, // expected state
 	StateConnFailed,
@@ -157,14 +490,28 @@ func (c *Conn) close() (Result, error) {
 	switch c.state.current {
 	case StateConnClosing, StateConnClosed:
 		return nopResult, nil
-	case StateConnInitialized, StateConnFailed, StateConnDisconnected:
+	case StateConnDisconnected, StateConnSuspended:
+		// Spec RTN12d
+		c.stopRetry()
+		c.setClosed()
+		return nopResult, nil
+	case StateConnInitialized, StateConnFailed:
 		return nil, stateError(c.state.current, errCloseInactive)
 	}
+	if c.conn == nil {
+		c.setClosed()
+		return nopResult, nil
+	}
 	res := c.state.listenResult(closeResultStates...)
 	c.state.set(StateConnClosing, nil)
 	msg := &proto.ProtocolMessage{Action: proto.ActionClose}
 	c.updateSerial(msg, nil)
-	return res, c.conn.Send(msg)
+	if err := c.conn.Send(msg); err != nil {
+		// The connection is already gone, there's no one to acknowledge
+		// the CLOSE message.
+		c.setClosed()
+	}
+	return res, nil
 }
 
 // ID gives unique ID string obtained from Ably upon successful connection.
@@ -185,13 +532,314 @@ func (c *Conn) Key() string {
 	return c.details.ConnectionKey
 }
 
-// Ping issues a ping request against configured endpoint and returns TTR times
-// for ping request and pong response.
+// RecoveryKey gives the key the connection can be recovered with by a new
+// client, for example after the process restarts, via ClientOptions.Recover.
+// The key holds the connection key, the serial of the last received message,
+// the serial of the next message to be sent and the time the key is valid
+// until in Unix milliseconds, separated with colons. If any channel has got
+// a serial, they're appended as a query string mapping channel names to
+// serials, so that the channels of the new client attach from where these
+// left off.
+//
+// It returns an empty string if there is no connection to recover.
+//
+// Spec RTN16b
+func (c *Conn) RecoveryKey() string {
+	key, _ := c.recoveryKey()
+	return key
+}
+
+// recoveryKey gives the recovery key along with the same key without the
+// validity, which changes with every received message, heartbeats included.
+func (c *Conn) recoveryKey() (key, serials string) {
+	// Channels lock their state before the connection's, so their serials
+	// are gathered beforehand.
+	var channelSerials map[string]string
+	if c.channelSerials != nil {
+		channelSerials = c.channelSerials()
+	}
+	c.state.Lock()
+	defer c.state.Unlock()
+	if !c.recoverable() {
+		return "", ""
+	}
+	key = fmt.Sprintf("%s:%d:%d", c.details.ConnectionKey, c.serial, c.msgSerial)
+	serials = key
+	if validUntil := c.recoveryKeyValidUntil(); !validUntil.IsZero() {
+		key += ":" + strconv.FormatInt(unixMilli(validUntil), 10)
+	}
+	channels := make(url.Values, len(channelSerials)+len(c.recoveredSerials))
+	for name, serial := range c.recoveredSerials {
+		channels.Set(name, serial)
+	}
+	for name, serial := range channelSerials {
+		channels.Set(name, serial)
+	}
+	if len(channels) != 0 {
+		key += ":" + channels.Encode()
+		serials += ":" + channels.Encode()
+	}
+	return key, serials
+}
+
+// RecoveryKeyValidUntil gives the time until which the key given by
+// RecoveryKey can be used to recover the connection, which is the connection
+// state TTL and the max idle interval after the last message was received.
+// A new client refuses to recover the connection with an expired key.
+//
+// It returns the zero time if there is no connection to recover.
+func (c *Conn) RecoveryKeyValidUntil() time.Time {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if !c.recoverable() {
+		return time.Time{}
+	}
+	return c.recoveryKeyValidUntil()
+}
+
+// recoverable reports whether the connection can be recovered by a new
+// client; it expects the state lock to be held.
+func (c *Conn) recoverable() bool {
+	switch c.state.current {
+	case StateConnClosing, StateConnClosed, StateConnFailed, StateConnSuspended:
+		return false
+	}
+	return c.details.ConnectionKey != ""
+}
+
+// recoveryKeyValidUntil expects the state lock to be held.
+func (c *Conn) recoveryKeyValidUntil() time.Time {
+	last := c.LastActivity()
+	if last.IsZero() {
+		return time.Time{}
+	}
+	maxIdle := time.Duration(c.details.MaxIdleInterval) * time.Millisecond
+	return last.Add(c.connectionStateTTL() + maxIdle)
+}
+
+// loadRecoveryKey asks RecoverCallback for the key to recover the connection
+// with, unless Recover is set. It's called before every connection attempt,
+// but only the first one asks, without the state lock held.
+func (c *Conn) loadRecoveryKey() {
+	if c.opts.Recover != "" || c.opts.RecoverCallback == nil {
+		return
+	}
+	c.recoverOnce.Do(func() {
+		key := c.opts.RecoverCallback()
+		c.state.Lock()
+		defer c.state.Unlock()
+		if c.details.ConnectionKey == "" {
+			c.recover = key
+		}
+	})
+}
+
+// storeRecoveryKey calls StoreRecoveryKey with the current recovery key,
+// if its connection key or serials have changed since the last call; a mere
+// extension of its validity, as on each heartbeat, isn't stored. It must be
+// called without any channel or connection lock held.
+func (c *Conn) storeRecoveryKey() {
+	if c.opts.StoreRecoveryKey == nil {
+		return
+	}
+	c.storeMtx.Lock()
+	defer c.storeMtx.Unlock()
+	key, serials := c.recoveryKey()
+	if serials == c.storedSerials {
+		return
+	}
+	c.storedSerials = serials
+	c.opts.StoreRecoveryKey(key)
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// recoveredSerial gives the serial the channel had in the recovered
+// connection, if any.
+func (c *Conn) recoveredSerial(channel string) string {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.recoveredSerials[channel]
+}
+
+var connectionKeyRegexp = regexp.MustCompile(`^[\w!-]+$`)
+
+// recoveryKey is a recovery key given by RecoveryKey, split into its parts.
+type recoveryKey struct {
+	connectionKey  string
+	serial         int64
+	msgSerial      int64
+	validUntil     time.Time // zero for keys without the validity
+	channelSerials map[string]string
+}
+
+// parseRecoveryKey splits the recovery key given by RecoveryKey into
+// the connection key, connection serial, message serial, validity and
+// channel serials. A malformed key fails with ErrInvalidParameterValue,
+// describing the invalid part.
+func parseRecoveryKey(recover string) (*recoveryKey, error) {
+	invalid := func(format string, v ...interface{}) error {
+		return newErrorf(ErrInvalidParameterValue, "invalid recovery key %q: "+format, append([]interface{}{recover}, v...)...)
+	}
+	parts := strings.SplitN(recover, ":", 4)
+	if len(parts) < 3 {
+		return nil, invalid("want connectionKey:connectionSerial:messageSerial, optionally followed by the validity and channel serials")
+	}
+	if !connectionKeyRegexp.MatchString(parts[0]) {
+		return nil, invalid("malformed connection key %q", parts[0])
+	}
+	key := &recoveryKey{connectionKey: parts[0]}
+	var err error
+	if key.serial, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, invalid("non-numeric connection serial %q", parts[1])
+	}
+	if key.msgSerial, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return nil, invalid("non-numeric message serial %q", parts[2])
+	}
+	if len(parts) == 3 {
+		return key, nil
+	}
+	// The validity is optional, as keys given by older versions don't
+	// have it; channel names and serials are escaped, so they hold no colons.
+	rest := strings.SplitN(parts[3], ":", 2)
+	if ms, err := strconv.ParseInt(rest[0], 10, 64); err == nil {
+		key.validUntil = time.Unix(0, ms*int64(time.Millisecond))
+		rest = rest[1:]
+	} else if len(rest) == 2 {
+		return nil, invalid("non-numeric validity %q", rest[0])
+	}
+	if len(rest) == 0 {
+		return key, nil
+	}
+	if rest[0] == "" {
+		return nil, invalid("empty channel serials")
+	}
+	channels, err := url.ParseQuery(rest[0])
+	if err != nil {
+		return nil, invalid("malformed channel serials: %v", err)
+	}
+	key.channelSerials = make(map[string]string, len(channels))
+	for name := range channels {
+		key.channelSerials[name] = channels.Get(name)
+	}
+	return key, nil
+}
+
+// Details gives the connection details sent by the server when the connection
+// was last established, or nil if it hasn't been established yet or its state
+// has been lost. The ConnectionStateTTL limits how long a disconnected
+// connection is retried before it's suspended; it's set to the effective
+// TTL when the server didn't send one.
+//
+// Spec RTN21
+func (c *Conn) Details() *proto.ConnectionDetails {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.details.ConnectionKey == "" {
+		return nil
+	}
+	details := c.details
+	details.ConnectionStateTTL = int64(c.connectionStateTTL() / time.Millisecond)
+	return &details
+}
+
+// MaxMessageSize gives the maximum size in bytes of the messages published
+// at once on the connection, as sent by the server when connecting; before
+// that it's ClientOptions.MaxMessageSize.
 //
-// Ping returns non-nil error without any attemp of communication with Ably
-// if the connection state is StateConnClosed or StateConnFailed.
-func (c *Conn) Ping() (ping, pong time.Duration, err error) {
-	return 0, 0, errors.New("TODO")
+// Spec CD2c
+func (c *Conn) MaxMessageSize() int64 {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.details.MaxMessageSize != 0 {
+		return c.details.MaxMessageSize
+	}
+	return c.opts.maxMessageSize()
+}
+
+// TransportName gives the name of the transport the connection was most
+// recently established with, one of TransportWebSocket and TransportComet;
+// it's empty before the first connection attempt.
+func (c *Conn) TransportName() string {
+	c.state.Lock()
+	defer c.state.Unlock()
+	return c.transport
+}
+
+// Ping sends a heartbeat to the server and returns the time it took to
+// receive the response.
+//
+// Ping returns non-nil error without any attempt of communication with Ably
+// if the connection is not connected, and when no response was received
+// within ClientOptions.RealtimeRequestTimeout.
+//
+// Spec RTN13
+func (c *Conn) Ping() (time.Duration, error) {
+	c.state.Lock()
+	state, conn := c.state.current, c.conn
+	c.state.Unlock()
+	if state != StateConnConnected {
+		return 0, stateError(state, errNotConnected)
+	}
+	return c.ping(conn)
+}
+
+func (c *Conn) ping(conn proto.Conn) (time.Duration, error) {
+	id := randomString(16)
+	pong := make(chan struct{})
+	c.state.Lock()
+	if c.pings == nil {
+		c.pings = make(map[string]chan<- struct{})
+	}
+	c.pings[id] = pong
+	c.state.Unlock()
+	defer func() {
+		c.state.Lock()
+		delete(c.pings, id)
+		c.state.Unlock()
+	}()
+	start := time.Now()
+	if err := conn.Send(&proto.ProtocolMessage{Action: proto.ActionHeartbeat, ID: id}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-time.After(c.opts.realtimeRequestTimeout()):
+		return 0, newError(ErrTimeoutError, errPingTimeout)
+	}
+}
+
+// keepalive periodically pings the server over conn until stop is closed.
+// A connection which doesn't respond in time is closed, so the eventloop
+// treats it as lost and attempts to resume it.
+func (c *Conn) keepalive(conn proto.Conn, stop <-chan struct{}) {
+	t := time.NewTicker(c.opts.realtimeRequestTimeout())
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		c.state.Lock()
+		connected := c.state.current == StateConnConnected && c.conn == conn
+		c.state.Unlock()
+		if !connected {
+			continue
+		}
+		if _, err := c.ping(conn); err != nil {
+			select {
+			case <-stop:
+			default:
+				c.logger().Printf(LogWarning, "closing unresponsive connection: %v", err)
+				conn.Close()
+			}
+			return
+		}
+	}
 }
 
 // Reason gives last known error that caused connection transit to
@@ -202,8 +850,40 @@ func (c *Conn) Reason() error {
 	return c.state.err
 }
 
+// ErrorReason gives the error which caused the connection to leave
+// the connected state most recently, for example when it got disconnected
+// or failed. It is nil once the connection is connected again.
+//
+// Spec RTN25
+func (c *Conn) ErrorReason() *Error {
+	c.state.Lock()
+	defer c.state.Unlock()
+	switch err := c.state.reason.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return err
+	default:
+		return newError(ErrConnectionFailed, err)
+	}
+}
+
+// LastActivity gives the time a message was last received from the server,
+// or the zero time if none has been received yet.
+func (c *Conn) LastActivity() time.Time {
+	nsec := atomic.LoadInt64(&c.lastActivity)
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
 // Serial gives serial number of a message received most recently. Last known
 // serial number is used when recovering connection state.
+//
+// The serial increases monotonically with every message received on the
+// connection; it is reset to -1 when a new connection is established instead
+// of resuming the previous one.
 func (c *Conn) Serial() int64 {
 	c.state.Lock()
 	defer c.state.Unlock()
@@ -217,42 +897,166 @@ func (c *Conn) State() StateEnum {
 	return c.state.current
 }
 
-// On relays request connection states to the given channel; on state transition
+// On registers fn to be called with every transition of the connection to
+// the given state. It gives a function which deregisters fn.
+//
+// The handlers are called in order of the transitions, from a goroutine
+// of their own, so the connection never waits for them; a handler which
+// blocks delays the following calls though.
+// If state is not a connection state or fn is nil, the method panics.
+func (c *Conn) On(state ConnState, fn func(ConnStateChange)) (off func()) {
+	if !StateConn.Contains(state) {
+		panic(fmt.Sprintf("ably: %s On using invalid state value: %s", StateConn, state.String()))
+	}
+	if fn == nil {
+		panic(fmt.Sprintf("ably: %s On using nil handler", StateConn))
+	}
+	return c.state.handlers.add(state, fn)
+}
+
+// OnAll works like On, registering fn for all of the connection's states.
+func (c *Conn) OnAll(fn func(ConnStateChange)) (off func()) {
+	if fn == nil {
+		panic(fmt.Sprintf("ably: %s OnAll using nil handler", StateConn))
+	}
+	return c.state.handlers.add(stateMasks[StateConn], fn)
+}
+
+// Off deregisters the handlers registered with On and OnAll from the given
+// states; the handlers registered with OnAll are kept for the other states.
+//
+// If no states are given, all handlers are deregistered.
+// If a state is not a connection state, the method panics.
+func (c *Conn) Off(states ...ConnState) {
+	mask := stateMasks[StateConn]
+	if len(states) != 0 {
+		mask = 0
+		for _, state := range states {
+			if !StateConn.Contains(state) {
+				panic(fmt.Sprintf("ably: %s Off using invalid state value: %s", StateConn, state.String()))
+			}
+			mask |= state
+		}
+	}
+	c.state.handlers.remove(mask)
+}
+
+// Notify relays request connection states to the given channel; on state transition
 // connection will not block sending to c - the caller must ensure the incoming
 // values are read at proper pace or the c is sufficiently buffered.
 //
 // If no states are given, c is registered for all of them.
 // If c is nil, the method panics.
 // If c is alreadt registered, its state set is expanded.
-func (c *Conn) On(ch chan<- State, states ...StateEnum) {
+func (c *Conn) Notify(ch chan<- State, states ...StateEnum) {
 	c.state.on(ch, states...)
 }
 
-// Off removes c from listetning on the given connection state transitions.
+// StopNotify removes c from listetning on the given connection state transitions.
 //
 // If no states are given, c is removed for all of the connection's states.
 // If c is nil, the method panics.
 // If c was not registered or is already removed, the method is a nop.
-func (c *Conn) Off(ch chan<- State, states ...StateEnum) {
+func (c *Conn) StopNotify(ch chan<- State, states ...StateEnum) {
 	c.state.off(ch, states...)
 }
 
+// Once returns a channel which receives a single ConnStateChange the first
+// time the connection reaches the given state. If the connection is already
+// in that state, the channel receives it immediately, with no Previous state.
+//
+// The returned channel is buffered, so the connection never blocks on it,
+// and it is deregistered once the state is reached.
+// If state is not a connection state, the method panics.
+func (c *Conn) Once(state ConnState) <-chan ConnStateChange {
+	if !StateConn.Contains(state) {
+		panic(fmt.Sprintf("ably: %s Once using invalid state value: %s", StateConn, state.String()))
+	}
+	ch := make(chan ConnStateChange, 1)
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.state.current == state {
+		ch <- ConnStateChange{
+			Current: state,
+			Reason:  stateReason(c.state.err),
+		}
+		return ch
+	}
+	// The handler is registered with the state lock held, so the state
+	// can't be reached before off is set.
+	var once sync.Once
+	var off func()
+	off = c.state.handlers.add(state, func(change ConnStateChange) {
+		once.Do(func() {
+			off()
+			ch <- change
+		})
+	})
+	return ch
+}
+
 func (c *Conn) updateSerial(msg *proto.ProtocolMessage, listen chan<- error) {
 	const maxint64 = 1<<63 - 1
 	msg.MsgSerial = c.msgSerial
 	c.msgSerial = (c.msgSerial + 1) % maxint64
 	if listen != nil {
-		c.pending.Enqueue(msg.MsgSerial, listen)
+		c.pending.Enqueue(msg, listen)
+		c.expireAck(listen)
 	}
 }
 
+// expireAck fails the message sent with listen with ErrTimeoutError, unless
+// it's acknowledged within RealtimeRequestTimeout. While the connection is
+// not connected the timeout is extended, as closing or regaining
+// the connection resolves the message itself. It expects the state lock
+// to be held.
+func (c *Conn) expireAck(listen chan<- error) {
+	time.AfterFunc(c.opts.realtimeRequestTimeout(), func() {
+		c.state.Lock()
+		defer c.state.Unlock()
+		switch {
+		case c.state.current == StateConnConnected:
+			c.pending.Expire(listen, newError(ErrTimeoutError, errAckTimeout))
+		case c.pending.Contains(listen):
+			c.expireAck(listen)
+		}
+	})
+}
+
+// resend sends again the messages which were awaiting an ACK when the
+// previous connection was lost without being resumed; they're failed
+// instead if queueing is disabled.
+//
+// Spec RTN19a
+func (c *Conn) resend(pending []serialCh) {
+	for _, sch := range pending {
+		if c.opts.NoQueueing {
+			sch.notify(newError(ErrDisconnected, errNotResumed))
+			continue
+		}
+		if err := c.send(sch.msg, sch.ch); err != nil {
+			sch.notify(err)
+		}
+	}
+}
+
+// cancelPending stops notifying listen about the outcome of the message
+// it was sent with; the message is dropped if it's still queued.
+func (c *Conn) cancelPending(listen chan<- error) {
+	c.queue.Remove(listen)
+	c.state.Lock()
+	c.pending.Remove(listen)
+	c.state.Unlock()
+}
+
 func (c *Conn) send(msg *proto.ProtocolMessage, listen chan<- error) error {
 	c.state.Lock()
 	switch state := c.state.current; state {
 	case StateConnInitialized, StateConnConnecting, StateConnDisconnected:
 		c.state.Unlock()
 		if c.opts.NoQueueing {
-			return stateError(state, errQueueing)
+			// Spec RTL6c4
+			return newError(ErrDisconnected, errQueueing)
 		}
 		c.queue.Enqueue(msg, listen)
 		return nil
@@ -261,13 +1065,19 @@ func (c *Conn) send(msg *proto.ProtocolMessage, listen chan<- error) error {
 		c.state.Unlock()
 		return stateError(state, nil)
 	}
+	// The conn may be dropped as soon as the lock is released.
+	conn := c.conn
+	if conn == nil {
+		c.state.Unlock()
+		return stateError(StateConnDisconnected, nil)
+	}
 	if err := c.verifyAndUpdateMessages(msg); err != nil {
 		c.state.Unlock()
 		return err
 	}
 	c.updateSerial(msg, listen)
 	c.state.Unlock()
-	return c.conn.Send(msg)
+	return conn.Send(msg)
 }
 
 // verifyAndUpdateMessages ensures the ClientID sent with published messages or
@@ -318,25 +1128,240 @@ func (c *Conn) lockIsActive() bool {
 
 func (c *Conn) setConn(conn proto.Conn) {
 	c.conn = conn
-	go c.eventloop()
+	go c.eventloop(conn)
+}
+
+// scheduleRetry makes the connection attempt to reconnect after the given
+// delay. It expects the state lock to be held.
+func (c *Conn) scheduleRetry(d time.Duration) {
+	c.stopRetry()
+	c.retry = time.AfterFunc(d, c.reconnect)
+}
+
+func (c *Conn) stopRetry() {
+	if c.retry != nil {
+		c.retry.Stop()
+		c.retry = nil
+	}
+}
+
+// reconnect attempts to resume the connection which was unexpectedly lost.
+// If in the meantime the connection was closed or connected explicitly,
+// the method is a nop.
+func (c *Conn) reconnect() {
+	c.state.Lock()
+	lost := c.state.current == StateConnDisconnected || c.state.current == StateConnSuspended
+	c.state.Unlock()
+	if !lost {
+		return
+	}
+	if _, err := c.connect(false); err != nil {
+		c.logger().Printf(LogWarning, "reconnect attempt failed: %v", err)
+	}
+}
+
+// disconnected transitions the connection to StateConnDisconnected state
+// and schedules an attempt to resume after the given delay. It expects
+// the state lock to be held.
+//
+// Once the connection has been lost for longer than the connection state TTL,
+// it's suspended instead.
+func (c *Conn) disconnected(err error, retryIn time.Duration) {
+	if !c.disconnectedAt.IsZero() && time.Since(c.disconnectedAt) >= c.connectionStateTTL() {
+		c.suspended(err)
+		return
+	}
+	c.lost()
+	c.state.setRetry(StateConnDisconnected, err, retryIn)
+	c.scheduleRetry(retryIn)
+}
+
+// lost records when the connection was lost, unless it already was, so that
+// it's suspended once it isn't resumed within the connection state TTL.
+func (c *Conn) lost() {
+	if c.disconnectedAt.IsZero() {
+		c.disconnectedAt = time.Now()
+		c.stopSuspend()
+		c.suspend = time.AfterFunc(c.connectionStateTTL(), c.stateTTLExpired)
+	}
+}
+
+// stateTTLExpired suspends the connection if it hasn't been resumed within
+// the connection state TTL, aborting the pending connection attempt if any.
+//
+// Spec RTN14e, RTN15g
+func (c *Conn) stateTTLExpired() {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if c.disconnectedAt.IsZero() || time.Since(c.disconnectedAt) < c.connectionStateTTL() {
+		return
+	}
+	switch c.state.current {
+	case StateConnConnecting:
+		if conn := c.conn; conn != nil {
+			c.conn = nil
+			conn.Close()
+		}
+	case StateConnDisconnected:
+	default:
+		return
+	}
+	c.suspended(newError(ErrConnectionSuspended, errStateTTL))
+}
+
+func (c *Conn) stopSuspend() {
+	if c.suspend != nil {
+		c.suspend.Stop()
+		c.suspend = nil
+	}
+}
+
+// suspended transitions the connection to StateConnSuspended state and
+// schedules another connection attempt, unless it was disconnected with
+// Disconnect. The server no longer keeps the connection state, so the next
+// connection is not resumed and the messages awaiting to be sent or
+// acknowledged are failed. It expects the state lock to be held.
+//
+// Spec RTN14e, RTN15g, RTN7c
+func (c *Conn) suspended(err error) {
+	var retryIn time.Duration
+	if !c.userDisconnected {
+		retryIn = c.retryDelay(c.opts.suspendedRetryTimeout())
+	}
+	c.details = proto.ConnectionDetails{}
+	c.state.setRetry(StateConnSuspended, err, retryIn)
+	c.pending.Fail(c.state.err)
+	c.queue.Fail(c.state.err)
+	if !c.userDisconnected {
+		c.scheduleRetry(retryIn)
+	}
+}
+
+// retryDelay gives the delay before the next connection attempt, which grows
+// with every consecutive failed attempt up to twice the initial one. It's
+// randomly reduced by up to 20%, so that clients which lost their connections
+// at once don't retry them at once. It expects the state lock to be held.
+//
+// Spec RTB1
+func (c *Conn) retryDelay(initial time.Duration) time.Duration {
+	c.retries++
+	backoff := math.Min(float64(c.retries+2)/3, 2)
+	jitter := 1 - rand.Float64()*0.2
+	return time.Duration(float64(initial) * backoff * jitter)
+}
+
+// connectionStateTTL gives the duration for which the server keeps the state
+// of a lost connection, so it can be resumed.
+func (c *Conn) connectionStateTTL() time.Duration {
+	if ttl := c.details.ConnectionStateTTL; ttl != 0 {
+		return time.Duration(ttl) * time.Millisecond
+	}
+	return c.opts.timeoutSuspended()
+}
+
+// retryWithNewToken reports whether the connection should be retried
+// with a renewed token after the server rejected it with the given error,
+// in which case the next connection attempt is going to request a new
+// token first. A token is renewed at most once per connection attempt.
+// It expects the state lock to be held.
+func (c *Conn) retryWithNewToken(err *proto.ErrorInfo) bool {
+	if !isTokenError(err) || c.reauthorized || !c.auth.isTokenRenewable() {
+		return false
+	}
+	c.reauthorize = true
+	return true
+}
+
+// onClientAuthorize reauthenticates the active connection in place with
+// the token obtained by an explicit call to Auth.Authorize.
+//
+// Spec RTC8a
+func (c *Conn) onClientAuthorize(tok *TokenDetails) {
+	c.sendAuth(tok)
+}
+
+// onServerAuthorize obtains a new token and reauthenticates the connection
+// with it, as requested by the server.
+//
+// Spec RTN22
+func (c *Conn) onServerAuthorize() {
+	tok, err := c.auth.reauthorize()
+	if err != nil {
+		c.logger().Printf(LogError, "failed to reauthorize connection: %v", err)
+		return
+	}
+	c.sendAuth(tok)
+}
+
+// sendAuth sends an AUTH message carrying the given token, if the connection
+// is connected. Otherwise the token is going to be used by the next
+// connection attempt.
+func (c *Conn) sendAuth(tok *TokenDetails) {
+	c.state.Lock()
+	if c.state.current != StateConnConnected || c.conn == nil {
+		c.state.Unlock()
+		return
+	}
+	conn := c.conn
+	c.state.Unlock()
+	msg := &proto.ProtocolMessage{
+		Action: proto.ActionAuth,
+		Auth:   &proto.AuthDetails{AccessToken: tok.Token},
+	}
+	if err := conn.Send(msg); err != nil {
+		c.logger().Printf(LogError, "failed to send AUTH message: %v", err)
+	}
+}
+
+func isTokenError(err *proto.ErrorInfo) bool {
+	return err != nil && isTokenErrorCode(err.Code)
+}
+
+// isTokenErrorCode reports whether code means the token used for
+// authentication is invalid or expired (Spec RTN14b, RSC10).
+func isTokenErrorCode(code int) bool {
+	return 40140 <= code && code < 40150
 }
 
 func (c *Conn) logger() *LoggerOptions {
 	return c.auth.logger()
 }
 
-func (c *Conn) eventloop() {
+func (c *Conn) eventloop(conn proto.Conn) {
+	stop := make(chan struct{})
+	defer close(stop)
+	// The recovery key changes with the received messages, so it's stored
+	// after each of them is handled, including the last one.
+	defer c.storeRecoveryKey()
+	go c.keepalive(conn, stop)
+	// The idle timer closes the connection if no message is received within
+	// the max idle interval, which is known once connected.
+	var idle *time.Timer
+	var idleTimeout time.Duration
+	defer func() {
+		if idle != nil {
+			idle.Stop()
+		}
+	}()
 	for {
-		msg, err := c.conn.Receive()
+		c.storeRecoveryKey()
+		msg, err := conn.Receive()
 		if err != nil {
 			c.state.Lock()
-			if c.state.current == StateConnClosed {
-				c.state.Unlock()
-				return
+			switch {
+			case c.state.current == StateConnClosing:
+				c.setClosed()
+			case c.isActive():
+				conn.Close()
+				// Spec RTN15a
+				c.disconnected(err, 0)
 			}
-			c.state.set(StateConnFailed, err)
 			c.state.Unlock()
-			return // TODO recovery
+			return
+		}
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+		if idle != nil {
+			idle.Reset(idleTimeout)
 		}
 		if msg.ConnectionSerial != 0 {
 			c.state.Lock()
@@ -345,6 +1370,12 @@ func (c *Conn) eventloop() {
 		}
 		switch msg.Action {
 		case proto.ActionHeartbeat:
+			c.state.Lock()
+			if pong, ok := c.pings[msg.ID]; ok {
+				delete(c.pings, msg.ID)
+				close(pong)
+			}
+			c.state.Unlock()
 		case proto.ActionAck:
 			c.state.Lock()
 			c.pending.Ack(msg.MsgSerial, msg.Count, newErrorProto(msg.Error))
@@ -356,43 +1387,127 @@ func (c *Conn) eventloop() {
 			c.state.Unlock()
 		case proto.ActionError:
 			if msg.Channel != "" {
-				c.msgCh <- msg
+				c.dispatch(msg)
 				break
 			}
 			c.state.Lock()
-			c.state.set(StateConnFailed, newErrorProto(msg.Error))
+			if c.retryWithNewToken(msg.Error) {
+				// Spec RTN14b
+				c.conn = nil
+				conn.Close()
+				c.disconnected(newErrorProto(msg.Error), 0)
+				c.state.Unlock()
+				return
+			}
+			if c.state.current == StateConnConnecting && c.details.ConnectionKey != "" {
+				// The server rejected the resume request, fall back to
+				// a fresh connection.
+				c.resumeErr = newErrorProto(msg.Error)
+				c.details = proto.ConnectionDetails{}
+				c.conn = nil
+				conn.Close()
+				c.disconnected(c.resumeErr, 0)
+				c.state.Unlock()
+				return
+			}
+			c.setFailed(newErrorProto(msg.Error))
+			c.details = proto.ConnectionDetails{}
+			// Spec RTN7c
+			c.pending.Fail(c.state.err)
 			c.state.Unlock()
 			c.queue.Fail(newErrorProto(msg.Error))
+			return
 		case proto.ActionConnected:
-			c.auth.updateClientID(msg.ConnectionDetails.ClientID)
 			c.state.Lock()
+			// Spec RTN15c1, RTN15c3
+			resumed := c.id != "" && c.id == msg.ConnectionID
+			if c.recovering {
+				// Spec RTN16e
+				resumed = msg.Error == nil
+				if !resumed {
+					c.recoveredSerials = nil
+				}
+			}
+			reason := c.resumeErr
+			if !resumed && reason == nil && msg.Error != nil {
+				reason = newErrorProto(msg.Error)
+			}
+			c.resumeErr = nil
+			c.retries = 0
+			c.recover = ""
+			c.recovering = false
+			c.reauthorized = false
+			c.disconnectedAt = time.Time{}
+			c.stopSuspend()
+			if d := msg.ConnectionDetails; d != nil && d.MaxIdleInterval > 0 {
+				// Spec RTN23a
+				idleTimeout = time.Duration(d.MaxIdleInterval)*time.Millisecond + c.opts.realtimeRequestTimeout()
+				if idle == nil {
+					idle = time.AfterFunc(idleTimeout, func() {
+						c.logger().Printf(LogWarning, "closing idle connection: %v", errIdleTimeout)
+						conn.Close()
+					})
+				}
+			}
 			c.id = msg.ConnectionID
 			if msg.ConnectionDetails != nil {
 				c.details = *msg.ConnectionDetails
 				// Spec RSA7b3, RSA7b4, RSA12a
 				c.auth.updateClientID(c.details.ClientID)
 			}
-			c.serial = -1
-			c.msgSerial = 0
-			c.state.set(StateConnConnected, nil)
+			var pending []serialCh
+			if !resumed {
+				c.serial = -1
+				c.msgSerial = 0
+				pending = c.pending.Dequeue()
+			}
+			c.state.set(StateConnConnected, reason)
 			c.state.Unlock()
+			c.resend(pending)
 			c.queue.Flush()
 		case proto.ActionDisconnected:
 			c.state.Lock()
-			c.id = ""
-			c.state.set(StateConnDisconnected, nil)
+			var reason error
+			if msg.Error != nil {
+				reason = newErrorProto(msg.Error)
+			}
+			if isTokenError(msg.Error) && !c.retryWithNewToken(msg.Error) {
+				// Spec RTN15h1
+				c.conn = nil
+				conn.Close()
+				c.setFailed(reason)
+				c.state.Unlock()
+				c.queue.Fail(reason)
+				return
+			}
+			c.conn = nil
+			conn.Close()
+			c.disconnected(reason, 0)
 			c.state.Unlock()
+			return
+		case proto.ActionAuth:
+			// Spec RTN22
+			go c.onServerAuthorize()
 		case proto.ActionClosed:
 			c.state.Lock()
-			c.id = ""
-			c.state.set(StateConnClosed, nil)
+			c.setClosed()
 			c.state.Unlock()
+			return
 		default:
-			c.msgCh <- msg
+			c.dispatch(msg)
 		}
 	}
 }
 
+// dispatch passes msg on to the client's channels, unless the client's
+// Context is done.
+func (c *Conn) dispatch(msg *proto.ProtocolMessage) {
+	select {
+	case c.msgCh <- msg:
+	case <-c.opts.done():
+	}
+}
+
 type verboseConn struct {
 	conn   proto.Conn
 	logger *LoggerOptions
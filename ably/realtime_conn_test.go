@@ -1,12 +1,26 @@
 package ably_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ably/ably-go/ably"
 	"github.com/ably/ably-go/ably/ablytest"
+	"github.com/ably/ably-go/ably/proto"
 )
 
 func await(fn func() ably.StateEnum, state ably.StateEnum) error {
@@ -42,6 +56,13 @@ func TestRealtimeConn_Connect(t *testing.T) {
 	if serial := client.Connection.Serial(); serial != -1 {
 		t.Fatalf("want serial=-1; got %d", serial)
 	}
+	rtt, err := client.Connection.Ping()
+	if err != nil {
+		t.Fatalf("Ping()=%v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("want positive round trip time; got %v", rtt)
+	}
 	if err := client.Close(); err != nil {
 		t.Fatalf("client.Close()=%v", err)
 	}
@@ -60,7 +81,7 @@ func TestRealtimeConn_NoConnect(t *testing.T) {
 	app, client := ablytest.NewRealtimeClient(opts)
 	defer safeclose(t, client, app)
 
-	client.Connection.On(rec.Channel())
+	client.Connection.Notify(rec.Channel())
 	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
 		t.Fatalf("Connect()=%v", err)
 	}
@@ -76,6 +97,55 @@ func TestRealtimeConn_NoConnect(t *testing.T) {
 	}
 }
 
+func TestRealtimeConn_NoConnectIdle(t *testing.T) {
+	// Not parallel, so that other tests don't start goroutines meanwhile.
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	states := make(chan ably.State, 8)
+	before := runtime.NumGoroutine()
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      dropConnDial(conns, out),
+		Listener:  states,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("want no goroutines started; got %d more", after-before)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state := client.Connection.State(); state != ably.StateConnInitialized {
+		t.Fatalf("want state=%v; got %v", ably.StateConnInitialized, state)
+	}
+	select {
+	case conn := <-conns:
+		t.Fatalf("want no connection dialed; got one to %s", conn.url)
+	case state := <-states:
+		t.Fatalf("want no state change; got %v", state.State)
+	default:
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	if state := <-states; state.State != ably.StateConnConnecting {
+		t.Fatalf("want state=%v; got %v", ably.StateConnConnecting, state.State)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	safeclose(t, client)
+}
+
 var connCloseTransitions = []ably.StateEnum{
 	ably.StateConnConnecting,
 	ably.StateConnConnected,
@@ -139,3 +209,2342 @@ func TestRealtimeConn_AuthError(t *testing.T) {
 		t.Fatal("Close(): want err != nil")
 	}
 }
+
+// dropConn is a proto.Conn mock, which delivers messages sent to in and fails
+// all pending and future Receive calls after drop was called. It replies
+// to CLOSE messages with CLOSED ones.
+type dropConn struct {
+	url  *url.URL
+	in   chan *proto.ProtocolMessage
+	out  chan<- *proto.ProtocolMessage
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *dropConn) Send(msg *proto.ProtocolMessage) error {
+	c.out <- msg
+	if msg.Action == proto.ActionClose {
+		c.in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+	}
+	return nil
+}
+
+func (c *dropConn) Receive() (*proto.ProtocolMessage, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-c.done:
+		return nil, errors.New("connection reset by peer")
+	}
+}
+
+func (c *dropConn) Close() error {
+	c.drop()
+	return nil
+}
+
+func (c *dropConn) drop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+func dropConnDial(conns chan<- *dropConn, out chan<- *proto.ProtocolMessage) func(string, *url.URL) (proto.Conn, error) {
+	return func(_ string, u *url.URL) (proto.Conn, error) {
+		conn := &dropConn{
+			url:  u,
+			in:   make(chan *proto.ProtocolMessage, 16),
+			out:  out,
+			done: make(chan struct{}),
+		}
+		conns <- conn
+		return conn, nil
+	}
+}
+
+// newDropConnClient gives a realtime client connected over a dropConn. The
+// returned channel receives all messages the client sends.
+func newDropConnClient(t *testing.T, opts *ably.ClientOptions) (*ably.RealtimeClient, *dropConn, <-chan *proto.ProtocolMessage) {
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	if opts.AuthCallback == nil && opts.AuthURL == "" && opts.Token == "" {
+		opts.Key = "abc:abc"
+	}
+	opts.NoConnect = true
+	opts.Dial = dropConnDial(conns, out)
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	return client, conn, out
+}
+
+// expectAction waits for a message with the given action sent by the client,
+// skipping all other ones.
+func expectAction(out <-chan *proto.ProtocolMessage, action proto.Action) (*proto.ProtocolMessage, error) {
+	timeout := time.After(ablytest.Timeout)
+	for {
+		select {
+		case msg := <-out:
+			if msg.Action == action {
+				return msg, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("waiting for %s message timed out after %v", action, ablytest.Timeout)
+		}
+	}
+}
+
+func TestRealtimeConn_ResumeOnDisconnect(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	rec := ablytest.NewStateConnRecorder(8)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      dropConnDial(conns, out),
+		Listener:  rec.Channel(),
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:           proto.ActionHeartbeat,
+		ConnectionSerial: 5,
+	}
+	conn.drop()
+	resumed := <-conns
+	if got := resumed.url.Query().Get("resume"); got != "connection-key" {
+		t.Errorf("want resume=%q; got %q", "connection-key", got)
+	}
+	if got := resumed.url.Query().Get("connection_serial"); got != "5" {
+		t.Errorf("want connection_serial=%q; got %q", "5", got)
+	}
+	resumed.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey: "connection-key",
+			ServerID:      "frontend.2",
+		},
+	}
+	want := []ably.StateEnum{
+		ably.StateConnConnecting,
+		ably.StateConnConnected,
+		ably.StateConnDisconnected,
+		ably.StateConnConnecting,
+		ably.StateConnConnected,
+	}
+	if err := rec.WaitFor(want); err != nil {
+		t.Fatal(err)
+	}
+	if serial := client.Connection.Serial(); serial != 5 {
+		t.Errorf("want serial=5; got %d", serial)
+	}
+	if id := client.Connection.ID(); id != "connection-id" {
+		t.Errorf("want id=%q; got %q", "connection-id", id)
+	}
+	if d := client.Connection.Details(); d == nil || d.ServerID != "frontend.2" {
+		t.Errorf("want details updated on reconnect with serverId=frontend.2; got %+v", d)
+	}
+	resumed.in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+}
+
+func TestRealtimeConn_ResumeRejected(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 3)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      dropConnDial(conns, out),
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test")
+	res, err = channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if msg := <-out; msg.Action != proto.ActionAttach {
+		t.Fatalf("want action=%q; got %q", proto.ActionAttach, msg.Action)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.drop()
+	rejected := <-conns
+	rejected.in <- &proto.ProtocolMessage{
+		Action: proto.ActionError,
+		Error:  &proto.ErrorInfo{Code: 80008, StatusCode: 400},
+	}
+	fresh := <-conns
+	if got := fresh.url.Query().Get("resume"); got != "" {
+		t.Errorf("want resume to be empty; got %q", got)
+	}
+	fresh.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "new-connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+	}
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkError(80008, client.Connection.Reason()); err != nil {
+		t.Error(err)
+	}
+	select {
+	case msg := <-out:
+		if msg.Action != proto.ActionAttach || msg.Channel != "test" {
+			t.Fatalf("want reattach of %q channel; got %v", "test", msg)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for channel reattach timed out after %v", ablytest.Timeout)
+	}
+	fresh.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := await(channel.State, ably.StateChanAttached); err != nil {
+		t.Fatal(err)
+	}
+	fresh.in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+}
+
+func TestRealtimeConn_StateChangeHandlers(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:   true,
+		Dial:        dropConnDial(conns, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	all := make(chan ably.ConnStateChange, 16)
+	release := make(chan struct{})
+	offAll := client.Connection.OnAll(func(change ably.ConnStateChange) {
+		all <- change
+		// A slow handler doesn't block the connection.
+		<-release
+	})
+	connected := make(chan ably.ConnStateChange, 16)
+	client.Connection.On(ably.StateConnConnected, func(change ably.ConnStateChange) {
+		connected <- change
+	})
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action: proto.ActionDisconnected,
+		Error:  &proto.ErrorInfo{StatusCode: 500, Code: 50000, Message: "fail"},
+	}
+	// The connection is retried right away.
+	conn = <-conns
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnecting, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	want := []ably.ConnStateChange{
+		{Previous: ably.StateConnInitialized, Current: ably.StateConnConnecting},
+		{Previous: ably.StateConnConnecting, Current: ably.StateConnConnected},
+		{Previous: ably.StateConnConnected, Current: ably.StateConnDisconnected},
+		{Previous: ably.StateConnDisconnected, Current: ably.StateConnConnecting},
+	}
+	for i, want := range want {
+		select {
+		case got := <-all:
+			if got.Previous != want.Previous || got.Current != want.Current {
+				t.Fatalf("%d: want %s->%s; got %s->%s", i, want.Previous, want.Current, got.Previous, got.Current)
+			}
+			if want.Current == ably.StateConnDisconnected {
+				if err := checkError(50000, got.Reason); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("%d: waiting for %s timed out", i, want.Current)
+		}
+	}
+	select {
+	case got := <-connected:
+		if got.Current != ably.StateConnConnected {
+			t.Fatalf("want state=%s; got %s", ably.StateConnConnected, got.Current)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for CONNECTED timed out")
+	}
+	// No handlers are called once they're deregistered.
+	offAll()
+	client.Connection.Off(ably.StateConnConnected)
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-all:
+		t.Fatalf("unexpected call of deregistered handler: %s->%s", got.Previous, got.Current)
+	case got := <-connected:
+		t.Fatalf("unexpected call of deregistered handler: %s->%s", got.Previous, got.Current)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRealtimeConn_StateChangeRetryIn(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	dial := dropConnDial(conns, out)
+	var dialed int
+	states := make(chan ably.State, 16)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:                true,
+		DisconnectedRetryTimeout: time.Minute,
+		Dial: func(proto string, u *url.URL) (proto.Conn, error) {
+			if dialed++; dialed > 1 {
+				return nil, errors.New("network unreachable")
+			}
+			return dial(proto, u)
+		},
+		Listener: states,
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	conn.drop()
+	want := []ably.State{
+		{State: ably.StateConnConnecting, Previous: ably.StateConnInitialized},
+		{State: ably.StateConnConnected, Previous: ably.StateConnConnecting},
+		{State: ably.StateConnDisconnected, Previous: ably.StateConnConnected},
+		{State: ably.StateConnConnecting, Previous: ably.StateConnDisconnected},
+		{State: ably.StateConnDisconnected, Previous: ably.StateConnConnecting, RetryIn: time.Minute},
+	}
+	for i, want := range want {
+		select {
+		case got := <-states:
+			// The retry delay is randomly reduced by up to 20%.
+			jittered := got.RetryIn <= want.RetryIn && got.RetryIn >= want.RetryIn*8/10
+			if got.State != want.State || got.Previous != want.Previous || !jittered {
+				t.Fatalf("%d: want %s->%s (retry in %v); got %s->%s (retry in %v)", i,
+					want.Previous, want.State, want.RetryIn, got.Previous, got.State, got.RetryIn)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("%d: waiting for %s timed out after %v", i, want.State, ablytest.Timeout)
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+	if state := client.Connection.State(); state != ably.StateConnClosed {
+		t.Fatalf("want state=%s; got %s", ably.StateConnClosed, state)
+	}
+}
+
+func TestRealtimeConn_Ping(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rtt, err := client.Connection.Ping()
+		done <- result{rtt, err}
+	}()
+	msg, err := expectAction(out, proto.ActionHeartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID == "" {
+		t.Fatal("want heartbeat with non-empty id")
+	}
+	time.Sleep(10 * time.Millisecond)
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionHeartbeat, ID: "other"}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionHeartbeat, ID: msg.ID}
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("Ping()=%v", res.err)
+		}
+		if res.rtt < 10*time.Millisecond {
+			t.Errorf("want round trip time >= 10ms; got %v", res.rtt)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for Ping timed out")
+	}
+}
+
+func TestRealtimeConn_PingNotConnected(t *testing.T) {
+	t.Parallel()
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if _, err := client.Connection.Ping(); err == nil {
+		t.Fatal("want Ping to fail on a connection which was never connected")
+	}
+}
+
+func TestRealtimeConn_PingTimeout(t *testing.T) {
+	t.Parallel()
+	states := make(chan ably.State, 1)
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{
+		RealtimeRequestTimeout: 50 * time.Millisecond,
+	})
+	defer safeclose(t, client)
+	client.Connection.Notify(states, ably.StateConnDisconnected)
+
+	// The connection is pinged periodically; when a ping isn't answered,
+	// it's considered lost.
+	if _, err := expectAction(out, proto.ActionHeartbeat); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state.Previous != ably.StateConnConnected {
+			t.Errorf("want disconnected from %s; got from %s", ably.StateConnConnected, state.Previous)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for disconnected state timed out")
+	}
+	select {
+	case <-conn.done:
+	default:
+		t.Error("want unresponsive connection closed")
+	}
+}
+
+// closeConn is a dropConn, which doesn't reply to CLOSE messages and fails
+// to send them with the closeErr error. It replies to heartbeats, so it's
+// not considered unresponsive.
+type closeConn struct {
+	*dropConn
+	closeErr error
+}
+
+func (c closeConn) Send(msg *proto.ProtocolMessage) error {
+	switch msg.Action {
+	case proto.ActionClose:
+		c.out <- msg
+		return c.closeErr
+	case proto.ActionHeartbeat:
+		c.in <- &proto.ProtocolMessage{Action: proto.ActionHeartbeat, ID: msg.ID}
+	}
+	return c.dropConn.Send(msg)
+}
+
+func TestRealtimeConn_Close(t *testing.T) {
+	t.Parallel()
+	// connect gives a client connected over a closeConn, with a message
+	// published on an attached channel, which still awaits an ACK.
+	connect := func(t *testing.T, closeErr error) (*ably.RealtimeClient, *dropConn, <-chan *proto.ProtocolMessage, ably.Result) {
+		t.Helper()
+		conns := make(chan *dropConn, 1)
+		out := make(chan *proto.ProtocolMessage, 16)
+		dial := dropConnDial(conns, out)
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions:            ably.AuthOptions{Key: "abc:abc"},
+			NoConnect:              true,
+			RealtimeRequestTimeout: 100 * time.Millisecond,
+			Dial: func(protocol string, u *url.URL) (proto.Conn, error) {
+				conn, err := dial(protocol, u)
+				return closeConn{conn.(*dropConn), closeErr}, err
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		channel := client.Channels.Get("test")
+		attach, err := channel.Attach()
+		if err != nil {
+			t.Fatalf("Attach()=%v", err)
+		}
+		if _, err := expectAction(out, proto.ActionAttach); err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+		if err := attach.Wait(); err != nil {
+			t.Fatalf("Attach()=%v", err)
+		}
+		res, err := channel.Publish("name", "data")
+		if err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+		return client, conn, out, res
+	}
+	// closed waits for the result of Close and ensures the connection
+	// is closed.
+	closed := func(t *testing.T, client *ably.RealtimeClient, errc <-chan error) {
+		t.Helper()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("Close()=%v", err)
+			}
+		case <-time.After(ablytest.Timeout):
+			t.Fatal("waiting for Close timed out")
+		}
+		if state := client.Connection.State(); state != ably.StateConnClosed {
+			t.Errorf("want state=%v; got %v", ably.StateConnClosed, state)
+		}
+	}
+
+	t.Run("acknowledged", func(t *testing.T) {
+		client, conn, out, res := connect(t, nil)
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- client.Close() }()
+		if _, err := expectAction(out, proto.ActionClose); err != nil {
+			t.Fatal(err)
+		}
+		if state := client.Connection.State(); state != ably.StateConnClosing {
+			t.Errorf("want state=%v; got %v", ably.StateConnClosing, state)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+		closed(t, client, errc)
+		if err := ablytest.Wait(res, nil); err != nil {
+			t.Errorf("Publish()=%v", err)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		client, _, out, res := connect(t, nil)
+		errc := make(chan error, 1)
+		go func() { errc <- client.Close() }()
+		if _, err := expectAction(out, proto.ActionClose); err != nil {
+			t.Fatal(err)
+		}
+		closed(t, client, errc)
+		if err := checkError(ably.ErrConnectionClosed, ablytest.Wait(res, nil)); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("connection gone", func(t *testing.T) {
+		client, _, _, res := connect(t, errors.New("broken pipe"))
+		errc := make(chan error, 1)
+		go func() { errc <- client.Close() }()
+		closed(t, client, errc)
+		if err := checkError(ably.ErrConnectionClosed, ablytest.Wait(res, nil)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRealtimeConn_ConnectedClientID(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newDropConnClient(t, &ably.ClientOptions{ClientID: "client"})
+	defer safeclose(t, client)
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey: "connection-key",
+			ClientID:      "server-client",
+		},
+	}
+	// The clientId the server identified the connection with is adopted.
+	deadline := time.Now().Add(ablytest.Timeout)
+	for client.Auth.ClientID() != "server-client" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want clientID=%q; got %q", "server-client", client.Auth.ClientID())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	channel := client.Channels.Get("test")
+	_, err := channel.PublishAll([]*proto.Message{{Name: "name", ClientID: "client"}})
+	if err := checkError(ably.ErrInvalidClientID, err); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRealtimeConn_Details(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRealtimeClient(&ably.ClientOptions{NoConnect: true})
+	defer safeclose(t, client, app)
+
+	if d := client.Connection.Details(); d != nil {
+		t.Fatalf("want nil details before connecting; got %+v", d)
+	}
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	d := client.Connection.Details()
+	if d == nil {
+		t.Fatal("want non-nil details after connecting")
+	}
+	if d.ConnectionKey != client.Connection.Key() {
+		t.Errorf("want ConnectionKey=%q; got %q", client.Connection.Key(), d.ConnectionKey)
+	}
+	if d.MaxMessageSize <= 0 || d.MaxFrameSize <= 0 || d.MaxInboundRate <= 0 {
+		t.Errorf("want positive size and rate limits; got %+v", d)
+	}
+	if d.ConnectionStateTTL <= 0 {
+		t.Errorf("want positive ConnectionStateTTL; got %d", d.ConnectionStateTTL)
+	}
+	if d.ServerID == "" {
+		t.Error("want non-empty ServerID")
+	}
+}
+
+func TestRealtimeConn_ConnectTimeout(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:              ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:                true,
+		RealtimeRequestTimeout:   50 * time.Millisecond,
+		DisconnectedRetryTimeout: time.Minute,
+		Dial:                     dropConnDial(conns, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	if err := checkError(ably.ErrTimeoutError, ablytest.Wait(res, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.Connection.State(); state != ably.StateConnDisconnected {
+		t.Errorf("want state=%v; got %v", ably.StateConnDisconnected, state)
+	}
+	select {
+	case <-conn.done:
+	default:
+		t.Error("want unconfirmed connection closed")
+	}
+}
+
+var recoveryKeyValidity = regexp.MustCompile(`^([^:]+:-?\d+:-?\d+):\d+`)
+
+// withoutValidity strips the time a recovery key is valid until from the key.
+func withoutValidity(key string) string {
+	return recoveryKeyValidity.ReplaceAllString(key, "$1")
+}
+
+func TestRealtimeConn_Recover(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	for i := 0; i < 2; i++ {
+		if _, err := channel.Publish("name", "data"); err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+		if i == 0 {
+			if _, err := expectAction(out, proto.ActionAttach); err != nil {
+				t.Fatal(err)
+			}
+			conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+		}
+		if _, err := expectAction(out, proto.ActionMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", ConnectionSerial: 5}
+	for deadline := time.Now().Add(ablytest.Timeout); client.Connection.Serial() != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want Serial()=5; got %d", client.Connection.Serial())
+		}
+	}
+	key := client.Connection.RecoveryKey()
+	if want := "connection-key:5:3"; withoutValidity(key) != want {
+		t.Fatalf("want RecoveryKey()=%q plus validity; got %q", want, key)
+	}
+	validUntil := client.Connection.RecoveryKeyValidUntil()
+	if want := client.Connection.LastActivity().Add(2 * time.Minute); !validUntil.Equal(want) {
+		t.Errorf("want RecoveryKeyValidUntil()=%v; got %v", want, validUntil)
+	}
+	if want := fmt.Sprintf("connection-key:5:3:%d", validUntil.UnixNano()/int64(time.Millisecond)); key != want {
+		t.Errorf("want RecoveryKey()=%q; got %q", want, key)
+	}
+	// dialRecover dials a new client with the given recovery key and replies to it
+	// with the given CONNECTED message.
+	dialRecover := func(t *testing.T, key string, connected *proto.ProtocolMessage) (*ably.RealtimeClient, *dropConn) {
+		conns := make(chan *dropConn, 1)
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+			Recover:     key,
+			Dial:        dropConnDial(conns, make(chan *proto.ProtocolMessage, 16)),
+		})
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- connected
+		if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+			t.Fatal(err)
+		}
+		return client, conn
+	}
+	t.Run("recovered", func(t *testing.T) {
+		recovered, conn := dialRecover(t, key, &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		})
+		defer safeclose(t, recovered)
+		query := conn.url.Query()
+		if got := query.Get("recover"); got != "connection-key" {
+			t.Errorf("want recover=%q; got %q", "connection-key", got)
+		}
+		if got := query.Get("connection_serial"); got != "5" {
+			t.Errorf("want connection_serial=%q; got %q", "5", got)
+		}
+		if err := recovered.Connection.Reason(); err != nil {
+			t.Errorf("want nil Reason(); got %v", err)
+		}
+		// Spec RTN16f
+		if got := recovered.Connection.RecoveryKey(); withoutValidity(got) != withoutValidity(key) {
+			t.Errorf("want RecoveryKey()=%q; got %q", key, got)
+		}
+	})
+	t.Run("rejected", func(t *testing.T) {
+		fresh, _ := dialRecover(t, key, &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "new-connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+			Error:             &proto.ErrorInfo{Code: 80008, StatusCode: 400},
+		})
+		defer safeclose(t, fresh)
+		if err := checkError(80008, fresh.Connection.Reason()); err != nil {
+			t.Error(err)
+		}
+		if want, got := "new-connection-key:-1:0", withoutValidity(fresh.Connection.RecoveryKey()); got != want {
+			t.Errorf("want RecoveryKey()=%q; got %q", want, got)
+		}
+	})
+	t.Run("expired key", func(t *testing.T) {
+		expired := fmt.Sprintf("connection-key:5:3:%d", time.Now().Add(-time.Second).UnixNano()/int64(time.Millisecond))
+		fresh, conn := dialRecover(t, expired, &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "new-connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+		})
+		defer safeclose(t, fresh)
+		if got := conn.url.Query().Get("recover"); got != "" {
+			t.Errorf("want recover to be empty; got %q", got)
+		}
+		if err := checkError(80008, fresh.Connection.Reason()); err != nil {
+			t.Error(err)
+		}
+		if want, got := "new-connection-key:-1:0", withoutValidity(fresh.Connection.RecoveryKey()); got != want {
+			t.Errorf("want RecoveryKey()=%q; got %q", want, got)
+		}
+	})
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+			Recover:     "invalid",
+			NoConnect:   true,
+		})
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRealtimeConn_RecoverInvalidKey(t *testing.T) {
+	t.Parallel()
+	invalid := []struct {
+		key    string
+		reason string
+	}{
+		{"invalid", "want connectionKey:connectionSerial:messageSerial"},
+		{"connection-key:5", "want connectionKey:connectionSerial:messageSerial"},
+		{"connection key:5:3", "malformed connection key"},
+		{":5:3", "malformed connection key"},
+		{"connection-key:five:3", "non-numeric connection serial"},
+		{"connection-key:5:", "non-numeric message serial"},
+		{"connection-key:5:3.0", "non-numeric message serial"},
+		{"connection-key:5:3:soon:test=serial", "non-numeric validity"},
+		{"connection-key:5:3:", "empty channel serials"},
+		{"connection-key:5:3:1600000000000:", "empty channel serials"},
+		{"connection-key:5:3:test=%zz", "malformed channel serials"},
+	}
+	for _, tt := range invalid {
+		_, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+			Recover:     tt.key,
+			NoConnect:   true,
+		})
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("%q: %v", tt.key, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%q: want error describing %q; got %v", tt.key, tt.reason, err)
+		}
+	}
+	valid := []string{
+		"connection-key:5:3",
+		"connection-key:-1:0",
+		"connection-key:5:3:1600000000000",
+		"connection-key:5:3:test=serial%3A1",
+		"connection-key:5:3:1600000000000:test=serial%3A1",
+	}
+	for _, key := range valid {
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+			Recover:     key,
+			NoConnect:   true,
+		})
+		if err != nil {
+			t.Errorf("%q: NewRealtimeClient()=%v", key, err)
+			continue
+		}
+		client.Close()
+	}
+}
+
+// cometServer mocks the comet endpoints of a realtime host.
+type cometServer struct {
+	*httptest.Server
+	in      chan *proto.ProtocolMessage // messages for the client
+	out     chan *proto.ProtocolMessage // messages sent by the client
+	connect chan url.Values             // query params of connection requests
+	ack     bool                        // whether to ACK messages in send responses
+}
+
+func newCometServer() *cometServer {
+	srv := &cometServer{
+		in:      make(chan *proto.ProtocolMessage, 16),
+		out:     make(chan *proto.ProtocolMessage, 16),
+		connect: make(chan url.Values, 1),
+	}
+	srv.Server = httptest.NewTLSServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+func (srv *cometServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var msgs []*proto.ProtocolMessage
+	switch r.URL.Path {
+	case "/comet/connect":
+		srv.connect <- r.URL.Query()
+		msgs = append(msgs, &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		})
+	case "/comet/connection-key/recv":
+		select {
+		case msg := <-srv.in:
+			msgs = append(msgs, msg)
+		case <-r.Context().Done():
+			return
+		}
+	case "/comet/connection-key/send":
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var replies []*proto.ProtocolMessage
+		for _, msg := range msgs {
+			srv.out <- msg
+			switch {
+			case msg.Action == proto.ActionClose:
+				srv.in <- &proto.ProtocolMessage{Action: proto.ActionClosed}
+			case msg.Action == proto.ActionMessage && srv.ack:
+				replies = append(replies, &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1})
+			}
+		}
+		msgs = replies
+	case "/comet/connection-key/close":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+func TestRealtimeConn_Comet(t *testing.T) {
+	t.Parallel()
+	srv := newCometServer()
+	defer srv.Close()
+	dialErr := errors.New("websockets are blocked")
+	sample := []struct {
+		desc       string
+		transports []string
+	}{
+		{"comet only", []string{ably.TransportComet}},
+		{"websocket fallback", []string{ably.TransportWebSocket, ably.TransportComet}},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+				AuthOptions:      ably.AuthOptions{Key: "abc:abc"},
+				NoConnect:        true,
+				NoBinaryProtocol: true,
+				Transports:       v.transports,
+				HTTPClient:       newTLSHTTPClientMock(srv.Server),
+				Dial: func(string, *url.URL) (proto.Conn, error) {
+					return nil, dialErr
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewRealtimeClient()=%v", err)
+			}
+			if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+				t.Fatalf("Connect()=%v", err)
+			}
+			if got := client.Connection.TransportName(); got != ably.TransportComet {
+				t.Errorf("want TransportName()=%q; got %q", ably.TransportComet, got)
+			}
+			if query := <-srv.connect; query.Get("key") != "abc:abc" {
+				t.Errorf("want key=%q query param; got %v", "abc:abc", query)
+			}
+			channel := client.Channels.Get("test")
+			res, err := channel.Publish("name", "data")
+			if err != nil {
+				t.Fatalf("Publish()=%v", err)
+			}
+			if _, err := expectAction(srv.out, proto.ActionAttach); err != nil {
+				t.Fatal(err)
+			}
+			srv.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+			msg, err := expectAction(srv.out, proto.ActionMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+			if err := res.Wait(); err != nil {
+				t.Fatalf("Wait()=%v", err)
+			}
+			if err := client.Close(); err != nil {
+				t.Fatalf("Close()=%v", err)
+			}
+		})
+	}
+}
+
+func TestRealtimeConn_CometSendResponse(t *testing.T) {
+	t.Parallel()
+	srv := newCometServer()
+	srv.ack = true
+	defer srv.Close()
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:      ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:        true,
+		NoBinaryProtocol: true,
+		Transports:       []string{ably.TransportComet},
+		HTTPClient:       newTLSHTTPClientMock(srv.Server),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	channel := client.Channels.Get("test", proto.PublishOnlyOptions())
+	res, err := channel.Publish("name", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	// The ACK comes with the response to the send request, while the long
+	// polling request is still waiting for messages.
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("want the message acknowledged; got %v", err)
+	}
+}
+
+func TestRealtimeConn_Disconnect(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:   true,
+		Dial:        dropConnDial(conns, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	channel := client.Channels.Get("test")
+	sub, err := channel.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", ChannelSerial: "serial:1"}
+	conn.in <- &proto.ProtocolMessage{
+		Action:           proto.ActionMessage,
+		Channel:          "test",
+		ChannelSerial:    "serial:2",
+		ConnectionSerial: 5,
+		Messages:         []*proto.Message{{Name: "before", Data: "data"}},
+	}
+	if err := expectMsg(sub.MessageChannel(), "before", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Connection.Disconnect()
+	if state := client.Connection.State(); state != ably.StateConnDisconnected {
+		t.Fatalf("want state=%v; got %v", ably.StateConnDisconnected, state)
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("want the transport closed")
+	}
+	if key := client.Connection.RecoveryKey(); withoutValidity(key) != "connection-key:5:1:test=serial%3A2" {
+		t.Errorf("want recovery key retained; got %q", key)
+	}
+	if state := channel.State(); state != ably.StateChanAttached {
+		t.Errorf("want channel to stay attached; got %v", state)
+	}
+	select {
+	case <-conns:
+		t.Fatal("want no reconnection until Connect is called")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	resumed := <-conns
+	if got := resumed.url.Query().Get("resume"); got != "connection-key" {
+		t.Errorf("want resume=%q; got %q", "connection-key", got)
+	}
+	if got := resumed.url.Query().Get("connection_serial"); got != "5" {
+		t.Errorf("want connection_serial=%q; got %q", "5", got)
+	}
+	resumed.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	resumed.in <- &proto.ProtocolMessage{
+		Action:           proto.ActionMessage,
+		Channel:          "test",
+		ChannelSerial:    "serial:3",
+		ConnectionSerial: 6,
+		Messages:         []*proto.Message{{Name: "after", Data: "data"}},
+	}
+	if err := expectMsg(sub.MessageChannel(), "after", "data", ablytest.Timeout, true); err != nil {
+		t.Fatal(err)
+	}
+	// The channel was resumed along with the connection, so it's not
+	// reattached.
+	for {
+		select {
+		case msg := <-out:
+			if msg.Action == proto.ActionAttach {
+				t.Fatal("want channel not reattached")
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if state := channel.State(); state != ably.StateChanAttached {
+		t.Errorf("want channel to stay attached; got %v", state)
+	}
+}
+
+func TestRealtimeConn_DisconnectStateTTL(t *testing.T) {
+	t.Parallel()
+	const stateTTL = 100 * time.Millisecond
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:           ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:             true,
+		Dial:                  dropConnDial(conns, out),
+		SuspendedRetryTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey:      "connection-key",
+			ConnectionStateTTL: int64(stateTTL / time.Millisecond),
+		},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	client.Connection.Disconnect()
+	// The connection is suspended once the state TTL expires, but it's
+	// not reconnected until Connect is called.
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnSuspended, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conns:
+		t.Fatal("want no reconnection until Connect is called")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	select {
+	case <-conns:
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("want reconnection once Connect is called")
+	}
+}
+
+func TestRealtimeConn_DisconnectWhilePublishing(t *testing.T) {
+	t.Parallel()
+	conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:   true,
+		Dial:        conn.Dial,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	// The channel isn't attached, so messages are sent right away.
+	channel := client.Channels.Get("test", proto.PublishOnlyOptions())
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Publishing fails or is queued once disconnected, but
+			// it must not touch the dropped transport.
+			channel.Publish("name", "data")
+		}
+	}()
+	if _, err := conn.WaitForSent(proto.ActionMessage, 0); err != nil {
+		t.Fatal(err)
+	}
+	client.Connection.Disconnect()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	<-done
+	if state := client.Connection.State(); state != ably.StateConnDisconnected {
+		t.Fatalf("want state=%v; got %v", ably.StateConnDisconnected, state)
+	}
+}
+
+func TestRealtimeConn_FallbackHosts(t *testing.T) {
+	t.Parallel()
+	// hostDial records the dialed hosts, failing to reach the unreachable
+	// ones like on DNS or TCP errors.
+	hostDial := func(hosts *[]string, unreachable func(host string) bool) func(string, *url.URL) (proto.Conn, error) {
+		var mtx sync.Mutex
+		dial := dropConnDial(make(chan *dropConn, 16), make(chan *proto.ProtocolMessage, 16))
+		return func(protocol string, u *url.URL) (proto.Conn, error) {
+			mtx.Lock()
+			*hosts = append(*hosts, u.Hostname())
+			mtx.Unlock()
+			if unreachable(u.Hostname()) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network unreachable")}
+			}
+			if u.Port() != "443" {
+				return nil, fmt.Errorf("want port 443; got %q", u.Port())
+			}
+			return dial(protocol, u)
+		}
+	}
+	// connect connects a client, which is closed once ctx is done.
+	connect := func(ctx context.Context, t *testing.T, opts *ably.ClientOptions) error {
+		opts.Key = "abc:abc"
+		opts.NoConnect = true
+		opts.Context = ctx
+		client, err := ably.NewRealtimeClient(opts)
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		_, err = client.Connection.Connect()
+		return err
+	}
+
+	t.Run("fallback succeeds", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var hosts []string
+		err := connect(ctx, t, &ably.ClientOptions{
+			FallbackHosts: []string{"a.example.com", "b.example.com", "c.example.com"},
+			Dial: hostDial(&hosts, func(host string) bool {
+				return host != "b.example.com"
+			}),
+		})
+		if err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		if len(hosts) < 2 || hosts[0] != "realtime.ably.io" || hosts[len(hosts)-1] != "b.example.com" {
+			t.Errorf("want realtime.ably.io, then fallbacks up to b.example.com dialed; got %v", hosts)
+		}
+	})
+	t.Run("environment", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var hosts []string
+		err := connect(ctx, t, &ably.ClientOptions{
+			Environment: "sandbox",
+			Dial: hostDial(&hosts, func(host string) bool {
+				return host == "sandbox-realtime.ably.io"
+			}),
+		})
+		if err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		if len(hosts) != 2 || hosts[0] != "sandbox-realtime.ably.io" {
+			t.Fatalf("want sandbox-realtime.ably.io and a fallback dialed; got %v", hosts)
+		}
+		if h := hosts[1]; !strings.HasPrefix(h, "sandbox-") || !strings.HasSuffix(h, "-fallback.ably-realtime.com") {
+			t.Errorf("want sandbox fallback host; got %q", h)
+		}
+	})
+	t.Run("retry count", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var hosts []string
+		err := connect(ctx, t, &ably.ClientOptions{
+			FallbackHosts:     []string{"a.example.com", "b.example.com", "c.example.com"},
+			HTTPMaxRetryCount: 2,
+			Dial: hostDial(&hosts, func(string) bool {
+				return true
+			}),
+		})
+		if err == nil {
+			t.Fatal("want Connect() to fail")
+		}
+		if len(hosts) != 3 {
+			t.Errorf("want the primary and 2 fallback hosts dialed; got %v", hosts)
+		}
+	})
+	t.Run("custom host", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var hosts []string
+		err := connect(ctx, t, &ably.ClientOptions{
+			RealtimeHost: "custom.example.com",
+			Dial: hostDial(&hosts, func(string) bool {
+				return true
+			}),
+		})
+		if err == nil {
+			t.Fatal("want Connect() to fail")
+		}
+		if want := []string{"custom.example.com"}; !reflect.DeepEqual(hosts, want) {
+			t.Errorf("want dialed hosts=%v; got %v", want, hosts)
+		}
+	})
+}
+
+func TestRealtimeConn_CloseWhileDialing(t *testing.T) {
+	t.Parallel()
+	dialed := make(chan string, 16)
+	release := make(chan struct{})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		FallbackHosts: []string{"a.example.com", "b.example.com"},
+		NoConnect:     true,
+		Dial: func(protocol string, u *url.URL) (proto.Conn, error) {
+			dialed <- u.Hostname()
+			<-release
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network unreachable")}
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	connectErr := make(chan error, 1)
+	go func() {
+		_, err := client.Connection.Connect()
+		connectErr <- err
+	}()
+	select {
+	case <-dialed:
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for dial timed out after %v", ablytest.Timeout)
+	}
+	// The connection isn't locked while dialing.
+	if state := client.Connection.State(); state != ably.StateConnConnecting {
+		t.Fatalf("want state=%v; got %v", ably.StateConnConnecting, state)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+	close(release)
+	select {
+	case err := <-connectErr:
+		if err == nil {
+			t.Fatal("want Connect() to fail once aborted")
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for Connect() timed out after %v", ablytest.Timeout)
+	}
+	// No fallback hosts are tried once the connection is closed.
+	select {
+	case host := <-dialed:
+		t.Fatalf("unexpected dial of %s after Close()", host)
+	default:
+	}
+	if state := client.Connection.State(); state != ably.StateConnClosed {
+		t.Fatalf("want state=%v; got %v", ably.StateConnClosed, state)
+	}
+}
+
+func TestRealtimeConn_Transports(t *testing.T) {
+	t.Parallel()
+	for _, transports := range [][]string{{}, {"xhr_streaming"}} {
+		_, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+			NoConnect:   true,
+			Transports:  transports,
+		})
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("Transports=%v: %v", transports, err)
+		}
+	}
+}
+
+func TestRealtimeConn_RetryBackoff(t *testing.T) {
+	t.Parallel()
+	const initial = 20 * time.Millisecond
+	const failures = 5
+	conns := make(chan *dropConn, 2)
+	dial := dropConnDial(conns, make(chan *proto.ProtocolMessage, 16))
+	var mtx sync.Mutex
+	var dialed int
+	states := make(chan ably.State, 64)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions:              ably.AuthOptions{Key: "abc:abc"},
+		NoConnect:                true,
+		DisconnectedRetryTimeout: initial,
+		FallbackHosts:            []string{}, // every attempt dials once
+		Dial: func(proto string, u *url.URL) (proto.Conn, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			// Dial the first connection, fail the following attempts to
+			// reconnect and then let the connection be resumed.
+			if dialed++; dialed > 1 && dialed <= failures+1 {
+				return nil, errors.New("network unreachable")
+			}
+			return dial(proto, u)
+		},
+		Listener: states,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	connected := &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- connected
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	// retries gives the delays of the reconnection attempts which follow
+	// a dropped connection, until the connection is connected again.
+	retries := func() []time.Duration {
+		var delays []time.Duration
+		for {
+			select {
+			case state := <-states:
+				switch state.State {
+				case ably.StateConnDisconnected:
+					delays = append(delays, state.RetryIn)
+				case ably.StateConnConnected:
+					return delays
+				}
+			case <-time.After(ablytest.Timeout):
+				t.Fatalf("waiting for reconnect timed out; retries so far: %v", delays)
+			}
+		}
+	}
+	for len(states) != 0 {
+		<-states
+	}
+	conn.drop()
+	conn = <-conns
+	conn.in <- connected
+	delays := retries()
+	if len(delays) != failures+1 {
+		t.Fatalf("want %d retries; got %v", failures+1, delays)
+	}
+	if delays[0] != 0 {
+		t.Errorf("want immediate first retry; got %v", delays[0])
+	}
+	for i, delay := range delays[1:] {
+		// Spec RTB1
+		backoff := i + 3
+		if backoff > 6 {
+			backoff = 6
+		}
+		max := initial * time.Duration(backoff) / 3
+		if delay > max || delay < max*8/10 {
+			t.Errorf("%d: want retry delay within [%v, %v]; got %v", i, max*8/10, max, delay)
+		}
+	}
+	if delays[1] == delays[2] && delays[2] == delays[3] {
+		t.Errorf("want jittered retry delays; got %v", delays)
+	}
+	// The backoff starts over once connected.
+	mtx.Lock()
+	dialed = 1
+	mtx.Unlock()
+	conn.drop()
+	conn = <-conns
+	conn.in <- connected
+	delays = retries()
+	if len(delays) < 2 || delays[1] > initial || delays[1] < initial*8/10 {
+		t.Errorf("want the first delayed retry within [%v, %v]; got %v", initial*8/10, initial, delays)
+	}
+}
+
+func TestRealtimeConn_ConnectCtx(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      dropConnDial(conns, out),
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Connection.ConnectCtx(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want ConnectCtx()=%v; got %v", context.DeadlineExceeded, err)
+	}
+	// Cancelling does not abort the connection attempt itself.
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connection.ConnectCtx(context.Background()); err != nil {
+		t.Fatalf("ConnectCtx()=%v", err)
+	}
+}
+
+func TestRealtimeConn_AckNack(t *testing.T) {
+	t.Parallel()
+	// publish connects a client over a dropConn, attaches a channel and
+	// publishes a message on it, which isn't acknowledged yet.
+	publish := func(t *testing.T, opts *ably.ClientOptions) (*ably.RealtimeClient, chan *dropConn, <-chan *proto.ProtocolMessage, ably.Result, *proto.ProtocolMessage) {
+		conns := make(chan *dropConn, 1)
+		out := make(chan *proto.ProtocolMessage, 16)
+		opts.Key = "abc:abc"
+		opts.NoConnect = true
+		opts.Dial = dropConnDial(conns, out)
+		client, err := ably.NewRealtimeClient(opts)
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+		}
+		if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Channels.Get("test").Publish("name", "data")
+		if err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+		if _, err := expectAction(out, proto.ActionAttach); err != nil {
+			t.Fatal(err)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Put the conn back, so the caller can use it.
+		conns <- conn
+		return client, conns, out, res, msg
+	}
+	t.Run("ACK", func(t *testing.T) {
+		t.Parallel()
+		client, conns, _, res, msg := publish(t, &ably.ClientOptions{})
+		defer safeclose(t, client)
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+		if err := ablytest.Wait(res, nil); err != nil {
+			t.Fatalf("Wait()=%v", err)
+		}
+	})
+	t.Run("NACK", func(t *testing.T) {
+		t.Parallel()
+		client, conns, _, res, msg := publish(t, &ably.ClientOptions{})
+		defer safeclose(t, client)
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:    proto.ActionNack,
+			MsgSerial: msg.MsgSerial,
+			Count:     1,
+			Error:     &proto.ErrorInfo{StatusCode: 401, Code: 40160, Message: "operation not permitted"},
+		}
+		err := ablytest.Wait(res, nil)
+		if err := checkError(ably.ErrOperationNotPermittedWithProvidedCapability, err); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		client, conns, _, res, msg := publish(t, &ably.ClientOptions{RealtimeRequestTimeout: 50 * time.Millisecond})
+		defer safeclose(t, client)
+		err := ablytest.Wait(res, nil)
+		if err := checkError(ably.ErrTimeoutError, err); err != nil {
+			t.Fatal(err)
+		}
+		// A late ACK is ignored.
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+	})
+	t.Run("resent when not resumed", func(t *testing.T) {
+		t.Parallel()
+		client, conns, out, res, _ := publish(t, &ably.ClientOptions{})
+		defer safeclose(t, client)
+		(<-conns).Close()
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "new-connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+			Error:             &proto.ErrorInfo{StatusCode: 400, Code: 80008, Message: "unable to resume"},
+		}
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MsgSerial != 0 {
+			t.Errorf("want resent message with serial 0; got %d", msg.MsgSerial)
+		}
+		conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+		if err := ablytest.Wait(res, nil); err != nil {
+			t.Fatalf("Wait()=%v", err)
+		}
+	})
+	t.Run("failed when not resumed with NoQueueing", func(t *testing.T) {
+		t.Parallel()
+		client, conns, _, res, _ := publish(t, &ably.ClientOptions{NoQueueing: true})
+		defer safeclose(t, client)
+		(<-conns).Close()
+		conn := <-conns
+		conn.in <- &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      "new-connection-id",
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "new-connection-key"},
+		}
+		err := ablytest.Wait(res, nil)
+		if err := checkError(ably.ErrDisconnected, err); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRealtimeConn_SuspendOnIdle(t *testing.T) {
+	t.Parallel()
+	const (
+		requestTimeout = 500 * time.Millisecond
+		maxIdle        = 50 * time.Millisecond
+		stateTTL       = 200 * time.Millisecond
+	)
+	conns := make(chan *dropConn, 4)
+	out := make(chan *proto.ProtocolMessage, 64)
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:              true,
+		Dial:                   dropConnDial(conns, out),
+		RealtimeRequestTimeout: requestTimeout,
+		SuspendedRetryTimeout:  time.Minute,
+	}
+	client, err := ably.NewRealtimeClient(opts)
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer client.Close()
+	states := make(chan ably.State, 8)
+	client.Connection.Notify(states, ably.StateConnDisconnected, ably.StateConnSuspended)
+	res, err := client.Connection.Connect()
+	if err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:       proto.ActionConnected,
+		ConnectionID: "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{
+			ConnectionKey:      "connection-key",
+			MaxIdleInterval:    int64(maxIdle / time.Millisecond),
+			ConnectionStateTTL: int64(stateTTL / time.Millisecond),
+		},
+	}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	if d := client.Connection.Details(); d == nil || d.ConnectionStateTTL != int64(stateTTL/time.Millisecond) {
+		t.Fatalf("want ConnectionStateTTL=%d; got %+v", stateTTL/time.Millisecond, d)
+	}
+	channel := client.Channels.Get("test")
+	attach, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := attach.Wait(); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	// The transport goes silent from now on.
+	start := time.Now()
+	expectState := func(want ably.StateEnum) time.Time {
+		t.Helper()
+		select {
+		case state := <-states:
+			if state.State != want {
+				t.Fatalf("want state=%v; got %v", want, state.State)
+			}
+			return time.Now()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("waiting for state=%v timed out", want)
+		}
+		return time.Time{}
+	}
+	disconnected := expectState(ably.StateConnDisconnected)
+	if d := disconnected.Sub(start); d < maxIdle || d >= 2*requestTimeout {
+		t.Errorf("want idle connection to be dropped after %v; got %v", maxIdle+requestTimeout, d)
+	}
+	suspended := expectState(ably.StateConnSuspended)
+	if d := suspended.Sub(disconnected); d < stateTTL || d >= requestTimeout {
+		t.Errorf("want connection to be suspended after %v; got %v", stateTTL, d)
+	}
+	if d := client.Connection.Details(); d != nil {
+		t.Errorf("want recovery state to be cleared; got %+v", d)
+	}
+	if key := client.Connection.RecoveryKey(); key != "" {
+		t.Errorf("want empty recovery key; got %q", key)
+	}
+	if err := await(channel.State, ably.StateChanSuspended); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeConn_TransportParams(t *testing.T) {
+	t.Parallel()
+	conns := make(chan *dropConn, 2)
+	out := make(chan *proto.ProtocolMessage, 16)
+	rec := ablytest.NewMessageRecorder()
+	params := map[string]string{
+		"heartbeats":       "true",
+		"remainPresentFor": "5000",
+		"custom":           "a b&c=d",
+	}
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:       true,
+		Dial:            rec.Hijack(dropConnDial(conns, out)),
+		TransportParams: params,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, client)
+	if _, err := client.Connection.Connect(); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	conn := <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := await(client.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	conn.drop()
+	conn = <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	urls := rec.URL()
+	if len(urls) != 2 {
+		t.Fatalf("want 2 connection requests; got %d", len(urls))
+	}
+	for i, u := range urls {
+		query := u.Query()
+		for k, v := range params {
+			if got := query.Get(k); got != v {
+				t.Errorf("%d: want %s=%q; got %q", i, k, v, got)
+			}
+		}
+		if got := query.Get("key"); got != "abc:abc" {
+			t.Errorf("%d: want key=%q; got %q", i, "abc:abc", got)
+		}
+	}
+	if got := urls[1].Query().Get("resume"); got != "connection-key" {
+		t.Errorf("want resume=%q; got %q", "connection-key", got)
+	}
+	for _, k := range []string{"key", "resume", ""} {
+		_, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions:     ably.AuthOptions{Key: "abc:abc"},
+			NoConnect:       true,
+			TransportParams: map[string]string{k: "value"},
+		})
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("transport param %q: %v", k, err)
+		}
+	}
+}
+
+func TestRealtimeConn_NoEcho(t *testing.T) {
+	t.Parallel()
+	for _, noEcho := range []bool{false, true} {
+		conns := make(chan *dropConn, 1)
+		out := make(chan *proto.ProtocolMessage, 16)
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key: "abc:abc",
+			},
+			NoConnect: true,
+			NoEcho:    noEcho,
+			Dial:      dropConnDial(conns, out),
+		})
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		if _, err := client.Connection.Connect(); err != nil {
+			t.Fatalf("Connect()=%v", err)
+		}
+		conn := <-conns
+		want := strconv.FormatBool(!noEcho)
+		if got := conn.url.Query().Get("echo"); got != want {
+			t.Errorf("NoEcho=%t: want echo=%q; got %q", noEcho, want, got)
+		}
+		client.Close()
+	}
+}
+
+func TestRealtimeConn_RecoverChannelSerials(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("chat:lobby")
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "chat:lobby", ChannelSerial: "serial:1"}
+	conn.in <- &proto.ProtocolMessage{
+		Action:           proto.ActionMessage,
+		Channel:          "chat:lobby",
+		ChannelSerial:    "serial:2",
+		ConnectionSerial: 2,
+		Messages:         []*proto.Message{{Name: "name", Data: "data"}},
+	}
+	for deadline := time.Now().Add(ablytest.Timeout); channel.Serial() != "serial:2"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want Serial()=%q; got %q", "serial:2", channel.Serial())
+		}
+	}
+	key := client.Connection.RecoveryKey()
+	if want := "connection-key:2:1:chat%3Alobby=serial%3A2"; withoutValidity(key) != want {
+		t.Fatalf("want RecoveryKey()=%q; got %q", want, key)
+	}
+
+	// A new client recovering the connection attaches the channel from the
+	// serial it was left at.
+	conns := make(chan *dropConn, 1)
+	recoveredOut := make(chan *proto.ProtocolMessage, 16)
+	recovered, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "abc:abc"},
+		Recover:     key,
+		Dial:        dropConnDial(conns, recoveredOut),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer safeclose(t, recovered)
+	conn = <-conns
+	conn.in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	if err := await(recovered.Connection.State, ably.StateConnConnected); err != nil {
+		t.Fatal(err)
+	}
+	if got := recovered.Connection.RecoveryKey(); withoutValidity(got) != withoutValidity(key) {
+		t.Errorf("want RecoveryKey()=%q; got %q", key, got)
+	}
+	channel = recovered.Channels.Get("chat:lobby")
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	msg, err := expectAction(recoveredOut, proto.ActionAttach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ChannelSerial != "serial:2" {
+		t.Fatalf("want ATTACH with channelSerial=%q; got %q", "serial:2", msg.ChannelSerial)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "chat:lobby", ChannelSerial: "serial:2", Flags: proto.FlagResumed}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "chat:lobby", ChannelSerial: "serial:3"}
+	for deadline := time.Now().Add(ablytest.Timeout); channel.Serial() != "serial:3"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want Serial()=%q; got %q", "serial:3", channel.Serial())
+		}
+	}
+	if got, want := withoutValidity(recovered.Connection.RecoveryKey()), "connection-key:2:2:chat%3Alobby=serial%3A3"; got != want {
+		t.Errorf("want RecoveryKey()=%q; got %q", want, got)
+	}
+}
+
+func TestRealtimeConn_ScriptedConn(t *testing.T) {
+	t.Parallel()
+	in := make(chan *proto.ProtocolMessage, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	rec := ablytest.NewStateConnRecorder(16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:                true,
+		Dial:                     ablytest.MessagePipe(in, out),
+		Listener:                 rec.Channel(),
+		DisconnectedRetryTimeout: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer rec.Stop()
+	connected := &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	in <- connected
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	// The server disconnects the client, which then resumes the connection.
+	in <- &proto.ProtocolMessage{Action: proto.ActionDisconnected}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnecting, 0); err != nil {
+		t.Fatal(err)
+	}
+	in <- connected
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	in <- &proto.ProtocolMessage{
+		Action: proto.ActionError,
+		Error:  &proto.ErrorInfo{Code: 80000, StatusCode: 400, Message: "fatal"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnFailed, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []ably.StateEnum{
+		ably.StateConnConnecting,
+		ably.StateConnConnected,
+		ably.StateConnDisconnected,
+		ably.StateConnConnecting,
+		ably.StateConnConnected,
+		ably.StateConnFailed,
+	}
+	if err := rec.WaitFor(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkError(80000, client.Connection.Reason()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimeConn_Once(t *testing.T) {
+	t.Parallel()
+	in := make(chan *proto.ProtocolMessage, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      ablytest.MessagePipe(in, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	connected := client.Connection.Once(ably.StateConnConnected)
+	select {
+	case st := <-connected:
+		t.Fatalf("unexpected state change before connecting: %v", st)
+	default:
+	}
+	in <- &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	client.Connection.Connect()
+	select {
+	case st := <-connected:
+		if st.Current != ably.StateConnConnected {
+			t.Fatalf("want state=%v; got %v", ably.StateConnConnected, st.Current)
+		}
+		if st.Previous != ably.StateConnConnecting {
+			t.Fatalf("want previous=%v; got %v", ably.StateConnConnecting, st.Previous)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for CONNECTED timed out")
+	}
+	// Once the state has been reached, the channel is resolved immediately.
+	select {
+	case st := <-client.Connection.Once(ably.StateConnConnected):
+		if st.Current != ably.StateConnConnected {
+			t.Fatalf("want state=%v; got %v", ably.StateConnConnected, st.Current)
+		}
+		if st.Previous != 0 {
+			t.Fatalf("want no previous state; got %v", st.Previous)
+		}
+	default:
+		t.Fatal("want Once to resolve immediately in the current state")
+	}
+}
+
+func TestRealtimeConn_ErrorReason(t *testing.T) {
+	t.Parallel()
+	in := make(chan *proto.ProtocolMessage, 1)
+	out := make(chan *proto.ProtocolMessage, 16)
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect: true,
+		Dial:      ablytest.MessagePipe(in, out),
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	if !client.Connection.LastActivity().IsZero() {
+		t.Fatalf("want zero LastActivity before connecting; got %v", client.Connection.LastActivity())
+	}
+	connected := &proto.ProtocolMessage{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}
+	before := time.Now()
+	in <- connected
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	if reason := client.Connection.ErrorReason(); reason != nil {
+		t.Fatalf("want nil ErrorReason once connected; got %v", reason)
+	}
+	if last := client.Connection.LastActivity(); last.Before(before) {
+		t.Fatalf("want LastActivity after %v; got %v", before, last)
+	}
+	// The server forcibly disconnects the client.
+	in <- &proto.ProtocolMessage{
+		Action: proto.ActionDisconnected,
+		Error:  &proto.ErrorInfo{Code: 80003, StatusCode: 500, Message: "forced"},
+	}
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnDisconnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkError(80003, client.Connection.ErrorReason()); err != nil {
+		t.Fatal(err)
+	}
+	// The reason is kept while reconnecting, and cleared once connected.
+	in <- connected
+	if err := ablytest.WaitConnState(client.Connection, ably.StateConnConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	if reason := client.Connection.ErrorReason(); reason != nil {
+		t.Fatalf("want nil ErrorReason after reconnecting; got %v", reason)
+	}
+}
+
+func TestRealtimeConn_MsgSerialAcks(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	res, err := channel.Attach()
+	if err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	const start = 100
+	client.Connection.SetMsgSerial(start)
+	var results []ably.Result
+	for i := 0; i < 3; i++ {
+		res, err := channel.Publish("name", strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Publish()=%v", err)
+		}
+		results = append(results, res)
+		msg, err := expectAction(out, proto.ActionMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(start + i); msg.MsgSerial != want {
+			t.Fatalf("want msgSerial=%d; got %d", want, msg.MsgSerial)
+		}
+	}
+	if serial := client.Connection.MsgSerial(); serial != start+3 {
+		t.Fatalf("want next msgSerial=%d; got %d", start+3, serial)
+	}
+	// Each ACK or NACK resolves the messages with the serials it refers to,
+	// while the following ones are still pending.
+	wait := func(res ably.Result) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- res.Wait() }()
+		return done
+	}
+	pending := wait(results[1])
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: start, Count: 1}
+	if err := ablytest.Wait(results[0], nil); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+	select {
+	case err := <-pending:
+		t.Fatalf("want the second message pending; got Wait()=%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:    proto.ActionNack,
+		MsgSerial: start + 1,
+		Count:     1,
+		Error:     &proto.ErrorInfo{StatusCode: 400, Code: 40000, Message: "rejected"},
+	}
+	select {
+	case err := <-pending:
+		if err := checkError(40000, err); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for NACK timed out")
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: start + 2, Count: 1}
+	if err := ablytest.Wait(results[2], nil); err != nil {
+		t.Fatalf("Wait()=%v", err)
+	}
+}
+
+func TestRealtimeConn_StoreRecoveryKey(t *testing.T) {
+	t.Parallel()
+	// The storage outlives the clients, which are restarted.
+	var mtx sync.Mutex
+	var stored string
+	keys := make(chan string, 16)
+	store := func(key string) {
+		mtx.Lock()
+		stored = key
+		mtx.Unlock()
+		keys <- key
+	}
+	load := func() string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return stored
+	}
+	expectKey := func(prefix string) string {
+		t.Helper()
+		select {
+		case key := <-keys:
+			if !strings.HasPrefix(key, prefix) {
+				t.Fatalf("want stored key with prefix %q; got %q", prefix, key)
+			}
+			return key
+		case <-time.After(ablytest.Timeout):
+			t.Fatalf("waiting for stored key with prefix %q timed out", prefix)
+			return ""
+		}
+	}
+	newClient := func(conn *ablytest.ScriptedConn) (*ably.RealtimeClient, <-chan *url.URL) {
+		urls := make(chan *url.URL, 1)
+		client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key: "abc:abc",
+			},
+			Dial: func(proto string, u *url.URL) (proto.Conn, error) {
+				// Only the first connection attempt is of interest.
+				select {
+				case urls <- u:
+				default:
+				}
+				return conn.Dial(proto, u)
+			},
+			DisconnectedRetryTimeout: time.Hour,
+			RecoverCallback:          load,
+			StoreRecoveryKey:         store,
+		})
+		if err != nil {
+			t.Fatalf("NewRealtimeClient()=%v", err)
+		}
+		return client, urls
+	}
+	connected := func(id, key string) *proto.ProtocolMessage {
+		return &proto.ProtocolMessage{
+			Action:            proto.ActionConnected,
+			ConnectionID:      id,
+			ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: key},
+		}
+	}
+
+	// The first run has got nothing to recover and stores the key of its
+	// connection, which changes with the received serials.
+	conn1 := ablytest.NewScriptedConn([]*proto.ProtocolMessage{connected("id-1", "key-1")})
+	client1, urls := newClient(conn1)
+	if u := <-urls; u.Query().Get("recover") != "" {
+		t.Fatalf("want no recover param; got %q", u.Query().Get("recover"))
+	}
+	expectKey("key-1:-1:0:")
+	conn1.Push(&proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", ConnectionSerial: 3})
+	expectKey("key-1:3:0:")
+	// A heartbeat only extends the validity of the key, which isn't stored;
+	// the time passes so the validity changes in milliseconds.
+	time.Sleep(10 * time.Millisecond)
+	conn1.Push(&proto.ProtocolMessage{Action: proto.ActionHeartbeat})
+	conn1.Push(&proto.ProtocolMessage{Action: proto.ActionMessage, Channel: "test", ConnectionSerial: 4})
+	expectKey("key-1:4:0:")
+	// The app is suspended, so the connection just drops.
+	conn1.Close()
+	if err := ablytest.WaitConnState(client1.Connection, ably.StateConnDisconnected, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second run recovers the stored connection.
+	conn2 := ablytest.NewScriptedConn([]*proto.ProtocolMessage{connected("id-1", "key-2")})
+	client2, urls := newClient(conn2)
+	u := <-urls
+	if recover := u.Query().Get("recover"); recover != "key-1" {
+		t.Fatalf("want recover=key-1; got %q", recover)
+	}
+	if serial := u.Query().Get("connection_serial"); serial != "4" {
+		t.Fatalf("want connection_serial=4; got %q", serial)
+	}
+	expectKey("key-2:4:0:")
+	// Closing the connection makes it unrecoverable.
+	if err := client2.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+	expectKey("")
+	if key := load(); key != "" {
+		t.Fatalf("want stored key to be cleared; got %q", key)
+	}
+}
+
+func TestRealtimeConn_RequestID(t *testing.T) {
+	t.Parallel()
+	rec := ablytest.NewMessageRecorder()
+	conn := ablytest.NewScriptedConn([]*proto.ProtocolMessage{{
+		Action:            proto.ActionConnected,
+		ConnectionID:      "connection-id",
+		ConnectionDetails: &proto.ConnectionDetails{ConnectionKey: "connection-key"},
+	}})
+	client, err := ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:     true,
+		Dial:          rec.Hijack(conn.Dial),
+		AddRequestIDs: true,
+	})
+	if err != nil {
+		t.Fatalf("NewRealtimeClient()=%v", err)
+	}
+	defer conn.Close()
+	if err := ablytest.Wait(client.Connection.Connect()); err != nil {
+		t.Fatalf("Connect()=%v", err)
+	}
+	urls := rec.URL()
+	if len(urls) != 1 {
+		t.Fatalf("want 1 connection attempt; got %d", len(urls))
+	}
+	if id := urls[0].Query().Get("request_id"); id == "" {
+		t.Fatal("want non-empty request_id")
+	}
+	// The param is set by the library only.
+	_, err = ably.NewRealtimeClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoConnect:       true,
+		TransportParams: map[string]string{"request_id": "id"},
+	})
+	if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+		t.Fatal(err)
+	}
+}
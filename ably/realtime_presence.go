@@ -21,23 +21,27 @@ const (
 // client or on behalf of other client.
 type RealtimePresence struct {
 	mtx       sync.Mutex
-	data      interface{}
 	serial    string
 	subs      *subscriptions
 	channel   *RealtimeChannel
 	members   map[string]*proto.PresenceMessage
 	stale     map[string]struct{}
-	state     proto.PresenceState
+	entered   map[string]enteredClient // clients entered by this connection
+	enterSeq  uint64                   // identifies the last enter or update
+	attached  bool                     // whether the channel has ever been attached
 	syncMtx   sync.Mutex
 	syncState syncState
+	syncDone  chan struct{} // closed once the ongoing or awaited sync completes
 }
 
 func newRealtimePresence(channel *RealtimeChannel) *RealtimePresence {
 	pres := &RealtimePresence{
-		subs:      newSubscriptions(subscriptionPresenceMessages, channel.logger()),
+		subs:      newSubscriptions(subscriptionPresenceMessages, channel.opts().InboundBufferSize, channel.logger()),
 		channel:   channel,
 		members:   make(map[string]*proto.PresenceMessage),
+		entered:   make(map[string]enteredClient),
 		syncState: syncInitial,
+		syncDone:  make(chan struct{}),
 	}
 	// Lock syncMtx to make all callers to Get(true) wait until the presence
 	// is in initial sync state. This is to not make them early return
@@ -46,6 +50,13 @@ func newRealtimePresence(channel *RealtimeChannel) *RealtimePresence {
 	return pres
 }
 
+// enteredClient is the data a client entered the presence with, recorded to
+// re-enter it after the attachment lost its continuity.
+type enteredClient struct {
+	data interface{}
+	seq  uint64 // enterSeq of the enter or update which set the data
+}
+
 func (pres *RealtimePresence) verifyChanState() error {
 	switch state := pres.channel.State(); state {
 	case StateChanDetached, StateChanDetaching, StateChanClosing, StateChanClosed, StateChanFailed:
@@ -56,18 +67,70 @@ func (pres *RealtimePresence) verifyChanState() error {
 }
 
 func (pres *RealtimePresence) send(msg *proto.PresenceMessage) (Result, error) {
+	protomsg, err := pres.protocolMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return pres.channel.send(protomsg)
+}
+
+// protocolMessage attaches the channel and wraps msg to be sent on it.
+func (pres *RealtimePresence) protocolMessage(msg *proto.PresenceMessage) (*proto.ProtocolMessage, error) {
 	if _, err := pres.channel.attach(false); err != nil {
 		return nil, err
 	}
 	if err := pres.verifyChanState(); err != nil {
 		return nil, err
 	}
-	protomsg := &proto.ProtocolMessage{
+	if opts := pres.channel.channelOptions(); opts != nil {
+		msg.ChannelOptions = opts
+	}
+	return &proto.ProtocolMessage{
 		Action:   proto.ActionPresence,
 		Channel:  pres.channel.state.channel,
 		Presence: []*proto.PresenceMessage{msg},
+	}, nil
+}
+
+// sendEntered sends an enter or update message which recorded the client as
+// entered; the record is removed if the message is not sent or gets NACKed,
+// so a rejected client is not re-entered later.
+func (pres *RealtimePresence) sendEntered(msg *proto.PresenceMessage, seq uint64) (Result, error) {
+	forget := func() {
+		pres.mtx.Lock()
+		if e, ok := pres.entered[msg.ClientID]; ok && e.seq == seq {
+			delete(pres.entered, msg.ClientID)
+		}
+		pres.mtx.Unlock()
 	}
-	return pres.channel.send(protomsg)
+	protomsg, err := pres.protocolMessage(msg)
+	if err != nil {
+		forget()
+		return nil, err
+	}
+	ack := make(chan error, 1)
+	res, listen := newErrResult()
+	if err := pres.channel.sendTo(protomsg, ack, res); err != nil {
+		forget()
+		return nil, err
+	}
+	done := make(chan struct{})
+	cancel := res.cancel
+	res.cancel = func() {
+		cancel()
+		close(done)
+	}
+	go func() {
+		select {
+		case err := <-ack:
+			if err != nil {
+				forget()
+			}
+			listen <- err
+		case <-done:
+		}
+	}()
+	return res, nil
 }
 
 func (pres *RealtimePresence) syncWait() {
@@ -88,16 +151,45 @@ func syncSerial(msg *proto.ProtocolMessage) string {
 func (pres *RealtimePresence) onAttach(msg *proto.ProtocolMessage) {
 	serial := syncSerial(msg)
 	pres.mtx.Lock()
-	defer pres.mtx.Unlock()
 	switch {
 	case msg.Flags.Has(proto.FlagPresence) || serial != "":
 		pres.syncStart(serial)
 	case pres.syncState == syncInitial:
 		pres.syncState = syncComplete
 		pres.syncMtx.Unlock()
+		close(pres.syncDone)
+	}
+	var reenter map[string]interface{}
+	if pres.attached && !msg.Flags.Has(proto.FlagResumed) {
+		reenter = make(map[string]interface{}, len(pres.entered))
+		for clientID, e := range pres.entered {
+			reenter[clientID] = e.data
+		}
+	}
+	pres.attached = true
+	pres.mtx.Unlock()
+	// Spec RTP17i
+	for clientID, data := range reenter {
+		pres.reenter(clientID, data)
 	}
 }
 
+// reenter sends an enter message for the given client, which was present
+// on the channel before the continuity of the attachment was lost.
+func (pres *RealtimePresence) reenter(clientID string, data interface{}) {
+	msg := &proto.PresenceMessage{
+		State: proto.PresenceEnter,
+	}
+	msg.ClientID = clientID
+	msg.Data = data
+	res, err := pres.send(msg)
+	go func() {
+		if err := wait(res, err); err != nil {
+			pres.logger().Printf(LogWarning, "failed to re-enter clientID=%q on channel %q: %v", clientID, pres.channel.Name, err)
+		}
+	}()
+}
+
 // SyncComplete gives true if the initial SYNC operation has completed
 // for the members present on the channel.
 func (pres *RealtimePresence) SyncComplete() bool {
@@ -106,6 +198,17 @@ func (pres *RealtimePresence) SyncComplete() bool {
 	return pres.syncState == syncComplete
 }
 
+// SyncDone gives a channel which is closed once the members present on
+// the channel are synced: when the ongoing SYNC, which may span multiple
+// messages, completes or, before the channel is attached, when the initial
+// one does. If no sync is ongoing, the returned channel is already closed.
+// A channel is closed only once; call SyncDone again to await the next sync.
+func (pres *RealtimePresence) SyncDone() <-chan struct{} {
+	pres.mtx.Lock()
+	defer pres.mtx.Unlock()
+	return pres.syncDone
+}
+
 func (pres *RealtimePresence) syncStart(serial string) {
 	if pres.syncState == syncInProgress {
 		return
@@ -113,6 +216,7 @@ func (pres *RealtimePresence) syncStart(serial string) {
 		// Sync has started, make all callers to Get(true) wait. If it's channel's
 		// initial sync, the callers are already waiting.
 		pres.syncMtx.Lock()
+		pres.syncDone = make(chan struct{})
 	}
 	pres.serial = serial
 	pres.syncState = syncInProgress
@@ -122,11 +226,22 @@ func (pres *RealtimePresence) syncStart(serial string) {
 	}
 }
 
-func (pres *RealtimePresence) syncEnd() {
+// syncEnd completes the sync, removing the members which were not part of it.
+// It returns the LEAVE messages synthesized for the removed members.
+//
+// Spec RTP19
+func (pres *RealtimePresence) syncEnd() (leaves []*proto.PresenceMessage) {
 	if pres.syncState != syncInProgress {
-		return
+		return nil
 	}
 	for memberKey := range pres.stale {
+		if member, ok := pres.members[memberKey]; ok && member.State != proto.PresenceAbsent {
+			leave := *member
+			leave.ID = ""
+			leave.State = proto.PresenceLeave
+			leave.Timestamp = TimeNow()
+			leaves = append(leaves, &leave)
+		}
 		delete(pres.members, memberKey)
 	}
 	for memberKey, presence := range pres.members {
@@ -139,17 +254,27 @@ func (pres *RealtimePresence) syncEnd() {
 	// Sync has completed, unblock all callers to Get(true) waiting
 	// for the sync.
 	pres.syncMtx.Unlock()
+	close(pres.syncDone)
+	return leaves
 }
 
-func (pres *RealtimePresence) processIncomingMessage(msg *proto.ProtocolMessage, syncSerial string) {
+// processIncomingMessage applies the PRESENCE or, if sync is true, SYNC
+// message to the presence map. A SYNC message without a cursor in its
+// serial is the last one of the sync, which may span multiple messages;
+// PRESENCE messages received in between don't end it.
+func (pres *RealtimePresence) processIncomingMessage(msg *proto.ProtocolMessage, sync bool) {
+	var cursor string
+	if sync {
+		cursor = syncSerial(msg)
+	}
 	for _, presmsg := range msg.Presence {
 		if presmsg.Timestamp == 0 {
 			presmsg.Timestamp = msg.Timestamp
 		}
 	}
 	pres.mtx.Lock()
-	if syncSerial != "" {
-		pres.syncStart(syncSerial)
+	if cursor != "" {
+		pres.syncStart(cursor)
 	}
 	// Filter out old messages by their timestamp.
 	messages := make([]*proto.PresenceMessage, 0, len(msg.Presence))
@@ -161,12 +286,14 @@ func (pres *RealtimePresence) processIncomingMessage(msg *proto.ProtocolMessage,
 				continue // do not process old message
 			}
 		}
+		// Members are stored as PRESENT, while subscribers get the messages
+		// with their original action (Spec RTP2d).
 		switch member.State {
-		case proto.PresenceUpdate:
+		case proto.PresenceEnter, proto.PresenceUpdate:
 			memberCopy := *member
-			member = &memberCopy
-			member.State = proto.PresencePresent
-			fallthrough
+			memberCopy.State = proto.PresencePresent
+			delete(pres.stale, memberKey)
+			pres.members[memberKey] = &memberCopy
 		case proto.PresencePresent:
 			delete(pres.stale, memberKey)
 			pres.members[memberKey] = member
@@ -175,41 +302,78 @@ func (pres *RealtimePresence) processIncomingMessage(msg *proto.ProtocolMessage,
 		}
 		messages = append(messages, member)
 	}
-	if syncSerial == "" {
-		pres.syncEnd()
+	if sync && cursor == "" {
+		messages = append(messages, pres.syncEnd()...)
 	}
 	pres.mtx.Unlock()
 	msg.Count = len(messages)
 	msg.Presence = messages
-	pres.subs.presenceEnqueue(msg)
+	if !pres.subs.presenceEnqueue(msg) {
+		pres.channel.overflow()
+	}
 }
 
 // Get returns a list of current members on the channel.
 //
-// If wait is true it blocks until undergoing sync operation completes.
+// If the channel is not attached, Get implicitly attaches it.
+// If wait is true it blocks until the channel is attached and undergoing sync
+// operation completes; if the channel fails to attach, the attach error
+// is returned.
 // If wait is false or sync already completed, the function returns immediately.
+//
+// The members returned without waiting while a sync is in progress are
+// a snapshot of what's known so far: members not synced yet are missing and
+// members which left since the previous sync are still listed. Use it for a
+// fast, approximate view only.
 func (pres *RealtimePresence) Get(wait bool) ([]*proto.PresenceMessage, error) {
-	if _, err := pres.channel.attach(false); err != nil {
+	return pres.GetWithParams(wait, nil)
+}
+
+// GetWithParams is like Get, but it gives only the members matching
+// the ClientID and ConnectionID of params; its PaginateParams are ignored.
+// The members are filtered locally.
+//
+// Spec RTP11c2, RTP11c3
+func (pres *RealtimePresence) GetWithParams(wait bool, params *PresenceGetParams) ([]*proto.PresenceMessage, error) {
+	res, err := pres.channel.attach(wait)
+	if err != nil {
 		return nil, err
 	}
 	if wait {
+		if err := res.Wait(); err != nil {
+			return nil, err
+		}
 		pres.syncWait()
 	}
 	pres.mtx.Lock()
 	defer pres.mtx.Unlock()
 	members := make([]*proto.PresenceMessage, 0, len(pres.members))
 	for _, member := range pres.members {
+		if params != nil && !params.matches(member) {
+			continue
+		}
 		members = append(members, member)
 	}
 	return members, nil
 }
 
+// History gives the channel's presence messages history according to the given
+// parameters. The returned result can be inspected for the presence messages
+// via the PresenceMessages() method.
+//
+// Spec RTP12
+func (pres *RealtimePresence) History(params *PaginateParams) (*PaginatedResult, error) {
+	c := pres.channel
+	return c.client.rest.Channels.Get(c.Name, c.channelOptions()).Presence.History(params)
+}
+
 // Subscribe subscribes to presence events on the associated channel.
 //
-// If the channel is not attached, Subscribe implicitly attaches it.
+// If the channel is not attached, Subscribe implicitly attaches it, unless
+// the channel's options have got NoAttachOnSubscribe set.
 // If no presence states are given, Subscribe subscribes to all of them.
 func (pres *RealtimePresence) Subscribe(states ...proto.PresenceState) (*Subscription, error) {
-	if _, err := pres.channel.attach(false); err != nil {
+	if err := pres.channel.attachOnSubscribe(); err != nil {
 		return nil, err
 	}
 	return pres.subs.subscribe(statesToKeys(states)...)
@@ -223,8 +387,12 @@ func (pres *RealtimePresence) Unsubscribe(sub *Subscription, states ...proto.Pre
 }
 
 // Enter announces presence of the current client with an enter message
-// for the associated channel.
-func (pres *RealtimePresence) Enter(data string) (Result, error) {
+// for the associated channel. The returned Result completes once the server
+// acknowledges the message.
+//
+// If the channel is not attached, Enter implicitly attaches it and the message
+// is sent once the channel becomes attached.
+func (pres *RealtimePresence) Enter(data interface{}) (Result, error) {
 	clientID := pres.auth().ClientID()
 	if clientID == "" {
 		return nil, newError(91000, nil)
@@ -236,7 +404,7 @@ func (pres *RealtimePresence) Enter(data string) (Result, error) {
 //
 // If the current client is not present on the channel, Update will
 // behave as Enter method.
-func (pres *RealtimePresence) Update(data string) (Result, error) {
+func (pres *RealtimePresence) Update(data interface{}) (Result, error) {
 	clientID := pres.auth().ClientID()
 	if clientID == "" {
 		return nil, newError(91000, nil)
@@ -245,8 +413,8 @@ func (pres *RealtimePresence) Update(data string) (Result, error) {
 }
 
 // Leave announces current client leave the channel altogether with a leave
-// message if data is non-empty.
-func (pres *RealtimePresence) Leave(data string) (Result, error) {
+// message if data is non-nil.
+func (pres *RealtimePresence) Leave(data interface{}) (Result, error) {
 	clientID := pres.auth().ClientID()
 	if clientID == "" {
 		return nil, newError(91000, nil)
@@ -256,24 +424,27 @@ func (pres *RealtimePresence) Leave(data string) (Result, error) {
 
 // EnterClient announces presence of the given clientID altogether with an enter
 // message for the associated channel.
+//
+// Clients entered by the connection are re-entered automatically when
+// the channel gets reattached after the connection could not be resumed.
 func (pres *RealtimePresence) EnterClient(clientID string, data interface{}) (Result, error) {
 	pres.mtx.Lock()
-	pres.data = data
-	pres.state = proto.PresenceEnter
+	seq := pres.enter(clientID, data)
 	pres.mtx.Unlock()
 	msg := &proto.PresenceMessage{
 		State: proto.PresenceEnter,
 	}
 	msg.Data = data
 	msg.ClientID = clientID
-	return pres.send(msg)
+	return pres.sendEntered(msg, seq)
 }
 
-func nonnil(a, b interface{}) interface{} {
-	if a != nil {
-		return a
-	}
-	return b
+// enter records the client as entered with the given data; it expects
+// pres.mtx to be held.
+func (pres *RealtimePresence) enter(clientID string, data interface{}) uint64 {
+	pres.enterSeq++
+	pres.entered[clientID] = enteredClient{data: data, seq: pres.enterSeq}
+	return pres.enterSeq
 }
 
 // UpdateClient announces an updated presence message for the given clientID.
@@ -282,32 +453,29 @@ func nonnil(a, b interface{}) interface{} {
 // behave as Enter method.
 func (pres *RealtimePresence) UpdateClient(clientID string, data interface{}) (Result, error) {
 	pres.mtx.Lock()
-	if pres.state != proto.PresenceEnter {
-		oldData := pres.data
+	if _, ok := pres.entered[clientID]; !ok {
 		pres.mtx.Unlock()
-		return pres.EnterClient(clientID, nonnil(data, oldData))
+		return pres.EnterClient(clientID, data)
 	}
-	pres.data = data
+	seq := pres.enter(clientID, data)
 	pres.mtx.Unlock()
 	msg := &proto.PresenceMessage{
 		State: proto.PresenceUpdate,
 	}
 	msg.ClientID = clientID
 	msg.Data = data
-	return pres.send(msg)
+	return pres.sendEntered(msg, seq)
 }
 
 // LeaveClient announces the given clientID leave the associated channel altogether
-// with a leave message if data is non-empty.
+// with a leave message if data is non-nil.
 func (pres *RealtimePresence) LeaveClient(clientID string, data interface{}) (Result, error) {
 	pres.mtx.Lock()
-	if pres.state != proto.PresenceEnter {
+	if _, ok := pres.entered[clientID]; !ok {
 		pres.mtx.Unlock()
 		return nil, newError(91001, nil)
 	}
-	if pres.data == nil {
-		pres.data = data
-	}
+	delete(pres.entered, clientID)
 	pres.mtx.Unlock()
 
 	msg := &proto.PresenceMessage{
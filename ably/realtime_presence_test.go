@@ -1,7 +1,10 @@
 package ably_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -136,3 +139,705 @@ func TestRealtimePresence_EnsureChannelIsAttached(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRealtimePresence_GetWaitsForSync(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	type result struct {
+		members []*proto.PresenceMessage
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		members, err := client.Channels.Get("test").Presence.Get(true)
+		done <- result{members, err}
+	}()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	member := func(clientID string) *proto.PresenceMessage {
+		m := &proto.PresenceMessage{State: proto.PresencePresent}
+		m.ClientID = clientID
+		m.ConnectionID = "other-connection-id"
+		m.Timestamp = 1
+		return m
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionAttached,
+		Channel:       "test",
+		ChannelSerial: "serial:cursor",
+		Flags:         proto.FlagPresence,
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "serial:cursor",
+		Presence:      []*proto.PresenceMessage{member("client1")},
+	}
+	select {
+	case res := <-done:
+		t.Fatalf("Get() returned before sync completed: %v, %v", res.members, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "serial:",
+		Presence:      []*proto.PresenceMessage{member("client2")},
+	}
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("Get()=%v", res.err)
+		}
+		if len(res.members) != 2 {
+			t.Fatalf("want 2 members; got %d", len(res.members))
+		}
+		if err := contains(res.members, "client1", "client2"); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for Get() timed out after %v", ablytest.Timeout)
+	}
+}
+
+func TestRealtimePresence_GetWithParams(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	done := make(chan error, 1)
+	go func() {
+		_, err := channel.Presence.Get(true)
+		done <- err
+	}()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	member := func(clientID, connectionID string) *proto.PresenceMessage {
+		m := &proto.PresenceMessage{State: proto.PresencePresent}
+		m.ClientID = clientID
+		m.ConnectionID = connectionID
+		m.Timestamp = 1
+		return m
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionAttached,
+		Channel:       "test",
+		ChannelSerial: "serial:",
+		Flags:         proto.FlagPresence,
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "serial:",
+		Presence: []*proto.PresenceMessage{
+			member("client1", "connection1"),
+			member("client2", "connection2"),
+			member("client3", "connection2"),
+		},
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Get()=%v", err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for Get() timed out after %v", ablytest.Timeout)
+	}
+	cases := []struct {
+		params  *ably.PresenceGetParams
+		members []string
+	}{
+		{nil, []string{"client1", "client2", "client3"}},                                                 // i=0
+		{&ably.PresenceGetParams{ClientID: "client2"}, []string{"client2"}},                              // i=1
+		{&ably.PresenceGetParams{ConnectionID: "connection2"}, []string{"client2", "client3"}},           // i=2
+		{&ably.PresenceGetParams{ClientID: "client1", ConnectionID: "connection1"}, []string{"client1"}}, // i=3
+		{&ably.PresenceGetParams{ClientID: "client1", ConnectionID: "connection2"}, nil},                 // i=4
+	}
+	for i, cas := range cases {
+		members, err := channel.Presence.GetWithParams(true, cas.params)
+		if err != nil {
+			t.Fatalf("%d: GetWithParams()=%v", i, err)
+		}
+		if len(members) != len(cas.members) {
+			t.Errorf("%d: want %d members; got %d", i, len(cas.members), len(members))
+			continue
+		}
+		if err := contains(members, cas.members...); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestRealtimePresence_GetAttachFailed(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Channels.Get("test").Presence.Get(true)
+		done <- err
+	}()
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionError,
+		Channel: "test",
+		Error:   &proto.ErrorInfo{Code: 40160, StatusCode: 401},
+	}
+	select {
+	case err := <-done:
+		if err := checkError(40160, err); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for Get() timed out after %v", ablytest.Timeout)
+	}
+}
+
+func TestRealtimePresence_EnterBeforeAttach(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	res, err := channel.Presence.EnterClient("client", "data")
+	if err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("unexpected %s message sent before ATTACHED", msg.Action)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	msg, err := expectAction(out, proto.ActionPresence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Presence) != 1 || msg.Presence[0].State != proto.PresenceEnter || msg.Presence[0].ClientID != "client" {
+		t.Fatalf("want enter message for %q; got %v", "client", msg.Presence)
+	}
+	done := make(chan error, 1)
+	go func() { done <- res.Wait() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Enter completed before ACK: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Wait()=%v", err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatalf("waiting for ACK timed out after %v", ablytest.Timeout)
+	}
+	if _, err := channel.Presence.LeaveClient("client", nil); err != nil {
+		t.Fatalf("LeaveClient()=%v", err)
+	}
+	if _, err := channel.Presence.LeaveClient("client", nil); err == nil {
+		t.Fatal("want LeaveClient() to fail for client which has already left")
+	}
+}
+
+func TestRealtimePresence_ReenterOnReattach(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	for _, clientID := range []string{"client1", "client2"} {
+		if _, err := channel.Presence.EnterClient(clientID, clientID+" data"); err != nil {
+			t.Fatalf("EnterClient()=%v", err)
+		}
+		if _, err := expectAction(out, proto.ActionPresence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := channel.Presence.LeaveClient("client2", nil); err != nil {
+		t.Fatalf("LeaveClient()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionPresence); err != nil {
+		t.Fatal(err)
+	}
+	// Attachment continuity was preserved, nothing to re-enter.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagResumed}
+	select {
+	case msg := <-out:
+		t.Fatalf("unexpected %s message after resumed ATTACHED", msg.Action)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	msg, err := expectAction(out, proto.ActionPresence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Presence) != 1 {
+		t.Fatalf("want 1 presence message; got %d", len(msg.Presence))
+	}
+	if m := msg.Presence[0]; m.State != proto.PresenceEnter || m.ClientID != "client1" || m.Data != "client1 data" {
+		t.Fatalf("want re-enter of %q; got %v", "client1", m)
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("unexpected %s message after re-entering", msg.Action)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRealtimePresence_NoReenterAfterNack(t *testing.T) {
+	t.Parallel()
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	res, err := channel.Presence.EnterClient("client1", "data")
+	if err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	msg, err := expectAction(out, proto.ActionPresence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAck, MsgSerial: msg.MsgSerial, Count: 1}
+	if err := ablytest.Wait(res, nil); err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	res, err = channel.Presence.EnterClient("client2", "data")
+	if err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	if msg, err = expectAction(out, proto.ActionPresence); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:    proto.ActionNack,
+		MsgSerial: msg.MsgSerial,
+		Count:     1,
+		Error:     &proto.ErrorInfo{StatusCode: 401, Code: 40160},
+	}
+	if err := checkError(40160, ablytest.Wait(res, nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the client whose enter was acknowledged is re-entered.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if msg, err = expectAction(out, proto.ActionPresence); err != nil {
+		t.Fatal(err)
+	}
+	if m := msg.Presence[0]; m.ClientID != "client1" {
+		t.Fatalf("want re-enter of %q; got %v", "client1", m)
+	}
+	select {
+	case msg := <-out:
+		t.Fatalf("unexpected %s message after re-entering", msg.Action)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectPresence(sub *ably.Subscription, state proto.PresenceState, clientID string) error {
+	select {
+	case msg := <-sub.PresenceChannel():
+		if msg.State != state || msg.ClientID != clientID {
+			return fmt.Errorf("want presence %d of %q; got %d of %q", state, clientID, msg.State, msg.ClientID)
+		}
+		return nil
+	case <-time.After(ablytest.Timeout):
+		return fmt.Errorf("waiting for presence %d of %q timed out after %v", state, clientID, ablytest.Timeout)
+	}
+}
+
+func TestRealtimePresence_SubscribeStates(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	if err := ablytest.Wait(channel.Attach()); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	sub, err := channel.Presence.Subscribe(proto.PresenceEnter, proto.PresenceUpdate, proto.PresenceLeave)
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	member := func(id string, state proto.PresenceState, clientID string, ts int64) *proto.PresenceMessage {
+		msg := &proto.PresenceMessage{State: state}
+		msg.ID = id
+		msg.ClientID = clientID
+		msg.ConnectionID = "other"
+		msg.Timestamp = ts
+		return msg
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:  proto.ActionPresence,
+		Channel: "test",
+		Presence: []*proto.PresenceMessage{
+			member("other:0:0", proto.PresenceEnter, "client1", 1),
+			member("other:0:1", proto.PresenceEnter, "client2", 1),
+			member("other:0:2", proto.PresencePresent, "client3", 1),
+			member("other:0:3", proto.PresenceUpdate, "client1", 2),
+			member("other:0:4", proto.PresenceLeave, "client2", 2),
+		},
+	}
+	expect := []struct {
+		state    proto.PresenceState
+		clientID string
+	}{
+		{proto.PresenceEnter, "client1"},
+		{proto.PresenceEnter, "client2"},
+		{proto.PresenceUpdate, "client1"},
+		{proto.PresenceLeave, "client2"},
+	}
+	for _, e := range expect {
+		if err := expectPresence(sub, e.state, e.clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err := channel.Presence.Get(false)
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("want 2 members; got %d", len(members))
+	}
+	if err := contains(members, "client1", "client3"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if m.State != proto.PresencePresent {
+			t.Errorf("want member %q to be present; got %d", m.ClientID, m.State)
+		}
+	}
+}
+
+func TestRealtimePresence_SyncLeave(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	sub, err := channel.Presence.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe()=%v", err)
+	}
+	defer sub.Close()
+	present := func(clientID string) *proto.PresenceMessage {
+		msg := &proto.PresenceMessage{State: proto.PresencePresent}
+		msg.ClientID = clientID
+		msg.ConnectionID = "other"
+		msg.Timestamp = 1
+		return msg
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagPresence}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:",
+		Presence:      []*proto.PresenceMessage{present("client1"), present("client2")},
+	}
+	for _, clientID := range []string{"client1", "client2"} {
+		if err := expectPresence(sub, proto.PresencePresent, clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The channel reattaches and the new sync no longer has client2, whose
+	// connection was lost.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagPresence}
+	resync := present("client1")
+	resync.Timestamp = 2
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:",
+		Presence:      []*proto.PresenceMessage{resync},
+	}
+	if err := expectPresence(sub, proto.PresencePresent, "client1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectPresence(sub, proto.PresenceLeave, "client2"); err != nil {
+		t.Fatal(err)
+	}
+	members, err := channel.Presence.Get(true)
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	if len(members) != 1 || members[0].ClientID != "client1" {
+		t.Fatalf("want only client1 to be present; got %v", members)
+	}
+}
+
+func TestRealtimePresence_History(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRealtimeClient(nil)
+	defer safeclose(t, client, app)
+	channel := client.Channels.Get("presence_history")
+	if err := ablytest.Wait(channel.Presence.EnterClient("client", "enter")); err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	if err := ablytest.Wait(channel.Presence.LeaveClient("client", "leave")); err != nil {
+		t.Fatalf("LeaveClient()=%v", err)
+	}
+	want := []proto.PresenceState{proto.PresenceEnter, proto.PresenceLeave}
+	params := &ably.PaginateParams{Direction: "forwards"}
+	var states []proto.PresenceState
+	// The presence history may not include the latest messages right away.
+	for deadline := time.Now().Add(ablytest.Timeout); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		page, err := channel.Presence.History(params)
+		if err != nil {
+			t.Fatalf("History()=%v", err)
+		}
+		states = states[:0]
+		for _, msg := range page.PresenceMessages() {
+			if msg.ClientID != "client" {
+				t.Errorf("want clientID=%q; got %q", "client", msg.ClientID)
+			}
+			if msg.Timestamp == 0 {
+				t.Errorf("want non-zero timestamp for %v message", msg.State)
+			}
+			states = append(states, msg.State)
+		}
+		if reflect.DeepEqual(states, want) {
+			return
+		}
+	}
+	t.Fatalf("want presence history=%v; got %v", want, states)
+}
+
+func TestRealtimePresence_GetDuringSync(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	present := func(clientID string) *proto.PresenceMessage {
+		msg := &proto.PresenceMessage{State: proto.PresencePresent}
+		msg.ClientID = clientID
+		msg.ConnectionID = "other"
+		msg.Timestamp = 1
+		return msg
+	}
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagPresence}
+	// The first part of the sync has got a cursor, so more is to come.
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:cursor",
+		Presence:      []*proto.PresenceMessage{present("client1")},
+	}
+	var members []*proto.PresenceMessage
+	for deadline := time.Now().Add(ablytest.Timeout); len(members) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("waiting for the first sync message timed out")
+		}
+		var err error
+		if members, err = channel.Presence.Get(false); err != nil {
+			t.Fatalf("Get(false)=%v", err)
+		}
+	}
+	if err := contains(members, "client1"); err != nil {
+		t.Fatal(err)
+	}
+	if channel.Presence.SyncComplete() {
+		t.Fatal("want sync to be in progress")
+	}
+	synced := make(chan []*proto.PresenceMessage, 1)
+	go func() {
+		members, err := channel.Presence.Get(true)
+		if err != nil {
+			t.Errorf("Get(true)=%v", err)
+		}
+		synced <- members
+	}()
+	select {
+	case members := <-synced:
+		t.Fatalf("want Get(true) to wait for the sync; got %v", members)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:",
+		Presence:      []*proto.PresenceMessage{present("client2")},
+	}
+	select {
+	case members := <-synced:
+		if len(members) != 2 {
+			t.Fatalf("want 2 members; got %v", members)
+		}
+		if err := contains(members, "client1", "client2"); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(ablytest.Timeout):
+		t.Fatal("waiting for Get(true) timed out")
+	}
+}
+
+func TestRealtimePresence_SyncDone(t *testing.T) {
+	t.Parallel()
+	client, conn, _ := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test")
+	present := func(clientID string) *proto.PresenceMessage {
+		msg := &proto.PresenceMessage{State: proto.PresencePresent}
+		msg.ClientID = clientID
+		msg.ConnectionID = "other"
+		msg.Timestamp = 1
+		return msg
+	}
+	done := channel.Presence.SyncDone()
+	expectDone := func(want bool) error {
+		select {
+		case <-done:
+			if !want {
+				return errors.New("want sync not to be done")
+			}
+		case <-time.After(50 * time.Millisecond):
+			if want {
+				return errors.New("want sync to be done")
+			}
+		}
+		return nil
+	}
+	if _, err := channel.Attach(); err != nil {
+		t.Fatalf("Attach()=%v", err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagPresence}
+	frames := []*proto.ProtocolMessage{{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:cursor1",
+		Presence:      []*proto.PresenceMessage{present("client1")},
+	}, {
+		// A PRESENCE message in between doesn't end the sync.
+		Action:   proto.ActionPresence,
+		Channel:  "test",
+		Presence: []*proto.PresenceMessage{present("client2")},
+	}, {
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:cursor2",
+		Presence:      []*proto.PresenceMessage{present("client3")},
+	}}
+	for _, frame := range frames {
+		conn.in <- frame
+		if err := expectDone(false); err != nil {
+			t.Fatalf("after %v: %v", frame.Action, err)
+		}
+	}
+	conn.in <- &proto.ProtocolMessage{
+		Action:        proto.ActionSync,
+		Channel:       "test",
+		ChannelSerial: "sync:",
+		Presence:      []*proto.PresenceMessage{present("client4")},
+	}
+	if err := expectDone(true); err != nil {
+		t.Fatal(err)
+	}
+	if !channel.Presence.SyncComplete() {
+		t.Fatal("want SyncComplete()=true")
+	}
+	members, err := channel.Presence.Get(false)
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	if err := contains(members, "client1", "client2", "client3", "client4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new sync, after the channel reattaches, gives a new channel.
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test", Flags: proto.FlagPresence}
+	for deadline := time.Now().Add(ablytest.Timeout); channel.Presence.SyncComplete(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("waiting for the sync to start timed out")
+		}
+	}
+	done = channel.Presence.SyncDone()
+	if err := expectDone(false); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionSync, Channel: "test", ChannelSerial: "sync:"}
+	if err := expectDone(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRealtimePresence_Encryption(t *testing.T) {
+	t.Parallel()
+	key, err := ably.GenerateRandomKey(128)
+	if err != nil {
+		t.Fatalf("GenerateRandomKey()=%v", err)
+	}
+	client, conn, out := newDropConnClient(t, &ably.ClientOptions{})
+	defer safeclose(t, client)
+	channel := client.Channels.Get("test", &proto.ChannelOptions{
+		Cipher: proto.CipherParams{Key: key, Algorithm: proto.AES},
+	})
+	if _, err := channel.Presence.EnterClient("client", "secret"); err != nil {
+		t.Fatalf("EnterClient()=%v", err)
+	}
+	if _, err := expectAction(out, proto.ActionAttach); err != nil {
+		t.Fatal(err)
+	}
+	conn.in <- &proto.ProtocolMessage{Action: proto.ActionAttached, Channel: "test"}
+	msg, err := expectAction(out, proto.ActionPresence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal()=%v", err)
+	}
+
+	// Relay the presence message back the way the server would.
+	var echo proto.ProtocolMessage
+	if err := json.Unmarshal(b, &echo); err != nil {
+		t.Fatalf("Unmarshal()=%v", err)
+	}
+	if len(echo.Presence) != 1 {
+		t.Fatalf("want 1 presence message; got %d", len(echo.Presence))
+	}
+	member := echo.Presence[0]
+	if want, got := "utf-8/cipher+aes-128-cbc", member.Encoding; got != want {
+		t.Fatalf("want encoding=%q; got %q", want, got)
+	}
+	if data, ok := member.Data.([]byte); !ok || string(data) == "secret" {
+		t.Fatalf("want encrypted payload; got %#v", member.Data)
+	}
+	member.ConnectionID = "connection-id"
+	member.ID = "connection-id:0:0"
+	conn.in <- &echo
+	deadline := time.Now().Add(ablytest.Timeout)
+	for {
+		members, err := channel.Presence.Get(true)
+		if err != nil {
+			t.Fatalf("Get()=%v", err)
+		}
+		if len(members) == 1 {
+			if members[0].ClientID != "client" || members[0].Data != "secret" {
+				t.Fatalf("want decrypted data of %q; got %+v", "client", members[0])
+			}
+			if members[0].Encoding != "" {
+				t.Fatalf("want encoding decoded; got %q", members[0].Encoding)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 1 member; got %d", len(members))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -46,7 +46,41 @@ func newRestChannel(name string, client *RestClient) *RestChannel {
 	return c
 }
 
-func (c *RestChannel) Publish(name string, data interface{}) error {
+// PublishResult describes the messages published with Publish or PublishAll.
+type PublishResult struct {
+	// Channel is the name of the channel the messages were published to.
+	Channel string
+
+	// MessageIDs are the IDs of the published messages, in order. They're
+	// the IDs set on the messages, either by the user or by idempotent
+	// publishing, or else the IDs derived from the one assigned by
+	// the server. MessageIDs is empty if the server didn't report any ID.
+	MessageIDs []string
+}
+
+// MessageID gives the ID of the first published message, which is the ID of
+// the message published with Publish; it's empty if the ID is unknown.
+func (r *PublishResult) MessageID() string {
+	if len(r.MessageIDs) == 0 {
+		return ""
+	}
+	return r.MessageIDs[0]
+}
+
+// publishResponse is the body of the response to a publish request.
+type publishResponse struct {
+	MessageID string `json:"messageId,omitempty" codec:"messageId,omitempty"`
+}
+
+// Publish publishes a single message with the given name and data to the
+// channel. It returns once the server acknowledged the message.
+//
+// The acknowledgement doesn't tell whether the message was persisted. Messages
+// are persisted only on channels whose namespace has persistence enabled,
+// like channels with the "persisted:" prefix when the app defines such
+// a namespace; once acknowledged, they are stored and can be read back with
+// History, typically after a short delay.
+func (c *RestChannel) Publish(name string, data interface{}) (*PublishResult, error) {
 	messages := []*proto.Message{
 		{Name: name, Data: data},
 	}
@@ -55,56 +89,144 @@ func (c *RestChannel) Publish(name string, data interface{}) error {
 
 // PublishAll sends multiple messages in the same http call.
 // This is the more efficient way of transmitting a batch of messages
-// using the Rest API.
-func (c *RestChannel) PublishAll(messages []*proto.Message) error {
+// using the Rest API. It returns once the server acknowledged all of them.
+//
+// See Publish for how the messages are persisted.
+//
+// With idempotent publishing enabled the messages share a single base ID,
+// which is only assigned when none of them has an ID set by the user.
+// Either all or none of the messages may have their IDs set.
+func (c *RestChannel) PublishAll(messages []*proto.Message) (*PublishResult, error) {
+	if err := checkClientIDs(c.client.Auth.clientIDForCheck(), messages); err != nil {
+		return nil, err
+	}
+	if err := checkPayloads(messages); err != nil {
+		return nil, err
+	}
+	if err := checkMessageSize(c.client.opts.maxMessageSize(), messages); err != nil {
+		return nil, err
+	}
 	if c.options != nil {
 		for _, v := range messages {
 			v.ChannelOptions = c.options
 		}
 	}
-	useIdempotent := c.client.opts.idempotentRestPublishing()
-	if useIdempotent {
-		switch len(messages) {
-		case 1:
-			// spec RSL1k2 we preserve the id if we have one message and it contains the
-			// id.
-			if messages[0].ID == "" {
-				base, err := ablyutil.BaseID()
-				if err != nil {
-					return err
-				}
-				messages[0].ID = fmt.Sprintf("%s:%d", base, 0)
-			}
-		default:
-			empty := true
-			for _, v := range messages {
-				if v.ID != "" {
-					empty = false
-				}
-			}
-			if empty { // spec RSL1k3,RSL1k1
-				base, err := ablyutil.BaseID()
-				if err != nil {
-					return err
-				}
-				for k, v := range messages {
-					v.ID = fmt.Sprintf("%s:%d", base, k)
-				}
-			}
+	if c.client.opts.idempotentRestPublishing() {
+		if err := setIdempotentIDs(messages); err != nil {
+			return nil, err
 		}
 	}
 	res, err := c.client.post(c.baseURL+"/messages", messages, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The messages were accepted, so a response body which can't be
+	// decoded only leaves the server-assigned ID unknown.
+	var body publishResponse
+	decodeResp(res, &body)
+	return newPublishResult(c.Name, body.MessageID, messages), nil
+}
+
+// newPublishResult gives the result of publishing the messages. When not all
+// of them have IDs, the i-th message's ID is <baseID>:<i>, where baseID is
+// the ID the server assigned to the request.
+func newPublishResult(channel, baseID string, messages []*proto.Message) *PublishResult {
+	res := &PublishResult{Channel: channel}
+	for _, v := range messages {
+		if v.ID == "" {
+			res.MessageIDs = nil
+			break
+		}
+		res.MessageIDs = append(res.MessageIDs, v.ID)
+	}
+	if res.MessageIDs == nil && baseID != "" {
+		for k := range messages {
+			res.MessageIDs = append(res.MessageIDs, fmt.Sprintf("%s:%d", baseID, k))
+		}
+	}
+	return res
+}
+
+// checkPayloads fails when any of the messages has a payload of a type that
+// can't be encoded, so the messages are rejected before being sent.
+//
+// Spec RSL1a
+func checkPayloads(messages []*proto.Message) error {
+	for _, v := range messages {
+		if err := proto.ValidateData(v.Data); err != nil {
+			return newError(ErrInvalidMessageDataOrEncoding, err)
+		}
+	}
+	return nil
+}
+
+// checkMessageSize fails when the messages published at once are larger than
+// max bytes in total, so they are rejected before being sent.
+//
+// Spec RSL1i
+func checkMessageSize(max int64, messages []*proto.Message) error {
+	var size int64
+	for _, v := range messages {
+		n, err := v.Size()
+		if err != nil {
+			return newError(ErrInvalidMessageDataOrEncoding, err)
+		}
+		size += int64(n)
+	}
+	if size > max {
+		return newErrorf(ErrMaximumMessageLengthExceeded, "messages size of %d bytes exceeds the maximum message size of %d bytes", size, max)
+	}
+	return nil
+}
+
+// checkClientIDs fails when any of the messages has an explicit clientId
+// which is incompatible with the clientID of the library, so the messages
+// are rejected before being sent.
+//
+// Spec RSL1g3, RSL1g4
+func checkClientIDs(clientID string, messages []*proto.Message) error {
+	for _, v := range messages {
+		if !isClientIDAllowed(clientID, v.ClientID) {
+			return newErrorf(ErrInvalidClientID, "unable to publish message containing a clientId (%s) that is incompatible with the library clientId (%s)", v.ClientID, clientID)
+		}
+	}
+	return nil
+}
+
+// setIdempotentIDs assigns a <baseId>:<index> ID to each of the messages,
+// unless all of them have their IDs already set by the user; it fails if only
+// some of them do. The IDs are assigned before the first publish attempt,
+// so retries to fallback hosts reuse them.
+//
+// Spec RSL1k1, RSL1k2, RSL1k3
+func setIdempotentIDs(messages []*proto.Message) error {
+	var withID int
+	for _, v := range messages {
+		if v.ID != "" {
+			withID++
+		}
+	}
+	switch {
+	case withID == len(messages):
+		return nil
+	case withID != 0:
+		return newErrorf(ErrInvalidMessageID, "unable to publish %d messages with IDs along with %d messages without IDs", withID, len(messages)-withID)
+	}
+	base, err := ablyutil.BaseID()
 	if err != nil {
 		return err
 	}
-	return res.Body.Close()
+	for k, v := range messages {
+		v.ID = fmt.Sprintf("%s:%d", base, k)
+	}
+	return nil
 }
 
 // History gives the channel's message history according to the given parameters.
 // The returned result can be inspected for the messages via the Messages()
 // method.
 func (c *RestChannel) History(params *PaginateParams) (*PaginatedResult, error) {
-	path := c.baseURL + "/history"
+	path := c.baseURL + "/messages"
 	rst, err := newPaginatedResult(c.options, paginatedRequest{typ: msgType, path: path, params: params, query: query(c.client.get), logger: c.logger(), respCheck: checkValidHTTPResponse})
 	if err != nil {
 		return nil, err
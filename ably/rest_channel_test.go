@@ -2,7 +2,10 @@ package ably_test
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,7 +14,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ably/ably-go/ably/internal/ablyutil"
 
@@ -69,7 +74,7 @@ func TestRestChannel(t *testing.T) {
 			}
 		}
 		for k, v := range m {
-			err := channel.Publish(k, v.data)
+			_, err := channel.Publish(k, v.data)
 			if err != nil {
 				ts.Fatal(err)
 			}
@@ -92,6 +97,31 @@ func TestRestChannel(t *testing.T) {
 		})
 	})
 
+	t.Run("Publish extras", func(ts *testing.T) {
+		channel := client.Channels.Get("test_publish_extras", nil)
+		extras := map[string]interface{}{
+			"headers": map[string]interface{}{"some": "header"},
+			"push": map[string]interface{}{
+				"notification": map[string]interface{}{"title": "title", "body": "body"},
+			},
+		}
+		_, err := channel.PublishAll([]*proto.Message{{Name: "extras", Data: "data", Extras: extras}})
+		if err != nil {
+			ts.Fatal(err)
+		}
+		page, err := channel.History(nil)
+		if err != nil {
+			ts.Fatal(err)
+		}
+		messages := page.Messages()
+		if len(messages) != 1 {
+			ts.Fatalf("expected 1 message got %d", len(messages))
+		}
+		if !reflect.DeepEqual(messages[0].Extras, extras) {
+			ts.Errorf("expected %#v got %#v", extras, messages[0].Extras)
+		}
+	})
+
 	t.Run("History", func(ts *testing.T) {
 		historyRestChannel := client.Channels.Get("channelhistory", nil)
 		for i := 0; i < 2; i++ {
@@ -121,13 +151,48 @@ func TestRestChannel(t *testing.T) {
 		}
 	})
 
+	t.Run("History direction", func(ts *testing.T) {
+		channel := client.Channels.Get("channelhistory_direction", nil)
+		names := []string{"one", "two", "three"}
+		for _, name := range names {
+			if _, err := channel.Publish(name, name); err != nil {
+				ts.Fatal(err)
+			}
+		}
+		for _, direction := range []string{"forwards", "backwards"} {
+			page, err := channel.History(&ably.PaginateParams{Limit: 2, Direction: direction})
+			if err != nil {
+				ts.Fatal(err)
+			}
+			var got []string
+			for {
+				for _, m := range page.Messages() {
+					got = append(got, m.Name)
+				}
+				if !page.HasNext() {
+					break
+				}
+				if page, err = page.Next(); err != nil {
+					ts.Fatal(err)
+				}
+			}
+			want := names
+			if direction == "backwards" {
+				want = []string{"three", "two", "one"}
+			}
+			if !reflect.DeepEqual(got, want) {
+				ts.Errorf("%s: expected %v got %v", direction, want, got)
+			}
+		}
+	})
+
 	t.Run("PublishAll", func(ts *testing.T) {
 		encodingRestChannel := client.Channels.Get("this?is#an?encoding#channel", nil)
 		messages := []*proto.Message{
 			{Name: "send", Data: "test data 1"},
 			{Name: "send", Data: "test data 2"},
 		}
-		err := encodingRestChannel.PublishAll(messages)
+		_, err := encodingRestChannel.PublishAll(messages)
 		if err != nil {
 			ts.Fatal(err)
 		}
@@ -169,7 +234,7 @@ func TestRestChannel(t *testing.T) {
 			{"publish_1", "second message"},
 		}
 		for _, v := range sample {
-			err := channel.Publish(v.event, v.message)
+			_, err := channel.Publish(v.event, v.message)
 			if err != nil {
 				ts.Error(err)
 			}
@@ -218,7 +283,7 @@ func TestIdempotentPublishing(t *testing.T) {
 	t.Run("when ID is not included (#RSL1k2)", func(ts *testing.T) {
 		channel := client.Channels.Get("idempotent_test_1", nil)
 		for range make([]struct{}, 3) {
-			err := channel.Publish("", randomStr)
+			_, err := channel.Publish("", randomStr)
 			if err != nil {
 				ts.Fatal(err)
 			}
@@ -236,7 +301,7 @@ func TestIdempotentPublishing(t *testing.T) {
 	t.Run("when ID is included (#RSL1k2, #RSL1k5)", func(ts *testing.T) {
 		channel := client.Channels.Get("idempotent_test_2", nil)
 		for range make([]struct{}, 3) {
-			err := channel.PublishAll([]*proto.Message{
+			_, err := channel.PublishAll([]*proto.Message{
 				{
 					ID:   randomStr,
 					Data: randomStr,
@@ -263,7 +328,7 @@ func TestIdempotentPublishing(t *testing.T) {
 
 	t.Run("multiple messages in one publish operation (#RSL1k3)", func(ts *testing.T) {
 		channel := client.Channels.Get("idempotent_test_3", nil)
-		err := channel.PublishAll([]*proto.Message{
+		_, err := channel.PublishAll([]*proto.Message{
 			{
 				ID:   randomStr,
 				Data: randomStr,
@@ -294,7 +359,7 @@ func TestIdempotentPublishing(t *testing.T) {
 				ID: fmt.Sprintf("%s:%d", randomStr, i),
 			})
 		}
-		err := channel.PublishAll(m)
+		_, err := channel.PublishAll(m)
 		if err != nil {
 			ts.Fatal(err)
 		}
@@ -336,7 +401,7 @@ func TestIdempotentPublishing(t *testing.T) {
 
 	t.Run("the ID is populated with a random ID and serial 0 from this lib (#RSL1k1)", func(ts *testing.T) {
 		channel := client.Channels.Get("idempotent_test_5", nil)
-		err := channel.Publish("event", "")
+		_, err := channel.Publish("event", "")
 		if err != nil {
 			ts.Fatal(err)
 		}
@@ -370,7 +435,7 @@ func TestIdempotentPublishing(t *testing.T) {
 	t.Run("publishing a batch of messages", func(ts *testing.T) {
 		channel := client.Channels.Get("idempotent_test_6", nil)
 		name := "event"
-		err := channel.PublishAll([]*proto.Message{
+		_, err := channel.PublishAll([]*proto.Message{
 			{Name: name},
 			{Name: name},
 			{Name: name},
@@ -455,7 +520,7 @@ func TestIdempotent_retry(t *testing.T) {
 
 		ts.Run("two REST publish retries result in only one message being published'", func(ts *testing.T) {
 			channel := client.Channels.Get("idempotent_test_fallback", nil)
-			err = channel.Publish("", randomStr)
+			_, err = channel.Publish("", randomStr)
 			if err != nil {
 				ts.Error(err)
 			}
@@ -518,7 +583,7 @@ func TestRSL1f1(t *testing.T) {
 			Data:     fmt.Sprint(i),
 		})
 	}
-	err = channel.PublishAll(msgs)
+	_, err = channel.PublishAll(msgs)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -555,7 +620,7 @@ func TestRSL1g(t *testing.T) {
 	}
 	t.Run("RSL1g1b", func(ts *testing.T) {
 		channel := client.Channels.Get("RSL1g1b", nil)
-		err := channel.PublishAll([]*proto.Message{
+		_, err := channel.PublishAll([]*proto.Message{
 			{Name: "some 1"},
 			{Name: "some 2"},
 			{Name: "some 3"},
@@ -579,7 +644,7 @@ func TestRSL1g(t *testing.T) {
 	})
 	t.Run("RSL1g2", func(ts *testing.T) {
 		channel := client.Channels.Get("RSL1g2", nil)
-		err := channel.PublishAll([]*proto.Message{
+		_, err := channel.PublishAll([]*proto.Message{
 			{Name: "1", ClientID: clientID},
 			{Name: "2", ClientID: clientID},
 			{Name: "3", ClientID: clientID},
@@ -603,7 +668,7 @@ func TestRSL1g(t *testing.T) {
 	})
 	t.Run("RSL1g3", func(ts *testing.T) {
 		channel := client.Channels.Get("RSL1g3", nil)
-		err := channel.PublishAll([]*proto.Message{
+		_, err := channel.PublishAll([]*proto.Message{
 			{Name: "1", ClientID: clientID},
 			{Name: "2", ClientID: "other client"},
 			{Name: "3", ClientID: clientID},
@@ -613,3 +678,530 @@ func TestRSL1g(t *testing.T) {
 		}
 	})
 }
+
+func TestRestChannel_PublishClientID(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	sample := []struct {
+		desc     string
+		opts     *ably.ClientOptions
+		clientID string
+		rejected bool
+	}{
+		{
+			desc: "conflicting",
+			opts: &ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+				ClientID:    "client",
+			},
+			clientID: "other",
+			rejected: true,
+		},
+		{
+			desc: "matching",
+			opts: &ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+				ClientID:    "client",
+			},
+			clientID: "client",
+		},
+		{
+			desc: "anonymous basic auth",
+			opts: &ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+			},
+			clientID: "other",
+		},
+		{
+			desc: "wildcard token",
+			opts: &ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{
+					TokenDetails: &ably.TokenDetails{Token: "token", ClientID: "*"},
+				},
+			},
+			clientID: "other",
+		},
+	}
+	for _, v := range sample {
+		t.Run(v.desc, func(t *testing.T) {
+			mtx.Lock()
+			requests = 0
+			mtx.Unlock()
+			v.opts.NoBinaryProtocol = true
+			v.opts.HTTPClient = newTLSHTTPClientMock(server)
+			client, err := ably.NewRestClient(v.opts)
+			if err != nil {
+				t.Fatalf("NewRestClient()=%v", err)
+			}
+			_, err = client.Channels.Get("test", nil).PublishAll([]*proto.Message{
+				{Name: "name", ClientID: v.clientID},
+			})
+			mtx.Lock()
+			n := requests
+			mtx.Unlock()
+			if v.rejected {
+				if err := checkError(ably.ErrInvalidClientID, err); err != nil {
+					t.Error(err)
+				}
+				if n != 0 {
+					t.Errorf("want message rejected before sending; got %d requests", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PublishAll()=%v", err)
+			}
+			if n != 1 {
+				t.Errorf("want 1 request; got %d", n)
+			}
+		})
+	}
+}
+
+func TestRestChannel_PublishPayloads(t *testing.T) {
+	t.Parallel()
+	type payload struct {
+		Name string `json:"name"`
+	}
+	var mtx sync.Mutex
+	var published []byte
+	var contentType string
+	// The server echoes the published messages back as the channel history.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if r.Method == "POST" {
+			published, _ = ioutil.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(published)
+	}))
+	defer server.Close()
+	sample := []struct {
+		desc    string
+		data    interface{}
+		decoded interface{}
+	}{
+		{"string", "data", "data"},
+		{"binary", []byte{0x00, 0xff}, []byte{0x00, 0xff}},
+		{"binary pointer", &[]byte{0x00, 0xff}, []byte{0x00, 0xff}},
+		{"map", map[string]interface{}{"key": "value"}, map[string]interface{}{"key": "value"}},
+		{"struct", payload{Name: "name"}, map[string]interface{}{"name": "name"}},
+		{"slice", []string{"a", "b"}, []interface{}{"a", "b"}},
+	}
+	for _, binary := range []bool{false, true} {
+		for _, v := range sample {
+			t.Run(fmt.Sprintf("%s binary=%t", v.desc, binary), func(t *testing.T) {
+				client, err := ably.NewRestClient(&ably.ClientOptions{
+					AuthOptions:      ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+					NoBinaryProtocol: !binary,
+					HTTPClient:       newTLSHTTPClientMock(server),
+				})
+				if err != nil {
+					t.Fatalf("NewRestClient()=%v", err)
+				}
+				channel := client.Channels.Get("test", nil)
+				if _, err := channel.Publish("name", v.data); err != nil {
+					t.Fatalf("Publish()=%v", err)
+				}
+				page, err := channel.History(nil)
+				if err != nil {
+					t.Fatalf("History()=%v", err)
+				}
+				messages := page.Messages()
+				if len(messages) != 1 {
+					t.Fatalf("want 1 message; got %d", len(messages))
+				}
+				if got := messages[0].Data; !reflect.DeepEqual(got, v.decoded) {
+					t.Errorf("want data=%#v; got %#v", v.decoded, got)
+				}
+				if enc := messages[0].Encoding; enc != "" {
+					t.Errorf("want empty encoding; got %q", enc)
+				}
+			})
+		}
+	}
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+		HTTPClient:  newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	mtx.Lock()
+	published = nil
+	mtx.Unlock()
+	_, err = client.Channels.Get("test", nil).Publish("name", 42)
+	if err := checkError(ably.ErrInvalidMessageDataOrEncoding, err); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if published != nil {
+		t.Errorf("want message rejected before sending; got %q", published)
+	}
+}
+
+func TestRestChannel_HistoryInvalidParams(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions:      ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	channel := client.Channels.Get("test", nil)
+	for _, params := range []*ably.PaginateParams{
+		{Limit: 1001},
+		{Direction: "sideways"},
+		{ScopeParams: ably.ScopeParams{Start: 2, End: 1}},
+	} {
+		_, err := channel.History(params)
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("History(%+v): %v", params, err)
+		}
+		_, err = channel.Presence.History(params)
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("Presence.History(%+v): %v", params, err)
+		}
+		_, err = client.Stats(params)
+		if err := checkError(ably.ErrInvalidParameterValue, err); err != nil {
+			t.Errorf("Stats(%+v): %v", params, err)
+		}
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if requests != 0 {
+		t.Errorf("want params rejected before sending; got %d requests", requests)
+	}
+}
+
+func TestRestChannel_PublishPersisted(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRestClient(nil)
+	defer safeclose(t, app)
+	channel := client.Channels.Get("persisted:publish_test", nil)
+	if _, err := channel.Publish("persisted", "data"); err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	// Persisted messages become available in history after a short delay.
+	deadline := time.Now().Add(ablytest.Timeout)
+	for {
+		res, err := channel.History(nil)
+		if err != nil {
+			t.Fatalf("History()=%v", err)
+		}
+		if msgs := res.Messages(); len(msgs) == 1 {
+			if msgs[0].Name != "persisted" || msgs[0].Data != "data" {
+				t.Fatalf("want persisted message; got %+v", msgs[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting for the message to be persisted timed out")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRestChannel_PublishMaxMessageSize(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions:      ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+		MaxMessageSize:   10,
+	})
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	channel := client.Channels.Get("test", nil)
+	_, err = channel.Publish("name", "too long data")
+	if err := checkError(ably.ErrMaximumMessageLengthExceeded, err); err != nil {
+		t.Errorf("Publish(): %v", err)
+	}
+	// Each of the messages fits, but all of them at once don't.
+	_, err = channel.PublishAll([]*proto.Message{
+		{Name: "name", Data: "data"},
+		{Name: "name", Data: "data"},
+	})
+	if err := checkError(ably.ErrMaximumMessageLengthExceeded, err); err != nil {
+		t.Errorf("PublishAll(): %v", err)
+	}
+	mtx.Lock()
+	n := requests
+	mtx.Unlock()
+	if n != 0 {
+		t.Errorf("want messages rejected before sending; got %d requests", n)
+	}
+	if _, err := channel.Publish("name", "data"); err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+}
+
+func TestIdempotent_fallbackReusesIDs(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var hosts []string
+	var published [][]map[string]interface{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var messages []map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&messages)
+		mtx.Lock()
+		defer mtx.Unlock()
+		if err != nil {
+			t.Errorf("decoding request body: %v", err)
+		}
+		hosts = append(hosts, r.Host)
+		published = append(published, messages)
+		w.Header().Set("Content-Type", "application/json")
+		if len(published) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"code":50000,"statusCode":500}}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		NoBinaryProtocol:         true,
+		IdempotentRestPublishing: true,
+		FallbackHosts:            []string{"fallback.example.com"},
+		HTTPClient:               newTLSHTTPClientMock(server),
+	}
+	client, err := ably.NewRestClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*proto.Message{
+		{Name: "first"},
+		{Name: "second"},
+	}
+	if _, err := client.Channels.Get("test", nil).PublishAll(messages); err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	if len(published) != 2 {
+		t.Fatalf("want 2 publish attempts; got %d", len(published))
+	}
+	if hosts[1] != "fallback.example.com" {
+		t.Errorf("want retry to %q; got %q", "fallback.example.com", hosts[1])
+	}
+	for i, msg := range messages {
+		if !strings.HasSuffix(msg.ID, ":"+strconv.Itoa(i)) {
+			t.Errorf("%d: want ID with :%d index suffix; got %q", i, i, msg.ID)
+		}
+		for _, attempt := range published {
+			if id := attempt[i]["id"]; id != msg.ID {
+				t.Errorf("%d: want id=%q; got %v", i, msg.ID, id)
+			}
+		}
+	}
+	if messages[0].ID[:len(messages[0].ID)-2] != messages[1].ID[:len(messages[1].ID)-2] {
+		t.Errorf("want messages to share base ID; got %q and %q", messages[0].ID, messages[1].ID)
+	}
+}
+
+func TestIdempotent_userSuppliedID(t *testing.T) {
+	t.Parallel()
+	var requests int
+	var published []map[string]interface{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if err := json.NewDecoder(r.Body).Decode(&published); err != nil {
+			t.Errorf("decoding request body: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	opts := &ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		RestHost:                 server.Listener.Addr().String(),
+		NoBinaryProtocol:         true,
+		IdempotentRestPublishing: true,
+		HTTPClient:               server.Client(),
+	}
+	client, err := ably.NewRestClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := client.Channels.Get("test", nil)
+	// Messages with and without IDs can't be mixed in a single batch.
+	mixed := []*proto.Message{
+		{Name: "first", ID: "user-id"},
+		{Name: "second"},
+	}
+	_, err = channel.PublishAll(mixed)
+	if err := checkError(ably.ErrInvalidMessageID, err); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Fatalf("want mixed IDs rejected before sending; got %d requests", requests)
+	}
+	if mixed[1].ID != "" {
+		t.Errorf("want no ID assigned; got %q", mixed[1].ID)
+	}
+	messages := []*proto.Message{
+		{Name: "first", ID: "user-id:0"},
+		{Name: "second", ID: "user-id:1"},
+	}
+	if _, err := channel.PublishAll(messages); err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	if len(published) != 2 {
+		t.Fatalf("want 2 published messages; got %d", len(published))
+	}
+	for i, msg := range messages {
+		if id := published[i]["id"]; id != msg.ID {
+			t.Errorf("%d: want id=%q; got %v", i, msg.ID, id)
+		}
+	}
+}
+
+func TestRestChannel_PublishResult(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"channel":"test","messageId":"base"}`))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		RestHost:         server.Listener.Addr().String(),
+		NoBinaryProtocol: true,
+		HTTPClient:       server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := client.Channels.Get("test", nil)
+	res, err := channel.Publish("event", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	if id := res.MessageID(); id != "base:0" {
+		t.Errorf("want MessageID=base:0; got %q", id)
+	}
+	if res.Channel != "test" {
+		t.Errorf("want Channel=test; got %q", res.Channel)
+	}
+	res, err = channel.PublishAll([]*proto.Message{{Name: "first"}, {Name: "second"}})
+	if err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	if want := []string{"base:0", "base:1"}; !reflect.DeepEqual(res.MessageIDs, want) {
+		t.Errorf("want MessageIDs=%v; got %v", want, res.MessageIDs)
+	}
+	// IDs set on the messages are the IDs of the published messages.
+	res, err = channel.PublishAll([]*proto.Message{{Name: "first", ID: "id-1"}, {Name: "second", ID: "id-2"}})
+	if err != nil {
+		t.Fatalf("PublishAll()=%v", err)
+	}
+	if want := []string{"id-1", "id-2"}; !reflect.DeepEqual(res.MessageIDs, want) {
+		t.Errorf("want MessageIDs=%v; got %v", want, res.MessageIDs)
+	}
+}
+
+func TestRestChannel_PublishMessageID(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRestClient(nil)
+	defer safeclose(t, app)
+	res, err := client.Channels.Get("test", nil).Publish("event", "data")
+	if err != nil {
+		t.Fatalf("Publish()=%v", err)
+	}
+	if res.MessageID() == "" {
+		t.Fatal("want non-empty MessageID")
+	}
+}
+
+func BenchmarkRestChannel_Publish(b *testing.B) {
+	const batch = 100
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		RestHost:                 server.Listener.Addr().String(),
+		NoBinaryProtocol:         true,
+		IdempotentRestPublishing: true,
+		HTTPClient:               server.Client(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	channel := client.Channels.Get("test", nil)
+	b.Run("Publish", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < batch; j++ {
+				if _, err := channel.Publish("event", "data"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("PublishAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			messages := make([]*proto.Message, batch)
+			for j := range messages {
+				messages[j] = &proto.Message{Name: "event", Data: "data"}
+			}
+			if _, err := channel.PublishAll(messages); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
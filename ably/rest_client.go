@@ -11,8 +11,10 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
 	"reflect"
 	"strings"
 	"sync"
@@ -133,9 +135,10 @@ type RestClient struct {
 	successFallbackHost *fallbackCache
 }
 
-func NewRestClient(opts *ClientOptions) (*RestClient, error) {
-	if opts == nil {
-		panic("called NewRealtimeClient with nil ClientOptions")
+func NewRestClient(options ...ClientOption) (*RestClient, error) {
+	opts := applyOptions("NewRestClient", options)
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
 	c := &RestClient{
 		opts: *opts,
@@ -152,13 +155,23 @@ func NewRestClient(opts *ClientOptions) (*RestClient, error) {
 	return c, nil
 }
 
+// Time asks the Ably servers for the current time.
+//
+// Spec RSC16.
 func (c *RestClient) Time() (time.Time, error) {
+	return c.time(false)
+}
+
+// time requests the server time; authLocked is set when it's called by Auth
+// with its mutex held.
+func (c *RestClient) time(authLocked bool) (time.Time, error) {
 	var times []int64
 	r := &Request{
-		Method: "GET",
-		Path:   "/time",
-		Out:    &times,
-		NoAuth: true,
+		Method:     "GET",
+		Path:       "/time",
+		Out:        &times,
+		NoAuth:     true,
+		authLocked: authLocked,
 	}
 	_, err := c.do(r)
 	if err != nil {
@@ -167,7 +180,7 @@ func (c *RestClient) Time() (time.Time, error) {
 	if len(times) != 1 {
 		return time.Time{}, newErrorf(ErrInternalError, "expected 1 timestamp, got %d", len(times))
 	}
-	return time.Unix(times[0]/1000, times[0]%1000), nil
+	return time.Unix(0, times[0]*int64(time.Millisecond)), nil
 }
 
 // Stats gives the channel's metrics according to the given parameters.
@@ -191,6 +204,14 @@ type Request struct {
 	// when true token is not refreshed when request fails with token expired response
 	NoRenew bool
 	header  http.Header
+
+	// requestID is sent with the request and its retries when
+	// ClientOptions.AddRequestIDs is set.
+	requestID string
+
+	// authLocked is set for the requests Auth makes with its mutex held,
+	// e.g. token requests, so that it's not locked again.
+	authLocked bool
 }
 
 // Request sends http request to ably.
@@ -211,11 +232,7 @@ func (c *RestClient) Request(method string, path string, params *PaginateParams,
 			})
 		}, c.logger())
 	default:
-		return nil, &proto.ErrorInfo{
-			Message:    fmt.Sprintf("%s method is not supported", method),
-			Code:       ErrMethodNotAllowed,
-			StatusCode: http.StatusMethodNotAllowed,
-		}
+		return nil, newErrorf(ErrMethodNotAllowed, "%s method is not supported", method)
 	}
 }
 
@@ -305,7 +322,18 @@ func (f *fallbackCache) put(host string) {
 	}
 }
 
-func (c *RestClient) doWithHandle(r *Request, handle func(*http.Response, interface{}) (*http.Response, error)) (*http.Response, error) {
+func (c *RestClient) doWithHandle(r *Request, handle func(*http.Response, interface{}) (*http.Response, error)) (_ *http.Response, err error) {
+	if c.opts.AddRequestIDs && r.requestID == "" {
+		// Spec RSC7c
+		if r.requestID, err = ablyutil.RequestID(); err != nil {
+			return nil, newError(ErrInternalError, err)
+		}
+		defer func() {
+			if e, ok := err.(*Error); ok {
+				e.RequestID = r.requestID
+			}
+		}()
+	}
 	if c.successFallbackHost == nil {
 		c.successFallbackHost = &fallbackCache{
 			duration: c.opts.fallbackRetryTimeout(),
@@ -321,77 +349,27 @@ func (c *RestClient) doWithHandle(r *Request, handle func(*http.Response, interf
 	if c.opts.Trace != nil {
 		req = req.WithContext(httptrace.WithClientTrace(req.Context(), c.opts.Trace))
 	}
+	start := time.Now()
 	resp, err := c.opts.httpclient().Do(req)
 	if err != nil {
-		return nil, newError(ErrInternalError, err)
+		retry := isRetryable(err, 0)
+		err = newHTTPError(err)
+		if retry && c.useFallbacks(req.URL.Hostname()) {
+			return c.doWithFallbacks(r, handle, start, err)
+		}
+		return nil, err
 	}
 	resp, err = handle(resp, r.Out)
 	if err != nil {
 		if e, ok := err.(*Error); ok {
-			if canFallBack(e.StatusCode) &&
-				(c.opts.FallbackHostsUseDefault ||
-					strings.HasSuffix(req.URL.Host, defaultOptions.RestHost) ||
-					c.opts.FallbackHosts != nil) {
-				fallback := defaultOptions.FallbackHosts
-				if c.opts.FallbackHosts != nil {
-					fallback = c.opts.FallbackHosts
-				}
-				if len(fallback) > 0 {
-					left := fallback
-					iteration := 0
-					maxLimit := c.opts.HTTPMaxRetryCount
-					if maxLimit == 0 {
-						maxLimit = defaultOptions.HTTPMaxRetryCount
-					}
-					for {
-						if len(left) == 0 {
-							return nil, err
-						}
-						var h string
-						if len(left) == 1 {
-							h = left[0]
-						} else {
-							h = left[rand.Intn(len(left)-1)]
-						}
-						var n []string
-						for _, v := range left {
-							if v != h {
-								n = append(n, v)
-							}
-						}
-						left = n
-						req, err := c.NewHTTPRequest(r)
-						if err != nil {
-							return nil, err
-						}
-						req.URL.Host = h
-						req.Host = ""
-						req.Header.Set(HostHeader, h)
-						resp, err := c.opts.httpclient().Do(req)
-						if err != nil {
-							return nil, newError(ErrInternalError, err)
-						}
-						resp, err = handle(resp, r.Out)
-						if err != nil {
-							if iteration == maxLimit-1 {
-								return nil, err
-							}
-							if ev, ok := err.(*Error); ok {
-								if canFallBack(ev.StatusCode) {
-									iteration++
-									continue
-								}
-							}
-							return nil, err
-						}
-						c.successFallbackHost.put(h)
-						return resp, nil
-					}
-				}
-				return nil, err
+			if isRetryable(e, e.StatusCode) && c.useFallbacks(req.URL.Hostname()) {
+				return c.doWithFallbacks(r, handle, start, err)
 			}
-			if e.Code == ErrTokenErrorUnspecified {
-				if r.NoRenew || !c.Auth.isTokenRenewable() {
+			// Spec RSC10
+			if isTokenErrorCode(e.Code) {
+				// Only requests authenticated with a token are retried;
+				// this excludes the token requests themselves.
+				if r.NoRenew || r.NoAuth || c.Auth.authMethod() != authToken || !c.Auth.isTokenRenewable() {
 					return nil, err
 				}
 				if _, err := c.Auth.reauthorize(); err != nil {
@@ -406,9 +384,85 @@ func (c *RestClient) doWithHandle(r *Request, handle func(*http.Response, interf
 	return resp, nil
 }
 
-func canFallBack(code int) bool {
-	return http.StatusInternalServerError <= code &&
-		code <= http.StatusGatewayTimeout
+// useFallbacks reports whether a failed request to the given host can be
+// retried against fallback hosts.
+//
+// Spec RSC15b
+func (c *RestClient) useFallbacks(host string) bool {
+	return c.opts.FallbackHostsUseDefault ||
+		strings.HasSuffix(host, defaultOptions.RestHost) ||
+		c.opts.FallbackHosts != nil
+}
+
+// doWithFallbacks retries the request against fallback hosts, picked in random
+// order, until it succeeds, fails with an error which does not qualify for
+// a retry or any of HTTPMaxRetryCount and HTTPMaxRetryDuration limits is
+// reached. The err is the error of the request made to the primary host.
+//
+// Spec RSC15a
+func (c *RestClient) doWithFallbacks(r *Request, handle func(*http.Response, interface{}) (*http.Response, error), start time.Time, err error) (*http.Response, error) {
+	fallback := c.opts.fallbackHosts()
+	maxCount := c.opts.httpMaxRetryCount()
+	maxDuration := c.opts.httpMaxRetryDuration()
+	for i, n := range rand.Perm(len(fallback)) {
+		if i == maxCount || time.Since(start) >= maxDuration {
+			break
+		}
+		h := fallback[n]
+		req, e := c.NewHTTPRequest(r)
+		if e != nil {
+			return nil, e
+		}
+		req.URL.Host = h
+		req.Host = ""
+		req.Header.Set(HostHeader, h)
+		resp, e := c.opts.httpclient().Do(req)
+		if e != nil {
+			err = newHTTPError(e)
+			if isRetryable(e, 0) {
+				continue
+			}
+			return nil, err
+		}
+		resp, e = handle(resp, r.Out)
+		if e != nil {
+			err = e
+			if ev, ok := e.(*Error); ok && isRetryable(ev, ev.StatusCode) {
+				continue
+			}
+			return nil, err
+		}
+		c.successFallbackHost.put(h)
+		return resp, nil
+	}
+	return nil, err
+}
+
+// newHTTPError gives an error for a failed HTTP request; requests which
+// have timed out fail with ErrTimeoutError.
+func newHTTPError(err error) *Error {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return newError(ErrTimeoutError, err)
+	}
+	return newError(ErrInternalError, err)
+}
+
+// isRetryable reports whether a request which failed with err and, if a
+// response was received, the given status code, can be retried against
+// a fallback host. Requests failing without a response, like on timeouts or
+// reset connections, and with a 500 to 504 status are retried; client errors,
+// including 401 and 403 ones, fail fast, as do cancelled requests.
+//
+// Spec RSC15d
+func isRetryable(err error, statusCode int) bool {
+	if statusCode != 0 {
+		return http.StatusInternalServerError <= statusCode &&
+			statusCode <= http.StatusGatewayTimeout
+	}
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	return err != nil && err != context.Canceled
 }
 
 // NewHTTPRequest creates a new http.Request that can be sent to ably endpoints.
@@ -434,10 +488,17 @@ func (c *RestClient) NewHTTPRequest(r *Request) (*http.Request, error) {
 	if r.header != nil {
 		copyHeader(req.Header, r.header)
 	}
+	if r.requestID != "" {
+		// Spec RSC7c
+		if req.URL.RawQuery != "" {
+			req.URL.RawQuery += "&"
+		}
+		req.URL.RawQuery += "request_id=" + url.QueryEscape(r.requestID)
+	}
 	req.Header.Set("Accept", proto) //spec RSC19c
 	req.Header.Set(AblyVersionHeader, AblyVersion)
 	req.Header.Set(AblyLibHeader, LibraryString)
-	if c.opts.ClientID != "" && c.Auth.method == authBasic {
+	if c.opts.ClientID != "" && c.authMethod(r) == authBasic {
 		// References RSA7e2
 		h := base64.StdEncoding.EncodeToString([]byte(c.opts.ClientID))
 		req.Header.Set(AblyClientIDHeader, h)
@@ -451,6 +512,15 @@ func (c *RestClient) NewHTTPRequest(r *Request) (*http.Request, error) {
 	return req, nil
 }
 
+// authMethod gives the method the client authenticates its requests with,
+// without locking Auth if r is made by Auth with its mutex held.
+func (c *RestClient) authMethod(r *Request) int {
+	if r.authLocked {
+		return c.Auth.method
+	}
+	return c.Auth.authMethod()
+}
+
 func (c *RestClient) handleResponse(resp *http.Response, out interface{}) (*http.Response, error) {
 	if err := checkValidHTTPResponse(resp); err != nil {
 		return nil, err
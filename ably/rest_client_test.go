@@ -1,15 +1,24 @@
 package ably_test
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httptrace"
 	"net/url"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,6 +36,25 @@ func newHTTPClientMock(srv *httptest.Server) *http.Client {
 	}
 }
 
+// newTLSHTTPClientMock returns a client which sends all requests to the given
+// TLS server, except for the ones addressed to any of the unreachable hosts,
+// which fail to connect.
+func newTLSHTTPClientMock(srv *httptest.Server, unreachable ...string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				for _, host := range unreachable {
+					if strings.HasPrefix(addr, host+":") {
+						return nil, errors.New("connection refused")
+					}
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
 func TestRestClient(t *testing.T) {
 	t.Parallel()
 	app, err := ablytest.NewSandbox(nil)
@@ -62,7 +90,7 @@ func TestRestClient(t *testing.T) {
 			if err != nil {
 				ts.Fatal(err)
 			}
-			err = client.Channels.Get("test", nil).Publish("ping", "pong")
+			_, err = client.Channels.Get("test", nil).Publish("ping", "pong")
 			if err != nil {
 				ts.Fatal(err)
 			}
@@ -100,7 +128,7 @@ func TestRestClient(t *testing.T) {
 			if err != nil {
 				ts.Fatal(err)
 			}
-			err = client.Channels.Get("test", nil).Publish("ping", "pong")
+			_, err = client.Channels.Get("test", nil).Publish("ping", "pong")
 			if err != nil {
 				ts.Fatal(err)
 			}
@@ -188,7 +216,8 @@ func TestRestClient(t *testing.T) {
 
 		longAgo := lastInterval.Add(-120 * time.Minute)
 		page, err := client.Stats(&ably.PaginateParams{
-			Limit: 1,
+			Limit:     1,
+			Direction: "forwards",
 			ScopeParams: ably.ScopeParams{
 				Start: ably.Time(longAgo),
 				Unit:  proto.StatGranularityMinute,
@@ -202,6 +231,9 @@ func TestRestClient(t *testing.T) {
 		if !re.MatchString(interval) {
 			ts.Errorf("got %s which is wrong interval format", interval)
 		}
+		if count := page.Stats()[0].Inbound.RealTime.Plain.Count; count != 50 {
+			ts.Errorf("expected 50 inbound realtime messages got %v", count)
+		}
 	})
 }
 
@@ -258,7 +290,7 @@ func TestRest_hostfallback(t *testing.T) {
 		if err != nil {
 			ts.Fatal(err)
 		}
-		err = client.Channels.Get("test", nil).Publish("ping", "pong")
+		_, err = client.Channels.Get("test", nil).Publish("ping", "pong")
 		if err == nil {
 			ts.Error("expected an error")
 		}
@@ -388,6 +420,106 @@ func TestRest_hostfallback(t *testing.T) {
 	})
 }
 
+func TestRest_hostfallbackStubbed(t *testing.T) {
+	t.Parallel()
+	runTestServer := func(ts *testing.T, options *ably.ClientOptions, fail func(host string) bool, unreachable ...string) ([]string, error) {
+		var mtx sync.Mutex
+		var hosts []string
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			hosts = append(hosts, r.Host)
+			mtx.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if fail(r.Host) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":{"code":50000,"statusCode":500}}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		}))
+		defer server.Close()
+		options.Key = "abc:abc"
+		options.NoBinaryProtocol = true
+		options.HTTPClient = newTLSHTTPClientMock(server, unreachable...)
+		client, err := ably.NewRestClient(options)
+		if err != nil {
+			ts.Fatal(err)
+		}
+		_, err = client.Channels.Get("test", nil).Publish("ping", "pong")
+		return hosts, err
+	}
+	isPrimary := func(host string) bool { return host == ably.RestHost }
+	isFallback := func(host string) bool {
+		for _, h := range ably.DefaultFallbackHosts() {
+			if h == host {
+				return true
+			}
+		}
+		return false
+	}
+	t.Run("RSC15a must retry against fallback on 5xx", func(ts *testing.T) {
+		hosts, err := runTestServer(ts, &ably.ClientOptions{}, isPrimary)
+		if err != nil {
+			ts.Fatal(err)
+		}
+		if len(hosts) != 2 {
+			ts.Fatalf("expected 2 http calls got %d", len(hosts))
+		}
+		if !isPrimary(hosts[0]) {
+			ts.Errorf("expected first call to %s got %s", ably.RestHost, hosts[0])
+		}
+		if !isFallback(hosts[1]) {
+			ts.Errorf("expected %s to be one of %v", hosts[1], ably.DefaultFallbackHosts())
+		}
+	})
+	t.Run("RSC15a must retry against fallback on network error", func(ts *testing.T) {
+		hosts, err := runTestServer(ts, &ably.ClientOptions{}, func(string) bool { return false }, ably.RestHost)
+		if err != nil {
+			ts.Fatal(err)
+		}
+		if len(hosts) != 1 {
+			ts.Fatalf("expected 1 http call got %d", len(hosts))
+		}
+		if !isFallback(hosts[0]) {
+			ts.Errorf("expected %s to be one of %v", hosts[0], ably.DefaultFallbackHosts())
+		}
+	})
+	t.Run("must honor HTTPMaxRetryCount", func(ts *testing.T) {
+		options := &ably.ClientOptions{HTTPMaxRetryCount: 2}
+		hosts, err := runTestServer(ts, options, func(string) bool { return true })
+		if err == nil {
+			ts.Fatal("expected an error")
+		}
+		if len(hosts) != 3 {
+			ts.Fatalf("expected 3 http calls got %d", len(hosts))
+		}
+		if hosts[1] == hosts[2] {
+			ts.Errorf("expected unique fallback hosts got %v", hosts[1:])
+		}
+	})
+	t.Run("TO3l6 must honor HTTPMaxRetryDuration", func(ts *testing.T) {
+		options := &ably.ClientOptions{HTTPMaxRetryDuration: time.Nanosecond}
+		hosts, err := runTestServer(ts, options, func(string) bool { return true })
+		if err == nil {
+			ts.Fatal("expected an error")
+		}
+		if len(hosts) != 1 {
+			ts.Fatalf("expected 1 http call got %d", len(hosts))
+		}
+	})
+	t.Run("RSC15b must not retry when RestHost is overridden", func(ts *testing.T) {
+		options := &ably.ClientOptions{RestHost: "example.com"}
+		hosts, err := runTestServer(ts, options, func(string) bool { return true })
+		if err == nil {
+			ts.Fatal("expected an error")
+		}
+		if len(hosts) != 1 {
+			ts.Fatalf("expected 1 http call got %d", len(hosts))
+		}
+	})
+}
+
 func TestRest_rememberHostFallback(t *testing.T) {
 	app, err := ablytest.NewSandbox(nil)
 	if err != nil {
@@ -429,7 +561,7 @@ func TestRest_rememberHostFallback(t *testing.T) {
 			ts.Fatal(err)
 		}
 		channel := client.Channels.Get("remember_fallback_host", nil)
-		err = channel.Publish("ping", "pong")
+		_, err = channel.Publish("ping", "pong")
 		if err != nil {
 			ts.Fatal(err)
 		}
@@ -440,7 +572,7 @@ func TestRest_rememberHostFallback(t *testing.T) {
 		retryCount = 0
 
 		// the same cached host is used again
-		err = channel.Publish("pong", "ping")
+		_, err = channel.Publish("pong", "ping")
 		if err != nil {
 			ts.Fatal(err)
 		}
@@ -545,7 +677,7 @@ func TestFixConnLeak_ISSUE89(t *testing.T) {
 	}
 	channel := client.Channels.Get("issue89", nil)
 	for i := 0; i < 10; i++ {
-		err := channel.Publish(fmt.Sprintf("msg_%d", i), fmt.Sprint(i))
+		_, err := channel.Publish(fmt.Sprintf("msg_%d", i), fmt.Sprint(i))
 		if err != nil {
 			t.Error(err)
 		}
@@ -564,3 +696,345 @@ func TestFixConnLeak_ISSUE89(t *testing.T) {
 func connIsClosed(err error) bool {
 	return strings.Contains(err.Error(), "use of closed network connection")
 }
+
+func TestRest_Time(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/time" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[1500000000123]`))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key:          "xxxxxx.yyyyyy:zzzzzz",
+			UseQueryTime: true,
+		},
+		NoBinaryProtocol: true,
+		HTTPClient:       newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTime, err := client.Time()
+	if err != nil {
+		t.Fatalf("Time()=%v", err)
+	}
+	if want := time.Unix(1500000000, 123*int64(time.Millisecond)); !serverTime.Equal(want) {
+		t.Errorf("want time=%s; got %s", want, serverTime)
+	}
+
+	// The offset between the local and server time is queried once and
+	// reused for subsequent token requests.
+	for i := 0; i < 3; i++ {
+		req, err := client.Auth.CreateTokenRequest(nil, nil)
+		if err != nil {
+			t.Fatalf("CreateTokenRequest()=%v", err)
+		}
+		if d := time.Duration(req.Timestamp-1500000000123) * time.Millisecond; d < 0 || d > time.Minute {
+			t.Errorf("want timestamp close to server time; got %d", req.Timestamp)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("want 2 requests to /time; got %d", n)
+	}
+}
+
+func TestRest_HTTPRequestTimeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions:        ably.AuthOptions{Key: "xxxxxx.yyyyyy:zzzzzz"},
+		RestHost:           "example.com",
+		NoBinaryProtocol:   true,
+		HTTPRequestTimeout: 50 * time.Millisecond,
+		HTTPClient:         newTLSHTTPClientMock(server),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Time()
+	if err := checkError(ably.ErrTimeoutError, err); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRest_TokenRenewal(t *testing.T) {
+	t.Parallel()
+	for _, code := range []int{40140, 40142} {
+		t.Run(strconv.Itoa(code), func(t *testing.T) {
+			var mtx sync.Mutex
+			var tokens []string
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				tokens = append(tokens, r.Header.Get("Authorization"))
+				w.Header().Set("Content-Type", "application/json")
+				if len(tokens) == 1 {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprintf(w, `{"error":{"code":%d,"statusCode":401}}`, code)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("{}"))
+			}))
+			defer server.Close()
+			client, err := ably.NewRestClient(&ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{
+					AuthCallback: tokenCallback(),
+				},
+				NoBinaryProtocol: true,
+				HTTPClient:       newTLSHTTPClientMock(server),
+			})
+			if err != nil {
+				t.Fatalf("NewRestClient()=%v", err)
+			}
+			if _, err := client.Channels.Get("test", nil).Publish("name", "data"); err != nil {
+				t.Fatalf("Publish()=%v", err)
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			want := []string{
+				"Bearer " + base64.StdEncoding.EncodeToString([]byte("token-1")),
+				"Bearer " + base64.StdEncoding.EncodeToString([]byte("token-2")),
+			}
+			if !reflect.DeepEqual(tokens, want) {
+				t.Errorf("want Authorization headers %v; got %v", want, tokens)
+			}
+		})
+	}
+}
+
+func TestRest_FallbackRetryable(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		status int
+		body   string
+		calls  int
+	}{
+		{http.StatusBadRequest, `{"error":{"code":40005,"statusCode":400}}`, 1},
+		{http.StatusUnauthorized, `{"error":{"code":40101,"statusCode":401}}`, 1},
+		{http.StatusForbidden, `{"error":{"code":40300,"statusCode":403}}`, 1},
+		{http.StatusInternalServerError, `{"error":{"code":50000,"statusCode":500}}`, 3},
+		{http.StatusServiceUnavailable, `{"error":{"code":50300,"statusCode":503}}`, 3},
+	}
+	for _, cas := range cases {
+		cas := cas
+		t.Run(strconv.Itoa(cas.status), func(t *testing.T) {
+			t.Parallel()
+			var mtx sync.Mutex
+			var hosts []string
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				hosts = append(hosts, r.Host)
+				mtx.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(cas.status)
+				w.Write([]byte(cas.body))
+			}))
+			defer server.Close()
+			client, err := ably.NewRestClient(&ably.ClientOptions{
+				AuthOptions: ably.AuthOptions{
+					Key: "xxxxxx.yyyyyy:zzzzzz",
+				},
+				FallbackHosts:    []string{"a.example.com", "b.example.com"},
+				NoBinaryProtocol: true,
+				HTTPClient:       newTLSHTTPClientMock(server),
+			})
+			if err != nil {
+				t.Fatalf("NewRestClient()=%v", err)
+			}
+			if _, err := client.Time(); err == nil {
+				t.Fatal("want Time() to fail")
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if len(hosts) != cas.calls {
+				t.Fatalf("want %d requests; got %d to %v", cas.calls, len(hosts), hosts)
+			}
+		})
+	}
+}
+
+// errTransport fails all requests with err, counting them.
+type errTransport struct {
+	err   error
+	calls int32
+}
+
+func (t *errTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return nil, t.err
+}
+
+func TestRest_FallbackTransportErrors(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		err   error
+		calls int
+	}{
+		{errors.New("connection reset"), 3},
+		{context.Canceled, 1},
+	}
+	for _, cas := range cases {
+		transport := &errTransport{err: cas.err}
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key: "xxxxxx.yyyyyy:zzzzzz",
+			},
+			FallbackHosts:    []string{"a.example.com", "b.example.com"},
+			NoBinaryProtocol: true,
+			HTTPClient:       &http.Client{Transport: transport},
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		if _, err := client.Time(); err == nil {
+			t.Fatalf("want Time() to fail with %v", cas.err)
+		}
+		if n := int(atomic.LoadInt32(&transport.calls)); n != cas.calls {
+			t.Errorf("want %d requests for %v; got %d", cas.calls, cas.err, n)
+		}
+	}
+}
+
+func TestRest_RequestIDs(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"code":50000,"statusCode":500}}`))
+	}))
+	defer server.Close()
+	newClient := func(addRequestIDs bool) (*ably.RestClient, *ablytest.RoundTripRecorder) {
+		rec := &ablytest.RoundTripRecorder{}
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key: "xxxxxx.yyyyyy:zzzzzz",
+			},
+			FallbackHosts:    []string{"a.example.com", "b.example.com"},
+			NoBinaryProtocol: true,
+			HTTPClient:       &http.Client{Transport: rec.Hijack(newTLSHTTPClientMock(server).Transport)},
+			AddRequestIDs:    addRequestIDs,
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		return client, rec
+	}
+	client, rec := newClient(true)
+	_, err := client.Time()
+	e, ok := err.(*ably.Error)
+	if !ok {
+		t.Fatalf("want Time() to fail with *ably.Error; got %v", err)
+	}
+	// The request keeps its ID when it's retried against the fallback hosts.
+	reqs := rec.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("want 3 requests; got %d", len(reqs))
+	}
+	id := reqs[0].URL.Query().Get("request_id")
+	if id == "" {
+		t.Fatal("want non-empty request_id")
+	}
+	for i, req := range reqs {
+		if h := req.Header.Get(ably.AblyVersionHeader); h != ably.AblyVersion {
+			t.Errorf("%d: want %s=%s; got %q", i, ably.AblyVersionHeader, ably.AblyVersion, h)
+		}
+		if got := req.URL.Query().Get("request_id"); got != id {
+			t.Errorf("%d: want request_id=%q; got %q", i, id, got)
+		}
+	}
+	if e.RequestID != id {
+		t.Errorf("want RequestID=%q; got %q", id, e.RequestID)
+	}
+	client.Time()
+	if next := rec.Request(3).URL.Query().Get("request_id"); next == "" || next == id {
+		t.Errorf("want new request_id for a new request; got %q", next)
+	}
+	client, rec = newClient(false)
+	_, err = client.Time()
+	if err := checkError(50000, err); err != nil {
+		t.Fatal(err)
+	}
+	if id := rec.Request(0).URL.Query().Get("request_id"); id != "" {
+		t.Errorf("want no request_id; got %q", id)
+	}
+	if id := err.(*ably.Error).RequestID; id != "" {
+		t.Errorf("want no RequestID; got %q", id)
+	}
+}
+
+func TestRest_HTTPClientKeepAlive(t *testing.T) {
+	t.Parallel()
+	var mtx sync.Mutex
+	var conns int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/time":
+			fmt.Fprintf(w, "[%d]\n", ably.TimeNow())
+		case "/channels/test/messages":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{\"channel\":\"test\",\"messageId\":\"id\"}\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":40400,"statusCode":404}}` + "\n"))
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mtx.Lock()
+			conns++
+			mtx.Unlock()
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	// Clients sharing an http.Client share its connection pool as well.
+	httpClient := newTLSHTTPClientMock(server)
+	for i := 0; i < 2; i++ {
+		client, err := ably.NewRestClient(&ably.ClientOptions{
+			AuthOptions: ably.AuthOptions{
+				Key: "xxxxxx.yyyyyy:zzzzzz",
+			},
+			NoBinaryProtocol: true,
+			HTTPClient:       httpClient,
+		})
+		if err != nil {
+			t.Fatalf("NewRestClient()=%v", err)
+		}
+		for j := 0; j < 3; j++ {
+			if _, err := client.Time(); err != nil {
+				t.Fatalf("Time()=%v", err)
+			}
+			if _, err := client.Channels.Get("test", nil).Publish("name", "data"); err != nil {
+				t.Fatalf("Publish()=%v", err)
+			}
+			if _, err := client.Request("get", "/missing", nil, nil, nil); err != nil {
+				t.Fatalf("Request()=%v", err)
+			}
+			if _, err := client.Stats(nil); err == nil {
+				t.Fatal("want Stats() to fail")
+			}
+		}
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if conns != 1 {
+		t.Fatalf("want all requests sent over 1 connection; got %d connections", conns)
+	}
+}
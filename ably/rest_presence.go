@@ -7,18 +7,44 @@ type RestPresence struct {
 
 // Get gives the channel's presence messages according to the given parameters.
 // The returned result can be inspected for the presence messages via
-// the PresenceMessages() method.
+// the PresenceMessages() method; they hold the members currently present on
+// the channel, as entered by realtime clients, so the member set can be read
+// without holding a realtime connection.
+//
+// Spec RSP3
 func (p *RestPresence) Get(params *PaginateParams) (*PaginatedResult, error) {
+	var getParams *PresenceGetParams
+	if params != nil {
+		getParams = &PresenceGetParams{PaginateParams: *params}
+	}
+	return p.GetWithParams(getParams)
+}
+
+// GetWithParams is like Get, but it gives only the members matching
+// the ClientID and ConnectionID of params, filtered by the server.
+//
+// Spec RSP3a2, RSP3a3
+func (p *RestPresence) GetWithParams(params *PresenceGetParams) (*PaginatedResult, error) {
 	path := p.channel.baseURL + "/presence"
-	return newPaginatedResult(nil, paginatedRequest{typ: presMsgType, path: path, params: params, query: query(p.client.get), logger: p.logger(), respCheck: checkValidHTTPResponse})
+	var pageParams *PaginateParams
+	if params != nil {
+		if filter := params.filterQuery(); len(filter) != 0 {
+			path += "?" + filter.Encode()
+		}
+		pageParams = &params.PaginateParams
+	}
+	return newPaginatedResult(p.channel.options, paginatedRequest{typ: presMsgType, path: path, params: pageParams, query: query(p.client.get), logger: p.logger(), respCheck: checkValidHTTPResponse})
 }
 
 // History gives the channel's presence messages history according to the given
 // parameters. The returned result can be inspected for the presence messages
-// via the PresenceMessages() method.
+// via the PresenceMessages() method; they hold the enter, leave and update
+// actions along with their timestamps.
+//
+// Spec RSP4
 func (p *RestPresence) History(params *PaginateParams) (*PaginatedResult, error) {
 	path := p.channel.baseURL + "/presence/history"
-	return newPaginatedResult(nil, paginatedRequest{typ: presMsgType, path: path, params: params, query: query(p.client.get), logger: p.logger(), respCheck: checkValidHTTPResponse})
+	return newPaginatedResult(p.channel.options, paginatedRequest{typ: presMsgType, path: path, params: params, query: query(p.client.get), logger: p.logger(), respCheck: checkValidHTTPResponse})
 }
 
 func (p *RestPresence) logger() *LoggerOptions {
@@ -1,6 +1,10 @@
 package ably_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
@@ -99,3 +103,114 @@ func TestChannel_Presence(t *testing.T) {
 	})
 
 }
+
+func TestRestPresence_GetRealtimeMembers(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRealtimeClient(&ably.ClientOptions{ClientID: "member"})
+	defer safeclose(t, client, app)
+	if err := ablytest.Wait(client.Channels.Get("presence").Presence.Enter("data")); err != nil {
+		t.Fatalf("Enter()=%v", err)
+	}
+	rest, err := ably.NewRestClient(app.Options())
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	// The member set is read without any realtime connection; it may take
+	// a moment for the entered member to become visible over REST.
+	presence := rest.Channels.Get("presence", nil).Presence
+	for deadline := time.Now().Add(ablytest.Timeout); ; time.Sleep(100 * time.Millisecond) {
+		page, err := presence.Get(nil)
+		if err != nil {
+			t.Fatalf("Get()=%v", err)
+		}
+		members := page.PresenceMessages()
+		if len(members) == 1 {
+			if m := members[0]; m.ClientID != "member" || m.Data != "data" {
+				t.Fatalf("want member clientId=%q data=%q; got %+v", "member", "data", m)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 1 member; got %d", len(members))
+		}
+	}
+}
+
+func TestRestPresence_GetWithParams(t *testing.T) {
+	t.Parallel()
+	queries := make(chan url.Values, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	client, err := ably.NewRestClient(&ably.ClientOptions{
+		AuthOptions: ably.AuthOptions{
+			Key: "abc:abc",
+		},
+		RestHost:         server.Listener.Addr().String(),
+		NoBinaryProtocol: true,
+		HTTPClient:       server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &ably.PresenceGetParams{
+		PaginateParams: ably.PaginateParams{Limit: 10},
+		ClientID:       "client",
+		ConnectionID:   "connection",
+	}
+	if _, err := client.Channels.Get("test", nil).Presence.GetWithParams(params); err != nil {
+		t.Fatalf("GetWithParams()=%v", err)
+	}
+	want := url.Values{
+		"clientId":     {"client"},
+		"connectionId": {"connection"},
+		"limit":        {"10"},
+	}
+	if query := <-queries; !reflect.DeepEqual(query, want) {
+		t.Fatalf("want query=%v; got %v", want, query)
+	}
+}
+
+func TestRestPresence_GetByClientID(t *testing.T) {
+	t.Parallel()
+	app, client := ablytest.NewRealtimeClient(nil)
+	defer safeclose(t, client, app)
+	channel := client.Channels.Get("presence")
+	for _, clientID := range []string{"member1", "member2", "member3"} {
+		if err := ablytest.Wait(channel.Presence.EnterClient(clientID, clientID)); err != nil {
+			t.Fatalf("EnterClient(%q)=%v", clientID, err)
+		}
+	}
+	rest, err := ably.NewRestClient(app.Options())
+	if err != nil {
+		t.Fatalf("NewRestClient()=%v", err)
+	}
+	params := &ably.PresenceGetParams{ClientID: "member2"}
+	presence := rest.Channels.Get("presence", nil).Presence
+	for deadline := time.Now().Add(ablytest.Timeout); ; time.Sleep(100 * time.Millisecond) {
+		page, err := presence.GetWithParams(params)
+		if err != nil {
+			t.Fatalf("GetWithParams()=%v", err)
+		}
+		members := page.PresenceMessages()
+		if len(members) == 1 {
+			if m := members[0]; m.ClientID != "member2" || m.Data != "member2" {
+				t.Fatalf("want member clientId=%q data=%q; got %+v", "member2", "member2", m)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 1 member; got %d", len(members))
+		}
+	}
+	members, err := channel.Presence.GetWithParams(true, params)
+	if err != nil {
+		t.Fatalf("GetWithParams()=%v", err)
+	}
+	if len(members) != 1 || members[0].ClientID != "member2" {
+		t.Fatalf("want only member2; got %+v", members)
+	}
+}
@@ -1,9 +1,11 @@
 package ably
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/ably/ably-go/ably/proto"
 )
@@ -71,6 +73,7 @@ const (
 	StateChanClosing
 	StateChanClosed
 	StateChanFailed
+	StateChanSuspended
 )
 
 // Result awaits completion of asynchronous operation.
@@ -88,6 +91,24 @@ func wait(res Result, err error) error {
 	return res.Wait()
 }
 
+// canceler is implemented by results which can stop waiting for completion
+// of their operation.
+type canceler interface {
+	waitCtx(ctx context.Context) error
+}
+
+// waitCtx is like wait, but it returns ctx.Err() as soon as ctx is done,
+// unregistering the result from whatever was meant to complete it.
+func waitCtx(ctx context.Context, res Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if res, ok := res.(canceler); ok {
+		return res.waitCtx(ctx)
+	}
+	return res.Wait()
+}
+
 var stateText = map[StateEnum]string{
 	StateConnInitialized:  "ably.StateConnInitialized",
 	StateConnConnecting:   "ably.StateConnConnecting",
@@ -105,6 +126,7 @@ var stateText = map[StateEnum]string{
 	StateChanClosing:      "ably.StateChanClosing",
 	StateChanClosed:       "ably.StateChanClosed",
 	StateChanFailed:       "ably.StateChanFailed",
+	StateChanSuspended:    "ably.StateChanSuspended",
 }
 
 // stateAll lists all valid connection and channel state values.
@@ -124,9 +146,11 @@ var stateAll = map[StateType][]StateEnum{
 		StateChanAttaching,
 		StateChanAttached,
 		StateChanDetaching,
-		StateChanClosed,
 		StateChanDetached,
+		StateChanClosing,
+		StateChanClosed,
 		StateChanFailed,
+		StateChanSuspended,
 	},
 }
 
@@ -137,7 +161,7 @@ var stateMasks = map[StateType]StateEnum{
 		StateConnFailed,
 	StateChan: StateChanInitialized | StateChanAttaching | StateChanAttached |
 		StateChanDetaching | StateChanDetached | StateChanClosing | StateChanClosed |
-		StateChanFailed,
+		StateChanFailed | StateChanSuspended,
 }
 
 var (
@@ -183,10 +207,32 @@ func stateError(state StateEnum, err error) error {
 // a channel, which will get notified with single State value for each transition
 // than takes place.
 type State struct {
-	Channel string    // channel name or empty if Type is StateConn
-	Err     error     // eventual error value associated with transition
-	State   StateEnum // state which connection or channel has transitioned to
-	Type    StateType // whether transition happened on connection or channel
+	Channel  string        // channel name or empty if Type is StateConn
+	Err      error         // eventual error value associated with transition
+	State    StateEnum     // state which connection or channel has transitioned to
+	Previous StateEnum     // state which connection or channel has transitioned from
+	Type     StateType     // whether transition happened on connection or channel
+	RetryIn  time.Duration // for StateConnDisconnected and StateConnSuspended, delay before the next connection attempt
+
+	// Resumed is true for StateChanAttached, when the channel's continuity
+	// was preserved and no messages were lost since it was last attached.
+	// Otherwise the application may need to resynchronize its state.
+	//
+	// Spec RTL2f, TH4
+	Resumed bool
+}
+
+// ConnState is a state of the realtime connection, one of the StateConn*
+// values.
+type ConnState = StateEnum
+
+// ConnStateChange describes a single transition of the realtime connection's
+// state, as given to the handlers registered with Conn.On and Conn.OnAll.
+type ConnStateChange struct {
+	Previous ConnState     // state which the connection has transitioned from
+	Current  ConnState     // state which the connection has transitioned to
+	Reason   *ErrorInfo    // eventual error associated with the transition
+	RetryIn  time.Duration // for StateConnDisconnected and StateConnSuspended, delay before the next connection attempt
 }
 
 type stateEmitter struct {
@@ -194,7 +240,9 @@ type stateEmitter struct {
 	channel   string
 	listeners map[StateEnum]map[chan<- State]struct{}
 	onetime   map[StateEnum]map[chan<- State]struct{}
+	handlers  *stateHandlers // handlers of connection state changes; nil for channels
 	err       error
+	reason    error // err of the last failed state; cleared once connected or attached
 	current   StateEnum
 	typ       StateType
 	logger    *LoggerOptions
@@ -215,20 +263,93 @@ func newStateEmitter(typ StateType, startState StateEnum, channel string, log *L
 }
 
 func (s *stateEmitter) set(state StateEnum, err error) error {
-	doemit := s.current != state
-	s.current = state
-	s.err = stateError(state, err)
-	if doemit {
-		s.emit(State{
-			Channel: s.channel,
-			Err:     s.err,
-			State:   s.current,
-			Type:    s.typ,
-		})
+	return s.setRetry(state, err, 0)
+}
+
+// setRetry works like set, additionally informing listeners that another
+// attempt to leave the state is going to be made after the given delay.
+func (s *stateEmitter) setRetry(state StateEnum, err error, retryIn time.Duration) error {
+	return s.transition(State{State: state, RetryIn: retryIn}, err)
+}
+
+// transition moves to the st.State state, emitting st to the listeners with
+// the remaining fields filled in.
+func (s *stateEmitter) transition(st State, err error) error {
+	return s.change(st, err, false)
+}
+
+// update works like transition, but it emits st to the listeners even if
+// the state doesn't change, like for an attached channel which lost its
+// continuity.
+func (s *stateEmitter) update(st State, err error) error {
+	return s.change(st, err, true)
+}
+
+func (s *stateEmitter) change(st State, err error, force bool) error {
+	previous := s.current
+	s.current = st.State
+	s.err = stateError(st.State, err)
+	switch {
+	case st.State == StateConnConnected || st.State == StateChanAttached:
+		s.reason = nil
+	case s.err != nil:
+		s.reason = s.err
+	}
+	if previous != st.State || force {
+		st.Channel = s.channel
+		st.Err = s.err
+		st.Previous = previous
+		st.Type = s.typ
+		s.logTransition(st)
+		s.emit(st)
+		if s.handlers != nil {
+			s.handlers.enqueue(ConnStateChange{
+				Previous: st.Previous,
+				Current:  st.State,
+				Reason:   stateReason(st.Err),
+				RetryIn:  st.RetryIn,
+			})
+		}
 	}
 	return s.err
 }
 
+// stateReason gives err as an *ErrorInfo for a ConnStateChange.
+func stateReason(err error) *ErrorInfo {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return err
+	default:
+		return newError(ErrConnectionFailed, err)
+	}
+}
+
+// logTransition logs connection state changes at LogInfo level and channel
+// ones at LogVerbose level.
+func (s *stateEmitter) logTransition(st State) {
+	level := LogInfo
+	if s.typ == StateChan {
+		level = LogVerbose
+	}
+	if !s.logger.Is(level) {
+		return
+	}
+	name := s.typ.String()
+	if s.channel != "" {
+		name += fmt.Sprintf(" %q", s.channel)
+	}
+	switch {
+	case st.Err != nil:
+		s.logger.Printf(level, "%s state changed from %s to %s: %v", name, st.Previous, st.State, st.Err)
+	case st.RetryIn != 0:
+		s.logger.Printf(level, "%s state changed from %s to %s, retrying in %v", name, st.Previous, st.State, st.RetryIn)
+	default:
+		s.logger.Printf(level, "%s state changed from %s to %s", name, st.Previous, st.State)
+	}
+}
+
 func (s *stateEmitter) emit(st State) {
 	for ch := range s.listeners[st.State] {
 		select {
@@ -273,6 +394,18 @@ func (s *stateEmitter) once(ch chan<- State, states ...StateEnum) {
 	}
 }
 
+// offOnce removes the one-time listener registered with once.
+func (s *stateEmitter) offOnce(ch chan<- State) {
+	s.Lock()
+	for state, l := range s.onetime {
+		delete(l, ch)
+		if len(l) == 0 {
+			delete(s.onetime, state)
+		}
+	}
+	s.Unlock()
+}
+
 func (s *stateEmitter) on(ch chan<- State, states ...StateEnum) {
 	if ch == nil {
 		panic(fmt.Sprintf("ably: %s On using nil channel", s.typ))
@@ -315,6 +448,103 @@ func (s *stateEmitter) off(ch chan<- State, states ...StateEnum) {
 	s.Unlock()
 }
 
+// stateHandlers calls the handlers registered for connection state changes.
+// The changes are queued and handled in order by a single goroutine, so that
+// the connection never waits for the handlers.
+type stateHandlers struct {
+	mtx      sync.Mutex
+	handlers map[*stateHandler]struct{}
+	queue    []stateDelivery
+	running  bool // whether the goroutine handling the queue is running
+}
+
+type stateHandler struct {
+	states StateEnum // mask of the states the handler is registered for
+	fn     func(ConnStateChange)
+	off    bool // set once the handler is removed
+}
+
+// stateDelivery is a state change along with the handlers registered for
+// its state at the time it happened.
+type stateDelivery struct {
+	change   ConnStateChange
+	handlers []*stateHandler
+}
+
+func newStateHandlers() *stateHandlers {
+	return &stateHandlers{
+		handlers: make(map[*stateHandler]struct{}),
+	}
+}
+
+// add registers fn for the states in the states mask, giving a function
+// which removes it.
+func (h *stateHandlers) add(states StateEnum, fn func(ConnStateChange)) (off func()) {
+	handler := &stateHandler{states: states, fn: fn}
+	h.mtx.Lock()
+	h.handlers[handler] = struct{}{}
+	h.mtx.Unlock()
+	return func() {
+		h.mtx.Lock()
+		handler.off = true
+		delete(h.handlers, handler)
+		h.mtx.Unlock()
+	}
+}
+
+// remove deregisters all handlers from the states in the states mask.
+func (h *stateHandlers) remove(states StateEnum) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for handler := range h.handlers {
+		if handler.states &^= states; handler.states == 0 {
+			handler.off = true
+			delete(h.handlers, handler)
+		}
+	}
+}
+
+func (h *stateHandlers) enqueue(change ConnStateChange) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var handlers []*stateHandler
+	for handler := range h.handlers {
+		if handler.states&change.Current != 0 {
+			handlers = append(handlers, handler)
+		}
+	}
+	if len(handlers) == 0 {
+		return
+	}
+	h.queue = append(h.queue, stateDelivery{change: change, handlers: handlers})
+	if !h.running {
+		h.running = true
+		go h.run()
+	}
+}
+
+func (h *stateHandlers) run() {
+	for {
+		h.mtx.Lock()
+		if len(h.queue) == 0 {
+			h.running = false
+			h.mtx.Unlock()
+			return
+		}
+		d := h.queue[0]
+		h.queue = h.queue[1:]
+		h.mtx.Unlock()
+		for _, handler := range d.handlers {
+			h.mtx.Lock()
+			off := handler.off
+			h.mtx.Unlock()
+			if !off {
+				handler.fn(d.change)
+			}
+		}
+	}
+}
+
 // queuedEmitter emits confirmation events triggered by ACK or NACK messages.
 type pendingEmitter struct {
 	queue  []serialCh
@@ -330,6 +560,13 @@ func newPendingEmitter(log *LoggerOptions) pendingEmitter {
 type serialCh struct {
 	serial int64
 	ch     chan<- error
+	msg    *proto.ProtocolMessage
+}
+
+func (sch serialCh) notify(err error) {
+	if sch.ch != nil {
+		sch.ch <- err
+	}
 }
 
 func (q pendingEmitter) Len() int {
@@ -348,16 +585,17 @@ func (q pendingEmitter) Search(serial int64) int {
 	return sort.Search(q.Len(), func(i int) bool { return q.queue[i].serial >= serial })
 }
 
-func (q *pendingEmitter) Enqueue(serial int64, ch chan<- error) {
+func (q *pendingEmitter) Enqueue(msg *proto.ProtocolMessage, ch chan<- error) {
+	serial := msg.MsgSerial
 	switch i := q.Search(serial); {
 	case i == q.Len():
-		q.queue = append(q.queue, serialCh{serial, ch})
+		q.queue = append(q.queue, serialCh{serial, ch, msg})
 	case q.queue[i].serial == serial:
 		q.logger.Printf(LogWarning, "duplicated message serial: %d", serial)
 	default:
 		q.queue = append(q.queue, serialCh{})
 		copy(q.queue[i+1:], q.queue[i:])
-		q.queue[i] = serialCh{serial, ch}
+		q.queue[i] = serialCh{serial, ch, msg}
 	}
 }
 
@@ -377,16 +615,20 @@ func (q *pendingEmitter) Ack(serial int64, count int, err error) {
 		nack = i + 1
 		ack = min(i+1+count, q.Len())
 	}
-	if err == nil {
+	if err == nil && nack != 0 {
 		err = newError(50000, err)
 	}
 	for _, sch := range q.queue[:nack] {
-		q.logger.Printf(LogVerbose, "received NACK for message serial %d", sch.serial)
-		sch.ch <- err
+		if q.logger.Is(LogVerbose) {
+			q.logger.Printf(LogVerbose, "received NACK for message serial %d", sch.serial)
+		}
+		sch.notify(err)
 	}
 	for _, sch := range q.queue[nack:ack] {
-		q.logger.Printf(LogVerbose, "received ACK for message serial %d", sch.serial)
-		sch.ch <- nil
+		if q.logger.Is(LogVerbose) {
+			q.logger.Printf(LogVerbose, "received ACK for message serial %d", sch.serial)
+		}
+		sch.notify(nil)
 	}
 	q.queue = q.queue[ack:]
 }
@@ -408,12 +650,73 @@ func (q *pendingEmitter) Nack(serial int64, count int, err error) {
 		err = newError(50000, err)
 	}
 	for _, sch := range q.queue[:nack] {
-		q.logger.Printf(LogVerbose, "received NACK for message serial %d", sch.serial)
-		sch.ch <- err
+		if q.logger.Is(LogVerbose) {
+			q.logger.Printf(LogVerbose, "received NACK for message serial %d", sch.serial)
+		}
+		sch.notify(err)
 	}
 	q.queue = q.queue[nack:]
 }
 
+// Fail fails all messages awaiting an ACK with the given error.
+func (q *pendingEmitter) Fail(err error) {
+	for _, sch := range q.queue {
+		if q.logger.Is(LogVerbose) {
+			q.logger.Printf(LogVerbose, "failed pending message serial %d", sch.serial)
+		}
+		sch.notify(err)
+	}
+	q.queue = nil
+}
+
+// Expire fails the message enqueued with ch, if it's still awaiting an ACK,
+// with the given error.
+func (q *pendingEmitter) Expire(ch chan<- error, err error) {
+	for i := range q.queue {
+		if q.queue[i].ch == ch {
+			if q.logger.Is(LogVerbose) {
+				q.logger.Printf(LogVerbose, "no ACK received for message serial %d", q.queue[i].serial)
+			}
+			q.queue[i].notify(err)
+			q.queue[i].ch = nil
+		}
+	}
+}
+
+// Contains reports whether the message enqueued with ch still awaits an ACK.
+func (q *pendingEmitter) Contains(ch chan<- error) bool {
+	for _, sch := range q.queue {
+		if sch.ch == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// Dequeue removes all messages awaiting an ACK, giving the ones which have
+// got a listener in order of their serials.
+func (q *pendingEmitter) Dequeue() []serialCh {
+	var pending []serialCh
+	for _, sch := range q.queue {
+		if sch.ch != nil {
+			pending = append(pending, sch)
+		}
+	}
+	q.queue = nil
+	return pending
+}
+
+// Remove stops notifying ch about the ACK or NACK of the message it was
+// enqueued with. The message itself is still awaiting the ACK, so that
+// the serials of the following ones are accounted for.
+func (q *pendingEmitter) Remove(ch chan<- error) {
+	for i := range q.queue {
+		if q.queue[i].ch == ch {
+			q.queue[i].ch = nil
+		}
+	}
+}
+
 type msgch struct {
 	msg *proto.ProtocolMessage
 	ch  chan<- error
@@ -438,29 +741,49 @@ func (q *msgQueue) Enqueue(msg *proto.ProtocolMessage, listen chan<- error) {
 	q.mtx.Unlock()
 }
 
+// Flush sends the queued messages. They're sent without the queue locked,
+// as a message is queued again if the connection was lost in the meantime.
 func (q *msgQueue) Flush() {
 	q.mtx.Lock()
-	for _, msgch := range q.queue {
+	queue := q.queue
+	q.queue = nil
+	q.mtx.Unlock()
+	for _, msgch := range queue {
 		err := q.conn.send(msgch.msg, msgch.ch)
 		if err != nil {
 			q.logger().Printf(LogError, "failure sending message (serial=%d): %v", msgch.msg.MsgSerial, err)
-			msgch.ch <- newError(90000, err)
+			if msgch.ch != nil {
+				msgch.ch <- newError(90000, err)
+			}
 		}
 	}
-	q.queue = nil
-	q.mtx.Unlock()
 }
 
 func (q *msgQueue) Fail(err error) {
 	q.mtx.Lock()
 	for _, msgch := range q.queue {
 		q.logger().Printf(LogError, "failure sending message (serial=%d): %v", msgch.msg.MsgSerial, err)
-		msgch.ch <- newError(90000, err)
+		if msgch.ch != nil {
+			msgch.ch <- newError(90000, err)
+		}
 	}
 	q.queue = nil
 	q.mtx.Unlock()
 }
 
+// Remove drops the queued messages which were enqueued with ch.
+func (q *msgQueue) Remove(ch chan<- error) {
+	q.mtx.Lock()
+	queue := q.queue[:0]
+	for _, msgch := range q.queue {
+		if msgch.ch != ch {
+			queue = append(queue, msgch)
+		}
+	}
+	q.queue = queue
+	q.mtx.Unlock()
+}
+
 func (q *msgQueue) logger() *LoggerOptions {
 	return q.conn.logger()
 }
@@ -470,9 +793,10 @@ var nopResult *errResult
 type errResult struct {
 	err    error
 	listen <-chan error
+	cancel func() // stops the result from being notified; may be nil
 }
 
-func newErrResult() (Result, chan<- error) {
+func newErrResult() (*errResult, chan<- error) {
 	listen := make(chan error, 1)
 	res := &errResult{listen: listen}
 	return res, listen
@@ -490,22 +814,39 @@ func (res *errResult) Wait() error {
 	return res.err
 }
 
+func (res *errResult) waitCtx(ctx context.Context) error {
+	if res == nil {
+		return nil
+	}
+	if res.listen != nil {
+		select {
+		case res.err = <-res.listen:
+		case <-ctx.Done():
+			if res.cancel != nil {
+				res.cancel()
+			}
+			res.err = ctx.Err()
+		}
+		res.listen = nil
+	}
+	return res.err
+}
+
 type stateResult struct {
 	err      error
 	listen   <-chan State
 	expected StateEnum
-}
-
-func newResult(expected StateEnum) (Result, chan<- State) {
-	listen := make(chan State, 1)
-	res := &stateResult{listen: listen, expected: expected}
-	return res, listen
+	cancel   func() // stops the result from being notified; may be nil
 }
 
 func (s *stateEmitter) listenResult(states ...StateEnum) Result {
-	res, listen := newResult(states[0])
+	listen := make(chan State, 1)
 	s.once(listen, states...)
-	return res
+	return &stateResult{
+		listen:   listen,
+		expected: states[0],
+		cancel:   func() { s.offOnce(listen) },
+	}
 }
 
 // Wait implements the Result interface.
@@ -514,21 +855,44 @@ func (res *stateResult) Wait() error {
 		return nil
 	}
 	if res.listen != nil {
-		switch state := <-res.listen; {
-		case state.State == res.expected:
-		case state.Err != nil:
-			res.err = state.Err
-		default:
-			code := 50001
-			if state.Type == StateConn {
-				code = 50002
-			}
-			res.err = &Error{
-				Code: code,
-				Err:  fmt.Errorf("failed %s state: %s", state.Type, state.State),
+		res.resolve(<-res.listen)
+	}
+	return res.err
+}
+
+func (res *stateResult) waitCtx(ctx context.Context) error {
+	if res == nil {
+		return nil
+	}
+	if res.listen != nil {
+		select {
+		case state := <-res.listen:
+			res.resolve(state)
+		case <-ctx.Done():
+			if res.cancel != nil {
+				res.cancel()
 			}
+			res.err = ctx.Err()
+			res.listen = nil
 		}
-		res.listen = nil
 	}
 	return res.err
 }
+
+func (res *stateResult) resolve(state State) {
+	switch {
+	case state.State == res.expected:
+	case state.Err != nil:
+		res.err = state.Err
+	default:
+		code := 50001
+		if state.Type == StateConn {
+			code = 50002
+		}
+		res.err = &Error{
+			Code: code,
+			Err:  fmt.Errorf("failed %s state: %s", state.Type, state.State),
+		}
+	}
+	res.listen = nil
+}
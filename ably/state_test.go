@@ -3,6 +3,9 @@ package ably
 import (
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/ably/ably-go/ably/proto"
 )
 
 var errNotEmitted = errors.New("not emitted")
@@ -42,7 +45,7 @@ func testQueuedEmitter(t *testing.T, serials, ack, nack []int64, emit func(*pend
 	}
 	q := &pendingEmitter{logger: &LoggerOptions{}}
 	for serial, i := range index {
-		q.Enqueue(serial, ch[i])
+		q.Enqueue(&proto.ProtocolMessage{MsgSerial: serial}, ch[i])
 	}
 	emit(q)
 	errs := receive(ch...)
@@ -108,3 +111,60 @@ func TestQueuedEmitter(t *testing.T) {
 		testQueuedEmitter(t, cas.serial, cas.ack, cas.nack, cas.emit)
 	}
 }
+
+func TestStateEmitter_LoggingDisabled(t *testing.T) {
+	s := newStateEmitter(StateConn, StateConnConnecting, "", &LoggerOptions{Level: LogNone})
+	q := &pendingEmitter{logger: s.logger}
+	ch := make(chan error, 1)
+	queue := make([]serialCh, 1)
+	allocs := testing.AllocsPerRun(100, func() {
+		queue[0] = serialCh{serial: 1, ch: ch}
+		q.queue = queue
+		q.Ack(1, 1, nil)
+		<-ch
+	})
+	if allocs != 0 {
+		t.Errorf("want no allocations with logging disabled; got %v", allocs)
+	}
+}
+
+func TestMsgQueue_Flush(t *testing.T) {
+	client := MustRealtimeClient(&ClientOptions{
+		AuthOptions: AuthOptions{Key: "abc:abc"},
+		NoConnect:   true,
+	})
+	defer client.Close()
+	c := client.Connection
+	flush := func() {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			c.queue.Flush()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Flush() blocked")
+		}
+	}
+	// The connection isn't connected, so the messages are queued again.
+	c.queue.Enqueue(&proto.ProtocolMessage{Action: proto.ActionAttach}, nil)
+	flush()
+	if n := len(c.queue.queue); n != 1 {
+		t.Fatalf("want 1 message queued again; got %d", n)
+	}
+	// Sending fails, which is reported only to the messages with listeners.
+	c.state.Lock()
+	c.state.set(StateConnFailed, nil)
+	c.state.Unlock()
+	listen := make(chan error, 1)
+	c.queue.Enqueue(&proto.ProtocolMessage{Action: proto.ActionMessage}, listen)
+	flush()
+	if err := <-listen; err == nil {
+		t.Fatal("want the message to fail")
+	}
+	if n := len(c.queue.queue); n != 0 {
+		t.Fatalf("want no messages queued; got %d", n)
+	}
+}
@@ -21,15 +21,17 @@ type Subscription struct {
 	queue       []interface{}
 	unsubscribe func(*Subscription)
 	stopped     bool
+	limit       int // max number of queued messages; zero means no limit
 	logger      *LoggerOptions
 }
 
-func newSubscription(typ reflect.Type, unsubscribe func(*Subscription), log *LoggerOptions) *Subscription {
+func newSubscription(typ reflect.Type, limit int, unsubscribe func(*Subscription), log *LoggerOptions) *Subscription {
 	sub := &Subscription{
 		typ:         typ,
 		channel:     reflect.MakeChan(typ, 0).Interface(),
 		sleep:       make(chan struct{}, 1),
 		unsubscribe: unsubscribe,
+		limit:       limit,
 		logger:      log,
 	}
 	go sub.loop()
@@ -96,17 +98,23 @@ func (sub *Subscription) Len() int {
 	return len(sub.queue)
 }
 
-func (sub *Subscription) enqueue(msg interface{}) {
+// enqueue queues msg for delivery. It reports false, dropping msg, when
+// the queue is already full.
+func (sub *Subscription) enqueue(msg interface{}) bool {
 	sub.mtx.Lock()
 	defer sub.mtx.Unlock()
 	if sub.stopped {
-		return
+		return true
+	}
+	if sub.limit > 0 && len(sub.queue) >= sub.limit {
+		return false
 	}
 	sleeping := len(sub.queue) == 0
 	sub.queue = append(sub.queue, msg)
 	if sleeping {
 		sub.sleep <- struct{}{}
 	}
+	return true
 }
 
 func (sub *Subscription) pop() (msg interface{}, n int) {
@@ -162,18 +170,22 @@ type subscriptions struct {
 	typ    reflect.Type
 	mtx    sync.Mutex
 	all    map[interface{}]map[*Subscription]struct{}
+	limit  int // queue limit of each subscription
 	logger *LoggerOptions
 }
 
-func newSubscriptions(typ reflect.Type, log *LoggerOptions) *subscriptions {
+func newSubscriptions(typ reflect.Type, limit int, log *LoggerOptions) *subscriptions {
 	return &subscriptions{
 		typ:    typ,
 		all:    make(map[interface{}]map[*Subscription]struct{}),
+		limit:  limit,
 		logger: log,
 	}
 }
 
 func (subs *subscriptions) close() {
+	subs.mtx.Lock()
+	defer subs.mtx.Unlock()
 	for _, subs := range subs.all {
 		for sub := range subs {
 			// Stop is idempotent, no need to keep track which sub was already
@@ -187,7 +199,7 @@ func (subs *subscriptions) close() {
 
 func (subs *subscriptions) subscribe(keys ...interface{}) (*Subscription, error) {
 	unsubscribe := func(sub *Subscription) { subs.unsubscribe(false, sub, keys...) }
-	sub := newSubscription(subs.typ, unsubscribe, subs.logger)
+	sub := newSubscription(subs.typ, subs.limit, unsubscribe, subs.logger)
 	if len(keys) == 0 {
 		keys = subsAllKeys
 	}
@@ -234,36 +246,42 @@ func (subs *subscriptions) unsubscribe(stop bool, sub *Subscription, keys ...int
 	subs.mtx.Unlock()
 }
 
-func (subs *subscriptions) messageEnqueue(msg *proto.ProtocolMessage) {
+// messageEnqueue queues the messages of msg to the subscriptions listening
+// for them. It reports false if any message was dropped by a subscription
+// whose queue was full.
+func (subs *subscriptions) messageEnqueue(msg *proto.ProtocolMessage) bool {
 	subs.mtx.Lock()
+	defer subs.mtx.Unlock()
+	ok := true
 	for _, msg := range msg.Messages {
-		if subs, ok := subs.all[subsAll]; ok {
-			for sub := range subs {
-				sub.enqueue(msg)
-			}
-		}
-		if subs, ok := subs.all[msg.Name]; ok {
-			for sub := range subs {
-				sub.enqueue(msg)
-			}
-		}
+		ok = subs.enqueue(subsAll, msg) && ok
+		ok = subs.enqueue(msg.Name, msg) && ok
 	}
-	subs.mtx.Unlock()
+	return ok
 }
 
-func (subs *subscriptions) presenceEnqueue(msg *proto.ProtocolMessage) {
+// presenceEnqueue is like messageEnqueue, but for the presence messages
+// of msg.
+func (subs *subscriptions) presenceEnqueue(msg *proto.ProtocolMessage) bool {
 	subs.mtx.Lock()
+	defer subs.mtx.Unlock()
+	ok := true
 	for _, msg := range msg.Presence {
-		if subs, ok := subs.all[subsAll]; ok {
-			for sub := range subs {
-				sub.enqueue(msg)
-			}
-		}
-		if subs, ok := subs.all[msg.State]; ok {
-			for sub := range subs {
-				sub.enqueue(msg)
-			}
+		ok = subs.enqueue(subsAll, msg) && ok
+		ok = subs.enqueue(msg.State, msg) && ok
+	}
+	return ok
+}
+
+// enqueue queues msg to the subscriptions listening for key; it expects
+// subs.mtx to be held.
+func (subs *subscriptions) enqueue(key, msg interface{}) bool {
+	ok := true
+	for sub := range subs.all[key] {
+		if !sub.enqueue(msg) {
+			subs.logger.Printf(LogWarning, "subscription queue is full (%d messages); dropping %v", sub.limit, msg)
+			ok = false
 		}
 	}
-	subs.mtx.Unlock()
+	return ok
 }
@@ -7,7 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,6 +35,138 @@ func (c Capability) Encode() string {
 	return string(p)
 }
 
+// CanPublish reports whether the capability allows publishing messages
+// on the channel.
+func (c Capability) CanPublish(channel string) bool {
+	return c.can("publish", channel)
+}
+
+// CanSubscribe reports whether the capability allows subscribing to messages
+// on the channel.
+func (c Capability) CanSubscribe(channel string) bool {
+	return c.can("subscribe", channel)
+}
+
+// CanPresence reports whether the capability allows registering presence
+// on the channel.
+func (c Capability) CanPresence(channel string) bool {
+	return c.can("presence", channel)
+}
+
+// can reports whether any resource matching the channel allows the operation.
+// The "*" resource matches all channels and a resource ending with "*", like
+// "chat:*", matches the channels starting with what precedes it. The "*"
+// operation allows all operations.
+func (c Capability) can(op, channel string) bool {
+	for resource, ops := range c {
+		if !matchResource(resource, channel) {
+			continue
+		}
+		for _, o := range ops {
+			if o == "*" || o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Intersect gives the capability which allows only the operations allowed
+// by both c and other. It is the effective capability of a token requested
+// with c by a key which has got the other capability.
+func (c Capability) Intersect(other Capability) Capability {
+	res := make(Capability)
+	for a, opsA := range c {
+		for b, opsB := range other {
+			var resource string
+			switch {
+			case coversResource(a, b):
+				resource = b
+			case coversResource(b, a):
+				resource = a
+			default:
+				continue
+			}
+			for _, op := range intersectOps(opsA, opsB) {
+				res[resource] = appendOp(res[resource], op)
+			}
+		}
+	}
+	for _, ops := range res {
+		sort.Strings(ops)
+	}
+	return res
+}
+
+// Covers reports whether c allows all the operations allowed by other,
+// in which case a token requested with other by a key which has got c
+// gets exactly the other capability.
+func (c Capability) Covers(other Capability) bool {
+	for resource, ops := range other {
+		for _, op := range ops {
+			if !c.covers(resource, op) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c Capability) covers(resource, op string) bool {
+	for r, ops := range c {
+		if !coversResource(r, resource) {
+			continue
+		}
+		for _, o := range ops {
+			if o == "*" || o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchResource(resource, channel string) bool {
+	if strings.HasSuffix(resource, "*") {
+		return strings.HasPrefix(channel, resource[:len(resource)-1])
+	}
+	return resource == channel
+}
+
+// coversResource reports whether all channels matched by the resource b
+// are matched by the resource a as well.
+func coversResource(a, b string) bool {
+	if !strings.HasSuffix(a, "*") {
+		return a == b
+	}
+	return strings.HasPrefix(b, a[:len(a)-1])
+}
+
+func intersectOps(a, b []string) []string {
+	var ops []string
+	for _, op := range a {
+		if op == "*" {
+			return b
+		}
+		for _, o := range b {
+			if o == "*" || o == op {
+				ops = append(ops, op)
+				break
+			}
+		}
+	}
+	return ops
+}
+
+func appendOp(ops []string, op string) []string {
+	for _, o := range ops {
+		if o == op {
+			return ops
+		}
+	}
+	return append(ops, op)
+}
+
 // TokenParams
 type TokenParams struct {
 	// TTL is a requested time to live for the token. If the token request
@@ -108,13 +242,15 @@ type TokenDetails struct {
 	// KeyName
 	KeyName string `json:"keyName,omitempty" codec:"keyName,omitempty"`
 
-	// Expires
+	// Expires is when the token expires, in milliseconds since the epoch;
+	// see ExpireTime.
 	Expires int64 `json:"expires,omitempty" codec:"expires,omitempty"`
 
 	// ClientID
 	ClientID string `json:"clientId,omitempty" codec:"clientId,omitempty"`
 
-	// Issued
+	// Issued is when the token was issued, in milliseconds since the epoch;
+	// see IssueTime.
 	Issued int64 `json:"issued,omitempty" codec:"issued,omitempty"`
 
 	// RawCapability
@@ -127,21 +263,68 @@ func (tok *TokenDetails) Capability() Capability {
 	return c
 }
 
-// Expired
+// Expired reports whether the token has already expired.
 func (tok *TokenDetails) Expired() bool {
-	return tok.Expires != 0 && tok.Expires <= TimeNow()
+	return tok.ExpiredAt(time.Now())
 }
 
+// ExpiredAt reports whether the token has expired by the given time. A token
+// without an expiry time never expires.
+func (tok *TokenDetails) ExpiredAt(now time.Time) bool {
+	return tok.Expires != 0 && tok.Expires <= Time(now)
+}
+
+// IssueTime gives the time the token was issued at.
 func (tok *TokenDetails) IssueTime() time.Time {
 	return time.Unix(tok.Issued/1000, tok.Issued%1000*int64(time.Millisecond))
 }
 
+// ExpireTime gives the time the token expires at.
 func (tok *TokenDetails) ExpireTime() time.Time {
 	return time.Unix(tok.Expires/1000, tok.Expires%1000*int64(time.Millisecond))
 }
 
+// newTokenDetails wraps a token string given by the user, an AuthCallback or
+// an AuthURL. An Ably JWT is used as is, with the expiry, issue time, client ID
+// and capability taken from its claims, so it's renewed once it expires.
 func newTokenDetails(token string) *TokenDetails {
-	return &TokenDetails{
+	tok := &TokenDetails{
 		Token: token,
 	}
+	if claims, ok := parseJWT(token); ok {
+		tok.Expires = claims.Expires * 1000
+		tok.Issued = claims.Issued * 1000
+		tok.ClientID = claims.ClientID
+		tok.RawCapability = claims.Capability
+	}
+	return tok
+}
+
+// jwtClaims are the claims of an Ably JWT the library makes use of.
+type jwtClaims struct {
+	Expires    int64  `json:"exp"` // Unix seconds
+	Issued     int64  `json:"iat"` // Unix seconds
+	ClientID   string `json:"x-ably-clientId"`
+	Capability string `json:"x-ably-capability"`
+}
+
+// parseJWT reports whether token is a JWT, that is three base64url-encoded
+// segments separated with dots, and gives its claims. The signature is not
+// verified, as it's only the server which holds the signing key.
+func parseJWT(token string) (*jwtClaims, bool) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 || segments[0] == "" || segments[1] == "" {
+		return nil, false
+	}
+	for _, segment := range segments {
+		if _, err := base64.RawURLEncoding.DecodeString(segment); err != nil {
+			return nil, false
+		}
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(segments[1])
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	return &claims, true
 }
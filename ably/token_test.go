@@ -0,0 +1,103 @@
+package ably_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ably/ably-go/ably"
+)
+
+func TestCapability_Can(t *testing.T) {
+	t.Parallel()
+	c, err := ably.ParseCapability(`{
+		"chat:*": ["publish", "subscribe"],
+		"chat:private:*": ["presence"],
+		"news": ["subscribe"],
+		"admin": ["*"]
+	}`)
+	if err != nil {
+		t.Fatalf("ParseCapability()=%v", err)
+	}
+	cases := []struct {
+		channel   string
+		publish   bool
+		subscribe bool
+		presence  bool
+	}{
+		{"chat:lobby", true, true, false},
+		{"chat:private:room", true, true, true},
+		{"chat", false, false, false},
+		{"news", false, true, false},
+		{"news:sport", false, false, false},
+		{"admin", true, true, true},
+		{"other", false, false, false},
+	}
+	for _, cas := range cases {
+		if got := c.CanPublish(cas.channel); got != cas.publish {
+			t.Errorf("CanPublish(%q)=%t; want %t", cas.channel, got, cas.publish)
+		}
+		if got := c.CanSubscribe(cas.channel); got != cas.subscribe {
+			t.Errorf("CanSubscribe(%q)=%t; want %t", cas.channel, got, cas.subscribe)
+		}
+		if got := c.CanPresence(cas.channel); got != cas.presence {
+			t.Errorf("CanPresence(%q)=%t; want %t", cas.channel, got, cas.presence)
+		}
+	}
+	all := ably.Capability{"*": {"*"}}
+	if !all.CanPublish("any:channel") || !all.CanPresence("any") {
+		t.Errorf("want %v to allow all operations", all)
+	}
+}
+
+func TestCapability_Intersect(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name   string
+		a, b   ably.Capability
+		expect ably.Capability
+	}{{
+		name:   "wildcard key",
+		a:      ably.Capability{"chat:*": {"publish", "subscribe"}},
+		b:      ably.Capability{"*": {"*"}},
+		expect: ably.Capability{"chat:*": {"publish", "subscribe"}},
+	}, {
+		name:   "nested wildcard",
+		a:      ably.Capability{"chat:private:*": {"*"}},
+		b:      ably.Capability{"chat:*": {"publish", "presence"}},
+		expect: ably.Capability{"chat:private:*": {"presence", "publish"}},
+	}, {
+		name:   "channel in namespace",
+		a:      ably.Capability{"chat:*": {"subscribe", "publish"}},
+		b:      ably.Capability{"chat:lobby": {"subscribe"}, "news": {"subscribe"}},
+		expect: ably.Capability{"chat:lobby": {"subscribe"}},
+	}, {
+		name:   "disjoint operations",
+		a:      ably.Capability{"chat:*": {"publish"}},
+		b:      ably.Capability{"chat:*": {"subscribe"}},
+		expect: ably.Capability{},
+	}, {
+		name:   "disjoint resources",
+		a:      ably.Capability{"chat:*": {"*"}},
+		b:      ably.Capability{"news:*": {"*"}},
+		expect: ably.Capability{},
+	}, {
+		name: "multiple resources",
+		a:    ably.Capability{"chat:*": {"subscribe"}, "news": {"publish", "subscribe"}},
+		b:    ably.Capability{"*": {"subscribe"}, "chat:lobby": {"*"}},
+		expect: ably.Capability{
+			"chat:*":     {"subscribe"},
+			"chat:lobby": {"subscribe"},
+			"news":       {"subscribe"},
+		},
+	}}
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			if got := cas.a.Intersect(cas.b); !reflect.DeepEqual(got, cas.expect) {
+				t.Errorf("want %v.Intersect(%v)=%v; got %v", cas.a, cas.b, cas.expect, got)
+			}
+			if got := cas.b.Intersect(cas.a); !reflect.DeepEqual(got, cas.expect) {
+				t.Errorf("want %v.Intersect(%v)=%v; got %v", cas.b, cas.a, cas.expect, got)
+			}
+		})
+	}
+}